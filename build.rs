@@ -0,0 +1,45 @@
+use std::{
+    env,
+    process::Command,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+/// Embeds the git commit and the build time, shown by `GET /version`. The
+/// `GIT_COMMIT` and `SOURCE_DATE_EPOCH` env vars override them, for builds
+/// outside of the git checkout or reproducible ones.
+fn main() {
+    println!("cargo:rerun-if-env-changed=GIT_COMMIT");
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs");
+
+    let commit = env::var("GIT_COMMIT")
+        .ok()
+        .filter(|commit| !commit.is_empty())
+        .or_else(git_commit)
+        .unwrap_or_else(|| "unknown".into());
+
+    let timestamp = env::var("SOURCE_DATE_EPOCH")
+        .ok()
+        .and_then(|secs| secs.parse::<u64>().ok())
+        .unwrap_or_else(|| {
+            SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map_or(0, |d| d.as_secs())
+        });
+
+    println!("cargo:rustc-env=DOWNLOADER_GIT_COMMIT={commit}");
+    println!("cargo:rustc-env=DOWNLOADER_BUILD_TIMESTAMP={timestamp}");
+}
+
+fn git_commit() -> Option<String> {
+    let output = Command::new("git")
+        .args(["rev-parse", "--short=12", "HEAD"])
+        .output()
+        .ok()?;
+
+    let commit = String::from_utf8(output.stdout).ok()?;
+    let commit = commit.trim();
+
+    (output.status.success() && !commit.is_empty()).then(|| commit.into())
+}
@@ -0,0 +1,5 @@
+-- Add down migration script here
+
+DROP INDEX IF EXISTS object_expires_at_idx;
+
+ALTER TABLE object DROP COLUMN expires_at;
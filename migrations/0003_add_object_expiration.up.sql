@@ -0,0 +1,5 @@
+-- Add up migration script here
+
+ALTER TABLE object ADD COLUMN expires_at integer;
+
+CREATE INDEX object_expires_at_idx ON object(expires_at);
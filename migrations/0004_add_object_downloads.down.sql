@@ -0,0 +1,5 @@
+-- Add down migration script here
+
+ALTER TABLE object DROP COLUMN max_downloads;
+
+ALTER TABLE object DROP COLUMN download_count;
@@ -0,0 +1,5 @@
+-- Add up migration script here
+
+ALTER TABLE object ADD COLUMN download_count integer NOT NULL DEFAULT 0;
+
+ALTER TABLE object ADD COLUMN max_downloads integer;
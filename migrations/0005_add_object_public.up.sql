@@ -0,0 +1,3 @@
+-- Add up migration script here
+
+ALTER TABLE object ADD COLUMN public integer NOT NULL DEFAULT 0;
@@ -0,0 +1,11 @@
+-- Add up migration script here
+
+CREATE TABLE invite (
+    code text PRIMARY KEY,
+    created_at integer NOT NULL,
+    expires_at integer NOT NULL,
+    created_by blob,
+    permission integer NOT NULL,
+    used_at integer,
+    used_by blob
+) STRICT;
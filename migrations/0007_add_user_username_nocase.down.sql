@@ -0,0 +1,5 @@
+-- Add down migration script here
+
+DROP INDEX IF EXISTS user_username_nocase_idx;
+
+CREATE UNIQUE INDEX user_username_idx ON user(username);
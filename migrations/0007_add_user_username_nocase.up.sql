@@ -0,0 +1,6 @@
+-- Add up migration script here
+
+-- Usernames differing only by case belong to the same account
+DROP INDEX user_username_idx;
+
+CREATE UNIQUE INDEX user_username_nocase_idx ON user(username COLLATE NOCASE);
@@ -0,0 +1,13 @@
+-- Add up migration script here
+
+-- Uploads made with an `Idempotency-Key` header, scoped by the user
+CREATE TABLE idempotency_key (
+    owner blob NOT NULL,
+    key text NOT NULL,
+    object_id blob NOT NULL,
+    created_at integer NOT NULL,
+    expires_at integer NOT NULL,
+    PRIMARY KEY (owner, key)
+) STRICT;
+
+CREATE INDEX idempotency_key_expires_at_idx ON idempotency_key(expires_at);
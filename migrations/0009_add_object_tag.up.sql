@@ -0,0 +1,11 @@
+-- Add up migration script here
+
+-- Key/value tags attached to the objects by their owners
+CREATE TABLE object_tag (
+    object_id blob NOT NULL REFERENCES object(id) ON DELETE CASCADE,
+    key text NOT NULL,
+    value text NOT NULL,
+    PRIMARY KEY (object_id, key)
+) STRICT;
+
+CREATE INDEX object_tag_key_value_idx ON object_tag(key, value);
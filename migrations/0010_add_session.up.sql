@@ -0,0 +1,14 @@
+-- Add up migration script here
+
+-- Logins of the users, referenced by the `jti` of the tokens they issued.
+-- Deleting a session revokes its tokens
+CREATE TABLE session (
+    id blob PRIMARY KEY,
+    user_id blob NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    created_at integer NOT NULL,
+    expires_at integer NOT NULL,
+    ip_addr text,
+    user_agent text
+) STRICT;
+
+CREATE INDEX session_user_id_idx ON session(user_id);
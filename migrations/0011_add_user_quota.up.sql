@@ -0,0 +1,3 @@
+-- Add up migration script here
+
+ALTER TABLE user ADD COLUMN quota integer;
@@ -0,0 +1,15 @@
+-- Add up migration script here
+
+-- Long lived keys the users authenticate their scripts with. Only the
+-- SHA-256 of each key is stored
+CREATE TABLE api_key (
+    id blob PRIMARY KEY,
+    user_id blob NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+    name text NOT NULL,
+    key_hash blob NOT NULL UNIQUE,
+    permission integer NOT NULL,
+    created_at integer NOT NULL,
+    last_used_at integer
+) STRICT;
+
+CREATE INDEX api_key_user_id_idx ON api_key(user_id);
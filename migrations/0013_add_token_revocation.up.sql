@@ -0,0 +1,7 @@
+-- Add up migration script here
+
+-- Single row holding the time before which every issued token is rejected
+CREATE TABLE token_revocation (
+    id integer PRIMARY KEY CHECK (id = 0),
+    revoked_before integer NOT NULL
+) STRICT;
@@ -0,0 +1,12 @@
+-- Add up migration script here
+
+-- Links letting a third party upload the data of a pre-created object once
+CREATE TABLE upload_link (
+    id blob PRIMARY KEY,
+    object_id blob NOT NULL,
+    created_at integer NOT NULL,
+    expires_at integer NOT NULL,
+    used_at integer
+) STRICT;
+
+CREATE INDEX upload_link_expires_at_idx ON upload_link(expires_at);
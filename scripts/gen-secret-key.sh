@@ -0,0 +1,3 @@
+#!/bin/bash
+
+openssl rand -base64 48
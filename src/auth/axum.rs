@@ -6,10 +6,18 @@ use axum::{
     http::{header, request::Parts, StatusCode},
 };
 use serde::Deserialize;
+use sqlx::Sqlite;
 
-use crate::{auth::AuthError, errors::DownloaderError};
+use crate::{
+    auth::AuthError,
+    errors::{DownloaderError, HttpError},
+    user::repository::UserRepository,
+    utils::limit::ApiKeyLimiter,
+};
 
-use super::{repository::TokenRepository, Token};
+use super::{
+    client_cert::ClientCert, repository::TokenRepository, Token, UserToken,
+};
 
 #[derive(Deserialize)]
 struct AuthorizationQuery {
@@ -40,29 +48,26 @@ impl<S: Send + Sync> FromRequestParts<S> for Authorization {
             }
 
             (s[0], s[1].to_owned())
+        } else if let Ok(Query(query)) =
+            Query::<AuthorizationQuery>::try_from_uri(&parts.uri)
+        {
+            ("Bearer", query.token)
+        } else if let Some(ClientCert {
+            service: Some(service),
+        }) = parts.extensions.get::<ClientCert>()
+        {
+            tracing::debug!(
+                service = %service.name,
+                "authorized by client certificate",
+            );
+            return Ok(Authorization(Token::Service(service.clone())));
         } else {
-            let token = Query::<AuthorizationQuery>::try_from_uri(&parts.uri)
-                .map_err(|_| AuthError::AuthorizationRequired)?
-                .0
-                .token;
-
-            ("Bearer", token)
+            return Err(AuthError::AuthorizationRequired.into());
         };
 
-        let repo = parts.extensions.get::<Arc<TokenRepository>>().ok_or_else(
-            || {
-                DownloaderError::Other(
-                    format!(
-                        "Extension of type `{}` was not found. \
-                        Perhaps you forgot to add it? See `axum::Extension`.",
-                        std::any::type_name::<Arc<TokenRepository>>()
-                    ),
-                    StatusCode::INTERNAL_SERVER_ERROR,
-                )
-            },
-        )?;
+        let repo = extension::<Arc<TokenRepository>>(parts)?;
 
-        match strategy {
+        let token = match strategy {
             "Bearer" => repo.decode_token(&token),
             "Secret" => repo.verify_srv_key(&token).and_then(|ok| {
                 if ok {
@@ -71,16 +76,81 @@ impl<S: Send + Sync> FromRequestParts<S> for Authorization {
                     Err(AuthError::InvalidToken)
                 }
             }),
+            "Service" => repo.verify_service_token(&token),
+            "ApiKey" => {
+                let user_repo = extension::<UserRepository<Sqlite>>(parts)?;
+                let (key, user) = user_repo
+                    .authenticate_api_key(&token)
+                    .await?
+                    .ok_or(AuthError::InvalidToken)?;
+
+                extension::<Arc<ApiKeyLimiter>>(parts)?
+                    .check(key.id)
+                    .map_err(|wait| HttpError::RateLimited {
+                        retry_after: wait.as_secs_f64().ceil() as u64,
+                    })?;
+
+                Ok(repo.api_key_token(&key, &user))
+            }
             s => {
                 return Err(AuthError::InvalidAuthStrategy(
                     s.to_owned(),
-                    &["Bearer", "Secret"],
+                    &["Bearer", "Secret", "Service", "ApiKey"],
                 )
                 .into())
             }
+        }?;
+
+        // Revoked sessions are only known by the database
+        if let Token::User(UserToken {
+            session_id: Some(session_id),
+            ..
+        }) = &token
+        {
+            let user_repo = extension::<UserRepository<Sqlite>>(parts)?;
+            if !user_repo.is_session_active(*session_id).await? {
+                return Err(AuthError::RevokedToken.into());
+            }
+        }
+
+        Ok(Authorization(token))
+    }
+}
+
+fn extension<T: Send + Sync + 'static>(
+    parts: &Parts,
+) -> Result<&T, DownloaderError> {
+    parts.extensions.get::<T>().ok_or_else(|| {
+        DownloaderError::Other(
+            format!(
+                "Extension of type `{}` was not found. \
+                Perhaps you forgot to add it? See `axum::Extension`.",
+                std::any::type_name::<T>()
+            ),
+            StatusCode::INTERNAL_SERVER_ERROR,
+        )
+    })
+}
+
+/// Same as [`Authorization`], but rejects only invalid credentials, resolving
+/// to [`None`] when none were provided.
+pub struct OptionalAuthorization(pub Option<Token>);
+
+#[async_trait]
+impl<S: Send + Sync> FromRequestParts<S> for OptionalAuthorization {
+    type Rejection = DownloaderError;
+
+    async fn from_request_parts(
+        parts: &mut Parts,
+        state: &S,
+    ) -> Result<Self, Self::Rejection> {
+        match Authorization::from_request_parts(parts, state).await {
+            Ok(Authorization(token)) => Ok(Self(Some(token))),
+            Err(DownloaderError::Auth(AuthError::AuthorizationRequired)) => {
+                Ok(Self(None))
+            }
+            Err(error) => Err(error),
         }
-        .map(Authorization)
-        .map_err(DownloaderError::Auth)
     }
 }
 
@@ -95,8 +165,14 @@ mod tests {
     use test_log::test;
     use uuid::Uuid;
 
-    use crate::auth::{
-        axum::Authorization, repository::tests::repository, Permission, Token,
+    use crate::{
+        auth::{
+            axum::{Authorization, OptionalAuthorization},
+            client_cert::ClientCert,
+            repository::tests::repository,
+            AuthError, Permission, ServiceToken, Token,
+        },
+        errors::DownloaderError,
     };
 
     async fn test_requests_insertions<F: FnOnce(Builder, String) -> Builder>(
@@ -109,7 +185,7 @@ mod tests {
         let username = Uuid::new_v4().to_string();
 
         let token = repo
-            .generate_user_token(user_id, permission, username.clone())
+            .generate_user_token(user_id, permission, username.clone(), None)
             .unwrap();
 
         let mut parts = f(Request::builder().extension(repo.clone()), token)
@@ -173,4 +249,76 @@ mod tests {
             _ => panic!("expected server token, but got {token:?}"),
         }
     }
+
+    #[test(tokio::test)]
+    async fn test_optional_authorization() {
+        let repo = Arc::new(repository());
+
+        let mut parts = Request::builder()
+            .extension(repo.clone())
+            .uri("https://example.com?name=file")
+            .body(())
+            .unwrap()
+            .into_parts()
+            .0;
+
+        let token = OptionalAuthorization::from_request_parts(&mut parts, &())
+            .await
+            .expect("expected missing authorization to be accepted")
+            .0;
+        assert!(token.is_none());
+
+        let mut parts = Request::builder()
+            .extension(repo.clone())
+            .header(header::AUTHORIZATION, "Bearer invalid")
+            .body(())
+            .unwrap()
+            .into_parts()
+            .0;
+
+        let res =
+            OptionalAuthorization::from_request_parts(&mut parts, &()).await;
+        assert!(res.is_err(), "expected invalid token to be rejected");
+    }
+
+    #[test(tokio::test)]
+    async fn test_client_cert() {
+        let service = ServiceToken {
+            name: "backup".into(),
+            permission: Permission::READ_ALL,
+        };
+        let mut parts = Request::builder()
+            .extension(ClientCert {
+                service: Some(service.clone()),
+            })
+            .body(())
+            .unwrap()
+            .into_parts()
+            .0;
+
+        let token = Authorization::from_request_parts(&mut parts, &())
+            .await
+            .expect("expected client certificate to be accepted")
+            .0;
+        assert!(matches!(&token, Token::Service(s) if *s == service));
+
+        // Limited to the permission of the service
+        assert!(token.can_read_all());
+        assert!(!token.can_write_all());
+        assert!(!token.can_write_users());
+        assert!(!token.permission().contains(Permission::ADMIN));
+
+        let mut parts = Request::builder()
+            .extension(ClientCert::default())
+            .body(())
+            .unwrap()
+            .into_parts()
+            .0;
+
+        let res = Authorization::from_request_parts(&mut parts, &()).await;
+        assert!(matches!(
+            res,
+            Err(DownloaderError::Auth(AuthError::AuthorizationRequired)),
+        ));
+    }
 }
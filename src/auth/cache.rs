@@ -0,0 +1,144 @@
+use std::{collections::HashMap, sync::Mutex};
+
+use chrono::{DateTime, Utc};
+use sha2::{Digest, Sha256};
+
+use super::Token;
+
+/// How a cached token was sent, so a token verified with one strategy is
+/// never accepted with another.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TokenKind {
+    Bearer,
+    Service,
+}
+
+/// Tokens whose signature was already verified, so clients sending the same
+/// token on every request only cost a SHA-256 of it instead of a signature
+/// check. The tokens themselves are not kept, only their hashes.
+///
+/// Their expiration is still checked on every use, and the whole cache must
+/// be cleared whenever a key stops being trusted.
+pub struct VerifiedTokens {
+    capacity: usize,
+    entries: Mutex<HashMap<[u8; 32], VerifiedToken>>,
+}
+
+#[derive(Debug, Clone)]
+pub struct VerifiedToken {
+    pub token: Token,
+    /// When the token stops being valid, which is not known by
+    /// [`Token::Server`] itself.
+    pub expiration: Option<DateTime<Utc>>,
+}
+
+fn cache_key(kind: TokenKind, token: &str) -> [u8; 32] {
+    Sha256::new()
+        .chain_update([kind as u8])
+        .chain_update(token)
+        .finalize()
+        .into()
+}
+
+impl VerifiedTokens {
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            entries: Mutex::default(),
+        }
+    }
+
+    pub fn get(&self, kind: TokenKind, token: &str) -> Option<VerifiedToken> {
+        if self.capacity == 0 {
+            return None;
+        }
+
+        let key = cache_key(kind, token);
+        self.entries.lock().unwrap().get(&key).cloned()
+    }
+
+    /// Keeps the token, evicting the expired ones when full. If every kept
+    /// token is still valid, an arbitrary one is evicted.
+    pub fn insert(
+        &self,
+        kind: TokenKind,
+        token: &str,
+        verified: VerifiedToken,
+    ) {
+        if self.capacity == 0 {
+            return;
+        }
+
+        let key = cache_key(kind, token);
+        let mut entries = self.entries.lock().unwrap();
+
+        if entries.len() >= self.capacity && !entries.contains_key(&key) {
+            let now = Utc::now();
+            entries.retain(|_, entry| {
+                entry.expiration.map_or(true, |expiration| expiration > now)
+            });
+
+            if entries.len() >= self.capacity {
+                if let Some(evicted) = entries.keys().next().copied() {
+                    entries.remove(&evicted);
+                }
+            }
+        }
+
+        entries.insert(key, verified);
+    }
+
+    pub fn clear(&self) {
+        self.entries.lock().unwrap().clear();
+    }
+
+    #[cfg(test)]
+    pub fn len(&self) -> usize {
+        self.entries.lock().unwrap().len()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::{TimeDelta, Utc};
+    use test_log::test;
+
+    use crate::auth::Token;
+
+    use super::{TokenKind, VerifiedToken, VerifiedTokens};
+
+    fn verified(expiration: TimeDelta) -> VerifiedToken {
+        VerifiedToken {
+            token: Token::Server,
+            expiration: Some(Utc::now() + expiration),
+        }
+    }
+
+    #[test]
+    fn test_verified_tokens() {
+        let cache = VerifiedTokens::new(2);
+        cache.insert(TokenKind::Bearer, "a", verified(TimeDelta::hours(1)));
+
+        assert!(cache.get(TokenKind::Bearer, "a").is_some());
+        assert!(cache.get(TokenKind::Service, "a").is_none());
+        assert!(cache.get(TokenKind::Bearer, "b").is_none());
+
+        // The expired tokens are evicted first
+        cache.insert(TokenKind::Bearer, "b", verified(-TimeDelta::hours(1)));
+        cache.insert(TokenKind::Bearer, "c", verified(TimeDelta::hours(1)));
+        assert_eq!(cache.len(), 2);
+        assert!(cache.get(TokenKind::Bearer, "a").is_some());
+        assert!(cache.get(TokenKind::Bearer, "b").is_none());
+
+        cache.insert(TokenKind::Bearer, "d", verified(TimeDelta::hours(1)));
+        assert_eq!(cache.len(), 2);
+        assert!(cache.get(TokenKind::Bearer, "d").is_some());
+
+        cache.clear();
+        assert_eq!(cache.len(), 0);
+
+        let disabled = VerifiedTokens::new(0);
+        disabled.insert(TokenKind::Bearer, "a", verified(TimeDelta::hours(1)));
+        assert!(disabled.get(TokenKind::Bearer, "a").is_none());
+    }
+}
@@ -0,0 +1,322 @@
+use std::{collections::HashMap, net::IpAddr, sync::Arc, time::Duration};
+
+use chrono::TimeDelta;
+use futures_util::future::BoxFuture;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+use crate::{
+    config::ChallengeConfig,
+    utils::clock::{Clock, SystemClock},
+};
+
+use super::AuthError;
+
+/// How long the captcha providers may take to verify a response.
+const VERIFY_TIMEOUT: Duration = Duration::from_secs(10);
+/// How long a proof of work stamp is accepted after it was made.
+const MAX_STAMP_AGE: TimeDelta = TimeDelta::minutes(5);
+/// How far in the future stamps may be, for clients with a skewed clock.
+const MAX_STAMP_SKEW: TimeDelta = TimeDelta::minutes(1);
+
+/// A check the clients must pass before an action, so it can't be
+/// automated cheaply. Only signups are challenged for now.
+pub trait Challenge: Send + Sync {
+    /// Verifies the `response` of the client to the challenge guarding the
+    /// action on `resource`, like the username signing up.
+    fn verify<'a>(
+        &'a self,
+        response: Option<&'a str>,
+        resource: &'a str,
+        remote_ip: Option<IpAddr>,
+    ) -> BoxFuture<'a, Result<(), AuthError>>;
+
+    /// What the clients need to know to solve the challenge.
+    fn info(&self) -> ChallengeInfo;
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+#[serde(tag = "kind", rename_all = "snake_case")]
+pub enum ChallengeInfo {
+    Hcaptcha { site_key: String },
+    Recaptcha { site_key: String },
+    ProofOfWork { difficulty: u8 },
+}
+
+pub fn from_config(cfg: &ChallengeConfig) -> Arc<dyn Challenge> {
+    match cfg {
+        ChallengeConfig::Hcaptcha { site_key, secret } => {
+            Arc::new(Captcha::new(CaptchaProvider::HCaptcha, site_key, secret))
+        }
+        ChallengeConfig::Recaptcha { site_key, secret } => {
+            Arc::new(Captcha::new(CaptchaProvider::ReCaptcha, site_key, secret))
+        }
+        ChallengeConfig::ProofOfWork { difficulty } => {
+            Arc::new(ProofOfWork::new(*difficulty))
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum CaptchaProvider {
+    HCaptcha,
+    ReCaptcha,
+}
+
+impl CaptchaProvider {
+    fn verify_url(self) -> &'static str {
+        match self {
+            CaptchaProvider::HCaptcha => "https://api.hcaptcha.com/siteverify",
+            CaptchaProvider::ReCaptcha => {
+                "https://www.google.com/recaptcha/api/siteverify"
+            }
+        }
+    }
+}
+
+/// A captcha solved by the client, whose token is verified by the provider.
+pub struct Captcha {
+    provider: CaptchaProvider,
+    site_key: String,
+    secret: String,
+    client: reqwest::Client,
+}
+
+#[derive(Deserialize)]
+struct SiteVerifyResponse {
+    success: bool,
+    #[serde(default, rename = "error-codes")]
+    error_codes: Vec<String>,
+}
+
+impl Captcha {
+    pub fn new(
+        provider: CaptchaProvider,
+        site_key: &str,
+        secret: &str,
+    ) -> Self {
+        let client = reqwest::Client::builder()
+            .timeout(VERIFY_TIMEOUT)
+            .build()
+            .expect("failed to build the http client");
+
+        Self {
+            provider,
+            site_key: site_key.into(),
+            secret: secret.into(),
+            client,
+        }
+    }
+}
+
+impl Challenge for Captcha {
+    fn verify<'a>(
+        &'a self,
+        response: Option<&'a str>,
+        _resource: &'a str,
+        remote_ip: Option<IpAddr>,
+    ) -> BoxFuture<'a, Result<(), AuthError>> {
+        Box::pin(async move {
+            let response = response.ok_or(AuthError::ChallengeFailed)?;
+
+            let mut form = vec![
+                ("secret", self.secret.clone()),
+                ("response", response.to_owned()),
+            ];
+            if let Some(ip) = remote_ip {
+                form.push(("remoteip", ip.to_string()));
+            }
+
+            let res: SiteVerifyResponse = self
+                .client
+                .post(self.provider.verify_url())
+                .form(&form)
+                .send()
+                .await
+                .and_then(|res| res.error_for_status())
+                .map_err(|error| {
+                    tracing::error!(%error, "failed to verify captcha");
+                    AuthError::ChallengeUnavailable
+                })?
+                .json()
+                .await
+                .map_err(|error| {
+                    tracing::error!(%error, "got invalid captcha verification");
+                    AuthError::ChallengeUnavailable
+                })?;
+
+            if !res.success {
+                tracing::debug!(
+                    error_codes = ?res.error_codes,
+                    "captcha rejected",
+                );
+                return Err(AuthError::ChallengeFailed);
+            }
+
+            Ok(())
+        })
+    }
+
+    fn info(&self) -> ChallengeInfo {
+        let site_key = self.site_key.clone();
+
+        match self.provider {
+            CaptchaProvider::HCaptcha => ChallengeInfo::Hcaptcha { site_key },
+            CaptchaProvider::ReCaptcha => ChallengeInfo::Recaptcha { site_key },
+        }
+    }
+}
+
+/// Hashcash-style stamps, which cost the client some work to make but need
+/// no third party. A stamp is `{unix_secs}:{nonce}`, valid for a resource
+/// when the SHA-256 of `{resource}:{stamp}` starts with at least
+/// `difficulty` zero bits. Each stamp is only accepted once.
+pub struct ProofOfWork {
+    difficulty: u8,
+    clock: Arc<dyn Clock>,
+    /// Hashes of the accepted stamps, with the time they stop being valid.
+    spent: std::sync::Mutex<HashMap<[u8; 32], i64>>,
+}
+
+impl ProofOfWork {
+    pub fn new(difficulty: u8) -> Self {
+        Self {
+            difficulty,
+            clock: Arc::new(SystemClock),
+            spent: Default::default(),
+        }
+    }
+
+    #[cfg(test)]
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    fn check(&self, stamp: &str, resource: &str) -> Result<(), AuthError> {
+        let (timestamp, _nonce) =
+            stamp.split_once(':').ok_or(AuthError::ChallengeFailed)?;
+        let timestamp: i64 =
+            timestamp.parse().map_err(|_| AuthError::ChallengeFailed)?;
+
+        let now = self.clock.now().timestamp();
+        if timestamp < now - MAX_STAMP_AGE.num_seconds()
+            || timestamp > now + MAX_STAMP_SKEW.num_seconds()
+        {
+            return Err(AuthError::ChallengeFailed);
+        }
+
+        let hash: [u8; 32] =
+            Sha256::digest(format!("{resource}:{stamp}")).into();
+        if leading_zero_bits(&hash) < self.difficulty as u32 {
+            return Err(AuthError::ChallengeFailed);
+        }
+
+        let mut spent = self.spent.lock().unwrap();
+        spent.retain(|_, expires_at| *expires_at > now);
+
+        let expires_at = timestamp + MAX_STAMP_AGE.num_seconds();
+        if spent.insert(hash, expires_at).is_some() {
+            return Err(AuthError::ChallengeFailed);
+        }
+
+        Ok(())
+    }
+}
+
+impl Challenge for ProofOfWork {
+    fn verify<'a>(
+        &'a self,
+        response: Option<&'a str>,
+        resource: &'a str,
+        _remote_ip: Option<IpAddr>,
+    ) -> BoxFuture<'a, Result<(), AuthError>> {
+        let res = response
+            .ok_or(AuthError::ChallengeFailed)
+            .and_then(|stamp| self.check(stamp, resource));
+
+        Box::pin(async move { res })
+    }
+
+    fn info(&self) -> ChallengeInfo {
+        ChallengeInfo::ProofOfWork {
+            difficulty: self.difficulty,
+        }
+    }
+}
+
+fn leading_zero_bits(hash: &[u8]) -> u32 {
+    let mut bits = 0;
+    for &byte in hash {
+        bits += byte.leading_zeros();
+        if byte != 0 {
+            break;
+        }
+    }
+    bits
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use chrono::{TimeDelta, Utc};
+    use sha2::{Digest, Sha256};
+    use test_log::test;
+
+    use crate::{auth::AuthError, utils::clock::MockClock};
+
+    use super::{leading_zero_bits, Challenge, ProofOfWork};
+
+    fn solve(resource: &str, timestamp: i64, difficulty: u32) -> String {
+        (0u64..)
+            .map(|nonce| format!("{timestamp}:{nonce}"))
+            .find(|stamp| {
+                let hash = Sha256::digest(format!("{resource}:{stamp}"));
+                leading_zero_bits(&hash) >= difficulty
+            })
+            .unwrap()
+    }
+
+    #[test]
+    fn test_leading_zero_bits() {
+        assert_eq!(leading_zero_bits(&[0xff, 0]), 0);
+        assert_eq!(leading_zero_bits(&[0, 0x10, 0]), 11);
+        assert_eq!(leading_zero_bits(&[0, 0]), 16);
+    }
+
+    #[test(tokio::test)]
+    async fn test_proof_of_work() {
+        let now = Utc::now();
+        let clock = Arc::new(MockClock::new(now));
+        let pow = ProofOfWork::new(8).with_clock(clock.clone());
+
+        let stamp = solve("user", now.timestamp(), 8);
+        pow.verify(Some(&stamp), "user", None).await.unwrap();
+
+        let failed = |res| matches!(res, Err(AuthError::ChallengeFailed));
+
+        // Spent
+        assert!(failed(pow.verify(Some(&stamp), "user", None).await));
+        // Made for another resource
+        let stamp = solve("other", now.timestamp(), 8);
+        assert!(failed(pow.verify(Some(&stamp), "user", None).await));
+        // Not enough work
+        let stamp = (0u64..)
+            .map(|nonce| format!("{}:{nonce}", now.timestamp()))
+            .find(|stamp| {
+                let hash = Sha256::digest(format!("user:{stamp}"));
+                leading_zero_bits(&hash) < 8
+            })
+            .unwrap();
+        assert!(failed(pow.verify(Some(&stamp), "user", None).await));
+
+        assert!(failed(pow.verify(None, "user", None).await));
+        assert!(failed(pow.verify(Some("garbage"), "user", None).await));
+
+        // Expired
+        let stamp = solve("user", now.timestamp(), 8);
+        clock.advance(TimeDelta::minutes(6));
+        assert!(failed(pow.verify(Some(&stamp), "user", None).await));
+    }
+}
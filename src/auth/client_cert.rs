@@ -0,0 +1,246 @@
+use std::{collections::HashMap, error::Error, io, sync::Arc};
+
+use axum::{middleware::AddExtension, Extension};
+use axum_server::accept::Accept;
+use futures_util::future::BoxFuture;
+use rustls::{
+    pki_types::{pem::PemObject, CertificateDer, PrivateKeyDer},
+    server::WebPkiClientVerifier,
+    RootCertStore, ServerConfig,
+};
+use tokio_rustls::server::TlsStream;
+use tower::Layer;
+
+use crate::config::ClientServiceConfig;
+
+use super::ServiceToken;
+
+/// The service proven by the client certificate of the connection, if it
+/// sent one mapped to a service.
+#[derive(Debug, Clone, Default)]
+pub struct ClientCert {
+    pub service: Option<ServiceToken>,
+}
+
+/// Builds a TLS config requesting the client certificates signed by
+/// `client_ca`. Clients without one are still accepted, so they can
+/// authenticate with tokens instead.
+pub fn tls_server_config(
+    cert: &str,
+    key: &str,
+    client_ca: &str,
+) -> Result<ServerConfig, Box<dyn Error + Send + Sync>> {
+    let certs =
+        CertificateDer::pem_file_iter(cert)?.collect::<Result<Vec<_>, _>>()?;
+    let key = PrivateKeyDer::from_pem_file(key)?;
+
+    let mut roots = RootCertStore::empty();
+    for ca in CertificateDer::pem_file_iter(client_ca)? {
+        roots.add(ca?)?;
+    }
+
+    let verifier = WebPkiClientVerifier::builder(Arc::new(roots))
+        .allow_unauthenticated()
+        .build()?;
+
+    Ok(ServerConfig::builder()
+        .with_client_cert_verifier(verifier)
+        .with_single_cert(certs, key)?)
+}
+
+/// Adds the [`ClientCert`] of the TLS connections accepted by the inner
+/// acceptor to their requests.
+#[derive(Debug, Clone)]
+pub struct ClientCertAcceptor<A> {
+    inner: A,
+    /// Services by certificate subject.
+    services: Arc<HashMap<String, ServiceToken>>,
+}
+
+impl<A> ClientCertAcceptor<A> {
+    pub fn new(inner: A, services: &[ClientServiceConfig]) -> Self {
+        let services = services
+            .iter()
+            .map(|service| {
+                let token = ServiceToken {
+                    name: service.name.clone(),
+                    permission: service.permission,
+                };
+                (service.subject.clone(), token)
+            })
+            .collect();
+
+        Self {
+            inner,
+            services: Arc::new(services),
+        }
+    }
+}
+
+impl<I, S, A, T> Accept<I, S> for ClientCertAcceptor<A>
+where
+    A: Accept<I, S, Stream = TlsStream<T>>,
+    A::Future: Send + 'static,
+{
+    type Stream = TlsStream<T>;
+    type Service = AddExtension<A::Service, ClientCert>;
+    type Future = BoxFuture<'static, io::Result<(Self::Stream, Self::Service)>>;
+
+    fn accept(&self, stream: I, service: S) -> Self::Future {
+        let accept = self.inner.accept(stream, service);
+        let services = self.services.clone();
+
+        Box::pin(async move {
+            let (stream, service) = accept.await?;
+
+            // Only verified certificates are kept by the connection
+            let service = stream
+                .get_ref()
+                .1
+                .peer_certificates()
+                .and_then(|certs| certs.first())
+                .and_then(|cert| common_name(cert))
+                .and_then(|subject| services.get(&subject).cloned());
+
+            let client_cert = ClientCert { service };
+            Ok((stream, Extension(client_cert).layer(service)))
+        })
+    }
+}
+
+const INTEGER: u8 = 0x02;
+const OID: u8 = 0x06;
+const UTF8_STRING: u8 = 0x0c;
+const PRINTABLE_STRING: u8 = 0x13;
+const IA5_STRING: u8 = 0x16;
+const SEQUENCE: u8 = 0x30;
+const SET: u8 = 0x31;
+/// The explicit `[0]` tag of the certificate version.
+const VERSION: u8 = 0xa0;
+
+/// `2.5.4.3`, the common name attribute.
+const COMMON_NAME_OID: &[u8] = &[0x55, 0x04, 0x03];
+
+/// Reads the elements of a DER encoded value.
+struct DerReader<'a>(&'a [u8]);
+
+impl<'a> DerReader<'a> {
+    fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    /// Returns the tag and the contents of the next element.
+    fn read(&mut self) -> Option<(u8, &'a [u8])> {
+        let (&tag, rest) = self.0.split_first()?;
+        let (&len, mut rest) = rest.split_first()?;
+
+        let len = if len < 0x80 {
+            len as usize
+        } else {
+            let size = (len & 0x7f) as usize;
+            if size == 0 || size > 4 || rest.len() < size {
+                return None;
+            }
+
+            let (len, after) = rest.split_at(size);
+            rest = after;
+            len.iter().fold(0, |acc, &b| acc << 8 | b as usize)
+        };
+
+        if rest.len() < len {
+            return None;
+        }
+        let (contents, rest) = rest.split_at(len);
+        self.0 = rest;
+
+        Some((tag, contents))
+    }
+
+    fn expect(&mut self, tag: u8) -> Option<&'a [u8]> {
+        self.read()
+            .and_then(|(got, contents)| (got == tag).then_some(contents))
+    }
+}
+
+/// Extracts the subject common name of a DER encoded X.509 certificate.
+pub fn common_name(cert: &[u8]) -> Option<String> {
+    // Certificate ::= SEQUENCE { TBSCertificate ::= SEQUENCE {
+    //   [0] version OPTIONAL, serialNumber, signature, issuer, validity,
+    //   subject, ... }, ... }
+    let cert = DerReader(cert).expect(SEQUENCE)?;
+    let mut tbs = DerReader(DerReader(cert).expect(SEQUENCE)?);
+
+    if tbs.0.first() == Some(&VERSION) {
+        tbs.read()?;
+    }
+    tbs.expect(INTEGER)?;
+    tbs.expect(SEQUENCE)?;
+    tbs.expect(SEQUENCE)?;
+    tbs.expect(SEQUENCE)?;
+
+    // Name ::= SEQUENCE OF SET OF SEQUENCE { type OID, value ANY }
+    let mut subject = DerReader(tbs.expect(SEQUENCE)?);
+    while !subject.is_empty() {
+        let mut names = DerReader(subject.expect(SET)?);
+
+        while !names.is_empty() {
+            let mut name = DerReader(names.expect(SEQUENCE)?);
+            if name.expect(OID)? != COMMON_NAME_OID {
+                continue;
+            }
+
+            return match name.read()? {
+                (UTF8_STRING | PRINTABLE_STRING | IA5_STRING, value) => {
+                    String::from_utf8(value.to_vec()).ok()
+                }
+                _ => None,
+            };
+        }
+    }
+
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use rustls::pki_types::{pem::PemObject, CertificateDer};
+    use test_log::test;
+
+    use super::common_name;
+
+    /// Self signed, with the `O=Downloader, CN=backup` subject.
+    const CERT: &str = "-----BEGIN CERTIFICATE-----
+MIIBYzCCARWgAwIBAgIUA+QTcXP0aPmfoApmO4GtNAgxw3wwBQYDK2VwMCYxEzAR
+BgNVBAoMCkRvd25sb2FkZXIxDzANBgNVBAMMBmJhY2t1cDAgFw0yNjEwMTYxNDQy
+MzBaGA8yMTI2MDkyMjE0NDIzMFowJjETMBEGA1UECgwKRG93bmxvYWRlcjEPMA0G
+A1UEAwwGYmFja3VwMCowBQYDK2VwAyEAApZkqpBhCOm+eblcO0iC4avBHeZno8My
+Bt5Ecoq327KjUzBRMB0GA1UdDgQWBBQ0sIeR6pKoSfvEeRD17+FYiIzS3DAfBgNV
+HSMEGDAWgBQ0sIeR6pKoSfvEeRD17+FYiIzS3DAPBgNVHRMBAf8EBTADAQH/MAUG
+AytlcANBAMTVAYYzp/8tAMoJG134qYySSMUipeXgjLTJa62I3eaczfAD06otRVtc
+O7n4FFe6+5oPSqFccv6D40v4K2uDsQA=
+-----END CERTIFICATE-----";
+
+    /// Self signed, with the `O=Downloader` subject.
+    const NO_CN_CERT: &str = "-----BEGIN CERTIFICATE-----
+MIIBQDCB86ADAgECAhR2PKPg/vEIiFP+1N8CfT11diJ3GzAFBgMrZXAwFTETMBEG
+A1UECgwKRG93bmxvYWRlcjAgFw0yNjEwMTYxNDQyMzBaGA8yMTI2MDkyMjE0NDIz
+MFowFTETMBEGA1UECgwKRG93bmxvYWRlcjAqMAUGAytlcAMhAFOaNHwkVD49YO1b
+R0dHDruB+daM+1Bk4B1zKJDjaVeAo1MwUTAdBgNVHQ4EFgQUgLZME/BCfF41tn0c
+4ePR8pTw4H0wHwYDVR0jBBgwFoAUgLZME/BCfF41tn0c4ePR8pTw4H0wDwYDVR0T
+AQH/BAUwAwEB/zAFBgMrZXADQQC6YvG5qV6L6TQdJDe810q1xac/kDGtcMN8r3ZD
+fsZR6ZDSD4oPp+7Yqmtsn+lnlzNsmq+rhNv3wxqvsdEwsisC
+-----END CERTIFICATE-----";
+
+    #[test]
+    fn test_common_name() {
+        let cert = CertificateDer::from_pem_slice(CERT.as_bytes()).unwrap();
+        assert_eq!(common_name(&cert).as_deref(), Some("backup"));
+
+        let cert =
+            CertificateDer::from_pem_slice(NO_CN_CERT.as_bytes()).unwrap();
+        assert_eq!(common_name(&cert), None);
+
+        assert_eq!(common_name(&cert[..cert.len() / 2]), None);
+        assert_eq!(common_name(&[]), None);
+    }
+}
@@ -1,12 +1,16 @@
 use std::time::Duration;
 
 use ::axum::http::StatusCode;
+use base64::{prelude::BASE64_URL_SAFE_NO_PAD, Engine};
 use bitflags::bitflags;
 use chrono::{DateTime, Utc};
 use serde::{de::Unexpected, Deserialize, Serialize};
 use uuid::Uuid;
 
 pub mod axum;
+pub mod cache;
+pub mod challenge;
+pub mod client_cert;
 pub mod repository;
 pub mod routes;
 
@@ -21,8 +25,10 @@ pub enum AuthError {
     InvalidToken,
     #[error("the provided token is expired")]
     ExpiredToken,
-    #[error("the provided token must be used in the future")]
+    #[error("the provided token is not valid yet")]
     ImatureToken,
+    #[error("the provided token was revoked")]
+    RevokedToken,
 
     #[error("authorization is required but no one was provided")]
     AuthorizationRequired,
@@ -37,6 +43,12 @@ pub enum AuthError {
     AccessDenied,
     #[error("you can not create a token with a permission higher than yours")]
     HigherPermissionRequired,
+    #[error("signup is disabled, an invite code is required")]
+    SignupNotAllowed,
+    #[error("the challenge response is missing or invalid")]
+    ChallengeFailed,
+    #[error("the challenge response could not be verified")]
+    ChallengeUnavailable,
 }
 
 impl AuthError {
@@ -47,12 +59,16 @@ impl AuthError {
             AuthError::TokenExpirationTooLong { .. } => StatusCode::BAD_REQUEST,
             AuthError::InvalidToken
             | AuthError::ExpiredToken
-            | AuthError::ImatureToken => StatusCode::UNAUTHORIZED,
+            | AuthError::ImatureToken
+            | AuthError::RevokedToken => StatusCode::UNAUTHORIZED,
             AuthError::AuthorizationRequired
             | AuthError::InvalidAuthHeader
             | AuthError::InvalidAuthStrategy(..) => StatusCode::BAD_REQUEST,
             AuthError::AccessDenied => StatusCode::FORBIDDEN,
             AuthError::HigherPermissionRequired => StatusCode::FORBIDDEN,
+            AuthError::SignupNotAllowed => StatusCode::FORBIDDEN,
+            AuthError::ChallengeFailed => StatusCode::FORBIDDEN,
+            AuthError::ChallengeUnavailable => StatusCode::SERVICE_UNAVAILABLE,
         }
     }
 
@@ -69,6 +85,10 @@ impl AuthError {
             AuthError::InvalidAuthStrategy(..) => 8,
             AuthError::AccessDenied => 9,
             AuthError::HigherPermissionRequired => 10,
+            AuthError::SignupNotAllowed => 11,
+            AuthError::RevokedToken => 12,
+            AuthError::ChallengeFailed => 13,
+            AuthError::ChallengeUnavailable => 14,
         }
     }
 }
@@ -79,6 +99,9 @@ pub enum Token {
     User(UserToken),
     File(FileToken),
     Server,
+    /// Never part of a jwt.
+    #[serde(skip)]
+    Service(ServiceToken),
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -89,10 +112,25 @@ pub struct UserToken {
     pub user_id: Uuid,
     #[serde(rename = "iat", with = "chrono::serde::ts_seconds")]
     pub created_at: DateTime<Utc>,
+    #[serde(
+        rename = "nbf",
+        with = "chrono::serde::ts_seconds_option",
+        default,
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub not_before: Option<DateTime<Utc>>,
     #[serde(rename = "exp", with = "chrono::serde::ts_seconds")]
     pub expiration: DateTime<Utc>,
     #[serde(rename = "iss")]
     pub issuer: String,
+    #[serde(rename = "aud")]
+    pub audience: String,
+    /// The session that issued the token, which is revoked along with it.
+    #[serde(rename = "jti", default, skip_serializing_if = "Option::is_none")]
+    pub session_id: Option<Uuid>,
+    /// The api key the request was authenticated with. Never part of a jwt.
+    #[serde(skip)]
+    pub api_key_id: Option<Uuid>,
 
     // Custom information
     #[serde(rename = "perm")]
@@ -108,26 +146,154 @@ pub struct FileToken {
     pub file_id: Uuid,
     #[serde(rename = "iat", with = "chrono::serde::ts_seconds")]
     pub created_at: DateTime<Utc>,
+    #[serde(
+        rename = "nbf",
+        with = "chrono::serde::ts_seconds_option",
+        default,
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub not_before: Option<DateTime<Utc>>,
     #[serde(rename = "exp", with = "chrono::serde::ts_seconds")]
     pub expiration: DateTime<Utc>,
     #[serde(rename = "iss")]
     pub issuer: String,
+    #[serde(rename = "aud")]
+    pub audience: String,
+    /// The upload link the token was issued for, spent by the first upload.
+    #[serde(rename = "jti", default, skip_serializing_if = "Option::is_none")]
+    pub upload_link_id: Option<Uuid>,
 
     // Custom information
+    /// Who delegated the access, `user/{id}`, `service/{name}` or `SRV`.
+    #[serde(rename = "by")]
+    pub shared_by: String,
     #[serde(rename = "perm")]
     pub permission: Permission,
 }
 
+/// A service authenticated by its client certificate, limited to the
+/// permission configured for it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ServiceToken {
+    pub name: String,
+    pub permission: Permission,
+}
+
+/// A public key in the JSON Web Key format (RFC 7517). Only the parameters
+/// of its key type are set.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Jwk {
+    pub kty: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub crv: Option<String>,
+    #[serde(rename = "use")]
+    pub key_use: String,
+    pub alg: String,
+    pub kid: String,
+    /// Coordinates of the OKP and EC keys.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub x: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub y: Option<String>,
+    /// Modulus and exponent of the RSA keys.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub n: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub e: Option<String>,
+}
+
+impl Jwk {
+    fn new(kty: &str, alg: &str, kid: String) -> Self {
+        Self {
+            kty: kty.into(),
+            crv: None,
+            key_use: "sig".into(),
+            alg: alg.into(),
+            kid,
+            x: None,
+            y: None,
+            n: None,
+            e: None,
+        }
+    }
+
+    pub fn ed25519(kid: String, public_key: &[u8; 32]) -> Self {
+        Self {
+            crv: Some("Ed25519".into()),
+            x: Some(BASE64_URL_SAFE_NO_PAD.encode(public_key)),
+            ..Self::new("OKP", "EdDSA", kid)
+        }
+    }
+
+    pub fn p256(kid: String, x: &[u8], y: &[u8]) -> Self {
+        Self {
+            crv: Some("P-256".into()),
+            x: Some(BASE64_URL_SAFE_NO_PAD.encode(x)),
+            y: Some(BASE64_URL_SAFE_NO_PAD.encode(y)),
+            ..Self::new("EC", "ES256", kid)
+        }
+    }
+
+    /// `n` and `e` are big-endian, without leading zeros.
+    pub fn rsa(kid: String, n: &[u8], e: &[u8]) -> Self {
+        Self {
+            n: Some(BASE64_URL_SAFE_NO_PAD.encode(n)),
+            e: Some(BASE64_URL_SAFE_NO_PAD.encode(e)),
+            ..Self::new("RSA", "RS256", kid)
+        }
+    }
+}
+
 impl Token {
+    #[inline]
+    pub fn expiration(&self) -> Option<DateTime<Utc>> {
+        match self {
+            Token::User(p) => Some(p.expiration),
+            Token::File(p) => Some(p.expiration),
+            Token::Server | Token::Service(..) => None,
+        }
+    }
+
+    #[inline]
+    pub fn created_at(&self) -> Option<DateTime<Utc>> {
+        match self {
+            Token::User(p) => Some(p.created_at),
+            Token::File(p) => Some(p.created_at),
+            Token::Server | Token::Service(..) => None,
+        }
+    }
+
+    #[inline]
+    pub fn not_before(&self) -> Option<DateTime<Utc>> {
+        match self {
+            Token::User(p) => p.not_before,
+            Token::File(p) => p.not_before,
+            Token::Server | Token::Service(..) => None,
+        }
+    }
+
     #[inline]
     pub fn permission(&self) -> Permission {
         match self {
             Token::User(p) => p.permission,
             Token::File(p) => p.permission,
             Token::Server => Permission::all(),
+            Token::Service(p) => p.permission,
         }
     }
 
+    /// Whether the token only grants uploading the data of its file, once.
+    #[inline]
+    pub fn is_upload_link(&self) -> bool {
+        matches!(
+            self,
+            Token::File(FileToken {
+                upload_link_id: Some(..),
+                ..
+            })
+        )
+    }
+
     #[inline]
     pub fn can_share(&self) -> bool {
         self.permission().contains(Permission::SHARE)
@@ -1,76 +1,364 @@
-use std::time::Duration;
+use std::{
+    collections::HashMap,
+    sync::{Arc, RwLock},
+    time::Duration,
+};
 
 use base64::Engine;
-use chrono::Utc;
+use chrono::{DateTime, TimeDelta, Utc};
 use jsonwebtoken::{
     errors::ErrorKind as JwtErrorKind, Algorithm, DecodingKey, EncodingKey,
     Header, Validation,
 };
 use uuid::Uuid;
 
-use super::{AuthError, FileToken, Permission, Token, UserToken};
+use crate::{
+    user::{ApiKey, User},
+    utils::clock::{checked_add, Clock, SystemClock},
+};
 
-pub struct TokenRepository {
+use super::{
+    cache::{TokenKind, VerifiedToken, VerifiedTokens},
+    AuthError, FileToken, Jwk, Permission, Token, UserToken,
+};
+
+/// Allowed clock skew while checking token expiration, the same used by
+/// [`Validation`] by default.
+const LEEWAY: TimeDelta = TimeDelta::seconds(60);
+
+/// Longest lifetime of the tokens signed by the services, so a leaked one
+/// can't be replayed for long.
+const MAX_SERVICE_TOKEN_DURATION: TimeDelta = TimeDelta::minutes(5);
+
+/// Claims of the tokens the services sign with their own key.
+#[derive(Debug, serde::Serialize, serde::Deserialize)]
+struct ServiceClaims {
+    /// Name the service key is registered with.
+    iss: String,
+    aud: String,
+    iat: i64,
+    exp: i64,
+}
+
+/// A key used to verify tokens, identified by the `kid` header.
+pub struct PublicKey {
+    pub kid: String,
+    pub dec_key: DecodingKey,
+    /// The key in JWK format, published in the JWKS endpoint when present.
+    pub jwk: Option<Jwk>,
+}
+
+struct KeySet {
     enc_key: EncodingKey,
-    dec_key: DecodingKey,
-    header: Header,
+    current: PublicKey,
+    /// Keys that are no longer used for signing but are still accepted while
+    /// verifying tokens.
+    accepted: Vec<PublicKey>,
+}
+
+impl KeySet {
+    fn decoding_key(&self, kid: Option<&str>) -> Option<&DecodingKey> {
+        match kid {
+            // Tokens issued before the `kid` header existed
+            None => Some(&self.current.dec_key),
+            Some(kid) if kid == self.current.kid => Some(&self.current.dec_key),
+            Some(kid) => self
+                .accepted
+                .iter()
+                .find(|key| key.kid == kid)
+                .map(|key| &key.dec_key),
+        }
+    }
+}
+
+pub struct TokenRepository {
+    keys: RwLock<KeySet>,
+    algo: Algorithm,
     validation: Validation,
+    clock: Arc<dyn Clock>,
+
+    /// Sent as `iss` and required while verifying, so tokens issued by
+    /// other deployments sharing the same keys are rejected.
+    issuer: String,
+    /// Sent as `aud` and required while verifying.
+    audience: String,
 
     user_token_duration: Duration,
     max_token_duration: Duration,
 
     srv_secret: Vec<u8>,
+    /// Public keys of the services, by name. Each service signs its own
+    /// tokens, so none of them holds a secret shared with the others.
+    service_keys: RwLock<HashMap<String, DecodingKey>>,
+    /// Cleared while holding the write lock of the keys, so tokens verified
+    /// with a replaced key are never cached after it.
+    verified: VerifiedTokens,
+    /// Tokens issued before it are rejected, whatever their expiration.
+    revoked_before: RwLock<Option<DateTime<Utc>>>,
 }
 
 impl TokenRepository {
     pub fn new(
         algo: Algorithm,
         enc_key: EncodingKey,
-        dec_key: DecodingKey,
+        public_key: PublicKey,
         user_token_duration: Duration,
         max_token_duration: Duration,
         srv_secret: Vec<u8>,
+        issuer: String,
+        audience: String,
     ) -> Self {
+        // Expiration is checked against `clock` after decoding
+        let mut validation = Validation::new(algo);
+        validation.validate_exp = false;
+        validation.set_issuer(&[&issuer]);
+        validation.set_audience(&[&audience]);
+        validation.set_required_spec_claims(&["exp", "iss", "aud"]);
+
         Self {
-            enc_key,
-            dec_key,
-            header: Header::new(algo),
-            validation: Validation::new(algo),
+            keys: RwLock::new(KeySet {
+                enc_key,
+                current: public_key,
+                accepted: Vec::new(),
+            }),
+            algo,
+            validation,
+            clock: Arc::new(SystemClock),
+            issuer,
+            audience,
             user_token_duration,
             max_token_duration,
             srv_secret,
+            service_keys: RwLock::default(),
+            verified: VerifiedTokens::new(0),
+            revoked_before: RwLock::default(),
         }
     }
+
+    /// Keeps up to `capacity` verified tokens, zero disables the cache.
+    pub fn with_token_cache(mut self, capacity: usize) -> Self {
+        self.verified = VerifiedTokens::new(capacity);
+        self
+    }
+
+    #[cfg(test)]
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
 }
 
 impl TokenRepository {
+    /// Starts signing tokens with the provided key. The current signing key
+    /// is kept as an accepted key, so tokens issued with it keep verifying
+    /// until it is dropped with [`TokenRepository::drop_key`].
+    ///
+    /// Returns the id of the replaced key, or `None` if the provided key is
+    /// already the signing key.
+    pub fn rotate_key(
+        &self,
+        enc_key: EncodingKey,
+        public_key: PublicKey,
+    ) -> Option<String> {
+        let mut guard = self.keys.write().unwrap();
+        let keys = &mut *guard;
+
+        if keys.current.kid == public_key.kid {
+            return None;
+        }
+
+        let old_key = std::mem::replace(&mut keys.current, public_key);
+        let old_kid = old_key.kid.clone();
+        keys.enc_key = enc_key;
+
+        keys.accepted.retain(|key| key.kid != keys.current.kid);
+        keys.accepted.push(old_key);
+        self.verified.clear();
+
+        tracing::info!(
+            kid = %keys.current.kid,
+            old_kid = %old_kid,
+            accepted_keys = keys.accepted.len(),
+            "rotated token signing key",
+        );
+
+        Some(old_kid)
+    }
+
+    /// Rotates the signing key like [`TokenRepository::rotate_key`], then
+    /// drops the replaced key once every token signed with it has expired.
+    pub fn rotate_key_with_overlap(
+        self: &Arc<Self>,
+        enc_key: EncodingKey,
+        public_key: PublicKey,
+    ) -> Option<String> {
+        let old_kid = self.rotate_key(enc_key, public_key)?;
+
+        let token_repo = self.clone();
+        let kid = old_kid.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(token_repo.max_token_duration()).await;
+            if token_repo.drop_key(&kid) {
+                tracing::info!(%kid, "dropped expired jwt key");
+            }
+        });
+
+        Some(old_kid)
+    }
+
+    /// Adds a key that is accepted while verifying tokens but never used to
+    /// sign new ones.
+    pub fn accept_key(&self, public_key: PublicKey) {
+        let mut guard = self.keys.write().unwrap();
+        let keys = &mut *guard;
+
+        if keys.current.kid == public_key.kid {
+            return;
+        }
+
+        keys.accepted.retain(|key| key.kid != public_key.kid);
+        keys.accepted.push(public_key);
+    }
+
+    /// Stops accepting tokens signed with the key identified by `kid`.
+    /// The current signing key can not be dropped.
+    pub fn drop_key(&self, kid: &str) -> bool {
+        let mut keys = self.keys.write().unwrap();
+
+        let len = keys.accepted.len();
+        keys.accepted.retain(|key| key.kid != kid);
+        self.verified.clear();
+
+        keys.accepted.len() != len
+    }
+
+    /// Returns the current and accepted public keys in JWK format.
+    pub fn jwks(&self) -> Vec<Jwk> {
+        let keys = self.keys.read().unwrap();
+
+        std::iter::once(&keys.current)
+            .chain(keys.accepted.iter())
+            .filter_map(|key| key.jwk.clone())
+            .collect()
+    }
+
+    /// Id of the current signing key.
+    pub fn kid(&self) -> String {
+        self.keys.read().unwrap().current.kid.clone()
+    }
+
+    #[inline]
+    pub fn user_token_duration(&self) -> Duration {
+        self.user_token_duration
+    }
+
+    #[inline]
+    pub fn max_token_duration(&self) -> Duration {
+        self.max_token_duration
+    }
+
+    fn encode<T: serde::Serialize>(
+        &self,
+        claims: &T,
+    ) -> Result<String, jsonwebtoken::errors::Error> {
+        let keys = self.keys.read().unwrap();
+
+        let mut header = Header::new(self.algo);
+        header.kid = Some(keys.current.kid.clone());
+
+        jsonwebtoken::encode(&header, claims, &keys.enc_key)
+    }
+
+    /// Generates a token for the user, valid for the user token duration.
+    /// Tokens issued by a `session_id` are only accepted while it is active.
     pub fn generate_user_token(
         &self,
         user_id: Uuid,
         permission: Permission,
         username: String,
+        session_id: Option<Uuid>,
     ) -> Result<String, AuthError> {
-        let now = Utc::now();
+        let now = self.clock.now();
 
         let claims = Token::User(UserToken {
             user_id,
             created_at: now,
+            not_before: Some(now),
             expiration: now + self.user_token_duration,
-            issuer: "SRV".into(),
+            issuer: self.issuer.clone(),
+            audience: self.audience.clone(),
+            session_id,
+            api_key_id: None,
             permission,
             username,
         });
 
-        jsonwebtoken::encode(&self.header, &claims, &self.enc_key)
+        self.encode(&claims)
             .map_err(|_| AuthError::GenerateTokenFailed)
     }
 
+    /// Builds the token of a request authenticated by the api key `key` of
+    /// `user`, limited to the permissions both still have. It is never
+    /// encoded, as the key is checked again on every request.
+    pub fn api_key_token(&self, key: &ApiKey, user: &User) -> Token {
+        let now = self.clock.now();
+
+        Token::User(UserToken {
+            user_id: user.id,
+            created_at: now,
+            not_before: None,
+            expiration: now,
+            issuer: self.issuer.clone(),
+            audience: self.audience.clone(),
+            session_id: None,
+            api_key_id: Some(key.id),
+            permission: key.permission & user.permission,
+            username: user.username.clone(),
+        })
+    }
+
+    /// Generates a token for the file `file_id`, valid for `expiration`
+    /// from `starts_at`, or from now when it is not provided.
     pub fn generate_file_token(
         &self,
         file_id: Uuid,
+        starts_at: Option<DateTime<Utc>>,
         expiration: Duration,
-        issuer: String,
+        shared_by: String,
         permission: Permission,
+    ) -> Result<String, AuthError> {
+        self.file_token(
+            file_id, starts_at, expiration, shared_by, permission, None,
+        )
+    }
+
+    /// Generates a token that can only upload the data of `file_id`, spent
+    /// along with the upload link `link_id` by its first upload.
+    pub fn generate_upload_link_token(
+        &self,
+        file_id: Uuid,
+        link_id: Uuid,
+        expiration: Duration,
+        shared_by: String,
+    ) -> Result<String, AuthError> {
+        self.file_token(
+            file_id,
+            None,
+            expiration,
+            shared_by,
+            Permission::SINGLE_FILE_RW,
+            Some(link_id),
+        )
+    }
+
+    fn file_token(
+        &self,
+        file_id: Uuid,
+        starts_at: Option<DateTime<Utc>>,
+        expiration: Duration,
+        shared_by: String,
+        permission: Permission,
+        upload_link_id: Option<Uuid>,
     ) -> Result<String, AuthError> {
         if expiration > self.max_token_duration {
             return Err(AuthError::TokenExpirationTooLong {
@@ -79,32 +367,123 @@ impl TokenRepository {
             });
         }
 
-        let now = Utc::now();
+        let now = self.clock.now();
+        let starts_at = starts_at.filter(|starts_at| *starts_at > now);
+        let expires_at = checked_add(starts_at.unwrap_or(now), expiration)
+            .ok_or(AuthError::TokenExpirationTooLong {
+                got: expiration,
+                max: self.max_token_duration,
+            })?;
 
         let claims = Token::File(FileToken {
             file_id,
             created_at: now,
-            expiration: now + expiration,
-            issuer,
+            not_before: starts_at,
+            expiration: expires_at,
+            issuer: self.issuer.clone(),
+            audience: self.audience.clone(),
+            upload_link_id,
+            shared_by,
             permission,
         });
 
-        jsonwebtoken::encode(&self.header, &claims, &self.enc_key).map_err(
-            |error| {
-                tracing::error!(%error, "generate JWT token failed");
-                AuthError::GenerateTokenFailed
-            },
-        )
+        self.encode(&claims).map_err(|error| {
+            tracing::error!(%error, "generate JWT token failed");
+            AuthError::GenerateTokenFailed
+        })
     }
 
     pub fn decode_token(&self, token: &str) -> Result<Token, AuthError> {
-        jsonwebtoken::decode(token, &self.dec_key, &self.validation)
-            .map_err(|error| match error.kind() {
-                JwtErrorKind::ExpiredSignature => AuthError::ExpiredToken,
-                JwtErrorKind::ImmatureSignature => AuthError::ImatureToken,
-                _ => AuthError::InvalidToken,
-            })
-            .map(|v| v.claims)
+        if let Some(verified) = self.verified.get(TokenKind::Bearer, token) {
+            let not_before = verified.token.not_before();
+            self.check_lifetime(verified.expiration, not_before)?;
+            self.check_not_revoked(&verified.token)?;
+            return Ok(verified.token);
+        }
+
+        let header = jsonwebtoken::decode_header(token)
+            .map_err(|_| AuthError::InvalidToken)?;
+
+        let keys = self.keys.read().unwrap();
+        let dec_key = keys
+            .decoding_key(header.kid.as_deref())
+            .ok_or(AuthError::InvalidToken)?;
+
+        let decoded: Token =
+            jsonwebtoken::decode(token, dec_key, &self.validation)
+                .map_err(|error| match error.kind() {
+                    JwtErrorKind::ExpiredSignature => AuthError::ExpiredToken,
+                    JwtErrorKind::ImmatureSignature => AuthError::ImatureToken,
+                    _ => AuthError::InvalidToken,
+                })?
+                .claims;
+
+        let expiration = decoded.expiration();
+        self.check_lifetime(expiration, decoded.not_before())?;
+        self.check_not_revoked(&decoded)?;
+
+        self.verified.insert(
+            TokenKind::Bearer,
+            token,
+            VerifiedToken {
+                token: decoded.clone(),
+                expiration,
+            },
+        );
+        drop(keys);
+
+        Ok(decoded)
+    }
+
+    /// Rejects every user and file token issued before `at`, such as all
+    /// the tokens issued so far, if the keys or the database leaked. Tokens
+    /// are only issued with a precision of seconds, so the ones issued
+    /// within the same second as `at` are rejected too.
+    pub fn revoke_before(&self, at: DateTime<Utc>) {
+        let mut revoked_before = self.revoked_before.write().unwrap();
+        if revoked_before.map_or(true, |current| current < at) {
+            *revoked_before = Some(at);
+        }
+    }
+
+    /// The time tokens issued before it are rejected, if any.
+    pub fn revoked_before(&self) -> Option<DateTime<Utc>> {
+        *self.revoked_before.read().unwrap()
+    }
+
+    fn check_not_revoked(&self, token: &Token) -> Result<(), AuthError> {
+        let Some(revoked_before) = self.revoked_before() else {
+            return Ok(());
+        };
+
+        match token.created_at() {
+            Some(created_at) if created_at < revoked_before => {
+                Err(AuthError::RevokedToken)
+            }
+            _ => Ok(()),
+        }
+    }
+
+    /// Checks the validity period of a token whose signature was verified.
+    fn check_lifetime(
+        &self,
+        expiration: Option<DateTime<Utc>>,
+        not_before: Option<DateTime<Utc>>,
+    ) -> Result<(), AuthError> {
+        let now = self.clock.now();
+
+        if let Some(expiration) = expiration {
+            if expiration < now - LEEWAY {
+                return Err(AuthError::ExpiredToken);
+            }
+        }
+        if let Some(not_before) = not_before {
+            if not_before > now + LEEWAY {
+                return Err(AuthError::ImatureToken);
+            }
+        }
+
+        Ok(())
     }
 
     pub fn verify_srv_key(&self, token: &str) -> Result<bool, AuthError> {
@@ -120,6 +499,68 @@ impl TokenRepository {
         Ok(eq)
     }
 
+    /// Accepts the tokens signed by the service `name` with the private key
+    /// matching `dec_key`.
+    pub fn add_service_key(&self, name: String, dec_key: DecodingKey) {
+        let mut service_keys = self.service_keys.write().unwrap();
+        service_keys.insert(name, dec_key);
+        self.verified.clear();
+    }
+
+    /// Verifies a token signed by a service with its own Ed25519 key. The
+    /// `kid` header names the service, which must also be the `iss`.
+    pub fn verify_service_token(
+        &self,
+        token: &str,
+    ) -> Result<Token, AuthError> {
+        if let Some(verified) = self.verified.get(TokenKind::Service, token) {
+            self.check_lifetime(verified.expiration, None)?;
+            return Ok(verified.token);
+        }
+
+        let header = jsonwebtoken::decode_header(token)
+            .map_err(|_| AuthError::InvalidToken)?;
+        let name = header.kid.ok_or(AuthError::InvalidToken)?;
+
+        let mut validation = Validation::new(Algorithm::EdDSA);
+        validation.validate_exp = false;
+        validation.set_issuer(&[&name]);
+        validation.set_audience(&[&self.audience]);
+        validation.set_required_spec_claims(&["exp", "iss", "aud"]);
+
+        let service_keys = self.service_keys.read().unwrap();
+        let dec_key = service_keys.get(&name).ok_or(AuthError::InvalidToken)?;
+
+        let claims =
+            jsonwebtoken::decode::<ServiceClaims>(token, dec_key, &validation)
+                .map_err(|_| AuthError::InvalidToken)?
+                .claims;
+
+        let now = self.clock.now().timestamp();
+        let lifetime = claims.exp.saturating_sub(claims.iat);
+
+        if lifetime > MAX_SERVICE_TOKEN_DURATION.num_seconds()
+            || claims.iat > now + LEEWAY.num_seconds()
+        {
+            return Err(AuthError::InvalidToken);
+        }
+        if claims.exp < now - LEEWAY.num_seconds() {
+            return Err(AuthError::ExpiredToken);
+        }
+
+        self.verified.insert(
+            TokenKind::Service,
+            token,
+            VerifiedToken {
+                token: Token::Server,
+                expiration: DateTime::from_timestamp(claims.exp, 0),
+            },
+        );
+        drop(service_keys);
+
+        Ok(Token::Server)
+    }
+
     #[cfg(test)]
     pub fn get_srv_key(&self) -> String {
         base64::prelude::BASE64_STANDARD.encode(&self.srv_secret)
@@ -128,17 +569,27 @@ impl TokenRepository {
 
 #[cfg(test)]
 pub mod tests {
-    use std::time::Duration;
+    use std::{
+        sync::Arc,
+        time::{Duration, Instant},
+    };
 
     use base64::Engine;
-    use jsonwebtoken::{Algorithm, DecodingKey, EncodingKey};
+    use chrono::{TimeDelta, Utc};
+    use jsonwebtoken::{Algorithm, DecodingKey, EncodingKey, Header};
     use rand::RngCore;
     use test_log::test;
     use uuid::Uuid;
 
-    use crate::auth::{Permission, Token};
+    use crate::{
+        auth::{AuthError, Permission, Token},
+        utils::{
+            clock::{Clock, MockClock},
+            crypto::generate_ed_keypair,
+        },
+    };
 
-    use super::TokenRepository;
+    use super::{PublicKey, ServiceClaims, TokenRepository};
 
     const USER_TOKEN_DURATION: Duration = Duration::from_secs(1);
 
@@ -152,13 +603,23 @@ pub mod tests {
         base64::engine::general_purpose::STANDARD.encode(rand_vec(24))
     }
 
+    const ISSUER: &str = "test";
+    const AUDIENCE: &str = "downloader";
+
     pub fn repository() -> TokenRepository {
-        let key = rand_vec(512);
+        repository_with_claims(&rand_vec(512), ISSUER, AUDIENCE)
+    }
+
+    fn repository_with_claims(
+        key: &[u8],
+        issuer: &str,
+        audience: &str,
+    ) -> TokenRepository {
         let srv_secret = rand_vec(128);
 
         let algo = Algorithm::HS256;
-        let enc_key = EncodingKey::from_secret(&key);
-        let dec_key = DecodingKey::from_secret(&key);
+        let enc_key = EncodingKey::from_secret(key);
+        let dec_key = DecodingKey::from_secret(key);
 
         let user_token_duration = USER_TOKEN_DURATION;
         let max_token_duration = Duration::from_secs(30 * 24 * 3600);
@@ -166,11 +627,18 @@ pub mod tests {
         TokenRepository::new(
             algo,
             enc_key,
-            dec_key,
+            PublicKey {
+                kid: "test".into(),
+                dec_key,
+                jwk: None,
+            },
             user_token_duration,
             max_token_duration,
             srv_secret,
+            issuer.into(),
+            audience.into(),
         )
+        .with_token_cache(64)
     }
 
     #[test]
@@ -184,7 +652,7 @@ pub mod tests {
         let username = rand_string();
 
         let tk = repo
-            .generate_user_token(user_id, permission, username.clone())
+            .generate_user_token(user_id, permission, username.clone(), None)
             .unwrap();
 
         let data = repo
@@ -196,7 +664,8 @@ pub mod tests {
             _ => panic!("decoded wrong token type"),
         };
 
-        assert_eq!(data.issuer, "SRV");
+        assert_eq!(data.issuer, ISSUER);
+        assert_eq!(data.audience, AUDIENCE);
         assert_eq!(
             (data.expiration - data.created_at).num_seconds(),
             USER_TOKEN_DURATION.as_secs() as i64
@@ -212,14 +681,15 @@ pub mod tests {
 
         let file_id = Uuid::new_v4();
         let expiration = Duration::from_secs(327);
-        let issuer = format!("user/{}", Uuid::new_v4());
+        let shared_by = format!("user/{}", Uuid::new_v4());
         let permission = Permission::ADMIN;
 
         let tk = repo
             .generate_file_token(
                 file_id,
+                None,
                 expiration,
-                issuer.clone(),
+                shared_by.clone(),
                 permission,
             )
             .unwrap();
@@ -233,12 +703,441 @@ pub mod tests {
             _ => panic!("decoded wrong token type"),
         };
 
-        assert_eq!(data.issuer, issuer);
+        assert_eq!(data.issuer, ISSUER);
+        assert_eq!(data.audience, AUDIENCE);
+        assert_eq!(data.shared_by, shared_by);
         assert_eq!(
             (data.expiration - data.created_at).num_seconds(),
             expiration.as_secs() as i64
         );
         assert_eq!(data.permission, permission);
         assert_eq!(data.file_id, file_id);
+        assert_eq!(data.upload_link_id, None);
+    }
+
+    #[test]
+    fn test_create_upload_link_token() {
+        let repo = repository();
+        let (file_id, link_id) = (Uuid::new_v4(), Uuid::new_v4());
+
+        let tk = repo
+            .generate_upload_link_token(
+                file_id,
+                link_id,
+                Duration::from_secs(60),
+                "SRV".into(),
+            )
+            .unwrap();
+
+        let token = repo
+            .decode_token(&tk)
+            .expect("failed to decode generated token");
+        assert!(token.is_upload_link());
+
+        let Token::File(data) = token else {
+            panic!("decoded wrong token type");
+        };
+        assert_eq!(data.file_id, file_id);
+        assert_eq!(data.upload_link_id, Some(link_id));
+        assert_eq!(data.permission, Permission::SINGLE_FILE_RW);
+    }
+
+    #[test]
+    fn test_file_token_max_duration() {
+        let repo = repository();
+        let generate = |expiration| {
+            repo.generate_file_token(
+                Uuid::new_v4(),
+                None,
+                expiration,
+                "SRV".into(),
+                Permission::SINGLE_FILE_R,
+            )
+        };
+
+        assert!(generate(repo.max_token_duration()).is_ok());
+        assert!(matches!(
+            generate(repo.max_token_duration() + Duration::from_secs(1)),
+            Err(AuthError::TokenExpirationTooLong { .. }),
+        ));
+        assert!(matches!(
+            generate(Duration::from_secs(u64::MAX)),
+            Err(AuthError::TokenExpirationTooLong { .. }),
+        ));
+    }
+
+    #[test]
+    fn test_rotate_key() {
+        let repo = repository();
+
+        let user_id = Uuid::new_v4();
+        let permission = Permission::UNPRIVILEGED;
+
+        let old_tk = repo
+            .generate_user_token(user_id, permission, rand_string(), None)
+            .unwrap();
+
+        let key = rand_vec(512);
+        let old_kid = repo.rotate_key(
+            EncodingKey::from_secret(&key),
+            PublicKey {
+                kid: "rotated".into(),
+                dec_key: DecodingKey::from_secret(&key),
+                jwk: None,
+            },
+        );
+        assert_eq!(old_kid.as_deref(), Some("test"));
+
+        let new_tk = repo
+            .generate_user_token(user_id, permission, rand_string(), None)
+            .unwrap();
+
+        let header = jsonwebtoken::decode_header(&new_tk).unwrap();
+        assert_eq!(header.kid.as_deref(), Some("rotated"));
+
+        repo.decode_token(&old_tk)
+            .expect("failed to decode token signed with the previous key");
+        repo.decode_token(&new_tk)
+            .expect("failed to decode token signed with the rotated key");
+
+        assert!(repo.drop_key("test"), "previous key was not accepted");
+
+        let res = repo.decode_token(&old_tk);
+        assert!(
+            matches!(res, Err(AuthError::InvalidToken)),
+            "expected invalid token error after dropping the previous key",
+        );
+        repo.decode_token(&new_tk)
+            .expect("failed to decode token signed with the rotated key");
+    }
+
+    #[test]
+    fn test_expired_token() {
+        let clock = Arc::new(MockClock::new(Utc::now()));
+        let repo = repository().with_clock(clock.clone());
+
+        let tk = repo
+            .generate_user_token(
+                Uuid::new_v4(),
+                Permission::UNPRIVILEGED,
+                rand_string(),
+                None,
+            )
+            .unwrap();
+
+        // Still valid inside the leeway
+        clock.advance(TimeDelta::from_std(USER_TOKEN_DURATION).unwrap());
+        clock.advance(TimeDelta::seconds(30));
+        repo.decode_token(&tk)
+            .expect("failed to decode token inside the expiration leeway");
+
+        clock.advance(TimeDelta::seconds(31));
+        let res = repo.decode_token(&tk);
+        assert!(
+            matches!(res, Err(AuthError::ExpiredToken)),
+            "expected expired token error, got {res:?}",
+        );
+    }
+
+    #[test]
+    fn test_claims_mismatch() {
+        let key = rand_vec(512);
+        let repo = repository_with_claims(&key, ISSUER, AUDIENCE);
+
+        let tk = repo
+            .generate_user_token(
+                Uuid::new_v4(),
+                Permission::UNPRIVILEGED,
+                rand_string(),
+                None,
+            )
+            .unwrap();
+
+        // Same keys, different deployment or service
+        for other in [
+            repository_with_claims(&key, "other", AUDIENCE),
+            repository_with_claims(&key, ISSUER, "other"),
+        ] {
+            let res = other.decode_token(&tk);
+            assert!(
+                matches!(res, Err(AuthError::InvalidToken)),
+                "expected invalid token error, got {res:?}",
+            );
+        }
+    }
+
+    #[test]
+    fn test_not_before() {
+        let clock = Arc::new(MockClock::new(Utc::now()));
+        let repo = repository().with_clock(clock.clone());
+
+        let starts_at = clock.now() + TimeDelta::hours(1);
+        let expiration = Duration::from_secs(600);
+
+        let tk = repo
+            .generate_file_token(
+                Uuid::new_v4(),
+                Some(starts_at),
+                expiration,
+                "SRV".into(),
+                Permission::SINGLE_FILE_R,
+            )
+            .unwrap();
+
+        let res = repo.decode_token(&tk);
+        assert!(
+            matches!(res, Err(AuthError::ImatureToken)),
+            "expected imature token error, got {res:?}",
+        );
+
+        clock.advance(TimeDelta::hours(1));
+        let data = match repo.decode_token(&tk) {
+            Ok(Token::File(v)) => v,
+            res => panic!("expected decoded file token, got {res:?}"),
+        };
+
+        assert_eq!(
+            data.not_before.map(|v| v.timestamp()),
+            Some(starts_at.timestamp())
+        );
+        assert_eq!(
+            (data.expiration - starts_at).num_seconds(),
+            expiration.as_secs() as i64
+        );
+    }
+
+    #[test]
+    fn test_not_before_overflow() {
+        let repo = repository();
+
+        let res = repo.generate_file_token(
+            Uuid::new_v4(),
+            Some(DateTime::<Utc>::MAX_UTC),
+            Duration::from_secs(600),
+            "SRV".into(),
+            Permission::SINGLE_FILE_R,
+        );
+        assert!(
+            matches!(res, Err(AuthError::TokenExpirationTooLong { .. })),
+            "expected expiration too long error, got {res:?}",
+        );
+    }
+
+    #[test]
+    fn test_revoke_before() {
+        let clock = Arc::new(MockClock::new(Utc::now()));
+        let repo = repository().with_clock(clock.clone());
+
+        let user_tk = repo
+            .generate_user_token(
+                Uuid::new_v4(),
+                Permission::UNPRIVILEGED,
+                rand_string(),
+                None,
+            )
+            .unwrap();
+        let file_tk = repo
+            .generate_file_token(
+                Uuid::new_v4(),
+                None,
+                Duration::from_secs(600),
+                "SRV".into(),
+                Permission::SINGLE_FILE_R,
+            )
+            .unwrap();
+        // Cached before being revoked
+        repo.decode_token(&user_tk).unwrap();
+
+        clock.advance(TimeDelta::seconds(2));
+        repo.revoke_before(clock.now());
+        // Never moved back
+        repo.revoke_before(clock.now() - TimeDelta::hours(1));
+        assert_eq!(repo.revoked_before(), Some(clock.now()));
+
+        for tk in [&user_tk, &file_tk] {
+            let res = repo.decode_token(tk);
+            assert!(
+                matches!(res, Err(AuthError::RevokedToken)),
+                "expected revoked token error, got {res:?}",
+            );
+        }
+
+        clock.advance(TimeDelta::seconds(1));
+        let tk = repo
+            .generate_user_token(
+                Uuid::new_v4(),
+                Permission::UNPRIVILEGED,
+                rand_string(),
+                None,
+            )
+            .unwrap();
+        repo.decode_token(&tk).unwrap();
+    }
+
+    #[test]
+    fn test_service_token() {
+        let clock = Arc::new(MockClock::new(Utc::now()));
+        let repo = repository().with_clock(clock.clone());
+
+        let (private_pem, public_pem) = generate_ed_keypair().unwrap();
+        let enc_key = EncodingKey::from_ed_pem(private_pem.as_bytes()).unwrap();
+        let dec_key = DecodingKey::from_ed_pem(public_pem.as_bytes()).unwrap();
+        repo.add_service_key("backup".into(), dec_key);
+
+        let sign = |name: &str, lifetime: TimeDelta| {
+            let mut header = Header::new(Algorithm::EdDSA);
+            header.kid = Some(name.into());
+            let now = clock.now().timestamp();
+
+            let claims = ServiceClaims {
+                iss: name.into(),
+                aud: AUDIENCE.into(),
+                iat: now,
+                exp: now + lifetime.num_seconds(),
+            };
+            jsonwebtoken::encode(&header, &claims, &enc_key).unwrap()
+        };
+
+        let tk = sign("backup", TimeDelta::minutes(1));
+        let res = repo.verify_service_token(&tk);
+        assert!(
+            matches!(res, Ok(Token::Server)),
+            "expected server token, got {res:?}",
+        );
+
+        for tk in [
+            sign("unknown", TimeDelta::minutes(1)),
+            sign("backup", TimeDelta::hours(1)),
+        ] {
+            let res = repo.verify_service_token(&tk);
+            assert!(
+                matches!(res, Err(AuthError::InvalidToken)),
+                "expected invalid token error, got {res:?}",
+            );
+        }
+
+        clock.advance(TimeDelta::minutes(3));
+        let res = repo.verify_service_token(&tk);
+        assert!(
+            matches!(res, Err(AuthError::ExpiredToken)),
+            "expected expired token error, got {res:?}",
+        );
+    }
+
+    #[test]
+    fn test_token_cache() {
+        let clock = Arc::new(MockClock::new(Utc::now()));
+        let repo = repository().with_clock(clock.clone());
+
+        let tk = repo
+            .generate_user_token(
+                Uuid::new_v4(),
+                Permission::UNPRIVILEGED,
+                rand_string(),
+                None,
+            )
+            .unwrap();
+
+        let first = repo.decode_token(&tk).unwrap();
+        let cached = repo.decode_token(&tk).unwrap();
+        assert_eq!(
+            serde_json::to_value(first).unwrap(),
+            serde_json::to_value(cached).unwrap(),
+        );
+        assert_eq!(repo.verified.len(), 1);
+
+        // Not accepted with another strategy
+        let res = repo.verify_service_token(&tk);
+        assert!(
+            matches!(res, Err(AuthError::InvalidToken)),
+            "expected invalid token error, got {res:?}",
+        );
+
+        // Replacing the key of a service drops its verified tokens
+        let sign = |enc_key: &EncodingKey| {
+            let mut header = Header::new(Algorithm::EdDSA);
+            header.kid = Some("backup".into());
+            let now = clock.now().timestamp();
+
+            let claims = ServiceClaims {
+                iss: "backup".into(),
+                aud: AUDIENCE.into(),
+                iat: now,
+                exp: now + 60,
+            };
+            jsonwebtoken::encode(&header, &claims, enc_key).unwrap()
+        };
+        let ed_keys = || {
+            let (private_pem, public_pem) = generate_ed_keypair().unwrap();
+            (
+                EncodingKey::from_ed_pem(private_pem.as_bytes()).unwrap(),
+                DecodingKey::from_ed_pem(public_pem.as_bytes()).unwrap(),
+            )
+        };
+
+        let (enc_key, dec_key) = ed_keys();
+        repo.add_service_key("backup".into(), dec_key);
+        let service_tk = sign(&enc_key);
+        repo.verify_service_token(&service_tk).unwrap();
+        repo.verify_service_token(&service_tk).unwrap();
+
+        let (_, dec_key) = ed_keys();
+        repo.add_service_key("backup".into(), dec_key);
+        assert_eq!(repo.verified.len(), 0);
+        let res = repo.verify_service_token(&service_tk);
+        assert!(
+            matches!(res, Err(AuthError::InvalidToken)),
+            "expected invalid token error, got {res:?}",
+        );
+    }
+
+    /// Run with `cargo test --release -- --ignored --nocapture bench_`
+    #[test]
+    #[ignore = "benchmark"]
+    fn bench_decode_token_cache() {
+        const ROUNDS: u32 = 10_000;
+
+        let (private_pem, public_pem) = generate_ed_keypair().unwrap();
+        let repo = |capacity| {
+            TokenRepository::new(
+                Algorithm::EdDSA,
+                EncodingKey::from_ed_pem(private_pem.as_bytes()).unwrap(),
+                PublicKey {
+                    kid: "test".into(),
+                    dec_key: DecodingKey::from_ed_pem(public_pem.as_bytes())
+                        .unwrap(),
+                    jwk: None,
+                },
+                Duration::from_secs(3600),
+                Duration::from_secs(3600),
+                rand_vec(128),
+                ISSUER.into(),
+                AUDIENCE.into(),
+            )
+            .with_token_cache(capacity)
+        };
+
+        for capacity in [0, 1024] {
+            let repo = repo(capacity);
+            let tk = repo
+                .generate_user_token(
+                    Uuid::new_v4(),
+                    Permission::UNPRIVILEGED,
+                    rand_string(),
+                    None,
+                )
+                .unwrap();
+
+            let start = Instant::now();
+            for _ in 0..ROUNDS {
+                repo.decode_token(&tk).unwrap();
+            }
+            let elapsed = start.elapsed();
+
+            println!(
+                "cache capacity {capacity}: {:.2} µs per token",
+                elapsed.as_secs_f64() * 1e6 / ROUNDS as f64,
+            );
+        }
     }
 }
@@ -1,32 +1,179 @@
-use std::{sync::Arc, time::Duration};
+use std::{
+    fmt::Display,
+    net::{IpAddr, SocketAddr},
+    sync::Arc,
+    time::Duration,
+};
 
-use axum::{extract::Path, routing, Extension, Router};
+use axum::{
+    extract::{ConnectInfo, Path},
+    http::{header, HeaderMap, StatusCode},
+    Extension,
+};
+use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
 use sqlx::Sqlite;
+use tokio::sync::Mutex;
 use uuid::Uuid;
 
 use crate::{
-    errors::DownloaderError,
-    storage::{repository::ObjectRepository, Object},
-    user::{repository::UserRepository, User, UserData},
-    utils::extractors::Json,
+    config::{RoutesConfig, TokenAlgorithm},
+    errors::{DownloaderError, ValidationError},
+    storage::{
+        quota::{QuotaUsage, Quotas},
+        repository::ObjectRepository,
+        Object,
+    },
+    user::{
+        repository::UserRepository, validate_api_key_name, validate_password,
+        ApiKey, Invite, Session, User, UserData,
+    },
+    utils::{
+        audit::{Actor, AuditAction, AuditEvent, AuditLogger},
+        clock::checked_add,
+        crypto::{
+            fetch_jwt_key_files, generate_keypair, write_jwt_key_files,
+            KeyError,
+        },
+        extractors::Json,
+        openapi::{ApiRouter, Content, RouteSpec, Schema},
+    },
 };
 
 use super::{
-    axum::Authorization, repository::TokenRepository, AuthError, Permission,
-    Token,
+    axum::{Authorization, OptionalAuthorization},
+    challenge::{Challenge, ChallengeInfo},
+    repository::TokenRepository,
+    AuthError, Jwk, Permission, Token,
 };
 
-pub fn auth_routes<S>(router: Router<S>) -> Router<S>
+pub const GET_JWKS: RouteSpec = RouteSpec::get(
+    "/.well-known/jwks.json",
+    "Public keys verifying the tokens",
+)
+.response(Content::Json(Schema::Named("JwksResponseData")));
+const GET_SELF: RouteSpec =
+    RouteSpec::get("/self", "Decodes the token of the request")
+        .auth()
+        .response(Content::Json(Schema::Named("Token")));
+const GET_ME: RouteSpec =
+    RouteSpec::get("/me", "Gets the user of the token and its storage")
+        .auth()
+        .response(Content::Json(Schema::Named("MeResponseData")))
+        .errors(&[3001, 3006, 4009]);
+const POST_LOGIN: RouteSpec =
+    RouteSpec::post("/login", "Signs in, starting a session")
+        .request(Content::Json(Schema::of::<LoginRequestData>()))
+        .response(Content::Json(Schema::Named("LoginResponseData")))
+        .errors(&[3001, 3003, 3005, 3006, 4001, 4010, 5001]);
+const POST_FILE_TOKEN: RouteSpec =
+    RouteSpec::post("/token/:id", "Creates a token to access a file")
+        .auth()
+        .request(Content::Json(Schema::of::<FileTokenRequestData>()))
+        .response(Content::Json(Schema::Named("FileTokenResponseData")))
+        .errors(&[1001, 1003, 4001, 4002, 4009, 4010, 5001]);
+const UPDATE_SELF_PASSWORD: RouteSpec =
+    RouteSpec::put("/password", "Changes the password of a user")
+        .request(Content::Json(Schema::of::<UpdatePasswordRequestData>()))
+        .response(Content::Json(Schema::Named("LoginResponseData")))
+        .errors(&[3001, 3003, 3004, 3005, 3006, 4001, 5001]);
+const GET_SESSIONS: RouteSpec =
+    RouteSpec::get("/sessions", "Lists the sessions of the user")
+        .auth()
+        .response(Content::Json(Schema::Named("SessionsResponseData")))
+        .errors(&[3006, 4009]);
+const DELETE_OTHER_SESSIONS: RouteSpec = RouteSpec::delete(
+    "/sessions",
+    "Ends the sessions of the user but the current one",
+)
+.auth()
+.response(Content::JsonList(Schema::of::<Session>()))
+.errors(&[3006, 4009]);
+const DELETE_SESSION: RouteSpec =
+    RouteSpec::delete("/sessions/:id", "Ends a session of the user")
+        .auth()
+        .response(Content::Json(Schema::of::<Session>()))
+        .errors(&[3006, 3009, 4009]);
+const GET_API_KEYS: RouteSpec =
+    RouteSpec::get("/api-keys", "Lists the api keys of the user")
+        .auth()
+        .response(Content::JsonList(Schema::of::<ApiKey>()))
+        .errors(&[3006, 4009]);
+const POST_API_KEY: RouteSpec =
+    RouteSpec::post("/api-keys", "Creates an api key for the user")
+        .auth()
+        .request(Content::Json(Schema::of::<ApiKeyRequestData>()))
+        .response(Content::Json(Schema::Named("ApiKeyResponseData")))
+        .errors(&[3006, 4009, 4010, 5001]);
+const DELETE_API_KEY: RouteSpec =
+    RouteSpec::delete("/api-keys/:id", "Revokes an api key of the user")
+        .auth()
+        .response(Content::Json(Schema::of::<ApiKey>()))
+        .errors(&[3006, 3010, 4009]);
+const ROTATE_SIGNING_KEY: RouteSpec =
+    RouteSpec::post("/keys/rotate", "Replaces the token signing key")
+        .auth()
+        .response(Content::Json(Schema::Named("RotateKeyResponseData")))
+        .errors(&[4001, 4009]);
+const REVOKE_ALL_TOKENS: RouteSpec = RouteSpec::post(
+    "/tokens/revoke",
+    "Revokes every user and file token issued until now",
+)
+.auth()
+.response(Content::Json(Schema::Named("RevokeTokensResponseData")))
+.errors(&[4009]);
+const POST_SIGNUP: RouteSpec =
+    RouteSpec::post("/signup", "Creates an account, starting a session")
+        .optional_auth()
+        .request(Content::Json(Schema::of::<SignupRequestData>()))
+        .response(Content::Json(Schema::Named("LoginResponseData")))
+        .errors(&[
+            3002, 3004, 3006, 3007, 4001, 4009, 4010, 4011, 4013, 4014, 5001,
+        ]);
+const GET_SIGNUP_CHALLENGE: RouteSpec = RouteSpec::get(
+    "/challenge",
+    "The challenge to solve to sign up without an invite, if any",
+)
+.response(Content::Json(Schema::Named("ChallengeInfo")));
+const POST_INVITE: RouteSpec =
+    RouteSpec::post("/invite", "Creates an invite code to sign up")
+        .auth()
+        .request(Content::Json(Schema::of::<InviteRequestData>()))
+        .response(Content::Json(Schema::of::<Invite>()))
+        .errors(&[3006, 4009, 4010, 5001]);
+
+pub fn auth_routes<S>(api: ApiRouter<S>, routes: &RoutesConfig) -> ApiRouter<S>
 where
     S: Clone + Send + Sync + 'static,
 {
-    router
-        .route("/self", routing::get(get_self))
-        .route("/login", routing::post(post_login))
-        .route("/signup", routing::post(post_signup))
-        .route("/token/:id", routing::post(post_file_token))
-        .route("/password", routing::put(update_self_password))
+    let mut api = api
+        .route(GET_SELF, get_self)
+        .route(GET_ME, get_me)
+        .route(POST_LOGIN, post_login)
+        .route(POST_FILE_TOKEN, post_file_token)
+        .route(UPDATE_SELF_PASSWORD, update_self_password)
+        .route(GET_SESSIONS, get_sessions)
+        .route(DELETE_OTHER_SESSIONS, delete_other_sessions)
+        .route(DELETE_SESSION, delete_session)
+        .route(GET_API_KEYS, get_api_keys)
+        .route(POST_API_KEY, post_api_key)
+        .route(DELETE_API_KEY, delete_api_key)
+        .route(ROTATE_SIGNING_KEY, rotate_signing_key)
+        .route(REVOKE_ALL_TOKENS, revoke_all_tokens);
+
+    if routes.signup {
+        api = api
+            .route(POST_SIGNUP, post_signup)
+            .route(GET_SIGNUP_CHALLENGE, get_signup_challenge)
+            .route(POST_INVITE, post_invite);
+    } else {
+        api = api
+            .disabled(POST_SIGNUP)
+            .disabled(GET_SIGNUP_CHALLENGE)
+            .disabled(POST_INVITE);
+    }
+
+    api
 }
 
 #[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
@@ -50,17 +197,60 @@ impl LoginRequestData {
     }
 }
 
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SignupRequestData {
+    pub username: String,
+    pub password: String,
+    pub permission: Option<Permission>,
+    pub invite_code: Option<String>,
+    /// Response to the signup challenge, when one is configured.
+    pub challenge: Option<String>,
+}
+
+impl SignupRequestData {
+    #[inline]
+    pub fn split(self) -> (UserData, Option<Permission>, Option<String>) {
+        (
+            UserData {
+                password: self.password,
+                username: self.username,
+            },
+            self.permission,
+            self.invite_code,
+        )
+    }
+}
+
+/// How long invites last if the request doesn't say.
+const DEFAULT_INVITE_DURATION: Duration = Duration::from_secs(7 * 86400);
+
+/// User agents longer than it are truncated before being recorded.
+pub const MAX_USER_AGENT_LEN: usize = 255;
+
 #[derive(Debug, Clone, PartialEq, Eq, Serialize)]
 pub struct LoginResponseData {
     pub user: User,
     pub token: String,
 }
 
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct MeResponseData {
+    pub user: User,
+    /// Permission carried by the token, which may be lower than the current
+    /// one of the user.
+    pub token_permission: Permission,
+    pub token_expires_at: DateTime<Utc>,
+    pub storage: QuotaUsage,
+}
+
 #[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
 #[serde(deny_unknown_fields)]
 pub struct FileTokenRequestData {
     pub permission: Option<Permission>,
     pub duration: Option<u64>,
+    /// When the token starts being valid, the duration is counted from it.
+    pub not_before: Option<DateTime<Utc>>,
 }
 
 #[derive(Debug, Clone, PartialEq, Eq, Serialize)]
@@ -69,6 +259,118 @@ pub struct FileTokenResponseData {
     pub token: String,
 }
 
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct InviteRequestData {
+    pub permission: Option<Permission>,
+    pub duration: Option<u64>,
+}
+
+/// How accounts can be created by callers without the `WRITE_USERS`
+/// permission.
+#[derive(Clone, Default)]
+pub struct SignupConfig {
+    /// Anyone can create an unprivileged account, with no invite needed.
+    pub allow_signup: bool,
+    /// Solved by the callers signing up without an invite.
+    pub challenge: Option<Arc<dyn Challenge>>,
+}
+
+/// Where the token signing key is kept, rewritten by the key rotations.
+pub struct KeyFiles {
+    pub token_cert: String,
+    pub token_key: String,
+    pub algorithm: TokenAlgorithm,
+    /// Rotations rewrite the same files, so only one runs at a time.
+    lock: Mutex<()>,
+}
+
+impl KeyFiles {
+    pub fn new(
+        token_cert: String,
+        token_key: String,
+        algorithm: TokenAlgorithm,
+    ) -> Self {
+        Self {
+            token_cert,
+            token_key,
+            algorithm,
+            lock: Mutex::new(()),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct RotateKeyResponseData {
+    pub kid: String,
+    pub previous_kid: String,
+    /// Copy of the replaced public key. It is only accepted in memory, so
+    /// it must be added to `previous_token_certs` if the server is restarted
+    /// before `previous_expires_at`.
+    pub previous_cert: String,
+    pub previous_expires_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct RevokeTokensResponseData {
+    /// User and file tokens issued before it are rejected.
+    pub revoked_before: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct JwksResponseData {
+    pub keys: Vec<Jwk>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct SessionsResponseData {
+    /// The session of the token used in the request, if any.
+    pub current: Option<Uuid>,
+    pub sessions: Vec<Session>,
+}
+
+/// The client starting a session, recorded so users can recognize it.
+#[derive(Debug, Clone, Default)]
+pub struct SessionClient {
+    pub ip_addr: Option<IpAddr>,
+    pub user_agent: Option<String>,
+}
+
+impl SessionClient {
+    pub fn new(
+        connect_info: Option<&ConnectInfo<SocketAddr>>,
+        headers: &HeaderMap,
+    ) -> Self {
+        Self {
+            ip_addr: connect_info.map(|ConnectInfo(addr)| addr.ip()),
+            user_agent: headers
+                .get(header::USER_AGENT)
+                .and_then(|value| value.to_str().ok())
+                .map(|value| value.chars().take(MAX_USER_AGENT_LEN).collect()),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ApiKeyRequestData {
+    pub name: String,
+    /// Defaults to the permission of the token creating the key.
+    pub permission: Option<Permission>,
+    /// Restricts the key to the read permissions.
+    #[serde(default)]
+    pub read_only: bool,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct ApiKeyResponseData {
+    /// The key to authenticate with, using the `ApiKey` strategy. It is
+    /// only returned here.
+    pub key: String,
+    #[serde(flatten)]
+    pub api_key: ApiKey,
+}
+
 #[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
 pub struct UpdatePasswordRequestData {
     pub username: String,
@@ -82,11 +384,64 @@ pub async fn get_self(
     Ok(Json(token))
 }
 
+/// Returns the user the token belongs to as currently stored, so permission
+/// changes made after the token was issued are visible.
+pub async fn get_me(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(quotas): Extension<Arc<Quotas>>,
+) -> Result<Json<MeResponseData>, DownloaderError> {
+    let Token::User(user_token) = token else {
+        return Err(AuthError::AccessDenied.into());
+    };
+
+    let user = user_repo.get(user_token.user_id).await?;
+    let storage = quotas.usage(&user).await?;
+
+    Ok(Json(MeResponseData {
+        user,
+        token_permission: user_token.permission,
+        token_expires_at: user_token.expiration,
+        storage,
+    }))
+}
+
+pub async fn get_jwks(
+    Extension(token_repo): Extension<Arc<TokenRepository>>,
+) -> Json<JwksResponseData> {
+    Json(JwksResponseData {
+        keys: token_repo.jwks(),
+    })
+}
+
 pub async fn post_login(
     Extension(token_repo): Extension<Arc<TokenRepository>>,
     Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    headers: HeaderMap,
     Json(data): Json<LoginRequestData>,
 ) -> Result<Json<LoginResponseData>, DownloaderError> {
+    let username = data.username.clone();
+    let client = SessionClient::new(connect_info.as_ref(), &headers);
+    let res = login(&token_repo, &user_repo, client, data).await;
+
+    let mut actor = Actor::new(None, connect_info.as_ref());
+    actor.user_id = res.as_ref().ok().map(|data| data.user.id);
+    audit.record(
+        AuditEvent::new(AuditAction::Signin, actor, actor.user_id, &res)
+            .with_username(username),
+    );
+
+    res.map(Json)
+}
+
+async fn login(
+    token_repo: &TokenRepository,
+    user_repo: &UserRepository<Sqlite>,
+    client: SessionClient,
+    data: LoginRequestData,
+) -> Result<LoginResponseData, DownloaderError> {
     let (data, permission) = data.split();
     let user = user_repo.authenticate(data).await?;
 
@@ -99,48 +454,207 @@ pub async fn post_login(
         user.permission
     };
 
+    let token =
+        start_session(token_repo, user_repo, &user, permission, client).await?;
+
+    Ok(LoginResponseData { token, user })
+}
+
+/// Records a new session of the user, returning a token issued by it.
+async fn start_session(
+    token_repo: &TokenRepository,
+    user_repo: &UserRepository<Sqlite>,
+    user: &User,
+    permission: Permission,
+    client: SessionClient,
+) -> Result<String, DownloaderError> {
+    let expires_at = Utc::now() + token_repo.user_token_duration();
+    let ip_addr = client.ip_addr.map(|ip| ip.to_string());
+    let session = user_repo
+        .create_session(
+            user.id,
+            expires_at,
+            ip_addr.as_deref(),
+            client.user_agent.as_deref(),
+        )
+        .await?;
+
     let token = token_repo.generate_user_token(
         user.id,
         permission,
         user.username.clone(),
+        Some(session.id),
     )?;
 
-    Ok(Json(LoginResponseData { token, user }))
+    Ok(token)
 }
 
 pub async fn post_signup(
-    Authorization(token): Authorization,
+    OptionalAuthorization(token): OptionalAuthorization,
+    Extension(signup): Extension<SignupConfig>,
     Extension(token_repo): Extension<Arc<TokenRepository>>,
     Extension(user_repo): Extension<UserRepository<Sqlite>>,
-    Json(data): Json<LoginRequestData>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    headers: HeaderMap,
+    Json(data): Json<SignupRequestData>,
 ) -> Result<Json<LoginResponseData>, DownloaderError> {
+    let actor = Actor::new(token.as_ref(), connect_info.as_ref());
+    let username = data.username.clone();
+    let client = SessionClient::new(connect_info.as_ref(), &headers);
+
+    let res =
+        signup_user(token, signup, &token_repo, &user_repo, client, data).await;
+
+    let target = res.as_ref().ok().map(|data| data.user.id);
+    audit.record(
+        AuditEvent::new(AuditAction::Signup, actor, target, &res)
+            .with_username(username),
+    );
+
+    res.map(Json)
+}
+
+async fn signup_user(
+    token: Option<Token>,
+    signup: SignupConfig,
+    token_repo: &TokenRepository,
+    user_repo: &UserRepository<Sqlite>,
+    client: SessionClient,
+    mut data: SignupRequestData,
+) -> Result<LoginResponseData, DownloaderError> {
+    let challenge = data.challenge.take();
+    let (data, permission, invite_code) = data.split();
+    data.validate()?;
+
+    let user = match token {
+        Some(token) if token.can_write_users() => {
+            let permission = permission.unwrap_or_else(|| match token {
+                Token::Server => Permission::ADMIN,
+                _ => Permission::UNPRIVILEGED,
+            });
+
+            user_repo.create(permission, data).await?
+        }
+        _ => {
+            // The permission of self-created accounts is decided by the
+            // invite or by the server, never by the caller
+            if permission.is_some() {
+                return Err(AuthError::HigherPermissionRequired.into());
+            }
+
+            if let Some(code) = invite_code {
+                user_repo.create_with_invite(&code, data).await?
+            } else if signup.allow_signup {
+                // Invites are handed out by admins, only the open signup
+                // is challenged
+                if let Some(verifier) = &signup.challenge {
+                    verifier
+                        .verify(
+                            challenge.as_deref(),
+                            &data.username,
+                            client.ip_addr,
+                        )
+                        .await?;
+                }
+
+                user_repo.create(Permission::UNPRIVILEGED, data).await?
+            } else {
+                return Err(AuthError::SignupNotAllowed.into());
+            }
+        }
+    };
+
+    let token =
+        start_session(token_repo, user_repo, &user, user.permission, client)
+            .await?;
+
+    Ok(LoginResponseData { user, token })
+}
+
+/// Returns what the clients signing up without an invite must solve, if
+/// anything.
+pub async fn get_signup_challenge(
+    Extension(signup): Extension<SignupConfig>,
+) -> Json<Option<ChallengeInfo>> {
+    let info = signup
+        .challenge
+        .filter(|_| signup.allow_signup)
+        .map(|challenge| challenge.info());
+
+    Json(info)
+}
+
+pub async fn post_invite(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(token_repo): Extension<Arc<TokenRepository>>,
+    Json(data): Json<InviteRequestData>,
+) -> Result<Json<Invite>, DownloaderError> {
     if !token.can_write_users() {
         return Err(AuthError::AccessDenied.into());
     }
 
-    let (data, permission) = data.split();
-    let permission = permission.unwrap_or_else(|| match token {
-        Token::Server => Permission::ADMIN,
-        _ => Permission::UNPRIVILEGED,
-    });
+    let permission = data.permission.unwrap_or(Permission::UNPRIVILEGED);
+    if !token.permission().contains(permission) {
+        return Err(AuthError::HigherPermissionRequired.into());
+    }
 
-    let user = user_repo.create(permission, data).await?;
-    let token = token_repo.generate_user_token(
-        user.id,
-        permission,
-        user.username.clone(),
-    )?;
+    // Invites are bounded like any other credential handed out
+    let max = token_repo.max_token_duration();
+    let duration = match data.duration {
+        Some(secs) => Duration::from_secs(secs),
+        None => DEFAULT_INVITE_DURATION.min(max),
+    };
+    if duration > max {
+        return Err(
+            AuthError::TokenExpirationTooLong { got: duration, max }.into()
+        );
+    }
+    let expires_at = checked_add(Utc::now(), duration)
+        .ok_or(AuthError::TokenExpirationTooLong { got: duration, max })?;
 
-    Ok(Json(LoginResponseData { user, token }))
+    let created_by = match &token {
+        Token::User(user_token) => Some(user_token.user_id),
+        _ => None,
+    };
+
+    let invite = user_repo
+        .create_invite(created_by, permission, expires_at)
+        .await?;
+
+    Ok(Json(invite))
 }
 
 pub async fn post_file_token(
     Authorization(token): Authorization,
     Extension(token_repo): Extension<Arc<TokenRepository>>,
     Extension(obj_repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
     Path(id): Path<Uuid>,
     Json(data): Json<FileTokenRequestData>,
 ) -> Result<Json<FileTokenResponseData>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    let res = file_token(&token, &token_repo, &obj_repo, id, data).await;
+
+    audit.record(AuditEvent::new(
+        AuditAction::IssueToken,
+        actor,
+        Some(id),
+        &res,
+    ));
+
+    res.map(Json)
+}
+
+async fn file_token(
+    token: &Token,
+    token_repo: &TokenRepository,
+    obj_repo: &ObjectRepository<Sqlite>,
+    id: Uuid,
+    data: FileTokenRequestData,
+) -> Result<FileTokenResponseData, DownloaderError> {
     if !token.can_share() {
         return Err(AuthError::AccessDenied.into());
     }
@@ -151,13 +665,35 @@ pub async fn post_file_token(
         .map(Duration::from_secs)
         .unwrap_or(Duration::from_secs(3600));
 
+    let file = obj_repo.get(id).await?;
+    let shared_by = file_token_sharer(token, &file, permission)?;
+
+    let token = token_repo.generate_file_token(
+        file.id,
+        data.not_before,
+        duration,
+        shared_by,
+        permission,
+    )?;
+
+    Ok(FileTokenResponseData { file, token })
+}
+
+/// Checks if `token` can delegate `permission` over `file`, returning who
+/// the file token is shared by.
+pub fn file_token_sharer(
+    token: &Token,
+    file: &Object,
+    permission: Permission,
+) -> Result<String, AuthError> {
+    if !token.can_share() {
+        return Err(AuthError::AccessDenied);
+    }
     if !token.permission().contains(permission) {
-        return Err(AuthError::HigherPermissionRequired.into());
+        return Err(AuthError::HigherPermissionRequired);
     }
 
-    let file = obj_repo.get(id).await?;
-
-    let (can_access, issuer) = match &token {
+    let (can_access, shared_by) = match token {
         Token::User(user_token) => (
             token.can_write_all() || file.user_id == user_token.user_id,
             format!("user/{}", user_token.user_id),
@@ -165,29 +701,161 @@ pub async fn post_file_token(
         Token::File(file_token) => {
             tracing::warn!(
                 file_id = %file_token.file_id,
-                issuer = %file_token.issuer,
+                shared_by = %file_token.shared_by,
                 "got a file token with `SHARE` permission"
             );
-            return Err(AuthError::AccessDenied.into());
+            return Err(AuthError::AccessDenied);
         }
         Token::Server => (true, "SRV".into()),
+        Token::Service(service) => {
+            (token.can_write_all(), format!("service/{}", service.name))
+        }
     };
 
     if !can_access {
+        return Err(AuthError::AccessDenied);
+    }
+
+    Ok(shared_by)
+}
+
+/// Replaces the token signing key by a newly generated one. Tokens signed
+/// with the previous key keep being accepted until all of them expired, so
+/// no client is logged out by the rotation.
+pub async fn rotate_signing_key(
+    Authorization(token): Authorization,
+    Extension(token_repo): Extension<Arc<TokenRepository>>,
+    Extension(key_files): Extension<Arc<KeyFiles>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+) -> Result<Json<RotateKeyResponseData>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    let res = rotate_key(&token, &token_repo, &key_files).await;
+
+    audit.record(AuditEvent::new(AuditAction::RotateKey, actor, None, &res));
+
+    res.map(Json)
+}
+
+async fn rotate_key(
+    token: &Token,
+    token_repo: &Arc<TokenRepository>,
+    key_files: &KeyFiles,
+) -> Result<RotateKeyResponseData, DownloaderError> {
+    if !token.permission().contains(Permission::ADMIN) {
         return Err(AuthError::AccessDenied.into());
     }
 
-    let token = token_repo
-        .generate_file_token(file.id, duration, issuer, permission)?;
+    let _guard = key_files.lock.lock().await;
+    let key_error = |error: &dyn Display| {
+        tracing::error!(%error, "failed to rotate jwt key");
+        DownloaderError::Other(
+            format!("failed to rotate the signing key: {error}"),
+            StatusCode::INTERNAL_SERVER_ERROR,
+        )
+    };
+
+    let (private_pem, public_pem) = match generate_keypair(key_files.algorithm)
+    {
+        Ok(keypair) => keypair,
+        Err(error @ KeyError::CantGenerate(..)) => {
+            return Err(DownloaderError::Other(
+                error.to_string(),
+                StatusCode::NOT_IMPLEMENTED,
+            ));
+        }
+        Err(error) => return Err(key_error(&error)),
+    };
+
+    // Checked before the files are touched, the replaced key is accepted
+    // for as long as the tokens it signed can last
+    let previous_expires_at =
+        checked_add(Utc::now(), token_repo.max_token_duration())
+            .ok_or_else(|| key_error(&"the max token duration is too long"))?;
+
+    let previous_kid = token_repo.kid();
+    let previous_cert = format!("{}.{previous_kid}", key_files.token_cert);
+    tokio::fs::copy(&key_files.token_cert, &previous_cert)
+        .await
+        .map_err(|e| key_error(&e))?;
+    write_jwt_key_files(
+        &key_files.token_cert,
+        &key_files.token_key,
+        &public_pem,
+        &private_pem,
+    )
+    .await
+    .map_err(|e| key_error(&e))?;
 
-    Ok(Json(FileTokenResponseData { file, token }))
+    let (enc_key, public_key) = fetch_jwt_key_files(
+        &key_files.token_cert,
+        &key_files.token_key,
+        key_files.algorithm,
+    )
+    .await
+    .map_err(|e| key_error(&e))?;
+    let kid = public_key.kid.clone();
+
+    token_repo.rotate_key_with_overlap(enc_key, public_key);
+
+    Ok(RotateKeyResponseData {
+        kid,
+        previous_kid,
+        previous_cert,
+        previous_expires_at,
+    })
+}
+
+/// Revokes every user and file token issued so far at once, for when they
+/// may have leaked. The server secret key is still accepted, so admins can
+/// act even if their own tokens are revoked.
+pub async fn revoke_all_tokens(
+    Authorization(token): Authorization,
+    Extension(token_repo): Extension<Arc<TokenRepository>>,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+) -> Result<Json<RevokeTokensResponseData>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+
+    let res = async {
+        if !token.permission().contains(Permission::ADMIN) {
+            return Err(AuthError::AccessDenied.into());
+        }
+
+        // Stored first, so the revocation outlives a restart
+        let revoked_before =
+            DateTime::from_timestamp_millis(Utc::now().timestamp_millis())
+                .unwrap_or_else(Utc::now);
+        user_repo.revoke_tokens_before(revoked_before).await?;
+        token_repo.revoke_before(revoked_before);
+
+        tracing::warn!(%revoked_before, "revoked every issued token");
+        Ok::<_, DownloaderError>(RevokeTokensResponseData { revoked_before })
+    }
+    .await;
+
+    audit.record(AuditEvent::new(
+        AuditAction::RevokeAllTokens,
+        actor,
+        None,
+        &res,
+    ));
+
+    res.map(Json)
 }
 
 pub async fn update_self_password(
     Extension(user_repo): Extension<UserRepository<Sqlite>>,
     Extension(token_repo): Extension<Arc<TokenRepository>>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    headers: HeaderMap,
     Json(data): Json<UpdatePasswordRequestData>,
 ) -> Result<Json<LoginResponseData>, DownloaderError> {
+    let mut violations = Vec::new();
+    validate_password("new_password", &data.new_password, &mut violations);
+    ValidationError::check(violations)?;
+
     let mut user = user_repo
         .authenticate(UserData {
             username: data.username,
@@ -199,11 +867,187 @@ pub async fn update_self_password(
         .update_password(user.id, data.new_password)
         .await?;
 
-    let token = token_repo.generate_user_token(
-        user.id,
-        user.permission,
-        user.username.clone(),
-    )?;
+    let client = SessionClient::new(connect_info.as_ref(), &headers);
+    let token =
+        start_session(&token_repo, &user_repo, &user, user.permission, client)
+            .await?;
 
     Ok(Json(LoginResponseData { user, token }))
 }
+
+/// Returns the user and the session of a user token.
+fn session_owner(token: &Token) -> Result<(Uuid, Option<Uuid>), AuthError> {
+    match token {
+        Token::User(user_token) => {
+            Ok((user_token.user_id, user_token.session_id))
+        }
+        _ => Err(AuthError::AccessDenied),
+    }
+}
+
+/// Lists the active sessions of the user, from the newest to the oldest.
+pub async fn get_sessions(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+) -> Result<Json<SessionsResponseData>, DownloaderError> {
+    let (user_id, current) = session_owner(&token)?;
+    let sessions = user_repo.list_sessions(user_id).await?;
+
+    Ok(Json(SessionsResponseData { current, sessions }))
+}
+
+/// Revokes one session of the user, which may be the current one.
+pub async fn delete_session(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Path(id): Path<Uuid>,
+) -> Result<Json<Session>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+
+    let res = match session_owner(&token) {
+        Ok((user_id, _)) => user_repo
+            .delete_session(user_id, id)
+            .await
+            .map_err(DownloaderError::from),
+        Err(error) => Err(error.into()),
+    };
+
+    audit.record(AuditEvent::new(
+        AuditAction::RevokeSession,
+        actor,
+        actor.user_id,
+        &res,
+    ));
+
+    res.map(Json)
+}
+
+/// Revokes every session of the user but the current one, returning the
+/// revoked ones.
+pub async fn delete_other_sessions(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+) -> Result<Json<Vec<Session>>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+
+    let res = match session_owner(&token) {
+        Ok((user_id, current)) => user_repo
+            .delete_other_sessions(user_id, current)
+            .await
+            .map_err(DownloaderError::from),
+        Err(error) => Err(error.into()),
+    };
+
+    audit.record(AuditEvent::new(
+        AuditAction::RevokeSession,
+        actor,
+        actor.user_id,
+        &res,
+    ));
+
+    res.map(Json)
+}
+
+/// Returns the user creating or revoking api keys with a user token.
+fn api_key_owner(token: &Token) -> Result<(Uuid, Permission), AuthError> {
+    match token {
+        // An api key can't be used to create other keys
+        Token::User(user_token) if user_token.api_key_id.is_none() => {
+            Ok((user_token.user_id, user_token.permission))
+        }
+        _ => Err(AuthError::AccessDenied),
+    }
+}
+
+/// Lists the api keys of the user, from the newest to the oldest.
+pub async fn get_api_keys(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+) -> Result<Json<Vec<ApiKey>>, DownloaderError> {
+    let user_id = match &token {
+        Token::User(user_token) => user_token.user_id,
+        _ => return Err(AuthError::AccessDenied.into()),
+    };
+
+    Ok(Json(user_repo.list_api_keys(user_id).await?))
+}
+
+/// Creates an api key for the user, with at most the permission of the
+/// token creating it.
+pub async fn post_api_key(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Json(data): Json<ApiKeyRequestData>,
+) -> Result<Json<ApiKeyResponseData>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    let res = create_api_key(&token, &user_repo, data).await;
+
+    audit.record(AuditEvent::new(
+        AuditAction::CreateApiKey,
+        actor,
+        actor.user_id,
+        &res,
+    ));
+
+    res.map(Json)
+}
+
+async fn create_api_key(
+    token: &Token,
+    user_repo: &UserRepository<Sqlite>,
+    data: ApiKeyRequestData,
+) -> Result<ApiKeyResponseData, DownloaderError> {
+    let mut violations = Vec::new();
+    validate_api_key_name("name", &data.name, &mut violations);
+    ValidationError::check(violations)?;
+
+    let (user_id, token_permission) = api_key_owner(token)?;
+
+    let mut permission = data.permission.unwrap_or(token_permission);
+    if !token_permission.contains(permission) {
+        return Err(AuthError::HigherPermissionRequired.into());
+    }
+    if data.read_only {
+        permission &= Permission::READ_ALL | Permission::READ_USERS;
+    }
+
+    let (api_key, key) = user_repo
+        .create_api_key(user_id, &data.name, permission)
+        .await?;
+
+    Ok(ApiKeyResponseData { key, api_key })
+}
+
+/// Revokes one api key of the user.
+pub async fn delete_api_key(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Path(id): Path<Uuid>,
+) -> Result<Json<ApiKey>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+
+    let res = match api_key_owner(&token) {
+        Ok((user_id, _)) => user_repo
+            .delete_api_key(user_id, id)
+            .await
+            .map_err(DownloaderError::from),
+        Err(error) => Err(error.into()),
+    };
+
+    audit.record(AuditEvent::new(
+        AuditAction::RevokeApiKey,
+        actor,
+        actor.user_id,
+        &res,
+    ));
+
+    res.map(Json)
+}
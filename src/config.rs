@@ -1,24 +1,48 @@
 use std::{
-    fs,
+    collections::HashMap,
+    fmt, fs,
     net::{IpAddr, Ipv4Addr, SocketAddr},
+    path::PathBuf,
     time::Duration,
 };
 
-use clap::Parser;
-use serde::{Deserialize, Serialize};
+use clap::{Parser, Subcommand, ValueEnum};
+use jsonwebtoken::Algorithm;
+use serde::{
+    de::{
+        value::{MapDeserializer, SeqDeserializer},
+        IntoDeserializer, Visitor,
+    },
+    forward_to_deserialize_any, Deserialize, Deserializer, Serialize,
+};
+use serde_json::{Map, Value};
 
-use crate::utils::serde::{
-    base64, deserialize_socket_addr, duration_secs, ResolvedFile, ResolvedPath,
+use crate::{
+    auth::Permission,
+    storage::sniff::ContentTypePattern,
+    user::HASH_COST_RANGE,
+    utils::serde::{
+        base64, deserialize_socket_addr, duration_secs, one_or_many,
+        permission_names, ResolvedFile, ResolvedPath,
+    },
 };
 
 pub const DEFAULT_HTTP_ADDR: SocketAddr =
     SocketAddr::new(IpAddr::V4(Ipv4Addr::new(0, 0, 0, 0)), 8080);
 pub const DEFAULT_TCP_ADDR: SocketAddr =
     SocketAddr::new(IpAddr::V4(Ipv4Addr::new(0, 0, 0, 0)), 7777);
-pub const DEFAULT_TEMP_DIR: &'static str = "/tmp/downloader";
+pub const DEFAULT_TOKEN_ISSUER: &'static str = "downloader";
+pub const DEFAULT_TOKEN_AUDIENCE: &'static str = "downloader";
+pub const MIN_SECRET_KEY_LEN: usize = 32;
+pub const DEFAULT_MAX_NAME_LEN: usize = 255;
 
 #[derive(Parser, Debug)]
-#[command(version, about, long_about = None)]
+#[command(
+    version,
+    long_version = crate::utils::version::LONG_VERSION,
+    about,
+    long_about = None
+)]
 pub struct Args {
     #[arg(short, long, default_value_t = false)]
     pub debug: bool,
@@ -31,15 +55,253 @@ pub struct Args {
         default_value_t = String::from("/etc/downloader/config.toml"),
     )]
     pub config_path: String,
+
+    #[command(subcommand)]
+    pub command: Option<Command>,
+}
+
+#[derive(Subcommand, Debug)]
+pub enum Command {
+    /// Runs the http server (default)
+    Serve,
+    /// Checks the stored files against the database, recomputing their
+    /// checksums. Exits with an error if they are not consistent
+    Scrub {
+        /// Deletes stored files that have no database entry. Only run it
+        /// while the server is stopped, files being uploaded would be
+        /// deleted too
+        #[arg(long, default_value_t = false)]
+        delete_orphans: bool,
+    },
+    /// Encrypts the stored files that are still in plain text and rewraps
+    /// the data keys of the ones encrypted with a previous master key, so
+    /// it can be removed. Only run it while the server is stopped
+    Reencrypt,
+    /// Loads and validates the config file, also reading the key and
+    /// certificate files it points to, without starting anything. Prints a
+    /// report and exits with an error if any check failed
+    CheckConfig,
+    /// Generates the keypair used to sign tokens and prints a random
+    /// `auth.secret_key`. No config file is needed
+    GenKeys {
+        /// Where to write the PKCS8 private key (`auth.token_key`)
+        #[arg(long)]
+        private_key: PathBuf,
+        /// Where to write the SPKI public key (`auth.token_cert`)
+        #[arg(long)]
+        public_key: PathBuf,
+        /// Overwrites the key files if they already exist
+        #[arg(long, default_value_t = false)]
+        force: bool,
+        /// Kind of the keypair (`auth.token_algorithm`). RSA keys can't be
+        /// generated, create them with `openssl genpkey` instead
+        #[arg(long, value_enum, default_value_t = TokenAlgorithm::EdDSA)]
+        algorithm: TokenAlgorithm,
+    },
+}
+
+pub const ENV_PREFIX: &'static str = "DOWNLOADER_";
+
+/// Printed in place of the secrets by the [`Debug`](fmt::Debug) impls, so
+/// the configuration can be logged.
+struct Redacted;
+
+impl fmt::Debug for Redacted {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("<redacted>")
+    }
 }
 
+/// Loads the configuration file at `path`, letting `DOWNLOADER_*`
+/// environment variables override its values.
 pub fn load(path: &str) -> Result<Config, Box<dyn std::error::Error>> {
     let file = fs::read_to_string(path)?;
 
-    if path.ends_with(".json") {
-        serde_json::from_str(&file).map_err(Into::into)
+    let mut value: Value = if path.ends_with(".json") {
+        serde_json::from_str(&file)?
     } else {
-        toml::from_str(&file).map_err(Into::into)
+        toml::from_str(&file)?
+    };
+
+    apply_env_overrides(&mut value, std::env::vars());
+
+    Config::deserialize(EnvValue(value)).map_err(Into::into)
+}
+
+/// Overrides the values of `value` with the variables prefixed by
+/// [`ENV_PREFIX`]. Nested keys are separated by a double underscore, so
+/// `DOWNLOADER_AUTH__TOKEN_DURATION` overrides `auth.token_duration`.
+///
+/// Variable values are kept as strings, parsed by [`EnvValue`] according to
+/// the field they are set to.
+fn apply_env_overrides(
+    value: &mut Value,
+    vars: impl Iterator<Item = (String, String)>,
+) {
+    for (key, var) in vars {
+        let Some(key) = key.strip_prefix(ENV_PREFIX) else {
+            continue;
+        };
+
+        let mut target = &mut *value;
+        for segment in key.split("__") {
+            if !target.is_object() {
+                *target = Value::Object(Map::new());
+            }
+
+            target = target
+                .as_object_mut()
+                .unwrap()
+                .entry(segment.to_lowercase())
+                .or_insert(Value::Null);
+        }
+
+        *target = Value::String(var);
+    }
+}
+
+/// Deserializes a configuration value where some fields may be strings set
+/// from the environment. The strings given to a field that is not one are
+/// parsed as JSON, so `"60"` fits a number and `"[1, 2]"` a list, while
+/// string fields keep them as they are.
+struct EnvValue(Value);
+
+impl EnvValue {
+    fn parsed(self) -> Self {
+        match self.0 {
+            Value::String(s) => {
+                Self(serde_json::from_str(&s).unwrap_or(Value::String(s)))
+            }
+            value => Self(value),
+        }
+    }
+}
+
+impl<'de> IntoDeserializer<'de, serde_json::Error> for EnvValue {
+    type Deserializer = Self;
+
+    fn into_deserializer(self) -> Self {
+        self
+    }
+}
+
+macro_rules! deserialize_parsed {
+    ($($method:ident)*) => {$(
+        fn $method<V: Visitor<'de>>(
+            self,
+            visitor: V,
+        ) -> Result<V::Value, Self::Error> {
+            self.parsed().deserialize_any(visitor)
+        }
+    )*};
+}
+
+impl<'de> Deserializer<'de> for EnvValue {
+    type Error = serde_json::Error;
+
+    fn deserialize_any<V: Visitor<'de>>(
+        self,
+        visitor: V,
+    ) -> Result<V::Value, Self::Error> {
+        match self.0 {
+            Value::Object(map) => {
+                let mut map = MapDeserializer::<_, Self::Error>::new(
+                    map.into_iter().map(|(k, v)| (k, EnvValue(v))),
+                );
+                let value = visitor.visit_map(&mut map)?;
+                map.end()?;
+                Ok(value)
+            }
+            Value::Array(seq) => {
+                let mut seq = SeqDeserializer::<_, Self::Error>::new(
+                    seq.into_iter().map(EnvValue),
+                );
+                let value = visitor.visit_seq(&mut seq)?;
+                seq.end()?;
+                Ok(value)
+            }
+            // Only lists and maps are told apart from strings, the scalars
+            // are up to the visitor
+            Value::String(s) => match serde_json::from_str(&s) {
+                Ok(value @ (Value::Array(..) | Value::Object(..))) => {
+                    EnvValue(value).deserialize_any(visitor)
+                }
+                _ => visitor.visit_string(s),
+            },
+            value => value.deserialize_any(visitor),
+        }
+    }
+
+    fn deserialize_option<V: Visitor<'de>>(
+        self,
+        visitor: V,
+    ) -> Result<V::Value, Self::Error> {
+        match self.0 {
+            Value::Null => visitor.visit_none(),
+            _ => visitor.visit_some(self),
+        }
+    }
+
+    fn deserialize_newtype_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        visitor: V,
+    ) -> Result<V::Value, Self::Error> {
+        visitor.visit_newtype_struct(self)
+    }
+
+    fn deserialize_enum<V: Visitor<'de>>(
+        self,
+        name: &'static str,
+        variants: &'static [&'static str],
+        visitor: V,
+    ) -> Result<V::Value, Self::Error> {
+        self.parsed().0.deserialize_enum(name, variants, visitor)
+    }
+
+    fn deserialize_unit_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        visitor: V,
+    ) -> Result<V::Value, Self::Error> {
+        self.parsed().deserialize_any(visitor)
+    }
+
+    fn deserialize_tuple<V: Visitor<'de>>(
+        self,
+        _len: usize,
+        visitor: V,
+    ) -> Result<V::Value, Self::Error> {
+        self.parsed().deserialize_any(visitor)
+    }
+
+    fn deserialize_tuple_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        _len: usize,
+        visitor: V,
+    ) -> Result<V::Value, Self::Error> {
+        self.parsed().deserialize_any(visitor)
+    }
+
+    fn deserialize_struct<V: Visitor<'de>>(
+        self,
+        _name: &'static str,
+        _fields: &'static [&'static str],
+        visitor: V,
+    ) -> Result<V::Value, Self::Error> {
+        self.parsed().deserialize_any(visitor)
+    }
+
+    deserialize_parsed! {
+        deserialize_bool deserialize_i8 deserialize_i16 deserialize_i32
+        deserialize_i64 deserialize_u8 deserialize_u16 deserialize_u32
+        deserialize_u64 deserialize_f32 deserialize_f64 deserialize_unit
+        deserialize_seq deserialize_map
+    }
+
+    forward_to_deserialize_any! {
+        char str string bytes byte_buf identifier ignored_any
     }
 }
 
@@ -49,6 +311,141 @@ pub struct Config {
     pub ssl: SslConfig,
     pub storage: StorageConfig,
     pub auth: AuthConfig,
+    #[serde(default)]
+    pub throttle: ThrottleConfig,
+    #[serde(default)]
+    pub quota: QuotaConfig,
+    #[serde(default)]
+    pub audit: AuditConfig,
+    #[serde(default)]
+    pub maintenance: MaintenanceConfig,
+    #[serde(default)]
+    pub routes: RoutesConfig,
+    #[serde(default)]
+    pub log: LogConfig,
+    #[serde(default)]
+    pub webhook: WebhookConfig,
+    #[serde(default)]
+    pub headers: HeadersConfig,
+}
+
+impl Config {
+    /// Checks constraints that can not be expressed by deserialization
+    /// alone.
+    pub fn validate(&self) -> Result<(), String> {
+        if self.net.http_addr.port() == 0 {
+            return Err("`net.http_addr` must have a non-zero port".into());
+        }
+        if self.net.enable_tcp && self.net.tpc_addr.port() == 0 {
+            return Err("`net.tpc_addr` must have a non-zero port".into());
+        }
+
+        if self.ssl.enable {
+            if self.ssl.cert.is_none() {
+                return Err("`ssl.cert` is required when TLS is enabled".into());
+            }
+            if self.ssl.key.is_none() {
+                return Err("`ssl.key` is required when TLS is enabled".into());
+            }
+        } else if self.ssl.client_auth.is_some() {
+            return Err("`ssl.client_auth` requires TLS to be enabled".into());
+        }
+
+        if self.storage.data_dirs.is_empty() {
+            return Err("`storage.data_dirs` must not be empty".into());
+        }
+        for dir in &self.storage.data_dirs {
+            let probe = dir.join(".downloader-write-test");
+
+            fs::write(&probe, [])
+                .and_then(|_| fs::remove_file(&probe))
+                .map_err(|err| {
+                    format!(
+                        "data dir `{}` is not writable: {err}",
+                        dir.as_str()
+                    )
+                })?;
+        }
+
+        if self.storage.db_max_connections == 0 {
+            return Err("`storage.db_max_connections` must not be zero".into());
+        }
+
+        if let Err(error) =
+            self.storage.default_content_type.parse::<mime::Mime>()
+        {
+            return Err(format!(
+                "`storage.default_content_type` is not a valid type: {error}"
+            ));
+        }
+
+        if self.storage.db_acquire_timeout.is_zero() {
+            return Err("`storage.db_acquire_timeout` must not be zero".into());
+        }
+
+        if self.storage.db_health_check_interval.is_zero() {
+            return Err(
+                "`storage.db_health_check_interval` must not be zero".into()
+            );
+        }
+
+        if self.audit.queue_size == 0 {
+            return Err("`audit.queue_size` must not be zero".into());
+        }
+        if self.webhook.queue_size == 0 {
+            return Err("`webhook.queue_size` must not be zero".into());
+        }
+
+        if !HASH_COST_RANGE.contains(&self.auth.password_hash_cost) {
+            return Err(format!(
+                "`auth.password_hash_cost` must be within {}..={}, got {}",
+                HASH_COST_RANGE.start(),
+                HASH_COST_RANGE.end(),
+                self.auth.password_hash_cost,
+            ));
+        }
+
+        // User tokens are the longest lived credential, also bounded by it
+        if self.auth.token_duration > self.auth.max_token_duration {
+            return Err(format!(
+                "`auth.token_duration` ({}s) must not exceed \
+                `auth.max_token_duration` ({}s)",
+                self.auth.token_duration.as_secs(),
+                self.auth.max_token_duration.as_secs(),
+            ));
+        }
+
+        if self.auth.secret_key.len() < MIN_SECRET_KEY_LEN {
+            return Err(format!(
+                "`auth.secret_key` is too weak: expected at least \
+                {MIN_SECRET_KEY_LEN} bytes, got {}. \
+                Try generating one with `scripts/gen-secret-key.sh`",
+                self.auth.secret_key.len(),
+            ));
+        }
+
+        if self.webhook.url.is_some() && self.webhook.secret.is_empty() {
+            return Err(
+                "`webhook.secret` is required when `webhook.url` is set".into(),
+            );
+        }
+
+        for (name, value) in [
+            ("frame_options", &self.headers.frame_options),
+            (
+                "content_security_policy",
+                &self.headers.content_security_policy,
+            ),
+        ] {
+            if axum::http::HeaderValue::from_str(value).is_err() {
+                return Err(format!(
+                    "`headers.{name}` is not a valid header value",
+                ));
+            }
+        }
+
+        Ok(())
+    }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -68,6 +465,74 @@ pub struct NetConfig {
         deserialize_with = "deserialize_socket_addr"
     )]
     pub tpc_addr: SocketAddr,
+
+    /// Serves HTTP/2 besides HTTP/1.1, negotiated with ALPN over TLS and
+    /// with prior knowledge over plain text.
+    #[serde(default = "default_false")]
+    pub enable_http2: bool,
+
+    #[serde(with = "duration_secs", default = "default_header_read_timeout")]
+    pub header_read_timeout: Duration,
+    #[serde(with = "duration_secs", default = "default_idle_timeout")]
+    pub idle_timeout: Duration,
+    #[serde(with = "duration_secs", default)]
+    pub write_timeout: Duration,
+    /// Longest a download waits for the file info before failing.
+    #[serde(with = "duration_secs", default = "default_metadata_timeout")]
+    pub metadata_timeout: Duration,
+    /// Longest a download waits for the file to be opened and its first
+    /// bytes to be read, before retrying. Zero for no limit.
+    #[serde(with = "duration_secs", default = "default_first_byte_timeout")]
+    pub first_byte_timeout: Duration,
+    /// Slowest download allowed to finish in bytes per second. Downloads
+    /// are cut once they take longer than their size at this rate plus
+    /// `download_timeout_grace`. Zero for no limit.
+    #[serde(default)]
+    pub download_min_throughput: u64,
+    #[serde(
+        with = "duration_secs",
+        default = "default_download_timeout_grace"
+    )]
+    pub download_timeout_grace: Duration,
+    /// Times a download retries reading the file info or opening the file
+    /// after a transient failure, before anything is sent to the client.
+    /// Also the times a read failing midway is resumed.
+    #[serde(default = "default_download_retries")]
+    pub download_retries: u32,
+    /// Wait before the first retry, doubled on each of the next ones.
+    #[serde(default = "default_download_retry_delay_ms")]
+    pub download_retry_delay_ms: u64,
+    /// Most http connections open at once, the ones over it are closed
+    /// right away. Zero for no limit.
+    #[serde(default)]
+    pub max_connections: usize,
+    /// Most requests handled at once, a download counting until its body
+    /// is sent. The ones over it are answered with 503 Service Unavailable.
+    /// Zero for no limit.
+    #[serde(default)]
+    pub max_concurrent_requests: usize,
+    /// Sent in the `Retry-After` header of the requests over the limit.
+    #[serde(
+        with = "duration_secs",
+        default = "default_concurrency_retry_after"
+    )]
+    pub concurrency_retry_after: Duration,
+
+    #[serde(default)]
+    pub access_log_format: AccessLogFormat,
+}
+
+#[derive(
+    Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize,
+)]
+#[serde(rename_all = "lowercase")]
+pub enum AccessLogFormat {
+    /// Structured `started`/`finished processing request` events.
+    #[default]
+    Default,
+    /// One NCSA Combined Log Format line per request, for existing log
+    /// pipelines and analyzers.
+    Combined,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -76,30 +541,673 @@ pub struct SslConfig {
     pub enable: bool,
     pub cert: Option<ResolvedFile>,
     pub key: Option<ResolvedFile>,
+    /// Lets services authenticate with client certificates.
+    #[serde(default)]
+    pub client_auth: Option<ClientAuthConfig>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ClientAuthConfig {
+    /// Certificates of the CAs signing the client certificates, in PEM
+    /// format.
+    pub ca: ResolvedFile,
+    #[serde(default)]
+    pub services: Vec<ClientServiceConfig>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ClientServiceConfig {
+    pub name: String,
+    /// Common name of the client certificate subject.
+    pub subject: String,
+    /// What the service is allowed to do, like `READ_ALL | SHARE`.
+    #[serde(with = "permission_names")]
+    pub permission: Permission,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct StorageConfig {
     pub state_dir: ResolvedPath,
-    pub data_dir: ResolvedPath,
-    #[serde(default = "default_temp_dir")]
-    pub temp_dir: ResolvedPath,
+    #[serde(alias = "data_dir", deserialize_with = "one_or_many")]
+    pub data_dirs: Vec<ResolvedPath>,
+    #[serde(default = "default_min_free_space")]
+    pub min_free_space: u64,
+    /// How new files are spread across the data dirs with enough space.
+    #[serde(default)]
+    pub dir_selection: DirSelection,
+    /// Where the files are written until complete. Defaults to a `tmp` dir
+    /// inside each data dir, so they are moved without being copied.
+    #[serde(default)]
+    pub temp_dir: Option<ResolvedPath>,
+    #[serde(with = "duration_secs", default = "default_sweep_interval")]
+    pub sweep_interval: Duration,
+    /// Most connections to the database kept open at once.
+    #[serde(default = "default_db_max_connections")]
+    pub db_max_connections: u32,
+    /// How long a request waits for a database connection before failing,
+    /// so an unreachable database doesn't make the requests hang.
+    #[serde(with = "duration_secs", default = "default_db_acquire_timeout")]
+    pub db_acquire_timeout: Duration,
+    /// How often the database is checked to be reachable.
+    #[serde(
+        with = "duration_secs",
+        default = "default_db_health_check_interval"
+    )]
+    pub db_health_check_interval: Duration,
+    /// How long retries of an upload with the same idempotency key return
+    /// the first created object.
+    #[serde(with = "duration_secs", default = "default_idempotency_key_ttl")]
+    pub idempotency_key_ttl: Duration,
+    /// Most objects kept in memory for the downloads, zero disables the
+    /// cache.
+    #[serde(default = "default_object_cache_size")]
+    pub object_cache_size: usize,
+    #[serde(with = "duration_secs", default = "default_object_cache_ttl")]
+    pub object_cache_ttl: Duration,
+    /// Bytes of small files kept in memory for the downloads, zero disables
+    /// the cache.
+    #[serde(default)]
+    pub content_cache_size: u64,
+    /// Largest file kept in the content cache, once decompressed.
+    #[serde(default = "default_content_cache_max_file_size")]
+    pub content_cache_max_file_size: u64,
+    #[serde(default)]
+    pub compression: Option<Compression>,
+    #[serde(default)]
+    pub content_type_check: ContentTypeCheck,
+    /// Type of the uploads sent without one whose content is not detected,
+    /// also sent for the stored files without a type.
+    #[serde(default = "default_content_type")]
+    pub default_content_type: String,
+    /// Content types accepted by the uploads, any if empty.
+    #[serde(default)]
+    pub allowed_content_types: Vec<ContentTypePattern>,
+    /// Content types rejected by the uploads, even if allowed.
+    #[serde(default)]
+    pub denied_content_types: Vec<ContentTypePattern>,
+    /// Maximum length of object names in bytes, once NFC normalized.
+    #[serde(default = "default_max_name_len")]
+    pub max_name_len: usize,
+    /// Largest file accepted by the uploads in bytes, zero for no limit.
+    #[serde(default)]
+    pub max_upload_size: u64,
+    #[serde(default)]
+    pub encryption: Option<EncryptionConfig>,
 }
 
+/// Encryption of the stored files at rest. Every file has its own data key,
+/// wrapped by the master key.
 #[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct EncryptionConfig {
+    /// File holding the base64 encoded 32 bytes master key.
+    pub master_key_file: ResolvedFile,
+    /// Master keys replaced by a rotation, only used to read the files
+    /// encrypted with them.
+    #[serde(default)]
+    pub previous_master_key_files: Vec<ResolvedFile>,
+}
+
+/// How the data dir of a new file is picked.
+#[derive(
+    Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize,
+)]
+#[serde(rename_all = "snake_case")]
+pub enum DirSelection {
+    Random,
+    /// Each dir in turns.
+    RoundRobin,
+    /// The dir with the fewest files being written.
+    #[default]
+    LeastInFlight,
+    /// The dir that took the least time to create and persist files
+    /// lately.
+    LatencyAware,
+}
+
+/// What to do when the content of an upload does not match its declared
+/// type.
+#[derive(
+    Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize,
+)]
+#[serde(rename_all = "lowercase")]
+pub enum ContentTypeCheck {
+    /// Keeps the declared type, without looking at the content.
+    #[default]
+    Trust,
+    /// Replaces the declared type by the detected one.
+    Correct,
+    /// Rejects the upload.
+    Reject,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Compression {
+    Gzip,
+    Zstd,
+}
+
+impl Compression {
+    /// Every way an object can be stored, including uncompressed.
+    pub const VARIANTS: [Option<Compression>; 3] =
+        [None, Some(Compression::Gzip), Some(Compression::Zstd)];
+
+    pub const fn extension(self) -> &'static str {
+        match self {
+            Compression::Gzip => "gz",
+            Compression::Zstd => "zst",
+        }
+    }
+
+    /// Whether compressing a file of the given mime type is likely to save
+    /// space. Most media and archive formats are already compressed.
+    pub fn is_worth_for(mime_type: &str) -> bool {
+        let essence = mime_type
+            .split(';')
+            .next()
+            .unwrap_or_default()
+            .trim()
+            .to_ascii_lowercase();
+
+        match essence.split_once('/') {
+            Some(("image", sub)) => matches!(sub, "svg+xml" | "bmp" | "x-icon"),
+            Some(("video" | "audio", _)) => false,
+            Some(("font", sub)) => !matches!(sub, "woff" | "woff2"),
+            Some(("application", sub)) => !matches!(
+                sub,
+                "zip"
+                    | "gzip"
+                    | "x-gzip"
+                    | "zstd"
+                    | "x-bzip2"
+                    | "x-xz"
+                    | "x-7z-compressed"
+                    | "vnd.rar"
+                    | "x-rar-compressed"
+                    | "pdf"
+                    | "epub+zip"
+            ),
+            _ => true,
+        }
+    }
+}
+
+#[derive(Clone, Serialize, Deserialize)]
 pub struct AuthConfig {
     pub token_cert: ResolvedFile,
+    /// Must not be encrypted, there is no passphrase setting.
     pub token_key: ResolvedFile,
+    /// Signs the user and file tokens, `token_key` and `token_cert` must
+    /// be keys of its kind.
+    #[serde(default)]
+    pub token_algorithm: TokenAlgorithm,
+    #[serde(default)]
+    pub previous_token_certs: Vec<ResolvedFile>,
     #[serde(with = "duration_secs", default = "default_token_duration")]
     pub token_duration: Duration,
     #[serde(with = "duration_secs", default = "default_max_token_duration")]
     pub max_token_duration: Duration,
+    /// Most tokens whose signature is kept as verified, zero disables the
+    /// cache.
+    #[serde(default = "default_token_cache_size")]
+    pub token_cache_size: usize,
+    /// The deployment name, set as the `iss` of the tokens.
+    #[serde(default = "default_token_issuer")]
+    pub token_issuer: String,
+    /// The service the tokens are intended for, set as their `aud`.
+    #[serde(default = "default_token_audience")]
+    pub token_audience: String,
+    /// Requests each api key can make per minute, zero disables the limit.
+    #[serde(default)]
+    pub api_key_requests_per_minute: u32,
 
     #[serde(with = "base64")]
     pub secret_key: Vec<u8>,
+    /// Services authenticating with tokens signed by their own key, instead
+    /// of sharing `secret_key`.
+    #[serde(default)]
+    pub service_keys: Vec<ServiceKeyConfig>,
 
     #[serde(default = "default_password_hash_cost")]
     pub password_hash_cost: u32,
+    #[serde(default)]
+    pub password_hash_target_ms: u64,
+
+    #[serde(default = "default_false")]
+    pub allow_signup: bool,
+    /// Challenge solved by the clients signing up without an invite.
+    #[serde(default)]
+    pub signup_challenge: Option<ChallengeConfig>,
+}
+
+impl fmt::Debug for AuthConfig {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let Self {
+            token_cert,
+            token_key,
+            token_algorithm,
+            previous_token_certs,
+            token_duration,
+            max_token_duration,
+            token_cache_size,
+            token_issuer,
+            token_audience,
+            api_key_requests_per_minute,
+            secret_key: _,
+            service_keys,
+            password_hash_cost,
+            password_hash_target_ms,
+            allow_signup,
+            signup_challenge,
+        } = self;
+
+        f.debug_struct("AuthConfig")
+            .field("token_cert", token_cert)
+            .field("token_key", token_key)
+            .field("token_algorithm", token_algorithm)
+            .field("previous_token_certs", previous_token_certs)
+            .field("token_duration", token_duration)
+            .field("max_token_duration", max_token_duration)
+            .field("token_cache_size", token_cache_size)
+            .field("token_issuer", token_issuer)
+            .field("token_audience", token_audience)
+            .field("api_key_requests_per_minute", api_key_requests_per_minute)
+            .field("secret_key", &Redacted)
+            .field("service_keys", service_keys)
+            .field("password_hash_cost", password_hash_cost)
+            .field("password_hash_target_ms", password_hash_target_ms)
+            .field("allow_signup", allow_signup)
+            .field("signup_challenge", signup_challenge)
+            .finish()
+    }
+}
+
+/// Algorithm of the keypair signing the tokens.
+#[derive(
+    Debug,
+    Clone,
+    Copy,
+    Default,
+    PartialEq,
+    Eq,
+    Serialize,
+    Deserialize,
+    ValueEnum,
+)]
+pub enum TokenAlgorithm {
+    /// Ed25519 keys.
+    #[default]
+    #[value(name = "EdDSA")]
+    EdDSA,
+    /// RSA keys of at least 2048 bits, for existing RSA infrastructure.
+    #[value(name = "RS256")]
+    RS256,
+    /// ECDSA P-256 keys.
+    #[value(name = "ES256")]
+    ES256,
+}
+
+impl From<TokenAlgorithm> for Algorithm {
+    fn from(value: TokenAlgorithm) -> Self {
+        match value {
+            TokenAlgorithm::EdDSA => Algorithm::EdDSA,
+            TokenAlgorithm::RS256 => Algorithm::RS256,
+            TokenAlgorithm::ES256 => Algorithm::ES256,
+        }
+    }
+}
+
+impl fmt::Display for TokenAlgorithm {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            TokenAlgorithm::EdDSA => "EdDSA",
+            TokenAlgorithm::RS256 => "RS256",
+            TokenAlgorithm::ES256 => "ES256",
+        })
+    }
+}
+
+#[derive(Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(tag = "kind", rename_all = "snake_case")]
+pub enum ChallengeConfig {
+    Hcaptcha {
+        site_key: String,
+        secret: String,
+    },
+    Recaptcha {
+        site_key: String,
+        secret: String,
+    },
+    /// Hashcash-style stamps, requiring no third party.
+    ProofOfWork {
+        /// Leading zero bits of the stamp hashes, each one doubling the
+        /// work of the clients.
+        #[serde(default = "default_pow_difficulty")]
+        difficulty: u8,
+    },
+}
+
+impl fmt::Debug for ChallengeConfig {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ChallengeConfig::Hcaptcha {
+                site_key,
+                secret: _,
+            } => f
+                .debug_struct("Hcaptcha")
+                .field("site_key", site_key)
+                .field("secret", &Redacted)
+                .finish(),
+            ChallengeConfig::Recaptcha {
+                site_key,
+                secret: _,
+            } => f
+                .debug_struct("Recaptcha")
+                .field("site_key", site_key)
+                .field("secret", &Redacted)
+                .finish(),
+            ChallengeConfig::ProofOfWork { difficulty } => f
+                .debug_struct("ProofOfWork")
+                .field("difficulty", difficulty)
+                .finish(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ServiceKeyConfig {
+    /// Sent by the service as the `kid` and `iss` of its tokens.
+    pub name: String,
+    /// Ed25519 public key of the service, in PEM format.
+    pub cert: ResolvedFile,
+}
+
+/// Download bandwidth limits, in bytes per second. A zero rate disables the
+/// respective limit.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ThrottleConfig {
+    /// Shared by every download from the same client ip.
+    #[serde(default)]
+    pub ip_rate: u64,
+    /// Shared by every download of the same user.
+    #[serde(default)]
+    pub user_rate: u64,
+    /// Replaces `user_rate` for the users of a role.
+    #[serde(default)]
+    pub roles: HashMap<UserRole, u64>,
+    #[serde(default = "default_true")]
+    pub exempt_admins: bool,
+}
+
+impl Default for ThrottleConfig {
+    fn default() -> Self {
+        Self {
+            ip_rate: 0,
+            user_rate: 0,
+            roles: HashMap::new(),
+            exempt_admins: true,
+        }
+    }
+}
+
+/// Bytes each user may store, counting the size of its files. A zero quota
+/// disables the limit. Admins can override it for each user.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct QuotaConfig {
+    #[serde(default)]
+    pub user_quota: u64,
+    /// Replaces `user_quota` for the users of a role.
+    #[serde(default)]
+    pub roles: HashMap<UserRole, u64>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum UserRole {
+    Admin,
+    Unprivileged,
+}
+
+impl UserRole {
+    pub fn of(permission: Permission) -> Self {
+        if permission.contains(Permission::ADMIN) {
+            UserRole::Admin
+        } else {
+            UserRole::Unprivileged
+        }
+    }
+}
+
+/// Groups of routes that can be left out, answered as if they didn't exist.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct RoutesConfig {
+    /// Signing up, with or without an invite, and creating invites.
+    #[serde(default = "default_true")]
+    pub signup: bool,
+    /// Uploading new files and replacing the data of existing ones.
+    #[serde(default = "default_true")]
+    pub upload: bool,
+    /// Deleting files and users.
+    #[serde(default = "default_true")]
+    pub delete: bool,
+}
+
+impl Default for RoutesConfig {
+    fn default() -> Self {
+        Self {
+            signup: true,
+            upload: true,
+            delete: true,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AuditConfig {
+    /// File the security events are appended to. Disabled if not set.
+    #[serde(default)]
+    pub log_file: Option<PathBuf>,
+    /// Events waiting to be written. Once full, the new events are only
+    /// logged instead of making the requests wait.
+    #[serde(default = "default_audit_queue_size")]
+    pub queue_size: usize,
+}
+
+impl Default for AuditConfig {
+    fn default() -> Self {
+        Self {
+            log_file: None,
+            queue_size: default_audit_queue_size(),
+        }
+    }
+}
+
+/// Rejects the writes while the server is under maintenance, which can
+/// also be toggled while running.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct MaintenanceConfig {
+    /// Whether the server starts under maintenance.
+    #[serde(default)]
+    pub enabled: bool,
+    /// Sent in the `Retry-After` header of the rejected writes.
+    #[serde(
+        with = "duration_secs",
+        default = "default_maintenance_retry_after"
+    )]
+    pub retry_after: Duration,
+}
+
+impl Default for MaintenanceConfig {
+    fn default() -> Self {
+        Self {
+            enabled: false,
+            retry_after: default_maintenance_retry_after(),
+        }
+    }
+}
+
+/// Where every log, the access logs included, is written.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct LogConfig {
+    #[serde(default)]
+    pub output: LogOutput,
+    /// Size in bytes at which the log file is rotated. Zero disables the
+    /// rotation.
+    #[serde(default = "default_log_max_size")]
+    pub max_size: u64,
+    /// How long the rotated files are kept. Zero keeps them forever.
+    #[serde(with = "duration_secs", default)]
+    pub max_age: Duration,
+    /// How many rotated files are kept. Zero keeps all of them.
+    #[serde(default = "default_log_max_files")]
+    pub max_files: usize,
+}
+
+impl Default for LogConfig {
+    fn default() -> Self {
+        Self {
+            output: LogOutput::default(),
+            max_size: default_log_max_size(),
+            max_age: Duration::ZERO,
+            max_files: default_log_max_files(),
+        }
+    }
+}
+
+/// Security headers added to the responses, so browsers don't render the
+/// served files as something else than what they are.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct HeadersConfig {
+    /// Sends `X-Content-Type-Options: nosniff`, so browsers stick to the
+    /// content type of the files instead of guessing one.
+    #[serde(default = "default_true")]
+    pub nosniff: bool,
+    /// Sent in the `X-Frame-Options` header. Empty to not send it.
+    #[serde(default = "default_frame_options")]
+    pub frame_options: String,
+    /// Sent in the `Content-Security-Policy` header of the api responses,
+    /// the downloads included. Empty to not send it.
+    #[serde(default = "default_content_security_policy")]
+    pub content_security_policy: String,
+    /// `max-age` of the `Strict-Transport-Security` header, only sent when
+    /// TLS is enabled. Zero to not send it.
+    #[serde(with = "duration_secs", default)]
+    pub hsts_max_age: Duration,
+}
+
+impl Default for HeadersConfig {
+    fn default() -> Self {
+        Self {
+            nosniff: true,
+            frame_options: default_frame_options(),
+            content_security_policy: default_content_security_policy(),
+            hsts_max_age: Duration::ZERO,
+        }
+    }
+}
+
+/// Where the file lifecycle events are posted, signed with an HMAC of the
+/// body so receivers can tell they come from the server.
+#[derive(Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct WebhookConfig {
+    /// Disabled if not set.
+    #[serde(default)]
+    pub url: Option<String>,
+    /// Key of the HMAC-SHA256 sent in the `X-Downloader-Signature` header.
+    #[serde(default)]
+    pub secret: String,
+    /// Times a failed delivery is retried before giving up.
+    #[serde(default = "default_webhook_retries")]
+    pub retries: u32,
+    #[serde(default = "default_webhook_retry_delay_ms")]
+    pub retry_delay_ms: u64,
+    #[serde(with = "duration_secs", default = "default_webhook_timeout")]
+    pub timeout: Duration,
+    /// File the events that could not be delivered are appended to, one
+    /// JSON object per line. They are only logged if not set.
+    #[serde(default)]
+    pub dead_letter_file: Option<PathBuf>,
+    /// Events waiting to be delivered. Once full, the new events go to the
+    /// dead letter file instead of growing the queue.
+    #[serde(default = "default_webhook_queue_size")]
+    pub queue_size: usize,
+}
+
+impl Default for WebhookConfig {
+    fn default() -> Self {
+        Self {
+            url: None,
+            secret: String::new(),
+            retries: default_webhook_retries(),
+            retry_delay_ms: default_webhook_retry_delay_ms(),
+            timeout: default_webhook_timeout(),
+            dead_letter_file: None,
+            queue_size: default_webhook_queue_size(),
+        }
+    }
+}
+
+impl fmt::Debug for WebhookConfig {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let Self {
+            url,
+            secret: _,
+            retries,
+            retry_delay_ms,
+            timeout,
+            dead_letter_file,
+            queue_size,
+        } = self;
+
+        f.debug_struct("WebhookConfig")
+            .field("url", url)
+            .field("secret", &Redacted)
+            .field("retries", retries)
+            .field("retry_delay_ms", retry_delay_ms)
+            .field("timeout", timeout)
+            .field("dead_letter_file", dead_letter_file)
+            .field("queue_size", queue_size)
+            .finish()
+    }
+}
+
+/// `stdout`, `stderr` or the path of a file the logs are appended to.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(from = "String", into = "String")]
+pub enum LogOutput {
+    #[default]
+    Stdout,
+    Stderr,
+    File(PathBuf),
+}
+
+impl From<String> for LogOutput {
+    fn from(value: String) -> Self {
+        match value.as_str() {
+            "stdout" => LogOutput::Stdout,
+            "stderr" => LogOutput::Stderr,
+            _ => LogOutput::File(value.into()),
+        }
+    }
+}
+
+impl From<LogOutput> for String {
+    fn from(value: LogOutput) -> Self {
+        match value {
+            LogOutput::Stdout => "stdout".into(),
+            LogOutput::Stderr => "stderr".into(),
+            LogOutput::File(path) => path.to_string_lossy().into_owned(),
+        }
+    }
 }
 
 const fn default_false() -> bool {
@@ -118,6 +1226,38 @@ const fn default_tcp_addr() -> SocketAddr {
     DEFAULT_TCP_ADDR
 }
 
+const fn default_header_read_timeout() -> Duration {
+    Duration::from_secs(30)
+}
+
+const fn default_idle_timeout() -> Duration {
+    Duration::from_secs(120)
+}
+
+const fn default_metadata_timeout() -> Duration {
+    Duration::from_secs(5)
+}
+
+const fn default_concurrency_retry_after() -> Duration {
+    Duration::from_secs(1)
+}
+
+const fn default_first_byte_timeout() -> Duration {
+    Duration::from_secs(10)
+}
+
+const fn default_download_timeout_grace() -> Duration {
+    Duration::from_secs(60)
+}
+
+const fn default_download_retries() -> u32 {
+    2
+}
+
+const fn default_download_retry_delay_ms() -> u64 {
+    50
+}
+
 const fn default_token_duration() -> Duration {
     Duration::from_secs(3600)
 }
@@ -126,11 +1266,216 @@ const fn default_max_token_duration() -> Duration {
     Duration::from_secs(7 * 24 * 3600)
 }
 
+const fn default_pow_difficulty() -> u8 {
+    20
+}
+
+const fn default_min_free_space() -> u64 {
+    1024 * 1024 * 1024
+}
+
+const fn default_max_name_len() -> usize {
+    DEFAULT_MAX_NAME_LEN
+}
+
+const fn default_sweep_interval() -> Duration {
+    Duration::from_secs(60)
+}
+
+const fn default_db_max_connections() -> u32 {
+    10
+}
+
+const fn default_db_acquire_timeout() -> Duration {
+    Duration::from_secs(5)
+}
+
+const fn default_db_health_check_interval() -> Duration {
+    Duration::from_secs(10)
+}
+
+const fn default_idempotency_key_ttl() -> Duration {
+    Duration::from_secs(24 * 3600)
+}
+
+const fn default_token_cache_size() -> usize {
+    1024
+}
+
+const fn default_audit_queue_size() -> usize {
+    4096
+}
+
+const fn default_object_cache_size() -> usize {
+    1024
+}
+
+const fn default_object_cache_ttl() -> Duration {
+    Duration::from_secs(60)
+}
+
+const fn default_content_cache_max_file_size() -> u64 {
+    1024 * 1024
+}
+
+const fn default_maintenance_retry_after() -> Duration {
+    Duration::from_secs(60)
+}
+
 const fn default_password_hash_cost() -> u32 {
     bcrypt::DEFAULT_COST
 }
 
-fn default_temp_dir() -> ResolvedPath {
-    ResolvedPath::new(DEFAULT_TEMP_DIR.into())
-        .expect("failed to parse default temp path into ResolvedPath")
+const fn default_log_max_size() -> u64 {
+    100 * 1024 * 1024
+}
+
+const fn default_log_max_files() -> usize {
+    5
+}
+
+const fn default_webhook_retries() -> u32 {
+    5
+}
+
+const fn default_webhook_retry_delay_ms() -> u64 {
+    500
+}
+
+const fn default_webhook_timeout() -> Duration {
+    Duration::from_secs(10)
+}
+
+const fn default_webhook_queue_size() -> usize {
+    1024
+}
+
+fn default_content_type() -> String {
+    mime::OCTET_STREAM.to_string()
+}
+
+fn default_frame_options() -> String {
+    "DENY".into()
+}
+
+/// Blocks the scripts and every other resource of the files rendered by
+/// browsers.
+fn default_content_security_policy() -> String {
+    "default-src 'none'; sandbox".into()
+}
+
+fn default_token_issuer() -> String {
+    DEFAULT_TOKEN_ISSUER.into()
+}
+
+fn default_token_audience() -> String {
+    DEFAULT_TOKEN_AUDIENCE.into()
+}
+
+#[cfg(test)]
+mod tests {
+    use serde::Deserialize;
+    use serde_json::json;
+    use test_log::test;
+
+    use super::{
+        apply_env_overrides, ChallengeConfig, ContentTypeCheck, EnvValue,
+        WebhookConfig,
+    };
+
+    fn vars(vars: &[(&str, &str)]) -> impl Iterator<Item = (String, String)> {
+        vars.iter()
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect::<Vec<_>>()
+            .into_iter()
+    }
+
+    #[test]
+    fn test_env_overrides() {
+        let mut value = json!({
+            "net": { "http_addr": 8080 },
+            "auth": { "token_duration": 3600, "secret_key": "AAAA" }
+        });
+
+        apply_env_overrides(
+            &mut value,
+            vars(&[
+                ("DOWNLOADER_NET__HTTP_ADDR", "0.0.0.0:9090"),
+                ("DOWNLOADER_AUTH__TOKEN_DURATION", "60"),
+                ("DOWNLOADER_SSL__ENABLE", "false"),
+                ("OTHER_VARIABLE", "1"),
+            ]),
+        );
+
+        assert_eq!(
+            value,
+            json!({
+                "net": { "http_addr": "0.0.0.0:9090" },
+                "auth": { "token_duration": "60", "secret_key": "AAAA" },
+                "ssl": { "enable": "false" }
+            }),
+        );
+    }
+
+    #[test]
+    fn test_debug_redacted() {
+        let webhook = WebhookConfig {
+            url: Some("https://example.com".into()),
+            secret: "webhook-secret".into(),
+            ..Default::default()
+        };
+        let challenge = ChallengeConfig::Hcaptcha {
+            site_key: "site".into(),
+            secret: "captcha-secret".into(),
+        };
+
+        let printed = format!("{webhook:?} {challenge:?}");
+        assert!(!printed.contains("webhook-secret"));
+        assert!(!printed.contains("captcha-secret"));
+        assert!(printed.contains("https://example.com"));
+        assert!(printed.contains("<redacted>"));
+    }
+
+    #[test]
+    fn test_env_value() {
+        #[derive(Debug, PartialEq, Deserialize)]
+        struct Section {
+            token_issuer: String,
+            token_duration: u64,
+            enable: bool,
+            label: Option<String>,
+            dirs: Vec<String>,
+            check: ContentTypeCheck,
+        }
+
+        let mut value = json!({
+            "section": { "token_duration": 3600, "enable": true }
+        });
+        apply_env_overrides(
+            &mut value,
+            vars(&[
+                ("DOWNLOADER_SECTION__TOKEN_ISSUER", "0123"),
+                ("DOWNLOADER_SECTION__TOKEN_DURATION", "60"),
+                ("DOWNLOADER_SECTION__ENABLE", "false"),
+                ("DOWNLOADER_SECTION__LABEL", "null"),
+                ("DOWNLOADER_SECTION__DIRS", r#"["/a", "/b"]"#),
+                ("DOWNLOADER_SECTION__CHECK", "reject"),
+            ]),
+        );
+
+        let section =
+            Section::deserialize(EnvValue(value["section"].take())).unwrap();
+        assert_eq!(
+            section,
+            Section {
+                // Numeric looking strings are kept as they are
+                token_issuer: "0123".into(),
+                token_duration: 60,
+                enable: false,
+                label: Some("null".into()),
+                dirs: vec!["/a".into(), "/b".into()],
+                check: ContentTypeCheck::Reject,
+            },
+        );
+    }
 }
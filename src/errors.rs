@@ -1,7 +1,7 @@
 use axum::{
     body::Body,
     extract::multipart::MultipartError,
-    http::{header, StatusCode},
+    http::{header, HeaderValue, StatusCode},
     response::{IntoResponse, Response},
 };
 use serde::Serialize;
@@ -23,6 +23,9 @@ pub enum DownloaderError {
     #[error("Auth error: {0}")]
     Auth(#[from] AuthError),
 
+    #[error("Validation error: {0}")]
+    Validation(#[from] ValidationError),
+
     #[error("Http error: {0}")]
     Http(#[from] HttpError),
 
@@ -43,6 +46,7 @@ impl DownloaderError {
             DownloaderError::Object(e) => e.status_code(),
             DownloaderError::User(e) => e.status_code(),
             DownloaderError::Auth(e) => e.status_code(),
+            DownloaderError::Validation(..) => StatusCode::BAD_REQUEST,
             DownloaderError::Http(e) => e.status_code(),
             DownloaderError::AxumHttp(..) => StatusCode::INTERNAL_SERVER_ERROR,
             DownloaderError::Multipart(e) => e.status(),
@@ -56,6 +60,7 @@ impl DownloaderError {
             DownloaderError::Object(e) => e.custom_code(),
             DownloaderError::User(e) => e.custom_code(),
             DownloaderError::Auth(e) => e.custom_code(),
+            DownloaderError::Validation(..) => 1,
             DownloaderError::Http(e) => e.custom_code(),
             DownloaderError::AxumHttp(..) => 0,
             DownloaderError::Multipart(..) => 0,
@@ -67,6 +72,7 @@ impl DownloaderError {
             DownloaderError::Object(..) => 2,
             DownloaderError::User(..) => 3,
             DownloaderError::Auth(..) => 4,
+            DownloaderError::Validation(..) => 5,
             DownloaderError::Http(..) => 99,
             DownloaderError::AxumHttp(..) => 100,
             DownloaderError::Multipart(..) => 101,
@@ -75,6 +81,15 @@ impl DownloaderError {
 
         (c * 1000) + (ic as u32)
     }
+
+    /// Whether the same request may succeed if retried shortly, like when
+    /// the database is busy.
+    pub fn is_transient(&self) -> bool {
+        match self {
+            DownloaderError::Object(e) => e.is_transient(),
+            e => e.status_code() == StatusCode::SERVICE_UNAVAILABLE,
+        }
+    }
 }
 
 #[derive(Debug, thiserror::Error)]
@@ -86,8 +101,22 @@ pub enum HttpError {
     InvalidFormLength { expected: usize, got: usize },
     #[error("the provided form boundary is invalid")]
     InvalidFormBoundary,
+    #[error("the provided `{0}` header is invalid")]
+    InvalidHeader(&'static str),
+    #[error("a request with the same idempotency key is still in progress")]
+    IdempotencyKeyInUse,
+    #[error("timed out while reading the file info")]
+    Timeout,
     #[error("route not found")]
     RouteNotFound,
+    #[error("method not allowed for the route")]
+    MethodNotAllowed,
+    #[error("the server is under maintenance, writes are disabled")]
+    Maintenance,
+    #[error("the server is handling too many requests")]
+    Overloaded,
+    #[error("too many requests with this api key, retry in {retry_after}s")]
+    RateLimited { retry_after: u64 },
     #[error("service panicked")]
     ServicePanicked,
 }
@@ -98,7 +127,14 @@ impl HttpError {
         match self {
             HttpError::InvalidFormBoundary => StatusCode::BAD_REQUEST,
             HttpError::InvalidFormLength { .. } => StatusCode::BAD_REQUEST,
+            HttpError::InvalidHeader(..) => StatusCode::BAD_REQUEST,
+            HttpError::IdempotencyKeyInUse => StatusCode::CONFLICT,
+            HttpError::Timeout => StatusCode::SERVICE_UNAVAILABLE,
+            HttpError::Maintenance => StatusCode::SERVICE_UNAVAILABLE,
+            HttpError::Overloaded => StatusCode::SERVICE_UNAVAILABLE,
+            HttpError::RateLimited { .. } => StatusCode::TOO_MANY_REQUESTS,
             HttpError::RouteNotFound => StatusCode::NOT_FOUND,
+            HttpError::MethodNotAllowed => StatusCode::METHOD_NOT_ALLOWED,
             HttpError::ServicePanicked => StatusCode::INTERNAL_SERVER_ERROR,
         }
     }
@@ -108,16 +144,231 @@ impl HttpError {
         match self {
             HttpError::InvalidFormLength { .. } => 1,
             HttpError::InvalidFormBoundary => 2,
+            HttpError::InvalidHeader(..) => 3,
+            HttpError::IdempotencyKeyInUse => 4,
+            HttpError::Timeout => 5,
+            HttpError::Maintenance => 6,
+            HttpError::Overloaded => 7,
+            HttpError::RateLimited { .. } => 8,
             HttpError::RouteNotFound => 100,
+            HttpError::MethodNotAllowed => 101,
             HttpError::ServicePanicked => 255,
         }
     }
 }
 
+/// An error code answered by the api, described in its OpenAPI document.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ErrorCode {
+    pub code: u32,
+    pub status: StatusCode,
+    pub description: &'static str,
+}
+
+impl ErrorCode {
+    #[inline]
+    const fn new(
+        code: u32,
+        status: StatusCode,
+        description: &'static str,
+    ) -> Self {
+        Self {
+            code,
+            status,
+            description,
+        }
+    }
+}
+
+/// Every code returned by [`DownloaderError::custom_code`]. The status of
+/// the database errors is the one of a failed query, they may also be
+/// answered with 503 Service Unavailable.
+pub const ERROR_CODES: &[ErrorCode] = &[
+    ErrorCode::new(0, StatusCode::INTERNAL_SERVER_ERROR, "unexpected error"),
+    ErrorCode::new(1001, StatusCode::NOT_FOUND, "file not found"),
+    ErrorCode::new(1002, StatusCode::BAD_REQUEST, "limit out of range"),
+    ErrorCode::new(1003, StatusCode::INTERNAL_SERVER_ERROR, "database error"),
+    ErrorCode::new(1004, StatusCode::GONE, "file reached its download limit"),
+    ErrorCode::new(2001, StatusCode::INTERNAL_SERVER_ERROR, "storage io error"),
+    ErrorCode::new(2002, StatusCode::NOT_FOUND, "stored file not found"),
+    ErrorCode::new(2003, StatusCode::PAYLOAD_TOO_LARGE, "file too large"),
+    ErrorCode::new(2004, StatusCode::INSUFFICIENT_STORAGE, "storage full"),
+    ErrorCode::new(
+        2005,
+        StatusCode::INTERNAL_SERVER_ERROR,
+        "stored file missing",
+    ),
+    ErrorCode::new(2006, StatusCode::BAD_REQUEST, "checksum mismatch"),
+    ErrorCode::new(2007, StatusCode::BAD_REQUEST, "checksum trailer missing"),
+    ErrorCode::new(2008, StatusCode::PAYLOAD_TOO_LARGE, "quota exceeded"),
+    ErrorCode::new(
+        2009,
+        StatusCode::UNSUPPORTED_MEDIA_TYPE,
+        "file type not accepted",
+    ),
+    ErrorCode::new(2010, StatusCode::CONFLICT, "another write in progress"),
+    ErrorCode::new(3001, StatusCode::NOT_FOUND, "user not found"),
+    ErrorCode::new(3002, StatusCode::CONFLICT, "username already taken"),
+    ErrorCode::new(3003, StatusCode::UNAUTHORIZED, "incorrect password"),
+    ErrorCode::new(
+        3004,
+        StatusCode::INTERNAL_SERVER_ERROR,
+        "password hash failed",
+    ),
+    ErrorCode::new(
+        3005,
+        StatusCode::INTERNAL_SERVER_ERROR,
+        "password compare failed",
+    ),
+    ErrorCode::new(3006, StatusCode::INTERNAL_SERVER_ERROR, "database error"),
+    ErrorCode::new(3007, StatusCode::FORBIDDEN, "invalid invite code"),
+    ErrorCode::new(3008, StatusCode::BAD_REQUEST, "limit out of range"),
+    ErrorCode::new(3009, StatusCode::NOT_FOUND, "session not found"),
+    ErrorCode::new(3010, StatusCode::NOT_FOUND, "api key not found"),
+    ErrorCode::new(
+        4001,
+        StatusCode::INTERNAL_SERVER_ERROR,
+        "token generation failed",
+    ),
+    ErrorCode::new(4002, StatusCode::BAD_REQUEST, "token expiration too long"),
+    ErrorCode::new(4003, StatusCode::UNAUTHORIZED, "invalid token"),
+    ErrorCode::new(4004, StatusCode::UNAUTHORIZED, "expired token"),
+    ErrorCode::new(4005, StatusCode::UNAUTHORIZED, "token not valid yet"),
+    ErrorCode::new(4006, StatusCode::BAD_REQUEST, "authorization required"),
+    ErrorCode::new(
+        4007,
+        StatusCode::BAD_REQUEST,
+        "invalid authorization header",
+    ),
+    ErrorCode::new(
+        4008,
+        StatusCode::BAD_REQUEST,
+        "invalid authorization strategy",
+    ),
+    ErrorCode::new(4009, StatusCode::FORBIDDEN, "access denied"),
+    ErrorCode::new(4010, StatusCode::FORBIDDEN, "higher permission required"),
+    ErrorCode::new(4011, StatusCode::FORBIDDEN, "signup not allowed"),
+    ErrorCode::new(4012, StatusCode::UNAUTHORIZED, "revoked token"),
+    ErrorCode::new(4013, StatusCode::FORBIDDEN, "challenge failed"),
+    ErrorCode::new(
+        4014,
+        StatusCode::SERVICE_UNAVAILABLE,
+        "challenge unavailable",
+    ),
+    ErrorCode::new(5001, StatusCode::BAD_REQUEST, "invalid fields"),
+    ErrorCode::new(99001, StatusCode::BAD_REQUEST, "invalid form length"),
+    ErrorCode::new(99002, StatusCode::BAD_REQUEST, "invalid form boundary"),
+    ErrorCode::new(99003, StatusCode::BAD_REQUEST, "invalid header"),
+    ErrorCode::new(99004, StatusCode::CONFLICT, "idempotency key in use"),
+    ErrorCode::new(
+        99005,
+        StatusCode::SERVICE_UNAVAILABLE,
+        "timed out reading the file info",
+    ),
+    ErrorCode::new(99006, StatusCode::SERVICE_UNAVAILABLE, "maintenance"),
+    ErrorCode::new(99007, StatusCode::SERVICE_UNAVAILABLE, "overloaded"),
+    ErrorCode::new(99008, StatusCode::TOO_MANY_REQUESTS, "rate limited"),
+    ErrorCode::new(99100, StatusCode::NOT_FOUND, "route not found"),
+    ErrorCode::new(99101, StatusCode::METHOD_NOT_ALLOWED, "method not allowed"),
+    ErrorCode::new(
+        99255,
+        StatusCode::INTERNAL_SERVER_ERROR,
+        "service panicked",
+    ),
+    ErrorCode::new(100000, StatusCode::INTERNAL_SERVER_ERROR, "http error"),
+    ErrorCode::new(101000, StatusCode::BAD_REQUEST, "invalid multipart form"),
+];
+
+/// Handler of the routes disabled by the configuration. Registering it
+/// makes them answer 404 as unknown routes do, instead of 405 when their
+/// path is still served for other methods.
+pub async fn route_disabled() -> DownloaderError {
+    HttpError::RouteNotFound.into()
+}
+
+/// Status of a failed database query. Failures to reach the database, or
+/// while it is busy, are unavailability that may go away by retrying later,
+/// unlike the remaining errors.
+pub fn sqlx_status_code(error: &sqlx::Error) -> StatusCode {
+    match error {
+        sqlx::Error::PoolTimedOut
+        | sqlx::Error::PoolClosed
+        | sqlx::Error::Io(..) => StatusCode::SERVICE_UNAVAILABLE,
+        sqlx::Error::Database(e) if is_sqlite_busy(e.code().as_deref()) => {
+            StatusCode::SERVICE_UNAVAILABLE
+        }
+        _ => StatusCode::INTERNAL_SERVER_ERROR,
+    }
+}
+
+/// Whether `code` is an extended result code of `SQLITE_BUSY` or
+/// `SQLITE_LOCKED`.
+fn is_sqlite_busy(code: Option<&str>) -> bool {
+    code.and_then(|code| code.parse::<i32>().ok())
+        .is_some_and(|code| matches!(code & 0xff, 5 | 6))
+}
+
+/// A single rule violated by a field of the request data.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct FieldViolation {
+    pub field: &'static str,
+    pub rule: &'static str,
+    pub message: String,
+}
+
+impl FieldViolation {
+    #[inline]
+    pub fn new(
+        field: &'static str,
+        rule: &'static str,
+        message: impl Into<String>,
+    ) -> Self {
+        Self {
+            field,
+            rule,
+            message: message.into(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ValidationError(pub Vec<FieldViolation>);
+
+impl ValidationError {
+    /// Returns `Ok` if no violations were collected.
+    #[inline]
+    pub fn check(violations: Vec<FieldViolation>) -> Result<(), Self> {
+        if violations.is_empty() {
+            Ok(())
+        } else {
+            Err(Self(violations))
+        }
+    }
+}
+
+impl std::fmt::Display for ValidationError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("invalid fields: ")?;
+
+        for (i, violation) in self.0.iter().enumerate() {
+            if i != 0 {
+                f.write_str(", ")?;
+            }
+            f.write_str(violation.field)?;
+        }
+
+        Ok(())
+    }
+}
+
+impl std::error::Error for ValidationError {}
+
 #[derive(Debug, Serialize)]
 pub struct ErrorResponse {
     pub error: String,
     pub error_code: u32,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub errors: Vec<FieldViolation>,
     #[serde(skip_serializing)]
     pub status_code: StatusCode,
 }
@@ -142,11 +393,159 @@ impl IntoResponse for ErrorResponse {
 impl IntoResponse for DownloaderError {
     #[inline]
     fn into_response(self) -> Response {
-        ErrorResponse {
-            error: self.to_string(),
-            error_code: self.custom_code(),
-            status_code: self.status_code(),
+        let error = self.to_string();
+        let error_code = self.custom_code();
+        let status_code = self.status_code();
+
+        let retry_after = match &self {
+            DownloaderError::Http(HttpError::RateLimited { retry_after }) => {
+                Some(*retry_after)
+            }
+            _ => None,
+        };
+        let errors = match self {
+            DownloaderError::Validation(ValidationError(violations)) => {
+                violations
+            }
+            _ => Vec::new(),
+        };
+
+        let mut res = ErrorResponse {
+            error,
+            error_code,
+            errors,
+            status_code,
+        }
+        .into_response();
+        if let Some(retry_after) = retry_after {
+            res.headers_mut()
+                .insert(header::RETRY_AFTER, HeaderValue::from(retry_after));
+        }
+        res
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{collections::HashSet, io, time::Duration};
+
+    use axum::http::{Request, StatusCode};
+    use test_log::test;
+    use uuid::Uuid;
+
+    use crate::{
+        auth::AuthError,
+        storage::{manager::ObjectError, repository::RepositoryError},
+        user::UserError,
+    };
+
+    use super::{
+        is_sqlite_busy, sqlx_status_code, DownloaderError, FieldViolation,
+        HttpError, ValidationError, ERROR_CODES,
+    };
+
+    #[test]
+    fn test_sqlx_status_code() {
+        assert_eq!(
+            sqlx_status_code(&sqlx::Error::PoolTimedOut),
+            StatusCode::SERVICE_UNAVAILABLE,
+        );
+        assert_eq!(
+            sqlx_status_code(&sqlx::Error::RowNotFound),
+            StatusCode::INTERNAL_SERVER_ERROR,
+        );
+
+        // SQLITE_BUSY, SQLITE_BUSY_TIMEOUT and SQLITE_LOCKED
+        assert!(is_sqlite_busy(Some("5")));
+        assert!(is_sqlite_busy(Some("773")));
+        assert!(is_sqlite_busy(Some("6")));
+        // SQLITE_CONSTRAINT_UNIQUE
+        assert!(!is_sqlite_busy(Some("2067")));
+        assert!(!is_sqlite_busy(None));
+    }
+
+    #[test]
+    fn test_error_codes() {
+        let errors: Vec<DownloaderError> = vec![
+            DownloaderError::Other(
+                "unexpected".into(),
+                StatusCode::INTERNAL_SERVER_ERROR,
+            ),
+            RepositoryError::NotFound(Uuid::nil()).into(),
+            RepositoryError::LimitOutOfRange(0).into(),
+            RepositoryError::Sqlx(sqlx::Error::RowNotFound).into(),
+            RepositoryError::DownloadLimitReached(Uuid::nil()).into(),
+            ObjectError::IoError(io::Error::other("failed")).into(),
+            ObjectError::NotFound.into(),
+            ObjectError::TooLarge(0).into(),
+            ObjectError::StorageFull.into(),
+            ObjectError::Missing.into(),
+            ObjectError::ChecksumMismatch.into(),
+            ObjectError::ChecksumMissing.into(),
+            ObjectError::QuotaExceeded.into(),
+            ObjectError::UnsupportedMediaType("text/plain".into()).into(),
+            ObjectError::WriteInProgress.into(),
+            UserError::NotFound.into(),
+            UserError::AlreadyExists("user".into()).into(),
+            UserError::PasswordMismatch.into(),
+            UserError::BcryptHashFailed.into(),
+            UserError::BcryptCompareFailed.into(),
+            UserError::Sqlx(sqlx::Error::RowNotFound).into(),
+            UserError::InvalidInvite.into(),
+            UserError::LimitOutOfRange(0).into(),
+            UserError::SessionNotFound.into(),
+            UserError::ApiKeyNotFound.into(),
+            AuthError::GenerateTokenFailed.into(),
+            AuthError::TokenExpirationTooLong {
+                got: Duration::ZERO,
+                max: Duration::ZERO,
+            }
+            .into(),
+            AuthError::InvalidToken.into(),
+            AuthError::ExpiredToken.into(),
+            AuthError::ImatureToken.into(),
+            AuthError::AuthorizationRequired.into(),
+            AuthError::InvalidAuthHeader.into(),
+            AuthError::InvalidAuthStrategy("Basic".into(), &["Bearer"]).into(),
+            AuthError::AccessDenied.into(),
+            AuthError::HigherPermissionRequired.into(),
+            AuthError::SignupNotAllowed.into(),
+            AuthError::RevokedToken.into(),
+            AuthError::ChallengeFailed.into(),
+            AuthError::ChallengeUnavailable.into(),
+            ValidationError(vec![FieldViolation::new("name", "length", "")])
+                .into(),
+            HttpError::InvalidFormLength {
+                expected: 1,
+                got: 2,
+            }
+            .into(),
+            HttpError::InvalidFormBoundary.into(),
+            HttpError::InvalidHeader("range").into(),
+            HttpError::IdempotencyKeyInUse.into(),
+            HttpError::Timeout.into(),
+            HttpError::Maintenance.into(),
+            HttpError::Overloaded.into(),
+            HttpError::RateLimited { retry_after: 1 }.into(),
+            HttpError::RouteNotFound.into(),
+            HttpError::MethodNotAllowed.into(),
+            HttpError::ServicePanicked.into(),
+            Request::builder().uri("\n").body(()).unwrap_err().into(),
+        ];
+
+        for error in errors {
+            let code = error.custom_code();
+            assert!(
+                ERROR_CODES.iter().any(|listed| {
+                    listed.code == code && listed.status == error.status_code()
+                }),
+                "error code {code} is not listed",
+            );
+        }
+
+        let mut codes = HashSet::new();
+        for listed in ERROR_CODES {
+            assert!(codes.insert(listed.code), "{} listed twice", listed.code);
         }
-        .into_response()
     }
 }
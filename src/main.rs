@@ -1,21 +1,63 @@
-use std::{error::Error, io::ErrorKind, path::Path, sync::Arc};
+use std::{
+    error::Error,
+    fmt::Display,
+    fs::OpenOptions,
+    io::{ErrorKind, Write},
+    net::SocketAddr,
+    path::Path,
+    sync::Arc,
+    time::Duration,
+};
 
-use auth::{repository::TokenRepository, routes::auth_routes};
-use axum::{Extension, Router};
-use axum_server::tls_rustls::RustlsConfig;
+use auth::{
+    challenge,
+    client_cert::{tls_server_config, ClientCertAcceptor},
+    repository::TokenRepository,
+    routes::{KeyFiles, SignupConfig},
+};
+use axum_server::{
+    tls_rustls::{RustlsAcceptor, RustlsConfig},
+    Server,
+};
 use clap::Parser;
-use config::{Args, Config};
-use jsonwebtoken::Algorithm;
-use server::layer_root_router;
+use config::{Args, Command, Config, NetConfig, StorageConfig, TokenAlgorithm};
+use hyper_util::rt::TokioTimer;
+use server::{app_router, AppDeps};
 use sqlx::{migrate, SqlitePool};
 use storage::{
-    manager::ObjectManager, repository::ObjectRepository, routes::file_routes,
+    backend::{LocalStorage, Storage},
+    cache::ObjectCache,
+    encryption::{EncryptedStorage, MasterKey, MasterKeys, Migration},
+    idempotency::IdempotencyKeys,
+    manager::ObjectManager,
+    quota::Quotas,
+    repository::ObjectRepository,
+    scrub::scrub,
+    sweeper::spawn_expiration_sweeper,
+    throttle::Throttle,
+    timeout::DownloadTimeouts,
 };
 use tokio::{runtime::Builder, select};
 use tracing::level_filters::LevelFilter;
 use tracing_subscriber::EnvFilter;
-use user::{repository::UserRepository, routes::user_routes};
-use utils::{crypto::fetch_jwt_key_files, sys::shutdown_signal};
+use user::repository::{calibrate_hash_cost, UserRepository};
+use utils::{
+    audit::{AuditLogger, FileAuditSink},
+    crypto::{
+        fetch_jwt_key_files, fetch_jwt_public_key, fetch_secret_key_file,
+        generate_keypair, generate_secret_key, recover_jwt_key_files,
+    },
+    db::{username_case_conflicts, DbHealth},
+    limit::{ApiKeyLimiter, RequestLimiter},
+    logging::LogSink,
+    maintenance::Maintenance,
+    net::{LimitAcceptor, TimeoutAcceptor},
+    retry::Backoff,
+    security::SecurityHeaders,
+    sys::shutdown_signal,
+    version::BuildInfo,
+    webhook::Webhooks,
+};
 
 mod auth;
 mod config;
@@ -25,74 +67,392 @@ mod storage;
 mod user;
 mod utils;
 
-async fn run_http(cfg: &Config) -> Result<(), Box<dyn Error + Send + Sync>> {
-    let manager = ObjectManager::new(&cfg.storage);
-
-    let sqlite_path = cfg.storage.state_dir.join("files.sqlite");
+async fn open_db(
+    cfg: &StorageConfig,
+    health: &Arc<DbHealth>,
+) -> Result<SqlitePool, Box<dyn Error + Send + Sync>> {
+    let sqlite_path = cfg.state_dir.join("files.sqlite");
     touch_file(&sqlite_path)?;
 
-    let db = SqlitePool::connect(&format!(
-        "sqlite:{}",
-        sqlite_path.to_string_lossy()
-    ))
-    .await?;
+    let db = health
+        .pool_options(cfg.db_max_connections, cfg.db_acquire_timeout)
+        .connect(&format!("sqlite:{}", sqlite_path.to_string_lossy()))
+        .await?;
+
+    let conflicts = username_case_conflicts(&db).await?;
+    if !conflicts.is_empty() {
+        return Err(format!(
+            "usernames must be unique regardless of case, rename all but one \
+            of each before upgrading: {}",
+            conflicts.join(", "),
+        )
+        .into());
+    }
     migrate!().run(&db).await?;
 
-    let obj_repo = ObjectRepository::new(db.clone());
-    let user_repo = UserRepository::new(db, cfg.auth.password_hash_cost);
+    Ok(db)
+}
 
-    let (enc_key, dec_key) =
-        fetch_jwt_key_files(&cfg.auth.token_cert, &cfg.auth.token_key)
-            .await
-            .map_err(|e| format!("failed to get jwt key files: {e}"))?;
-
-    let token_repo = TokenRepository::new(
-        Algorithm::EdDSA,
-        enc_key,
-        dec_key,
-        cfg.auth.token_duration,
-        cfg.auth.token_duration,
-        cfg.auth.secret_key.clone(),
+/// Reads the master keys of the storage encryption, if it is enabled.
+async fn load_master_keys(
+    cfg: &StorageConfig,
+) -> Result<Option<MasterKeys>, Box<dyn Error + Send + Sync>> {
+    let Some(encryption) = &cfg.encryption else {
+        return Ok(None);
+    };
+
+    let current = fetch_master_key(&encryption.master_key_file).await?;
+    let mut previous = Vec::new();
+    for path in &encryption.previous_master_key_files {
+        previous.push(fetch_master_key(path).await?);
+    }
+
+    tracing::info!(master_key = %current.id(), "storage encryption enabled");
+
+    Ok(Some(MasterKeys { current, previous }))
+}
+
+async fn fetch_master_key(path: &str) -> Result<MasterKey, String> {
+    fetch_secret_key_file(path)
+        .await
+        .map(|key| MasterKey::new(&key))
+        .map_err(|e| format!("failed to get master key file `{path}`: {e}"))
+}
+
+async fn run_http(
+    cfg: &Config,
+    webhooks: Webhooks,
+    audit: AuditLogger,
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let build = BuildInfo::current();
+    tracing::info!(
+        version = %build.version,
+        git_commit = %build.git_commit,
+        build_date = %build
+            .build_date
+            .map_or_else(|| "unknown".into(), |date| date.to_rfc3339()),
+        "starting downloader",
     );
 
-    let app = layer_root_router(
-        Router::new()
-            .nest("/api/file", file_routes(Router::new()))
-            .nest("/api/auth", auth_routes(Router::new()))
-            .nest("/api/user", user_routes(Router::new())),
+    LocalStorage::from_config(&cfg.storage)
+        .prepare()
+        .await
+        .map_err(|e| format!("failed to prepare the data dirs: {e}"))?;
+
+    let manager = Arc::new(ObjectManager::new(
+        &cfg.storage,
+        load_master_keys(&cfg.storage).await?,
+    ));
+    let db_health = DbHealth::new();
+    let db = open_db(&cfg.storage, &db_health).await?;
+    db_health
+        .clone()
+        .spawn_checks(db.clone(), cfg.storage.db_health_check_interval);
+
+    let mut obj_repo = ObjectRepository::new(db.clone());
+    if cfg.storage.object_cache_size > 0 {
+        obj_repo = obj_repo.with_cache(ObjectCache::new(
+            cfg.storage.object_cache_size,
+            cfg.storage.object_cache_ttl,
+        ));
+    }
+
+    let hash_cost = if cfg.auth.password_hash_target_ms > 0 {
+        let target = Duration::from_millis(cfg.auth.password_hash_target_ms);
+        let cost =
+            tokio::task::spawn_blocking(move || calibrate_hash_cost(target))
+                .await?;
+
+        tracing::info!(cost, ?target, "calibrated password hash cost");
+        cost
+    } else {
+        cfg.auth.password_hash_cost
+    };
+
+    let user_repo = UserRepository::new(db, hash_cost);
+
+    spawn_expiration_sweeper(
+        obj_repo.clone(),
+        manager.clone(),
+        cfg.storage.sweep_interval,
+    );
+
+    recover_jwt_key_files(&cfg.auth.token_cert, &cfg.auth.token_key)
+        .await
+        .map_err(|e| format!("failed to recover jwt key files: {e}"))?;
+
+    let algorithm = cfg.auth.token_algorithm;
+    let (enc_key, public_key) = fetch_jwt_key_files(
+        &cfg.auth.token_cert,
+        &cfg.auth.token_key,
+        algorithm,
     )
-    .layer(Extension(obj_repo))
-    .layer(Extension(Arc::new(manager)))
-    .layer(Extension(user_repo))
-    .layer(Extension(Arc::new(token_repo)));
+    .await
+    .map_err(|e| format!("failed to get {algorithm} jwt key files: {e}"))?;
+
+    let token_repo = Arc::new(
+        TokenRepository::new(
+            algorithm.into(),
+            enc_key,
+            public_key,
+            cfg.auth.token_duration,
+            cfg.auth.max_token_duration,
+            cfg.auth.secret_key.clone(),
+            cfg.auth.token_issuer.clone(),
+            cfg.auth.token_audience.clone(),
+        )
+        .with_token_cache(cfg.auth.token_cache_size),
+    );
 
-    let tls_cfg = load_tls_config(&cfg.ssl).await;
+    let revoked_before = user_repo
+        .tokens_revoked_before()
+        .await
+        .map_err(|e| format!("failed to get the token revocation: {e}"))?;
+    if let Some(revoked_before) = revoked_before {
+        tracing::info!(%revoked_before, "rejecting the tokens issued before");
+        token_repo.revoke_before(revoked_before);
+    }
+
+    for path in &cfg.auth.previous_token_certs {
+        let public_key =
+            fetch_jwt_public_key(path, algorithm).await.map_err(|e| {
+                format!(
+                    "failed to get previous jwt key file `{}`: {e}",
+                    path.as_str()
+                )
+            })?;
+        token_repo.accept_key(public_key);
+    }
+
+    for service in &cfg.auth.service_keys {
+        // The services always sign with Ed25519 keys
+        let public_key =
+            fetch_jwt_public_key(&service.cert, TokenAlgorithm::EdDSA)
+                .await
+                .map_err(|e| {
+                    format!(
+                        "failed to get service key file `{}`: {e}",
+                        service.cert.as_str()
+                    )
+                })?;
+        token_repo.add_service_key(service.name.clone(), public_key.dec_key);
+    }
+
+    #[cfg(unix)]
+    spawn_key_reloader(cfg.auth.clone(), token_repo.clone())?;
+
+    let signup = SignupConfig {
+        allow_signup: cfg.auth.allow_signup,
+        challenge: cfg
+            .auth
+            .signup_challenge
+            .as_ref()
+            .map(challenge::from_config),
+    };
+    let quotas =
+        Quotas::new(cfg.quota.clone(), user_repo.clone(), obj_repo.clone());
+
+    let maintenance = Arc::new(Maintenance::from_config(&cfg.maintenance));
+    #[cfg(unix)]
+    spawn_maintenance_toggler(maintenance.clone())?;
+
+    let tls_cfg = load_tls_config(&cfg.ssl)
+        .await
+        .map(|tls_cfg| with_alpn(tls_cfg, cfg.net.enable_http2));
+
+    let acceptor = LimitAcceptor::new(
+        TimeoutAcceptor::new(cfg.net.idle_timeout, cfg.net.write_timeout),
+        cfg.net.max_connections,
+    );
+
+    let deps = AppDeps {
+        obj_repo,
+        manager,
+        user_repo,
+        token_repo,
+        db_health,
+        throttle: Arc::new(Throttle::new(cfg.throttle.clone())),
+        quotas: Arc::new(quotas),
+        maintenance,
+        limiter: Arc::new(RequestLimiter::from_config(&cfg.net)),
+        api_key_limiter: Arc::new(ApiKeyLimiter::new(
+            cfg.auth.api_key_requests_per_minute,
+        )),
+        timeouts: DownloadTimeouts::from_config(&cfg.net),
+        download_backoff: Backoff::new(
+            cfg.net.download_retries,
+            Duration::from_millis(cfg.net.download_retry_delay_ms),
+        ),
+        idempotency: Arc::new(IdempotencyKeys::new(
+            cfg.storage.idempotency_key_ttl,
+        )),
+        key_files: Arc::new(KeyFiles::new(
+            cfg.auth.token_cert.as_str().into(),
+            cfg.auth.token_key.as_str().into(),
+            algorithm,
+        )),
+        audit,
+        webhooks,
+        signup,
+        security: Arc::new(SecurityHeaders::from_config(
+            &cfg.headers,
+            tls_cfg.is_some(),
+        )),
+        connections: acceptor.connections(),
+    };
+    let app = app_router(deps, &cfg.routes, cfg.net.access_log_format);
 
     tracing::info!(
         addr = %cfg.net.http_addr,
         tls_enabled = tls_cfg.is_some(),
+        client_auth_enabled = cfg.ssl.client_auth.is_some(),
+        http2_enabled = cfg.net.enable_http2,
         "listening for http connections",
     );
 
     if let Some(tls_cfg) = tls_cfg {
-        axum_server::bind_rustls(cfg.net.http_addr, tls_cfg)
-            .serve(app.into_make_service())
+        let services = match &cfg.ssl.client_auth {
+            Some(client_auth) => client_auth.services.as_slice(),
+            None => &[],
+        };
+        let mut server = axum_server::bind(cfg.net.http_addr).acceptor(
+            ClientCertAcceptor::new(
+                RustlsAcceptor::new(tls_cfg).acceptor(acceptor),
+                services,
+            ),
+        );
+        configure_http(&mut server, &cfg.net);
+
+        server
+            .serve(app.into_make_service_with_connect_info::<SocketAddr>())
             .await?;
     } else {
-        axum_server::bind(cfg.net.http_addr)
-            .serve(app.into_make_service())
+        let mut server =
+            axum_server::bind(cfg.net.http_addr).acceptor(acceptor);
+        configure_http(&mut server, &cfg.net);
+
+        server
+            .serve(app.into_make_service_with_connect_info::<SocketAddr>())
             .await?;
     }
 
     Ok(())
 }
 
-async fn run(cfg: Config) -> Result<(), Box<dyn Error + Send + Sync>> {
+async fn run_scrub(
+    cfg: &Config,
+    delete_orphans: bool,
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let manager =
+        ObjectManager::new(&cfg.storage, load_master_keys(&cfg.storage).await?);
+    let repo =
+        ObjectRepository::new(open_db(&cfg.storage, &DbHealth::new()).await?);
+
+    let report = scrub(&repo, &manager, delete_orphans).await?;
+
+    for name in &report.unknown {
+        tracing::warn!(%name, "unknown file in data dir");
+    }
+    tracing::info!(
+        checked = report.checked,
+        missing = report.missing.len(),
+        corrupted = report.corrupted.len(),
+        orphans = report.orphans.len(),
+        deleted_orphans = delete_orphans,
+        "finished scrub",
+    );
+
+    let fixed_orphans = delete_orphans || report.orphans.is_empty();
+    if !report.missing.is_empty()
+        || !report.corrupted.is_empty()
+        || !fixed_orphans
+    {
+        return Err("stored files are not consistent with the database".into());
+    }
+
+    Ok(())
+}
+
+fn configure_http<A>(server: &mut Server<A>, cfg: &NetConfig) {
+    if !cfg.enable_http2 {
+        let builder = server.http_builder();
+        *builder = builder.clone().http1_only();
+    }
+
+    if !cfg.header_read_timeout.is_zero() {
+        server
+            .http_builder()
+            .http1()
+            .timer(TokioTimer::new())
+            .header_read_timeout(cfg.header_read_timeout);
+    }
+}
+
+async fn run_reencrypt(
+    cfg: &Config,
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let keys = load_master_keys(&cfg.storage)
+        .await?
+        .ok_or("`storage.encryption` is not configured")?;
+    let local = LocalStorage::from_config(&cfg.storage);
+    local
+        .prepare()
+        .await
+        .map_err(|e| format!("failed to prepare the data dirs: {e}"))?;
+    let storage = EncryptedStorage::new(local, keys);
+
+    let (mut encrypted, mut rewrapped, mut failed) = (0, 0, 0);
+    for name in storage.list().await? {
+        match storage.migrate(&name).await {
+            Ok(Migration::Unchanged) => {}
+            Ok(Migration::Encrypted) => encrypted += 1,
+            Ok(Migration::Rewrapped) => rewrapped += 1,
+            Err(error) => {
+                tracing::error!(%error, %name, "reencrypt file failed");
+                failed += 1;
+            }
+        }
+    }
+
+    tracing::info!(encrypted, rewrapped, failed, "finished reencrypt");
+
+    if failed > 0 {
+        return Err("some files could not be reencrypted".into());
+    }
+
+    Ok(())
+}
+
+async fn run(
+    cfg: Config,
+    command: Command,
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    match command {
+        Command::Scrub { delete_orphans } => {
+            return run_scrub(&cfg, delete_orphans).await;
+        }
+        Command::Reencrypt => return run_reencrypt(&cfg).await,
+        _ => {}
+    }
+
     let signal = shutdown_signal()?;
+    let webhooks = Webhooks::new(&cfg.webhook);
+    let audit = match &cfg.audit.log_file {
+        Some(path) => {
+            let sink = FileAuditSink::open(path).await.map_err(|e| {
+                format!(
+                    "failed to open audit log file `{}`: {e}",
+                    path.display()
+                )
+            })?;
+            AuditLogger::new(sink, cfg.audit.queue_size)
+        }
+        None => AuditLogger::disabled(),
+    };
 
     select! {
         _ = signal => {}
-        res = run_http(&cfg) => {
+        res = run_http(&cfg, webhooks.clone(), audit.clone()) => {
             if let Err(err) = res {
                 return Err(err);
             }
@@ -100,10 +460,131 @@ async fn run(cfg: Config) -> Result<(), Box<dyn Error + Send + Sync>> {
     }
 
     tracing::info!("closed http server");
+    audit.close().await;
+    webhooks.notify_offline().await;
 
     Ok(())
 }
 
+/// Reloads the jwt key files when a SIGHUP is received, rotating the token
+/// signing key if it changed. The previous key keeps being accepted until
+/// every token signed with it has expired.
+#[cfg(unix)]
+fn spawn_key_reloader(
+    cfg: config::AuthConfig,
+    token_repo: Arc<TokenRepository>,
+) -> std::io::Result<()> {
+    use tokio::signal::unix::{signal, SignalKind};
+
+    let mut hangup = signal(SignalKind::hangup())?;
+
+    tokio::spawn(async move {
+        while hangup.recv().await.is_some() {
+            tracing::info!(target: "sys_signals", "received SIGHUP");
+
+            let (enc_key, public_key) = match fetch_jwt_key_files(
+                &cfg.token_cert,
+                &cfg.token_key,
+                cfg.token_algorithm,
+            )
+            .await
+            {
+                Ok(v) => v,
+                Err(error) => {
+                    tracing::error!(
+                        %error,
+                        "failed to reload jwt key files",
+                    );
+                    continue;
+                }
+            };
+
+            token_repo.rotate_key_with_overlap(enc_key, public_key);
+        }
+    });
+
+    Ok(())
+}
+
+/// Toggles the maintenance when a SIGUSR1 is received.
+#[cfg(unix)]
+fn spawn_maintenance_toggler(
+    maintenance: Arc<Maintenance>,
+) -> std::io::Result<()> {
+    use tokio::signal::unix::{signal, SignalKind};
+
+    let mut user_defined1 = signal(SignalKind::user_defined1())?;
+
+    tokio::spawn(async move {
+        while user_defined1.recv().await.is_some() {
+            tracing::info!(target: "sys_signals", "received SIGUSR1");
+            maintenance.toggle("SIGUSR1");
+        }
+    });
+
+    Ok(())
+}
+
+/// Writes a new token signing keypair and prints the config values to use
+/// it, along with a random secret key.
+fn gen_keys(
+    private_key: &Path,
+    public_key: &Path,
+    force: bool,
+    algorithm: TokenAlgorithm,
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let (private_pem, public_pem) = generate_keypair(algorithm)?;
+    // Same as scripts/gen-secret-key.sh
+    let secret_key = generate_secret_key(48)?;
+
+    write_key_file(private_key, &private_pem, 0o600, force)?;
+    write_key_file(public_key, &public_pem, 0o644, force)?;
+
+    println!("[auth]");
+    println!("token_cert = \"{}\"", public_key.display());
+    println!("token_key = \"{}\"", private_key.display());
+    if algorithm != TokenAlgorithm::default() {
+        println!("token_algorithm = \"{algorithm}\"");
+    }
+    println!("secret_key = \"{secret_key}\"");
+
+    Ok(())
+}
+
+fn write_key_file(
+    path: &Path,
+    contents: &str,
+    mode: u32,
+    force: bool,
+) -> Result<(), String> {
+    let mut options = OpenOptions::new();
+    if force {
+        options.write(true).create(true).truncate(true);
+    } else {
+        options.write(true).create_new(true);
+    }
+
+    #[cfg(unix)]
+    std::os::unix::fs::OpenOptionsExt::mode(&mut options, mode);
+    #[cfg(not(unix))]
+    let _ = mode;
+
+    options
+        .open(path)
+        .and_then(|mut file| {
+            // The mode is only applied to new files
+            #[cfg(unix)]
+            {
+                use std::os::unix::fs::PermissionsExt;
+                file.set_permissions(std::fs::Permissions::from_mode(mode))?;
+            }
+            file.write_all(contents.as_bytes())
+        })
+        .map_err(|err| {
+            format!("failed to write key file `{}`: {err}", path.display())
+        })
+}
+
 fn touch_file(path: &Path) -> Result<(), String> {
     std::fs::File::open(path)
         .or_else(|err| {
@@ -117,6 +598,119 @@ fn touch_file(path: &Path) -> Result<(), String> {
         .map_err(|err| format!("failed to open/create sqlite file: {err}"))
 }
 
+/// Runs the checks of the `check-config` command, printing the outcome of
+/// each one. Returns whether all of them passed.
+fn check_config(path: &str) -> bool {
+    let res = config::load(path);
+    report_check(&format!("load `{path}`"), res.as_ref().map(|_| ()));
+    let Ok(cfg) = res else {
+        return false;
+    };
+
+    let mut ok = report_check("validate", cfg.validate());
+
+    let checks = Builder::new_current_thread()
+        .enable_all()
+        .build()
+        .expect("Failed building the Runtime")
+        .block_on(check_config_files(&cfg));
+
+    for (name, res) in checks {
+        ok &= report_check(&name, res);
+    }
+
+    ok
+}
+
+fn report_check<E: Display>(name: &str, res: Result<(), E>) -> bool {
+    match res {
+        Ok(()) => {
+            println!("ok     {name}");
+            true
+        }
+        Err(err) => {
+            println!("error  {name}: {err}");
+            false
+        }
+    }
+}
+
+/// Reads every key and certificate file of `cfg`, the same way the server
+/// does while starting.
+async fn check_config_files(
+    cfg: &Config,
+) -> Vec<(String, Result<(), Box<dyn Error + Send + Sync>>)> {
+    let mut checks = Vec::new();
+
+    let algorithm = cfg.auth.token_algorithm;
+    let res = fetch_jwt_key_files(
+        &cfg.auth.token_cert,
+        &cfg.auth.token_key,
+        algorithm,
+    )
+    .await
+    .map(|_| ())
+    .map_err(Into::into);
+    checks.push(("jwt key files".to_owned(), res));
+
+    for path in &cfg.auth.previous_token_certs {
+        let res = fetch_jwt_public_key(path, algorithm)
+            .await
+            .map(|_| ())
+            .map_err(Into::into);
+        checks
+            .push((format!("previous jwt key file `{}`", path.as_str()), res));
+    }
+
+    for service in &cfg.auth.service_keys {
+        let res = fetch_jwt_public_key(&service.cert, TokenAlgorithm::EdDSA)
+            .await
+            .map(|_| ())
+            .map_err(Into::into);
+        checks.push((format!("service key `{}`", service.name), res));
+    }
+
+    if let (true, Some(cert), Some(key)) =
+        (cfg.ssl.enable, &cfg.ssl.cert, &cfg.ssl.key)
+    {
+        let res = RustlsConfig::from_pem_file(cert.as_str(), key.as_str())
+            .await
+            .map(|_| ())
+            .map_err(Into::into);
+        checks.push(("tls pem files".to_owned(), res));
+
+        if let Some(client_auth) = &cfg.ssl.client_auth {
+            let res = tls_server_config(
+                cert.as_str(),
+                key.as_str(),
+                client_auth.ca.as_str(),
+            )
+            .map(|_| ());
+            checks.push(("tls client ca".to_owned(), res));
+        }
+    }
+
+    if cfg.storage.encryption.is_some() {
+        let res = load_master_keys(&cfg.storage).await.map(|_| ());
+        checks.push(("encryption master keys".to_owned(), res));
+    }
+
+    checks
+}
+
+/// Advertises the protocols served by the listener, so clients don't pick
+/// HTTP/2 when only HTTP/1.1 is.
+fn with_alpn(tls_cfg: RustlsConfig, http2: bool) -> RustlsConfig {
+    let mut server_cfg = (*tls_cfg.get_inner()).clone();
+    server_cfg.alpn_protocols = if http2 {
+        vec![b"h2".to_vec(), b"http/1.1".to_vec()]
+    } else {
+        vec![b"http/1.1".to_vec()]
+    };
+
+    RustlsConfig::from_config(Arc::new(server_cfg))
+}
+
 async fn load_tls_config(cfg: &config::SslConfig) -> Option<RustlsConfig> {
     if !cfg.enable {
         return None;
@@ -129,21 +723,33 @@ async fn load_tls_config(cfg: &config::SslConfig) -> Option<RustlsConfig> {
         tracing::error!("TLS is enable but key file was not provided");
     }
 
-    RustlsConfig::from_pem_file(
-        cfg.cert.as_ref()?.as_str(),
-        cfg.key.as_ref()?.as_str(),
-    )
-    .await
-    .map_err(|error| tracing::error!(%error, "failed to load TLS pem files"))
-    .ok()
+    let cert = cfg.cert.as_ref()?.as_str();
+    let key = cfg.key.as_ref()?.as_str();
+
+    let res = match &cfg.client_auth {
+        Some(client_auth) => {
+            tls_server_config(cert, key, client_auth.ca.as_str()).map(
+                |server_cfg| RustlsConfig::from_config(Arc::new(server_cfg)),
+            )
+        }
+        None => RustlsConfig::from_pem_file(cert, key)
+            .await
+            .map_err(Into::into),
+    };
+
+    res.map_err(|error| tracing::error!(%error, "failed to load TLS pem files"))
+        .ok()
 }
 
-fn main() {
-    let args = Args::parse();
+/// Sets up the global logger, writing to `sink`.
+fn init_logging(args: &Args, sink: LogSink) {
+    let ansi = !sink.is_file();
 
     if args.debug {
-        let builder =
-            tracing_subscriber::fmt().with_max_level(LevelFilter::DEBUG);
+        let builder = tracing_subscriber::fmt()
+            .with_max_level(LevelFilter::DEBUG)
+            .with_writer(sink)
+            .with_ansi(ansi);
 
         if args.json_logs {
             builder.json().init();
@@ -151,11 +757,14 @@ fn main() {
             builder.init();
         }
     } else {
-        let builder = tracing_subscriber::fmt().with_env_filter(
-            EnvFilter::builder()
-                .with_default_directive(LevelFilter::INFO.into())
-                .from_env_lossy(),
-        );
+        let builder = tracing_subscriber::fmt()
+            .with_env_filter(
+                EnvFilter::builder()
+                    .with_default_directive(LevelFilter::INFO.into())
+                    .from_env_lossy(),
+            )
+            .with_writer(sink)
+            .with_ansi(ansi);
 
         if args.json_logs {
             builder.json().init();
@@ -163,6 +772,33 @@ fn main() {
             builder.init();
         }
     }
+}
+
+fn main() {
+    let args = Args::parse();
+
+    if let Some(Command::GenKeys {
+        private_key,
+        public_key,
+        force,
+        algorithm,
+    }) = &args.command
+    {
+        init_logging(&args, LogSink::default());
+        if let Err(err) = gen_keys(private_key, public_key, *force, *algorithm)
+        {
+            fatal!("Failed to generate keys: {err}");
+        }
+        return;
+    }
+
+    if let Some(Command::CheckConfig) = &args.command {
+        init_logging(&args, LogSink::default());
+        if !check_config(&args.config_path) {
+            std::process::exit(1);
+        }
+        return;
+    }
 
     let cfg = match config::load(&args.config_path) {
         Ok(v) => v,
@@ -176,13 +812,22 @@ fn main() {
         }
     };
 
+    if let Err(err) = cfg.validate() {
+        fatal!("Invalid configuration: {err}");
+    }
+
+    match LogSink::open(&cfg.log) {
+        Ok(sink) => init_logging(&args, sink),
+        Err(err) => fatal!("Failed to open the log output: {err}"),
+    }
+
     tracing::debug!(config = ?cfg, "loaded configuration");
 
     let tokio_result = Builder::new_multi_thread()
         .enable_all()
         .build()
         .expect("Failed building the Runtime")
-        .block_on(run(cfg));
+        .block_on(run(cfg, args.command.unwrap_or(Command::Serve)));
 
     if let Err(e) = tokio_result {
         fatal!("Unhandled error: {e}");
@@ -1,11 +1,17 @@
-use std::{fmt::Display, iter::once, time::Duration};
+use std::{
+    fmt::Display, iter::once, net::SocketAddr, sync::Arc, time::Duration,
+};
 
 use axum::{
     body::Body,
-    http::{header, HeaderValue},
+    extract::{ConnectInfo, DefaultBodyLimit, Request},
+    http::{header, HeaderValue, Method, StatusCode},
+    middleware::{self, Next},
     response::{IntoResponse, Response},
-    routing, Router,
+    routing, Extension, Router,
 };
+use serde::{Deserialize, Serialize};
+use sqlx::Sqlite;
 use tower::ServiceBuilder;
 use tower_http::{
     catch_panic::{CatchPanicLayer, ResponseForPanic},
@@ -19,8 +25,36 @@ use tower_http::{
 use tracing::Level;
 
 use crate::{
+    auth::{
+        axum::Authorization,
+        repository::TokenRepository,
+        routes::{auth_routes, get_jwks, KeyFiles, SignupConfig, GET_JWKS},
+        AuthError, Permission,
+    },
+    config::{AccessLogFormat, RoutesConfig},
     errors::{DownloaderError, HttpError},
-    utils::fmt::fmt_duration,
+    storage::{
+        idempotency::IdempotencyKeys, manager::ObjectManager,
+        progress::UploadProgress, quota::Quotas, repository::ObjectRepository,
+        routes::file_routes, throttle::Throttle, timeout::DownloadTimeouts,
+    },
+    user::{repository::UserRepository, routes::user_routes},
+    utils::{
+        access_log::combined_access_log,
+        audit::{Actor, AuditAction, AuditEvent, AuditLogger},
+        db::{DbHealth, DbStats},
+        extractors::{Json, MAX_JSON_BODY_SIZE},
+        fmt::fmt_duration,
+        limit::{limit_requests, ApiKeyLimiter, RequestLimiter},
+        maintenance::{reject_writes, Maintenance},
+        net::ActiveConnections,
+        openapi::{ApiRouter, Content, RouteSpec, Schema},
+        retry::Backoff,
+        security::{set_security_headers, SecurityHeaders},
+        serde::duration_secs,
+        version::BuildInfo,
+        webhook::Webhooks,
+    },
 };
 
 #[cfg(feature = "embed")]
@@ -28,8 +62,9 @@ use crate::{
 #[folder = "frontend/build"]
 pub struct Asset;
 
+/// Disabled when access logs are written in another format.
 #[derive(Clone)]
-struct CustomOnResponse;
+struct CustomOnResponse(bool);
 
 impl<B> OnResponse<B> for CustomOnResponse {
     #[inline]
@@ -39,6 +74,9 @@ impl<B> OnResponse<B> for CustomOnResponse {
         latency: Duration,
         span: &tracing::Span,
     ) {
+        if !self.0 {
+            return;
+        }
         let _guard = span.enter();
         let latency = fmt_duration(latency);
 
@@ -52,8 +90,9 @@ impl<B> OnResponse<B> for CustomOnResponse {
     }
 }
 
+/// Disabled when access logs are written in another format.
 #[derive(Clone)]
-struct CustomOnRequest;
+struct CustomOnRequest(bool);
 
 impl<B> OnRequest<B> for CustomOnRequest {
     #[inline]
@@ -62,6 +101,9 @@ impl<B> OnRequest<B> for CustomOnRequest {
         _request: &axum::http::Request<B>,
         span: &tracing::Span,
     ) {
+        if !self.0 {
+            return;
+        }
         let _guard = span.enter();
 
         tracing::info!(
@@ -135,6 +177,35 @@ impl ResponseForPanic for JsonPanicHandler {
     }
 }
 
+/// Answers the `OPTIONS` requests with the methods allowed by the route,
+/// and the other methods it does not allow with a JSON error. Both keep the
+/// `Allow` header set by the router. CORS preflights are answered before.
+async fn handle_method_not_allowed(req: Request, next: Next) -> Response {
+    let is_options = req.method() == Method::OPTIONS;
+
+    let res = next.run(req).await;
+    if res.status() != StatusCode::METHOD_NOT_ALLOWED {
+        return res;
+    }
+
+    let allow = res
+        .headers()
+        .get(header::ALLOW)
+        .and_then(|allow| allow.to_str().ok())
+        .and_then(|allow| {
+            HeaderValue::from_str(&format!("{allow},OPTIONS")).ok()
+        })
+        .unwrap_or(HeaderValue::from_static("OPTIONS"));
+
+    let mut res = if is_options {
+        StatusCode::NO_CONTENT.into_response()
+    } else {
+        DownloaderError::Http(HttpError::MethodNotAllowed).into_response()
+    };
+    res.headers_mut().insert(header::ALLOW, allow);
+    res
+}
+
 #[cfg(not(feature = "embed"))]
 async fn fallback_handler() -> Response {
     DownloaderError::Http(HttpError::RouteNotFound).into_response()
@@ -144,8 +215,6 @@ async fn fallback_handler() -> Response {
 async fn fallback_handler(req: axum::extract::Request) -> Response {
     use std::borrow::Cow;
 
-    use axum::http::StatusCode;
-
     const NO_CACHE_HEADER: &'static str =
         "no-cache, no-store, max-age=0, must-revalidate";
     const CACHE_HEADER: &'static str = "public, max-age=31536000";
@@ -212,18 +281,23 @@ async fn fallback_handler(req: axum::extract::Request) -> Response {
         .unwrap()
 }
 
-pub fn layer_root_router<S>(router: Router<S>) -> Router<S>
+pub fn layer_root_router<S>(
+    router: Router<S>,
+    access_log_format: AccessLogFormat,
+) -> Router<S>
 where
     S: Clone + Send + Sync + 'static,
 {
+    let default_logs = access_log_format == AccessLogFormat::Default;
+
     let layer = ServiceBuilder::new()
         .layer(SetSensitiveHeadersLayer::new(once(header::AUTHORIZATION)))
         .layer(RequestDecompressionLayer::new())
         .layer(
             TraceLayer::new_for_http()
                 .make_span_with(CustomMakeSpan)
-                .on_response(CustomOnResponse)
-                .on_request(CustomOnRequest)
+                .on_response(CustomOnResponse(default_logs))
+                .on_request(CustomOnRequest(default_logs))
                 .on_failure(CustomOnFailure),
         )
         .layer(SetResponseHeaderLayer::overriding(
@@ -232,7 +306,8 @@ where
         ))
         .layer(CatchPanicLayer::custom(JsonPanicHandler))
         .layer(CorsLayer::permissive().max_age(Duration::from_secs(86400)))
-        .layer(NormalizePathLayer::trim_trailing_slash());
+        .layer(NormalizePathLayer::trim_trailing_slash())
+        .layer(middleware::from_fn(handle_method_not_allowed));
 
     #[cfg(feature = "embed")]
     {
@@ -261,3 +336,2428 @@ where
         return router.fallback(routing::any(fallback_handler)).layer(layer);
     }
 }
+
+/// Sent by `/readyz` once every token issued before it was revoked.
+pub const TOKENS_REVOKED_BEFORE_HEADER: &str = "x-tokens-revoked-before";
+
+/// Reports whether requests can be served, which is not the case while the
+/// database is unreachable. Also tells since when tokens are accepted, if
+/// all of them were ever revoked.
+async fn readyz(
+    Extension(obj_repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(token_repo): Extension<Arc<TokenRepository>>,
+) -> Result<Response, DownloaderError> {
+    obj_repo.ping().await.map_err(|_| {
+        DownloaderError::Other(
+            "the database is unavailable".into(),
+            StatusCode::SERVICE_UNAVAILABLE,
+        )
+    })?;
+
+    let mut builder = Response::builder().status(StatusCode::NO_CONTENT);
+    if let Some(revoked_before) = token_repo.revoked_before() {
+        builder = builder
+            .header(TOKENS_REVOKED_BEFORE_HEADER, revoked_before.to_rfc3339());
+    }
+
+    builder.body(Body::empty()).map_err(DownloaderError::from)
+}
+
+/// Identifies the running build.
+async fn version() -> Json<BuildInfo> {
+    Json(BuildInfo::current())
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct MaintenanceStatusData {
+    pub enabled: bool,
+    #[serde(with = "duration_secs")]
+    pub retry_after: Duration,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SetMaintenanceRequestData {
+    pub enabled: bool,
+}
+
+fn maintenance_status(maintenance: &Maintenance) -> MaintenanceStatusData {
+    MaintenanceStatusData {
+        enabled: maintenance.is_enabled(),
+        retry_after: maintenance.retry_after(),
+    }
+}
+
+async fn get_maintenance(
+    Authorization(token): Authorization,
+    Extension(maintenance): Extension<Arc<Maintenance>>,
+) -> Result<Json<MaintenanceStatusData>, DownloaderError> {
+    if !token.permission().contains(Permission::ADMIN) {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    Ok(Json(maintenance_status(&maintenance)))
+}
+
+/// Enables or disables the maintenance, in which the writes are rejected.
+async fn set_maintenance(
+    Authorization(token): Authorization,
+    Extension(maintenance): Extension<Arc<Maintenance>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Json(data): Json<SetMaintenanceRequestData>,
+) -> Result<Json<MaintenanceStatusData>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+
+    let res = if token.permission().contains(Permission::ADMIN) {
+        let source = match actor.user_id {
+            Some(user_id) => format!("admin endpoint, by user {user_id}"),
+            None => "admin endpoint".into(),
+        };
+        maintenance.set(data.enabled, &source);
+        Ok(maintenance_status(&maintenance))
+    } else {
+        Err(DownloaderError::from(AuthError::AccessDenied))
+    };
+
+    audit.record(AuditEvent::new(
+        AuditAction::SetMaintenance,
+        actor,
+        None,
+        &res,
+    ));
+
+    res.map(Json)
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DbStatsResponseData {
+    #[serde(flatten)]
+    pub db: DbStats,
+    /// Http connections open at the moment.
+    pub http_connections: usize,
+    /// Zero if unlimited.
+    pub max_http_connections: usize,
+}
+
+/// Whether the database is reachable, and how many times it came back,
+/// along with the open http connections.
+async fn get_db_stats(
+    Authorization(token): Authorization,
+    Extension(db_health): Extension<Arc<DbHealth>>,
+    Extension(connections): Extension<Arc<ActiveConnections>>,
+) -> Result<Json<DbStatsResponseData>, DownloaderError> {
+    if !token.permission().contains(Permission::ADMIN) {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    Ok(Json(DbStatsResponseData {
+        db: db_health.stats(),
+        http_connections: connections.count(),
+        max_http_connections: connections.max(),
+    }))
+}
+
+/// Dependencies of the http application, each one shared with the
+/// handlers as an extension.
+pub struct AppDeps {
+    pub obj_repo: ObjectRepository<Sqlite>,
+    pub manager: Arc<ObjectManager>,
+    pub user_repo: UserRepository<Sqlite>,
+    pub token_repo: Arc<TokenRepository>,
+    pub db_health: Arc<DbHealth>,
+    pub throttle: Arc<Throttle>,
+    pub quotas: Arc<Quotas>,
+    pub maintenance: Arc<Maintenance>,
+    pub limiter: Arc<RequestLimiter>,
+    pub api_key_limiter: Arc<ApiKeyLimiter>,
+    pub timeouts: DownloadTimeouts,
+    pub download_backoff: Backoff,
+    pub idempotency: Arc<IdempotencyKeys>,
+    pub key_files: Arc<KeyFiles>,
+    pub audit: AuditLogger,
+    pub webhooks: Webhooks,
+    pub signup: SignupConfig,
+    pub security: Arc<SecurityHeaders>,
+    pub connections: Arc<ActiveConnections>,
+}
+
+const READYZ: RouteSpec =
+    RouteSpec::get("/readyz", "Reports whether requests can be served");
+const GET_VERSION: RouteSpec = RouteSpec::get("/version", "The running build")
+    .response(Content::Json(Schema::of::<BuildInfo>()));
+const GET_MAINTENANCE: RouteSpec =
+    RouteSpec::get("/api/maintenance", "Whether the writes are rejected")
+        .auth()
+        .response(Content::Json(Schema::of::<MaintenanceStatusData>()))
+        .errors(&[4009]);
+const SET_MAINTENANCE: RouteSpec =
+    RouteSpec::put("/api/maintenance", "Enables or disables the maintenance")
+        .auth()
+        .request(Content::Json(Schema::of::<SetMaintenanceRequestData>()))
+        .response(Content::Json(Schema::of::<MaintenanceStatusData>()))
+        .errors(&[4009]);
+const GET_DB_STATS: RouteSpec =
+    RouteSpec::get("/api/db/stats", "Health of the database")
+        .auth()
+        .response(Content::Json(Schema::Named("DbStatsResponseData")))
+        .errors(&[4009]);
+
+/// Builds the whole http application with its dependencies.
+pub fn app_router(
+    deps: AppDeps,
+    routes: &RoutesConfig,
+    access_log_format: AccessLogFormat,
+) -> Router {
+    let mut router = layer_root_router(
+        ApiRouter::new()
+            .route(GET_JWKS, get_jwks)
+            .route(READYZ, readyz)
+            .route(GET_VERSION, version)
+            .route(GET_MAINTENANCE, get_maintenance)
+            .route(SET_MAINTENANCE, set_maintenance)
+            .route(GET_DB_STATS, get_db_stats)
+            .nest("/api/file", file_routes(ApiRouter::new(), routes))
+            .nest("/api/auth", auth_routes(ApiRouter::new(), routes))
+            .nest("/api/user", user_routes(ApiRouter::new(), routes))
+            .into_router(),
+        access_log_format,
+    );
+
+    router = router
+        .layer(middleware::from_fn(reject_writes))
+        .layer(middleware::from_fn(limit_requests))
+        .layer(middleware::from_fn(set_security_headers));
+
+    if access_log_format == AccessLogFormat::Combined {
+        router = router.layer(middleware::from_fn(combined_access_log));
+    }
+
+    let AppDeps {
+        obj_repo,
+        manager,
+        user_repo,
+        token_repo,
+        db_health,
+        throttle,
+        quotas,
+        maintenance,
+        limiter,
+        api_key_limiter,
+        timeouts,
+        download_backoff,
+        idempotency,
+        key_files,
+        audit,
+        webhooks,
+        signup,
+        security,
+        connections,
+    } = deps;
+
+    router
+        .layer(Extension(obj_repo))
+        .layer(Extension(manager))
+        .layer(Extension(user_repo))
+        .layer(Extension(token_repo))
+        .layer(Extension(db_health))
+        .layer(Extension(throttle))
+        .layer(Extension(quotas))
+        .layer(Extension(maintenance))
+        .layer(Extension(limiter))
+        .layer(Extension(api_key_limiter))
+        .layer(Extension(timeouts))
+        .layer(Extension(download_backoff))
+        .layer(Extension(Arc::new(UploadProgress::new())))
+        .layer(Extension(idempotency))
+        .layer(Extension(key_files))
+        .layer(Extension(audit))
+        .layer(Extension(webhooks))
+        .layer(Extension(signup))
+        .layer(Extension(security))
+        .layer(Extension(connections))
+        .layer(DefaultBodyLimit::max(MAX_JSON_BODY_SIZE))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{io, sync::Arc, time::Duration};
+
+    use axum::{
+        body::{to_bytes, Body},
+        http::{header, HeaderValue, Method, Request, StatusCode},
+        Router,
+    };
+    use bytes::Bytes;
+    use chrono::{TimeDelta, Utc};
+    use futures_util::{stream, StreamExt};
+    use serde_json::{json, Value};
+    use sha2::{Digest, Sha256};
+    use sqlx::{migrate, SqlitePool};
+    use tempfile::TempDir;
+    use test_log::test;
+    use tokio::sync::oneshot;
+    use tower::ServiceExt;
+    use uuid::Uuid;
+
+    use crate::{
+        auth::{
+            client_cert::ClientCert,
+            repository::tests::repository,
+            routes::{KeyFiles, SignupConfig},
+            Permission, ServiceToken,
+        },
+        config::{AccessLogFormat, RoutesConfig, TokenAlgorithm},
+        storage::{
+            backend::LocalStorage, idempotency::IdempotencyKeys,
+            manager::ObjectManager, quota::Quotas,
+            repository::ObjectRepository, throttle::Throttle,
+            timeout::DownloadTimeouts,
+        },
+        user::{repository::UserRepository, UserData},
+        utils::{
+            audit::AuditLogger,
+            db::DbHealth,
+            extractors::MAX_JSON_BODY_SIZE,
+            limit::{ApiKeyLimiter, RequestLimiter},
+            maintenance::Maintenance,
+            retry::Backoff,
+            security::SecurityHeaders,
+            webhook::Webhooks,
+        },
+    };
+
+    use super::{app_router, AppDeps, TOKENS_REVOKED_BEFORE_HEADER};
+
+    struct TestApp {
+        router: Router,
+        token: String,
+        other_token: String,
+        admin_token: String,
+        _dirs: (TempDir, TempDir),
+    }
+
+    async fn app() -> TestApp {
+        app_with_routes(&RoutesConfig::default()).await
+    }
+
+    async fn app_with_routes(routes: &RoutesConfig) -> TestApp {
+        let db = SqlitePool::connect("sqlite::memory:").await.unwrap();
+        migrate!().run(&db).await.unwrap();
+
+        let data_dir = tempfile::tempdir().unwrap();
+        let temp_dir = tempfile::tempdir().unwrap();
+        let manager = ObjectManager::with_storage(
+            LocalStorage::new(
+                vec![data_dir.path().to_owned()],
+                temp_dir.path().to_owned(),
+                0,
+            ),
+            None,
+        );
+
+        let obj_repo = ObjectRepository::new(db.clone());
+        let user_repo = UserRepository::new(db, 4);
+
+        // Backed by stored users, as the uploads are charged to them
+        let token_repo = Arc::new(repository());
+        let mut tokens = Vec::new();
+        for (username, permission) in [
+            ("user", Permission::UNPRIVILEGED),
+            ("other", Permission::UNPRIVILEGED),
+            ("admin", Permission::ADMIN),
+        ] {
+            let user = user_repo
+                .create(
+                    permission,
+                    UserData {
+                        username: username.into(),
+                        password: "password".into(),
+                    },
+                )
+                .await
+                .unwrap();
+            tokens.push(
+                token_repo
+                    .generate_user_token(
+                        user.id,
+                        permission,
+                        user.username,
+                        None,
+                    )
+                    .unwrap(),
+            );
+        }
+        let [token, other_token, admin_token] = tokens.try_into().unwrap();
+
+        let token_cert = temp_dir.path().join("jwt-cert.pem");
+        let token_key = temp_dir.path().join("jwt-key.pem");
+        std::fs::write(&token_cert, "test").unwrap();
+
+        let quotas = Quotas::new(
+            Default::default(),
+            user_repo.clone(),
+            obj_repo.clone(),
+        );
+
+        let router = app_router(
+            AppDeps {
+                obj_repo,
+                manager: Arc::new(manager),
+                user_repo,
+                token_repo,
+                db_health: DbHealth::new(),
+                throttle: Arc::new(Throttle::new(Default::default())),
+                quotas: Arc::new(quotas),
+                maintenance: Arc::new(Maintenance::new(
+                    false,
+                    Duration::from_secs(30),
+                )),
+                limiter: Arc::new(RequestLimiter::new(0, Duration::ZERO)),
+                api_key_limiter: Arc::new(ApiKeyLimiter::new(0)),
+                timeouts: DownloadTimeouts::default(),
+                download_backoff: Backoff::default(),
+                idempotency: Arc::new(IdempotencyKeys::new(
+                    Duration::from_secs(60),
+                )),
+                key_files: Arc::new(KeyFiles::new(
+                    token_cert.to_string_lossy().into(),
+                    token_key.to_string_lossy().into(),
+                    TokenAlgorithm::EdDSA,
+                )),
+                audit: AuditLogger::disabled(),
+                webhooks: Webhooks::disabled(),
+                signup: SignupConfig::default(),
+                security: Arc::new(SecurityHeaders::from_config(
+                    &Default::default(),
+                    false,
+                )),
+                connections: Arc::default(),
+            },
+            routes,
+            AccessLogFormat::Default,
+        );
+
+        TestApp {
+            router,
+            token,
+            other_token,
+            admin_token,
+            _dirs: (data_dir, temp_dir),
+        }
+    }
+
+    async fn send(
+        app: &TestApp,
+        req: Request<Body>,
+    ) -> (StatusCode, axum::body::Bytes) {
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        let status = res.status();
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+
+        (status, body)
+    }
+
+    fn request(
+        method: Method,
+        uri: &str,
+        token: Option<&str>,
+        body: impl Into<Body>,
+    ) -> Request<Body> {
+        let mut req = Request::builder().method(method).uri(uri);
+        if let Some(token) = token {
+            req = req.header(header::AUTHORIZATION, format!("Bearer {token}"));
+        }
+        req.body(body.into()).unwrap()
+    }
+
+    fn json_request(
+        method: Method,
+        uri: &str,
+        token: Option<&str>,
+        body: Value,
+    ) -> Request<Body> {
+        let mut req = request(method, uri, token, body.to_string());
+        req.headers_mut().insert(
+            header::CONTENT_TYPE,
+            HeaderValue::from_static("application/json"),
+        );
+        req
+    }
+
+    #[test(tokio::test)]
+    async fn test_upload_download_delete() {
+        let app = app().await;
+        let data = Uuid::new_v4().to_string().repeat(1024);
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                data.clone(),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let id = object["id"].as_str().unwrap().to_owned();
+
+        assert_eq!(
+            object["data"]["checksum_256"].as_str().unwrap(),
+            hex::encode(Sha256::digest(data.as_bytes())),
+        );
+
+        let uri = format!("/api/file/{id}/data");
+
+        let (status, body) =
+            send(&app, request(Method::GET, &uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(body, data.as_bytes());
+
+        let (status, _) =
+            send(&app, request(Method::GET, &uri, None, ())).await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+
+        let (status, _) =
+            send(&app, request(Method::GET, &uri, Some("invalid"), ())).await;
+        assert_eq!(status, StatusCode::UNAUTHORIZED);
+
+        let (status, _) =
+            send(&app, request(Method::GET, &uri, Some(&app.other_token), ()))
+                .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, _) = send(
+            &app,
+            request(
+                Method::DELETE,
+                &format!("/api/file/{id}"),
+                Some(&app.other_token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, _) = send(
+            &app,
+            request(
+                Method::DELETE,
+                &format!("/api/file/{id}"),
+                Some(&app.token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let (status, _) =
+            send(&app, request(Method::GET, &uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::NOT_FOUND);
+    }
+
+    #[test(tokio::test)]
+    async fn test_upload_idempotency_key() {
+        let app = app().await;
+        let key = Uuid::new_v4().to_string();
+
+        let upload = |token: &str, data: &'static str| {
+            let mut req = request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(token),
+                data,
+            );
+            req.headers_mut().insert(
+                "idempotency-key",
+                HeaderValue::from_str(&key).unwrap(),
+            );
+            req
+        };
+
+        let (status, body) = send(&app, upload(&app.token, "first")).await;
+        assert_eq!(status, StatusCode::OK);
+        let first: Value = serde_json::from_slice(&body).unwrap();
+
+        let (status, body) = send(&app, upload(&app.token, "second")).await;
+        assert_eq!(status, StatusCode::OK);
+        let retry: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(retry, first, "retry created another object");
+
+        let (status, body) =
+            send(&app, upload(&app.other_token, "other")).await;
+        assert_eq!(status, StatusCode::OK);
+        let other: Value = serde_json::from_slice(&body).unwrap();
+        assert_ne!(other["id"], first["id"], "key shared between users");
+    }
+
+    #[test(tokio::test)]
+    async fn test_upload_checksum() {
+        let app = app().await;
+
+        let upload = |checksum: &str| {
+            let mut req = request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                "data",
+            );
+            req.headers_mut().insert(
+                "x-checksum-sha256",
+                HeaderValue::from_str(checksum).unwrap(),
+            );
+            req
+        };
+
+        let other = hex::encode(Sha256::digest(b"other"));
+        let (status, body) = send(&app, upload(&other)).await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(body["error_code"], 2006);
+
+        let stored = std::fs::read_dir(app._dirs.0.path())
+            .unwrap()
+            .filter(|entry| entry.as_ref().unwrap().path().is_file())
+            .count();
+        assert_eq!(stored, 0, "file with a wrong checksum was stored");
+
+        let (status, _) = send(&app, upload("not hex")).await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+
+        let checksum = hex::encode(Sha256::digest(b"data"));
+        let (status, body) = send(&app, upload(&checksum)).await;
+        assert_eq!(status, StatusCode::OK);
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(object["data"]["checksum_256"], checksum);
+    }
+
+    #[test(tokio::test)]
+    async fn test_maintenance() {
+        let app = app().await;
+        let set = |token: &str, enabled: bool| {
+            json_request(
+                Method::PUT,
+                "/api/maintenance",
+                Some(token),
+                json!({ "enabled": enabled }),
+            )
+        };
+        let upload = || {
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                "data",
+            )
+        };
+
+        let (status, body) = send(&app, upload()).await;
+        assert_eq!(status, StatusCode::OK);
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let id = object["id"].as_str().unwrap().to_owned();
+
+        let (status, _) = send(&app, set(&app.token, true)).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, body) = send(&app, set(&app.admin_token, true)).await;
+        assert_eq!(status, StatusCode::OK);
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(body, json!({ "enabled": true, "retry_after": 30 }));
+
+        let res = app.router.clone().oneshot(upload()).await.unwrap();
+        assert_eq!(res.status(), StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(res.headers()[header::RETRY_AFTER], "30");
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(body["error_code"], 99006);
+
+        let uri = format!("/api/file/{id}");
+        let (status, _) =
+            send(&app, request(Method::DELETE, &uri, Some(&app.token), ()))
+                .await;
+        assert_eq!(status, StatusCode::SERVICE_UNAVAILABLE);
+
+        // Reads are still served
+        let (status, body) = send(
+            &app,
+            request(Method::GET, &format!("{uri}/data"), Some(&app.token), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(body, "data");
+
+        let (status, _) = send(&app, set(&app.admin_token, false)).await;
+        assert_eq!(status, StatusCode::OK);
+
+        let (status, _) =
+            send(&app, request(Method::DELETE, &uri, Some(&app.token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+    }
+
+    #[test(tokio::test)]
+    async fn test_upload_link() {
+        let app = app().await;
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/file/upload-link",
+                Some(&app.token),
+                json!({ "name": "file.txt", "duration": 60 }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let link: Value = serde_json::from_slice(&body).unwrap();
+        let id = link["file"]["id"].as_str().unwrap().to_owned();
+        assert_eq!(link["file"]["data"]["size"], 0);
+
+        let token = link["token"].as_str().unwrap();
+        let uri = format!("{}&name=file.txt", link["url"].as_str().unwrap());
+
+        // The link can't read or change anything else
+        let (status, _) = send(
+            &app,
+            request(Method::GET, &format!("/api/file/{id}"), Some(token), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+        let (status, _) = send(
+            &app,
+            request(
+                Method::DELETE,
+                &format!("/api/file/{id}"),
+                Some(token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        // A failed upload doesn't spend the link
+        let body = stream::iter([
+            Ok(Bytes::from_static(b"partial")),
+            Err(io::Error::other("connection reset")),
+        ]);
+        let (status, _) = send(
+            &app,
+            request(Method::PUT, &uri, None, Body::from_stream(body)),
+        )
+        .await;
+        assert_ne!(status, StatusCode::OK);
+
+        let (status, body) =
+            send(&app, request(Method::PUT, &uri, None, "data")).await;
+        assert_eq!(status, StatusCode::OK);
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(object["id"], id.as_str());
+        assert_eq!(object["data"]["size"], 4);
+
+        // Used links are rejected
+        let (status, _) =
+            send(&app, request(Method::PUT, &uri, None, "other")).await;
+        assert_eq!(status, StatusCode::UNAUTHORIZED);
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::GET,
+                &format!("/api/file/{id}/data"),
+                Some(&app.token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(body, "data");
+    }
+
+    #[test(tokio::test)]
+    async fn test_concurrent_update() {
+        let app = app().await;
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                "initial",
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let id = object["id"].as_str().unwrap().to_owned();
+        let uri = format!("/api/file/{id}/data?name=file.txt");
+
+        // The first update stays in progress until released
+        let (started_tx, started_rx) = oneshot::channel();
+        let (release_tx, release_rx) = oneshot::channel::<()>();
+        let body = stream::once(async move {
+            let _ = started_tx.send(());
+            Ok::<_, io::Error>(Bytes::from_static(b"first "))
+        })
+        .chain(stream::once(async move {
+            let _ = release_rx.await;
+            Ok(Bytes::from_static(b"writer"))
+        }));
+        let first = tokio::spawn(app.router.clone().oneshot(request(
+            Method::PUT,
+            &uri,
+            Some(&app.token),
+            Body::from_stream(body),
+        )));
+        started_rx.await.unwrap();
+
+        let (status, body) = send(
+            &app,
+            request(Method::PUT, &uri, Some(&app.token), "second writer"),
+        )
+        .await;
+        assert_eq!(status, StatusCode::CONFLICT);
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(body["error_code"], 2010);
+
+        let (status, _) = send(
+            &app,
+            request(
+                Method::DELETE,
+                &format!("/api/file/{id}"),
+                Some(&app.token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::CONFLICT);
+
+        release_tx.send(()).unwrap();
+        let res = first.await.unwrap().unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::GET,
+                &format!("/api/file/{id}/data"),
+                Some(&app.token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(body, "first writer");
+    }
+
+    #[test(tokio::test)]
+    async fn test_readyz() {
+        let app = app().await;
+
+        let (status, _) =
+            send(&app, request(Method::GET, "/readyz", None, ())).await;
+        assert_eq!(status, StatusCode::NO_CONTENT);
+    }
+
+    #[test(tokio::test)]
+    async fn test_revoke_all_tokens() {
+        let app = app().await;
+        let uri = "/api/auth/tokens/revoke";
+
+        let (status, _) =
+            send(&app, request(Method::POST, uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, _) =
+            send(&app, request(Method::POST, uri, Some(&app.admin_token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+
+        for token in [&app.token, &app.admin_token] {
+            let (status, _) = send(
+                &app,
+                request(Method::GET, "/api/auth/self", Some(token), ()),
+            )
+            .await;
+            assert_eq!(status, StatusCode::UNAUTHORIZED);
+        }
+
+        let req = request(Method::GET, "/readyz", None, ());
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        assert_eq!(res.status(), StatusCode::NO_CONTENT);
+        assert!(res.headers().contains_key(TOKENS_REVOKED_BEFORE_HEADER));
+    }
+
+    #[test(tokio::test)]
+    async fn test_disabled_routes() {
+        let app = app_with_routes(&RoutesConfig {
+            signup: false,
+            upload: false,
+            delete: false,
+        })
+        .await;
+        let id = Uuid::new_v4();
+
+        let signup = json!({ "username": "someone", "password": "password" });
+        let (status, _) = send(
+            &app,
+            json_request(Method::POST, "/api/auth/signup", None, signup),
+        )
+        .await;
+        assert_eq!(status, StatusCode::NOT_FOUND);
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/file/delete",
+                Some(&app.token),
+                json!({ "ids": [id] }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::NOT_FOUND);
+
+        // Also unknown in the paths still served for other methods
+        let uri = format!("/api/file/{id}/data");
+        let (status, _) =
+            send(&app, request(Method::PUT, &uri, Some(&app.token), "data"))
+                .await;
+        assert_eq!(status, StatusCode::NOT_FOUND);
+
+        let (status, _) = send(
+            &app,
+            request(Method::DELETE, "/api/user/self", Some(&app.token), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::NOT_FOUND);
+
+        let (status, _) = send(
+            &app,
+            request(Method::POST, "/api/file", Some(&app.token), "data"),
+        )
+        .await;
+        assert_eq!(status, StatusCode::NOT_FOUND);
+
+        // Methods never served by a path are still not allowed
+        let (status, _) =
+            send(&app, request(Method::PATCH, &uri, Some(&app.token), "data"))
+                .await;
+        assert_eq!(status, StatusCode::METHOD_NOT_ALLOWED);
+
+        let (status, _) = send(
+            &app,
+            request(Method::GET, "/api/file", Some(&app.token), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        // And left out of the document
+        let (status, body) =
+            send(&app, request(Method::GET, "/openapi.json", None, ())).await;
+        assert_eq!(status, StatusCode::OK);
+
+        let document: Value = serde_json::from_slice(&body).unwrap();
+        let paths = &document["paths"];
+        assert!(paths["/api/auth/signup"].is_null());
+        assert!(paths["/api/file/{id}/data"]["put"].is_null());
+        assert!(paths["/api/file/{id}/data"]["get"].is_object());
+        assert!(paths["/api/user/self"]["delete"].is_null());
+    }
+
+    #[test(tokio::test)]
+    async fn test_openapi() {
+        let app = app().await;
+
+        let (status, body) =
+            send(&app, request(Method::GET, "/openapi.json", None, ())).await;
+        assert_eq!(status, StatusCode::OK);
+
+        let document: Value = serde_json::from_slice(&body).unwrap();
+        let error_codes = document
+            .pointer(
+                "/components/schemas/ErrorResponse/properties/error_code/enum",
+            )
+            .and_then(Value::as_array)
+            .unwrap();
+        assert!(error_codes.contains(&json!(2008)));
+
+        let paths = document["paths"].as_object().unwrap();
+        assert!(paths.contains_key("/api/file"));
+        assert!(paths.contains_key("/api/auth/login"));
+        assert!(paths.contains_key("/openapi.json"));
+
+        let id = Uuid::nil().to_string();
+        let methods = [
+            Method::GET,
+            Method::POST,
+            Method::PUT,
+            Method::PATCH,
+            Method::DELETE,
+        ];
+
+        // Every documented route is served, and the methods of the paths
+        // that are not documented are not allowed
+        for (path, operations) in paths {
+            let uri = path
+                .replace("{id}", &id)
+                .replace("{user_id}", &id)
+                .replace("{name}", "file.txt");
+
+            for method in &methods {
+                let operation = &operations[method.as_str().to_lowercase()];
+                let (status, body) =
+                    send(&app, request(method.clone(), &uri, None, ())).await;
+
+                if operation.is_null() {
+                    assert_eq!(
+                        status,
+                        StatusCode::METHOD_NOT_ALLOWED,
+                        "{method} {path} is served but not documented",
+                    );
+                    continue;
+                }
+
+                let error_code = serde_json::from_slice::<Value>(&body)
+                    .ok()
+                    .and_then(|body| body["error_code"].as_u64());
+                assert_ne!(
+                    status,
+                    StatusCode::METHOD_NOT_ALLOWED,
+                    "{method} {path} is documented but not served",
+                );
+                assert_ne!(
+                    error_code,
+                    Some(99100),
+                    "{method} {path} is documented but not served",
+                );
+
+                let responses = operation["responses"].as_object().unwrap();
+                for response in responses.values() {
+                    let codes = response
+                        .pointer(
+                            "/content/application~1json/schema/allOf/1/properties/error_code/enum",
+                        )
+                        .and_then(Value::as_array);
+                    for code in codes.into_iter().flatten() {
+                        assert!(
+                            error_codes.contains(code),
+                            "{method} {path} answers the unknown code {code}",
+                        );
+                    }
+                }
+            }
+        }
+    }
+
+    #[test(tokio::test)]
+    async fn test_version() {
+        let app = app().await;
+
+        let (status, body) =
+            send(&app, request(Method::GET, "/version", None, ())).await;
+        assert_eq!(status, StatusCode::OK);
+
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(body["version"], env!("CARGO_PKG_VERSION"));
+        assert!(body["git_commit"].is_string());
+        assert!(body["build_date"].is_string());
+    }
+
+    #[test(tokio::test)]
+    async fn test_rotate_signing_key() {
+        let app = app().await;
+        let rotate = |token: &str| {
+            request(Method::POST, "/api/auth/keys/rotate", Some(token), ())
+        };
+
+        let (status, _) = send(&app, rotate(&app.token)).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, body) = send(&app, rotate(&app.admin_token)).await;
+        assert_eq!(status, StatusCode::OK);
+
+        let res: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(res["previous_kid"], "test");
+        let previous_cert = res["previous_cert"].as_str().unwrap();
+        assert_eq!(std::fs::read_to_string(previous_cert).unwrap(), "test");
+
+        let (status, body) = send(
+            &app,
+            request(Method::GET, "/.well-known/jwks.json", None, ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let jwks: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(jwks["keys"][0]["kid"], res["kid"]);
+
+        // Tokens signed with the previous key are still accepted
+        let (status, _) = send(
+            &app,
+            request(Method::GET, "/api/auth/self", Some(&app.admin_token), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+    }
+
+    #[test(tokio::test)]
+    async fn test_body_limits() {
+        let app = app().await;
+        let data = "a".repeat(MAX_JSON_BODY_SIZE + 1);
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                None,
+                json!({
+                    "username": Uuid::new_v4().simple().to_string(),
+                    "password": data,
+                }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::PAYLOAD_TOO_LARGE);
+
+        // Uploads are not held to the JSON limit
+        let (status, _) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                data.repeat(4),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+    }
+
+    #[test(tokio::test)]
+    async fn test_download_missing_file() {
+        let app = app().await;
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                "data",
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let uri = format!("/api/file/{}/data", object["id"].as_str().unwrap());
+
+        for entry in std::fs::read_dir(app._dirs.0.path()).unwrap() {
+            let path = entry.unwrap().path();
+            if path.is_file() {
+                std::fs::remove_file(path).unwrap();
+            }
+        }
+
+        let (status, body) =
+            send(&app, request(Method::GET, &uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::INTERNAL_SERVER_ERROR);
+
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(body["error_code"], 2005);
+    }
+
+    #[test(tokio::test)]
+    async fn test_share_not_before() {
+        let app = app().await;
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                "data",
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let uri = format!("/api/file/{}/share", object["id"].as_str().unwrap());
+        let share = |not_before: &str| {
+            json_request(
+                Method::POST,
+                &uri,
+                Some(&app.token),
+                json!({ "not_before": not_before }),
+            )
+        };
+
+        let (status, _) = send(&app, share("9999-12-31T23:59:59Z")).await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+
+        let in_a_minute = (Utc::now() + TimeDelta::minutes(1)).to_rfc3339();
+        let (status, _) = send(&app, share(&in_a_minute)).await;
+        assert_eq!(status, StatusCode::OK);
+    }
+
+    #[test(tokio::test)]
+    async fn test_download_range() {
+        let app = app().await;
+        let data = Uuid::new_v4().to_string().repeat(64);
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                data.clone(),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let uri = format!("/api/file/{}/data", object["id"].as_str().unwrap());
+
+        let mut req = request(Method::GET, &uri, Some(&app.token), ());
+        req.headers_mut()
+            .insert(header::RANGE, HeaderValue::from_static("bytes=10-19"));
+
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        assert_eq!(res.status(), StatusCode::PARTIAL_CONTENT);
+        assert_eq!(
+            res.headers()[header::CONTENT_RANGE],
+            format!("bytes 10-19/{}", data.len()),
+        );
+        assert!(
+            !res.headers().contains_key("x-checksum-sha256"),
+            "sent the whole file checksum with a partial body",
+        );
+
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+        assert_eq!(body, data.as_bytes()[10..20]);
+
+        let mut req = request(Method::GET, &uri, Some(&app.token), ());
+        req.headers_mut()
+            .insert(header::RANGE, HeaderValue::from_static("bytes=100000-"));
+
+        let (status, _) = send(&app, req).await;
+        assert_eq!(status, StatusCode::RANGE_NOT_SATISFIABLE);
+
+        // The range is only honored while the file is the one the client
+        // started downloading
+        let etag = hex::encode(Sha256::digest(data.as_bytes()));
+        for (if_range, expected) in [
+            (format!("\"{etag}\""), StatusCode::PARTIAL_CONTENT),
+            ("\"outdated\"".to_owned(), StatusCode::OK),
+        ] {
+            let mut req = request(Method::GET, &uri, Some(&app.token), ());
+            req.headers_mut()
+                .insert(header::RANGE, HeaderValue::from_static("bytes=10-19"));
+            req.headers_mut().insert(
+                header::IF_RANGE,
+                HeaderValue::from_str(&if_range).unwrap(),
+            );
+
+            let (status, body) = send(&app, req).await;
+            assert_eq!(status, expected, "{if_range}");
+            if status == StatusCode::OK {
+                assert_eq!(body, data.as_bytes());
+            }
+        }
+
+        let req = request(Method::GET, &uri, Some(&app.token), ());
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+        assert_eq!(
+            res.headers()["x-checksum-sha256"],
+            hex::encode(Sha256::digest(data.as_bytes())),
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_stream_files() {
+        let app = app().await;
+
+        let mut ids = Vec::new();
+        for _ in 0..3 {
+            let (status, body) = send(
+                &app,
+                request(
+                    Method::POST,
+                    "/api/file?name=file.txt",
+                    Some(&app.token),
+                    "data",
+                ),
+            )
+            .await;
+            assert_eq!(status, StatusCode::OK);
+            let object: Value = serde_json::from_slice(&body).unwrap();
+            ids.push(object["id"].as_str().unwrap().to_owned());
+        }
+        ids.sort();
+
+        let (status, _) = send(
+            &app,
+            request(Method::GET, "/api/file/stream", Some(&app.token), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let req = request(
+            Method::GET,
+            "/api/file/stream",
+            Some(&app.admin_token),
+            (),
+        );
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+        assert_eq!(res.headers()[header::CONTENT_TYPE], "application/json");
+
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+        let objects: Vec<Value> = serde_json::from_slice(&body).unwrap();
+        let streamed = objects
+            .iter()
+            .map(|object| object["id"].as_str().unwrap())
+            .collect::<Vec<_>>();
+        assert_eq!(streamed, ids);
+    }
+
+    #[test(tokio::test)]
+    async fn test_default_content_type() {
+        let app = app().await;
+
+        let upload = |body: &'static [u8]| {
+            request(Method::POST, "/api/file?name=file", Some(&app.token), body)
+        };
+
+        // Uploads without a type get the detected one, or the default
+        let (status, body) = send(&app, upload(b"some text")).await;
+        assert_eq!(status, StatusCode::OK);
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(object["data"]["mime_type"], "text/plain");
+
+        let (status, body) = send(&app, upload(b"\x00\x01\x02")).await;
+        assert_eq!(status, StatusCode::OK);
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(object["data"]["mime_type"], "application/octet-stream");
+
+        let id = object["id"].as_str().unwrap();
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::PUT,
+                &format!("/api/file/{id}"),
+                Some(&app.token),
+                json!({ "name": "file", "mime_type": "" }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        // Stored files without a type are sent with the default one
+        let uri = format!("/api/file/{id}/data");
+        let req = request(Method::GET, &uri, Some(&app.token), ());
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+        assert_eq!(
+            res.headers()[header::CONTENT_TYPE],
+            "application/octet-stream",
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_download_multiple_ranges() {
+        let app = app().await;
+        let data = Uuid::new_v4().to_string().repeat(64);
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                data.clone(),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let uri = format!("/api/file/{}/data", object["id"].as_str().unwrap());
+
+        let mut req = request(Method::GET, &uri, Some(&app.token), ());
+        req.headers_mut().insert(
+            header::RANGE,
+            HeaderValue::from_static("bytes=30-39,0-4,3-9"),
+        );
+
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        assert_eq!(res.status(), StatusCode::PARTIAL_CONTENT);
+        assert!(!res.headers().contains_key(header::CONTENT_RANGE));
+
+        let content_type =
+            res.headers()[header::CONTENT_TYPE].to_str().unwrap();
+        let boundary = content_type
+            .strip_prefix("multipart/byteranges; boundary=")
+            .unwrap()
+            .to_owned();
+        let len: usize = res.headers()[header::CONTENT_LENGTH]
+            .to_str()
+            .unwrap()
+            .parse()
+            .unwrap();
+
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+        assert_eq!(body.len(), len);
+
+        // The overlapping ranges are sent as one part
+        let size = data.len();
+        let mime_type = object["data"]["mime_type"].as_str().unwrap();
+        let expected = format!(
+            "--{boundary}\r\n\
+            Content-Type: {mime_type}\r\n\
+            Content-Range: bytes 0-9/{size}\r\n\r\n\
+            {}\r\n\
+            --{boundary}\r\n\
+            Content-Type: {mime_type}\r\n\
+            Content-Range: bytes 30-39/{size}\r\n\r\n\
+            {}\r\n\
+            --{boundary}--\r\n",
+            &data[0..10],
+            &data[30..40],
+        );
+        assert_eq!(body, expected);
+    }
+
+    #[test(tokio::test)]
+    async fn test_download_named() {
+        let app = app().await;
+        let data = Uuid::new_v4().to_string();
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=my%20report.txt",
+                Some(&app.token),
+                data.clone(),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let uri = format!("/api/file/{}/data", object["id"].as_str().unwrap());
+
+        let req = request(
+            Method::GET,
+            &format!("{uri}/my%20report.txt"),
+            Some(&app.token),
+            (),
+        );
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+        assert_eq!(
+            res.headers()[header::CONTENT_DISPOSITION],
+            "attachment; filename=\"my report.txt\"",
+        );
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+        assert_eq!(body, data.as_bytes());
+
+        let (status, _) = send(
+            &app,
+            request(
+                Method::GET,
+                &format!("{uri}/other.txt"),
+                Some(&app.token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::NOT_FOUND);
+
+        // The right name doesn't grant any access
+        let (status, _) = send(
+            &app,
+            request(
+                Method::GET,
+                &format!("{uri}/my%20report.txt"),
+                Some(&app.other_token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+    }
+
+    #[test(tokio::test)]
+    async fn test_download_archive() {
+        let app = app().await;
+
+        let mut ids = Vec::new();
+        for (token, data) in [
+            (&app.token, "first"),
+            (&app.token, "second"),
+            (&app.other_token, "other"),
+        ] {
+            let (status, body) = send(
+                &app,
+                request(
+                    Method::POST,
+                    "/api/file?name=file.txt",
+                    Some(token),
+                    data,
+                ),
+            )
+            .await;
+            assert_eq!(status, StatusCode::OK);
+
+            let object: Value = serde_json::from_slice(&body).unwrap();
+            ids.push(object["id"].as_str().unwrap().to_owned());
+        }
+        let missing = Uuid::new_v4().to_string();
+        ids.push(missing.clone());
+        // Repeated ids are only included once
+        ids.push(ids[0].clone());
+
+        let req = json_request(
+            Method::POST,
+            "/api/file/archive?format=tar",
+            Some(&app.token),
+            serde_json::to_value(&ids).unwrap(),
+        );
+        let res = app.router.clone().oneshot(req).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+        assert_eq!(res.headers()[header::CONTENT_TYPE], "application/x-tar");
+        assert_eq!(
+            res.headers()[header::CONTENT_DISPOSITION],
+            "attachment; filename=\"files.tar\"",
+        );
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+
+        let mut entries = Vec::new();
+        let mut offset = 0;
+        while body[offset] != 0 {
+            let header = &body[offset..offset + 512];
+            let name_len = header.iter().position(|&b| b == 0).unwrap();
+            let name = String::from_utf8(header[..name_len].to_vec()).unwrap();
+            let size = std::str::from_utf8(&header[124..135]).unwrap();
+            let size = usize::from_str_radix(size, 8).unwrap();
+
+            offset += 512;
+            entries.push((name, body[offset..offset + size].to_vec()));
+            offset += size.div_ceil(512) * 512;
+        }
+
+        assert_eq!(entries.len(), 3);
+        assert_eq!(entries[0], ("file.txt".to_owned(), b"first".to_vec()));
+        assert_eq!(entries[1], ("file (1).txt".to_owned(), b"second".to_vec()));
+        assert_eq!(entries[2].0, "manifest.json");
+
+        let manifest: Value = serde_json::from_slice(&entries[2].1).unwrap();
+        let statuses: Vec<_> = manifest
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|entry| entry["status"].as_str().unwrap())
+            .collect();
+        assert_eq!(
+            statuses,
+            ["included", "included", "forbidden", "not_found"],
+        );
+        assert_eq!(manifest[3]["id"], missing);
+    }
+
+    #[test(tokio::test)]
+    async fn test_signup_with_invite() {
+        let app = app().await;
+        let signup = |invite_code: Option<&str>| {
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                None,
+                json!({
+                    "username": Uuid::new_v4().simple().to_string(),
+                    "password": "password",
+                    "invite_code": invite_code,
+                }),
+            )
+        };
+
+        let (status, _) = send(&app, signup(None)).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, _) = send(&app, signup(Some("unknown"))).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/invite",
+                Some(&app.token),
+                json!({}),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        // Bounded by the max token duration
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/invite",
+                Some(&app.admin_token),
+                json!({ "duration": u64::MAX }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/invite",
+                Some(&app.admin_token),
+                json!({}),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let invite: Value = serde_json::from_slice(&body).unwrap();
+        let code = invite["code"].as_str().unwrap();
+
+        let (status, _) = send(&app, signup(Some(code))).await;
+        assert_eq!(status, StatusCode::OK);
+
+        let (status, _) = send(&app, signup(Some(code))).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+    }
+
+    #[test(tokio::test)]
+    async fn test_sessions() {
+        let app = app().await;
+        let username = Uuid::new_v4().simple().to_string();
+        let credentials =
+            json!({ "username": username, "password": "password" });
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                Some(&app.admin_token),
+                credentials.clone(),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let mut tokens = Vec::new();
+        for _ in 0..3 {
+            let mut req = json_request(
+                Method::POST,
+                "/api/auth/login",
+                None,
+                credentials.clone(),
+            );
+            req.headers_mut()
+                .insert(header::USER_AGENT, HeaderValue::from_static("test"));
+
+            let (status, body) = send(&app, req).await;
+            assert_eq!(status, StatusCode::OK);
+            let body: Value = serde_json::from_slice(&body).unwrap();
+            tokens.push(body["token"].as_str().unwrap().to_owned());
+        }
+
+        let (status, body) = send(
+            &app,
+            request(Method::GET, "/api/auth/sessions", Some(&tokens[0]), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        // Also counts the session started by the signup
+        let sessions = body["sessions"].as_array().unwrap();
+        assert_eq!(sessions.len(), 4);
+        let with_agent = sessions
+            .iter()
+            .filter(|session| session["user_agent"] == "test")
+            .count();
+        assert_eq!(with_agent, 3);
+
+        let current = body["current"].as_str().unwrap();
+        let other = sessions
+            .iter()
+            .map(|session| session["id"].as_str().unwrap())
+            .find(|&id| id != current)
+            .unwrap();
+
+        let uri = format!("/api/auth/sessions/{other}");
+        let (status, _) =
+            send(&app, request(Method::DELETE, &uri, Some(&tokens[0]), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+        let (status, _) =
+            send(&app, request(Method::DELETE, &uri, Some(&tokens[0]), ()))
+                .await;
+        assert_eq!(status, StatusCode::NOT_FOUND);
+
+        // Revokes every session but the current one
+        let (status, body) = send(
+            &app,
+            request(Method::DELETE, "/api/auth/sessions", Some(&tokens[0]), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let revoked: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(revoked.as_array().unwrap().len(), 2);
+
+        for token in &tokens[1..] {
+            let (status, body) = send(
+                &app,
+                request(Method::GET, "/api/auth/me", Some(token), ()),
+            )
+            .await;
+            assert_eq!(status, StatusCode::UNAUTHORIZED);
+            let body: Value = serde_json::from_slice(&body).unwrap();
+            assert_eq!(body["error_code"], 4012);
+        }
+
+        let (status, _) = send(
+            &app,
+            request(Method::GET, "/api/auth/me", Some(&tokens[0]), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        // Tokens not issued by a session have none to list
+        let (status, _) = send(
+            &app,
+            request(Method::GET, "/api/auth/sessions", Some(&app.token), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+    }
+
+    #[test(tokio::test)]
+    async fn test_api_keys() {
+        let app = app().await;
+        let username = Uuid::new_v4().simple().to_string();
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                Some(&app.admin_token),
+                json!({ "username": username, "password": "password" }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        let token = body["token"].as_str().unwrap().to_owned();
+
+        let create = |body: Value| {
+            json_request(Method::POST, "/api/auth/api-keys", Some(&token), body)
+        };
+        let with_key = |method: Method, uri: &str, key: &str| {
+            let mut req = request(method, uri, None, "data");
+            req.headers_mut().insert(
+                header::AUTHORIZATION,
+                HeaderValue::from_str(&format!("ApiKey {key}")).unwrap(),
+            );
+            req
+        };
+
+        let (status, body) =
+            send(&app, create(json!({ "name": "uploads" }))).await;
+        assert_eq!(status, StatusCode::OK);
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        let key = body["key"].as_str().unwrap().to_owned();
+        let key_id = body["id"].as_str().unwrap().to_owned();
+
+        let (status, body) =
+            send(&app, create(json!({ "name": "reads", "read_only": true })))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        let read_key = body["key"].as_str().unwrap().to_owned();
+
+        let (status, _) = send(
+            &app,
+            create(json!({ "name": "admin", "permission": Permission::ADMIN })),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, _) =
+            send(&app, with_key(Method::POST, "/api/file?name=a", &key)).await;
+        assert_eq!(status, StatusCode::OK);
+        let (status, _) =
+            send(&app, with_key(Method::POST, "/api/file?name=b", &read_key))
+                .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        // Keys can't create other keys
+        let (status, _) =
+            send(&app, with_key(Method::POST, "/api/auth/api-keys", &key))
+                .await;
+        assert_ne!(status, StatusCode::OK);
+
+        let (status, body) = send(
+            &app,
+            request(Method::GET, "/api/auth/api-keys", Some(&token), ()),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let body: Value = serde_json::from_slice(&body).unwrap();
+        let keys = body.as_array().unwrap();
+        assert_eq!(keys.len(), 2);
+        assert!(keys.iter().all(|key| key.get("key").is_none()));
+
+        let uri = format!("/api/auth/api-keys/{key_id}");
+        let (status, _) =
+            send(&app, request(Method::DELETE, &uri, Some(&token), ())).await;
+        assert_eq!(status, StatusCode::OK);
+
+        let (status, _) =
+            send(&app, with_key(Method::GET, "/api/auth/me", &key)).await;
+        assert_eq!(status, StatusCode::UNAUTHORIZED);
+    }
+
+    #[test(tokio::test)]
+    async fn test_transfer_file() {
+        let app = app().await;
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                Some(&app.admin_token),
+                json!({
+                    "username": Uuid::new_v4().simple().to_string(),
+                    "password": "password",
+                }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let signup: Value = serde_json::from_slice(&body).unwrap();
+        let new_owner = signup["user"]["id"].as_str().unwrap().to_owned();
+        let new_owner_token = signup["token"].as_str().unwrap().to_owned();
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                "data",
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let uri = format!("/api/file/{}", object["id"].as_str().unwrap());
+        let transfer_uri = format!("{uri}/transfer");
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                &transfer_uri,
+                Some(&app.token),
+                json!({ "user_id": new_owner }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                &transfer_uri,
+                Some(&app.admin_token),
+                json!({ "user_id": Uuid::new_v4() }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                &transfer_uri,
+                Some(&app.admin_token),
+                json!({ "user_id": new_owner }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(object["user_id"], new_owner);
+
+        let (status, _) =
+            send(&app, request(Method::GET, &uri, Some(&new_owner_token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let (status, _) =
+            send(&app, request(Method::GET, &uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/file/transfer",
+                Some(&app.admin_token),
+                json!({
+                    "user_id": new_owner,
+                    "ids": [object["id"], Uuid::new_v4()],
+                }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let results: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(results[0]["status"], "transferred");
+        assert_eq!(results[1]["status"], "not_found");
+
+        // Files that don't fit in the quota of the receiver are kept
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::PUT,
+                &format!("/api/user/{new_owner}/quota"),
+                Some(&app.admin_token),
+                json!({ "quota": 5 }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=other.txt",
+                Some(&app.token),
+                "data",
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let other: Value = serde_json::from_slice(&body).unwrap();
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                &format!(
+                    "/api/file/{}/transfer",
+                    other["id"].as_str().unwrap()
+                ),
+                Some(&app.admin_token),
+                json!({ "user_id": new_owner }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::PAYLOAD_TOO_LARGE);
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/file/transfer",
+                Some(&app.admin_token),
+                json!({ "user_id": new_owner, "ids": [other["id"]] }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let results: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(results[0]["status"], "quota_exceeded");
+    }
+
+    #[test(tokio::test)]
+    async fn test_file_tags() {
+        let app = app().await;
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                "data",
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let uri = format!("/api/file/{}/tags", object["id"].as_str().unwrap());
+        let tags = json!({ "tags": { "project": "downloader" } });
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::PUT,
+                &uri,
+                Some(&app.other_token),
+                tags.clone(),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::PUT,
+                &uri,
+                Some(&app.token),
+                json!({ "tags": { "a:b": "value" } }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+
+        for _ in 0..2 {
+            let (status, body) = send(
+                &app,
+                json_request(Method::PUT, &uri, Some(&app.token), tags.clone()),
+            )
+            .await;
+            assert_eq!(status, StatusCode::OK);
+            assert_eq!(serde_json::from_slice::<Value>(&body).unwrap(), tags);
+        }
+
+        let (status, body) =
+            send(&app, request(Method::GET, &uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(serde_json::from_slice::<Value>(&body).unwrap(), tags);
+
+        let (status, _) =
+            send(&app, request(Method::GET, &uri, Some(&app.other_token), ()))
+                .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::GET,
+                "/api/file?tag=project:downloader",
+                Some(&app.admin_token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let objects: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(objects.as_array().unwrap().len(), 1);
+        assert_eq!(objects[0]["id"], object["id"]);
+
+        let (status, _) = send(
+            &app,
+            request(
+                Method::GET,
+                "/api/file?tag=project",
+                Some(&app.admin_token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+    }
+
+    #[test(tokio::test)]
+    async fn test_cache_stats() {
+        let app = app().await;
+        let uri = "/api/file/cache/stats";
+
+        let (status, _) =
+            send(&app, request(Method::GET, uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, body) =
+            send(&app, request(Method::GET, uri, Some(&app.admin_token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let stats: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(stats["capacity"], 0);
+        assert_eq!(stats["hit_rate"], 0.0);
+        assert_eq!(stats["content"]["capacity"], 0);
+        assert_eq!(stats["content"]["hits"], 0);
+    }
+
+    #[test(tokio::test)]
+    async fn test_db_stats() {
+        let app = app().await;
+        let uri = "/api/db/stats";
+
+        let (status, _) =
+            send(&app, request(Method::GET, uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, body) =
+            send(&app, request(Method::GET, uri, Some(&app.admin_token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let stats: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(stats["available"], true);
+        assert_eq!(stats["reconnects"], 0);
+        // The requests don't go through the acceptor
+        assert_eq!(stats["http_connections"], 0);
+        assert_eq!(stats["max_http_connections"], 0);
+    }
+
+    #[test(tokio::test)]
+    async fn test_method_not_allowed() {
+        let app = app().await;
+        let uri = format!("/api/file/{}", Uuid::new_v4());
+
+        let res = app
+            .router
+            .clone()
+            .oneshot(request(Method::OPTIONS, &uri, None, ()))
+            .await
+            .unwrap();
+        assert_eq!(res.status(), StatusCode::NO_CONTENT);
+
+        let allow = res.headers()[header::ALLOW].to_str().unwrap();
+        for method in ["GET", "PUT", "DELETE", "OPTIONS"] {
+            assert!(allow.contains(method), "{method} missing in `{allow}`");
+        }
+
+        let res = app
+            .router
+            .clone()
+            .oneshot(request(Method::PATCH, &uri, None, ()))
+            .await
+            .unwrap();
+        assert_eq!(res.status(), StatusCode::METHOD_NOT_ALLOWED);
+        assert!(res.headers().contains_key(header::ALLOW));
+
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+        let error: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(error["error_code"], 99101);
+    }
+
+    #[test(tokio::test)]
+    async fn test_get_me() {
+        let app = app().await;
+        let username = Uuid::new_v4().simple().to_string();
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                Some(&app.admin_token),
+                json!({ "username": username, "password": "password" }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let signup: Value = serde_json::from_slice(&body).unwrap();
+        let token = signup["token"].as_str().unwrap();
+
+        let (status, body) =
+            send(&app, request(Method::GET, "/api/auth/me", Some(token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let me: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(me["user"], signup["user"]);
+        assert!(me["token_expires_at"].is_string());
+
+        let (status, _) =
+            send(&app, request(Method::GET, "/api/auth/me", None, ())).await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+    }
+
+    #[test(tokio::test)]
+    async fn test_user_quota() {
+        let app = app().await;
+        let username = Uuid::new_v4().simple().to_string();
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                Some(&app.admin_token),
+                json!({ "username": username, "password": "password" }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let signup: Value = serde_json::from_slice(&body).unwrap();
+        let token = signup["token"].as_str().unwrap();
+        let user_id = signup["user"]["id"].as_str().unwrap();
+
+        let quota_uri = format!("/api/user/{user_id}/quota");
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::PUT,
+                &quota_uri,
+                Some(token),
+                json!({ "quota": null }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::PUT,
+                &quota_uri,
+                Some(&app.admin_token),
+                json!({ "quota": 1000 }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let user: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(user["quota"], 1000);
+
+        let upload = |data: &'static str| {
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(token),
+                data.repeat(100),
+            )
+        };
+
+        let (status, body) = send(&app, upload("0123456")).await;
+        assert_eq!(status, StatusCode::OK);
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let id = object["id"].as_str().unwrap();
+
+        let (status, body) = send(&app, upload("0123")).await;
+        assert_eq!(status, StatusCode::PAYLOAD_TOO_LARGE);
+        let error: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(error["error_code"], 2008);
+
+        // The replaced file is not counted
+        let (status, _) = send(
+            &app,
+            request(
+                Method::PUT,
+                &format!("/api/file/{id}/data?name=file.txt"),
+                Some(token),
+                "012345678".repeat(100),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let (status, body) =
+            send(&app, request(Method::GET, "/api/auth/me", Some(token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+        let me: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(me["storage"], json!({ "used": 900, "quota": 1000 }));
+    }
+
+    #[test(tokio::test)]
+    async fn test_concurrent_uploads_quota() {
+        let app = app().await;
+        let username = Uuid::new_v4().simple().to_string();
+
+        let (status, body) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                Some(&app.admin_token),
+                json!({ "username": username, "password": "password" }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let signup: Value = serde_json::from_slice(&body).unwrap();
+        let token = signup["token"].as_str().unwrap().to_owned();
+        let user_id = signup["user"]["id"].as_str().unwrap();
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::PUT,
+                &format!("/api/user/{user_id}/quota"),
+                Some(&app.admin_token),
+                json!({ "quota": 1000 }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        // Both uploads fit in the quota alone, but not together
+        let mut releases = Vec::new();
+        let mut uploads = Vec::new();
+        for _ in 0..2 {
+            let (started_tx, started_rx) = oneshot::channel();
+            let (release_tx, release_rx) = oneshot::channel::<()>();
+            let body = stream::once(async move {
+                let _ = started_tx.send(());
+                Ok::<_, io::Error>(Bytes::from("a".repeat(300)))
+            })
+            .chain(stream::once(async move {
+                let _ = release_rx.await;
+                Ok(Bytes::from("b".repeat(300)))
+            }));
+
+            uploads.push(tokio::spawn(app.router.clone().oneshot(request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&token),
+                Body::from_stream(body),
+            ))));
+            started_rx.await.unwrap();
+            releases.push(release_tx);
+        }
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        for release_tx in releases {
+            release_tx.send(()).unwrap();
+        }
+
+        let mut statuses = Vec::new();
+        for upload in uploads {
+            statuses.push(upload.await.unwrap().unwrap().status());
+        }
+        statuses.sort();
+        assert_eq!(statuses, [StatusCode::OK, StatusCode::PAYLOAD_TOO_LARGE]);
+
+        let (status, body) =
+            send(&app, request(Method::GET, "/api/auth/me", Some(&token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+        let me: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(me["storage"], json!({ "used": 600, "quota": 1000 }));
+    }
+
+    #[test(tokio::test)]
+    async fn test_client_cert_service() {
+        let app = app().await;
+
+        let (status, body) = send(
+            &app,
+            request(
+                Method::POST,
+                "/api/file?name=file.txt",
+                Some(&app.token),
+                "data",
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        let object: Value = serde_json::from_slice(&body).unwrap();
+        let id = object["id"].as_str().unwrap();
+
+        let as_service = |method, uri: &str| {
+            let mut req = request(method, uri, None, ());
+            req.extensions_mut().insert(ClientCert {
+                service: Some(ServiceToken {
+                    name: "backup".into(),
+                    permission: Permission::READ_ALL,
+                }),
+            });
+            req
+        };
+
+        let (status, body) = send(
+            &app,
+            as_service(Method::GET, &format!("/api/file/{id}/data")),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(body, "data");
+
+        // Admin only actions are out of its permission
+        let (status, _) =
+            send(&app, as_service(Method::GET, "/api/user")).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+        let (status, _) =
+            send(&app, as_service(Method::DELETE, &format!("/api/file/{id}")))
+                .await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+    }
+
+    #[test(tokio::test)]
+    async fn test_list_users() {
+        let app = app().await;
+        let username = Uuid::new_v4().simple().to_string();
+
+        let (status, _) = send(
+            &app,
+            json_request(
+                Method::POST,
+                "/api/auth/signup",
+                Some(&app.admin_token),
+                json!({ "username": username, "password": "password" }),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let uri = format!("/api/user?search={username}&role=unprivileged");
+
+        let (status, _) =
+            send(&app, request(Method::GET, &uri, Some(&app.token), ())).await;
+        assert_eq!(status, StatusCode::FORBIDDEN);
+
+        let (status, body) =
+            send(&app, request(Method::GET, &uri, Some(&app.admin_token), ()))
+                .await;
+        assert_eq!(status, StatusCode::OK);
+
+        let list: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(list["total"], 1);
+        assert_eq!(list["users"][0]["username"], username.as_str());
+        assert!(list["users"][0].get("password").is_none());
+
+        let (status, _) = send(
+            &app,
+            request(
+                Method::GET,
+                "/api/user?limit=1000",
+                Some(&app.admin_token),
+                (),
+            ),
+        )
+        .await;
+        assert_eq!(status, StatusCode::BAD_REQUEST);
+    }
+}
@@ -0,0 +1,546 @@
+use std::{collections::HashSet, io};
+
+use chrono::{DateTime, Datelike, Timelike, Utc};
+use crc32fast::Hasher;
+use serde::{Deserialize, Serialize};
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use uuid::Uuid;
+
+use super::disposition::sanitize_file_name;
+
+const TAR_BLOCK: usize = 512;
+/// Biggest size the octal field of a tar header can hold, bigger ones are
+/// written in the GNU base-256 encoding.
+const TAR_MAX_OCTAL_SIZE: u64 = 0o77777777777;
+
+const ZIP_LOCAL_HEADER: u32 = 0x04034b50;
+const ZIP_DATA_DESCRIPTOR: u32 = 0x08074b50;
+const ZIP_CENTRAL_HEADER: u32 = 0x02014b50;
+const ZIP_END_OF_CENTRAL_DIR: u32 = 0x06054b50;
+/// Sizes and crc are written after the data, names are UTF-8.
+const ZIP_FLAGS: u16 = 1 << 3 | 1 << 11;
+const ZIP_VERSION: u16 = 20;
+
+/// Room left for the headers of each zip entry when checking the archive
+/// fits, the names included.
+const ZIP_ENTRY_OVERHEAD: u64 = 2048;
+
+/// Name of the entry listing what happened to every requested file.
+pub const MANIFEST_NAME: &'static str = "manifest.json";
+
+#[derive(
+    Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize,
+)]
+#[serde(rename_all = "lowercase")]
+pub enum ArchiveFormat {
+    #[default]
+    Tar,
+    Zip,
+}
+
+impl ArchiveFormat {
+    pub const fn content_type(self) -> &'static str {
+        match self {
+            Self::Tar => "application/x-tar",
+            Self::Zip => "application/zip",
+        }
+    }
+
+    pub const fn extension(self) -> &'static str {
+        match self {
+            Self::Tar => "tar",
+            Self::Zip => "zip",
+        }
+    }
+
+    /// Whether the format can hold `entries` files totalling `size` bytes.
+    /// Zip archives are written without the zip64 extensions.
+    pub const fn can_hold(self, entries: usize, size: u64) -> bool {
+        match self {
+            Self::Tar => true,
+            Self::Zip => {
+                let overhead = entries as u64 * ZIP_ENTRY_OVERHEAD;
+                entries < u16::MAX as usize
+                    && size.saturating_add(overhead) < u32::MAX as u64
+            }
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ArchiveStatus {
+    Included,
+    NotFound,
+    Forbidden,
+    Failed,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ManifestEntry {
+    pub id: Uuid,
+    /// Name of the entry in the archive, if it was included.
+    #[serde(default)]
+    pub name: Option<String>,
+    pub status: ArchiveStatus,
+}
+
+/// Gives every entry a name usable as a path of its own, adding a counter
+/// to the names already taken.
+#[derive(Debug, Default)]
+pub struct EntryNames {
+    taken: HashSet<String>,
+}
+
+impl EntryNames {
+    pub fn unique(&mut self, name: &str) -> String {
+        let name = sanitize_file_name(name);
+        if self.taken.insert(name.clone()) {
+            return name;
+        }
+
+        let (stem, ext) = match name.rfind('.') {
+            Some(i) if i > 0 => name.split_at(i),
+            _ => (name.as_str(), ""),
+        };
+
+        (1..)
+            .map(|n| format!("{stem} ({n}){ext}"))
+            .find(|candidate| self.taken.insert(candidate.clone()))
+            .unwrap()
+    }
+}
+
+/// Writes the archive entries one after the other, so it can be streamed
+/// without knowing all of them upfront.
+pub enum ArchiveWriter<W> {
+    Tar(W),
+    Zip(ZipWriter<W>),
+}
+
+impl<W: AsyncWrite + Unpin> ArchiveWriter<W> {
+    pub fn new(format: ArchiveFormat, writer: W) -> Self {
+        match format {
+            ArchiveFormat::Tar => Self::Tar(writer),
+            ArchiveFormat::Zip => Self::Zip(ZipWriter {
+                inner: writer,
+                offset: 0,
+                entries: Vec::new(),
+            }),
+        }
+    }
+
+    /// Appends an entry with the `size` bytes read from `reader`. Fails if
+    /// the reader ends early, the archive is broken from then on.
+    pub async fn append(
+        &mut self,
+        name: &str,
+        size: u64,
+        modified: DateTime<Utc>,
+        reader: impl AsyncRead + Unpin,
+    ) -> io::Result<()> {
+        match self {
+            Self::Tar(writer) => {
+                tar_append(writer, name, size, modified, reader).await
+            }
+            Self::Zip(writer) => {
+                writer.append(name, size, modified, reader).await
+            }
+        }
+    }
+
+    pub async fn finish(self) -> io::Result<()> {
+        match self {
+            Self::Tar(mut writer) => {
+                writer.write_all(&[0; TAR_BLOCK * 2]).await?;
+                writer.shutdown().await
+            }
+            Self::Zip(writer) => writer.finish().await,
+        }
+    }
+}
+
+async fn tar_append<W: AsyncWrite + Unpin>(
+    writer: &mut W,
+    name: &str,
+    size: u64,
+    modified: DateTime<Utc>,
+    reader: impl AsyncRead + Unpin,
+) -> io::Result<()> {
+    let mtime = modified.timestamp().max(0) as u64;
+
+    // Names that don't fit in the header go in a pax extended header
+    // placed right before the entry
+    if name.len() > 100 {
+        let record = pax_record("path", name);
+        writer
+            .write_all(&tar_header(
+                "pax_header",
+                record.len() as u64,
+                mtime,
+                b'x',
+            ))
+            .await?;
+        writer.write_all(&record).await?;
+        writer.write_all(tar_padding(record.len() as u64)).await?;
+    }
+
+    writer
+        .write_all(&tar_header(name, size, mtime, b'0'))
+        .await?;
+    copy_exact(reader, writer, size, None).await?;
+    writer.write_all(tar_padding(size)).await
+}
+
+fn tar_header(name: &str, size: u64, mtime: u64, kind: u8) -> [u8; TAR_BLOCK] {
+    let mut header = [0u8; TAR_BLOCK];
+
+    // Truncated names are replaced by the pax header path
+    let name = name.as_bytes();
+    let name_len = name.len().min(100);
+    header[..name_len].copy_from_slice(&name[..name_len]);
+
+    write_octal(&mut header[100..108], 0o644);
+    write_octal(&mut header[108..116], 0);
+    write_octal(&mut header[116..124], 0);
+    if size <= TAR_MAX_OCTAL_SIZE {
+        write_octal(&mut header[124..136], size);
+    } else {
+        header[124] = 0x80;
+        header[128..136].copy_from_slice(&size.to_be_bytes());
+    }
+    write_octal(&mut header[136..148], mtime.min(TAR_MAX_OCTAL_SIZE));
+    header[156] = kind;
+    header[257..263].copy_from_slice(b"ustar\0");
+    header[263..265].copy_from_slice(b"00");
+
+    // The checksum is computed with its own field filled with spaces
+    header[148..156].fill(b' ');
+    let checksum: u32 = header.iter().map(|&b| b as u32).sum();
+    write_octal(&mut header[148..155], checksum as u64);
+
+    header
+}
+
+/// Writes `value` as zero-padded octal digits ended by a NUL byte.
+fn write_octal(field: &mut [u8], value: u64) {
+    let digits = field.len() - 1;
+    let octal = format!("{value:0digits$o}");
+    field[..digits].copy_from_slice(&octal.as_bytes()[octal.len() - digits..]);
+    field[digits] = 0;
+}
+
+/// Formats a `<length> <key>=<value>\n` pax record, the length counting
+/// its own digits.
+fn pax_record(key: &str, value: &str) -> Vec<u8> {
+    let content_len = key.len() + value.len() + 3;
+    let mut len = content_len + 1;
+    while len != content_len + len.to_string().len() {
+        len = content_len + len.to_string().len();
+    }
+
+    format!("{len} {key}={value}\n").into_bytes()
+}
+
+fn tar_padding(size: u64) -> &'static [u8] {
+    const ZEROS: [u8; TAR_BLOCK] = [0; TAR_BLOCK];
+    let rem = (size % TAR_BLOCK as u64) as usize;
+
+    if rem == 0 {
+        &[]
+    } else {
+        &ZEROS[rem..]
+    }
+}
+
+struct ZipEntry {
+    name: String,
+    crc: u32,
+    size: u32,
+    time: u16,
+    date: u16,
+    offset: u32,
+}
+
+/// Writes stored (uncompressed) zip entries, their sizes and checksums
+/// following the data since they are only known once it is streamed.
+pub struct ZipWriter<W> {
+    inner: W,
+    offset: u64,
+    entries: Vec<ZipEntry>,
+}
+
+impl<W: AsyncWrite + Unpin> ZipWriter<W> {
+    async fn append(
+        &mut self,
+        name: &str,
+        size: u64,
+        modified: DateTime<Utc>,
+        reader: impl AsyncRead + Unpin,
+    ) -> io::Result<()> {
+        let offset = self.offset_u32()?;
+        let size_u32: u32 = size.try_into().map_err(|_| too_large())?;
+        let (time, date) = dos_date_time(modified);
+        let name_len: u16 = name.len().try_into().map_err(|_| too_large())?;
+
+        let mut header = Vec::with_capacity(30 + name.len());
+        header.extend_from_slice(&ZIP_LOCAL_HEADER.to_le_bytes());
+        header.extend_from_slice(&ZIP_VERSION.to_le_bytes());
+        header.extend_from_slice(&ZIP_FLAGS.to_le_bytes());
+        // Stored, no compression
+        header.extend_from_slice(&0u16.to_le_bytes());
+        header.extend_from_slice(&time.to_le_bytes());
+        header.extend_from_slice(&date.to_le_bytes());
+        // Crc and sizes, in the data descriptor
+        header.extend_from_slice(&[0; 12]);
+        header.extend_from_slice(&name_len.to_le_bytes());
+        header.extend_from_slice(&0u16.to_le_bytes());
+        header.extend_from_slice(name.as_bytes());
+        self.inner.write_all(&header).await?;
+
+        let mut hasher = Hasher::new();
+        copy_exact(reader, &mut self.inner, size, Some(&mut hasher)).await?;
+        let crc = hasher.finalize();
+
+        let mut descriptor = Vec::with_capacity(16);
+        descriptor.extend_from_slice(&ZIP_DATA_DESCRIPTOR.to_le_bytes());
+        descriptor.extend_from_slice(&crc.to_le_bytes());
+        descriptor.extend_from_slice(&size_u32.to_le_bytes());
+        descriptor.extend_from_slice(&size_u32.to_le_bytes());
+        self.inner.write_all(&descriptor).await?;
+
+        self.offset += (header.len() + descriptor.len()) as u64 + size;
+        self.entries.push(ZipEntry {
+            name: name.to_owned(),
+            crc,
+            size: size_u32,
+            time,
+            date,
+            offset,
+        });
+
+        Ok(())
+    }
+
+    async fn finish(mut self) -> io::Result<()> {
+        let start = self.offset_u32()?;
+        let count: u16 =
+            self.entries.len().try_into().map_err(|_| too_large())?;
+
+        let mut central = Vec::new();
+        for entry in &self.entries {
+            central.extend_from_slice(&ZIP_CENTRAL_HEADER.to_le_bytes());
+            central.extend_from_slice(&ZIP_VERSION.to_le_bytes());
+            central.extend_from_slice(&ZIP_VERSION.to_le_bytes());
+            central.extend_from_slice(&ZIP_FLAGS.to_le_bytes());
+            central.extend_from_slice(&0u16.to_le_bytes());
+            central.extend_from_slice(&entry.time.to_le_bytes());
+            central.extend_from_slice(&entry.date.to_le_bytes());
+            central.extend_from_slice(&entry.crc.to_le_bytes());
+            central.extend_from_slice(&entry.size.to_le_bytes());
+            central.extend_from_slice(&entry.size.to_le_bytes());
+            central.extend_from_slice(&(entry.name.len() as u16).to_le_bytes());
+            // Extra field, comment, disk and attributes
+            central.extend_from_slice(&[0; 12]);
+            central.extend_from_slice(&entry.offset.to_le_bytes());
+            central.extend_from_slice(entry.name.as_bytes());
+        }
+        let central_len: u32 =
+            central.len().try_into().map_err(|_| too_large())?;
+
+        central.extend_from_slice(&ZIP_END_OF_CENTRAL_DIR.to_le_bytes());
+        central.extend_from_slice(&[0; 4]);
+        central.extend_from_slice(&count.to_le_bytes());
+        central.extend_from_slice(&count.to_le_bytes());
+        central.extend_from_slice(&central_len.to_le_bytes());
+        central.extend_from_slice(&start.to_le_bytes());
+        central.extend_from_slice(&0u16.to_le_bytes());
+
+        self.inner.write_all(&central).await?;
+        self.inner.shutdown().await
+    }
+
+    fn offset_u32(&self) -> io::Result<u32> {
+        self.offset.try_into().map_err(|_| too_large())
+    }
+}
+
+fn too_large() -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidInput, "zip archive too large")
+}
+
+/// Packs the time in the MS-DOS format used by zip, which starts in 1980
+/// and has a two seconds resolution.
+fn dos_date_time(time: DateTime<Utc>) -> (u16, u16) {
+    if time.year() < 1980 {
+        return (0, 1 << 5 | 1);
+    }
+    let year = time.year().min(2107) as u16 - 1980;
+
+    let dos_time = (time.hour() as u16) << 11
+        | (time.minute() as u16) << 5
+        | time.second() as u16 / 2;
+    let dos_date = year << 9 | (time.month() as u16) << 5 | time.day() as u16;
+
+    (dos_time, dos_date)
+}
+
+/// Copies exactly `size` bytes, failing if the reader ends before that.
+async fn copy_exact<W: AsyncWrite + Unpin>(
+    reader: impl AsyncRead + Unpin,
+    writer: &mut W,
+    size: u64,
+    mut hasher: Option<&mut Hasher>,
+) -> io::Result<()> {
+    let mut reader = reader.take(size);
+    let mut buf = vec![0u8; 64 * 1024];
+    let mut copied = 0;
+
+    loop {
+        let n = reader.read(&mut buf).await?;
+        if n == 0 {
+            break;
+        }
+        if let Some(hasher) = hasher.as_mut() {
+            hasher.update(&buf[..n]);
+        }
+        writer.write_all(&buf[..n]).await?;
+        copied += n as u64;
+    }
+
+    if copied != size {
+        return Err(io::Error::new(
+            io::ErrorKind::UnexpectedEof,
+            format!("expected {size} bytes, got {copied}"),
+        ));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::{TimeZone, Utc};
+    use test_log::test;
+
+    use super::{
+        dos_date_time, pax_record, ArchiveFormat, ArchiveWriter, EntryNames,
+    };
+
+    async fn archive(
+        format: ArchiveFormat,
+        files: &[(&str, &[u8])],
+    ) -> Vec<u8> {
+        let mut out = Vec::new();
+        let mut writer = ArchiveWriter::new(format, &mut out);
+        let modified = Utc.with_ymd_and_hms(2024, 5, 17, 13, 45, 30).unwrap();
+
+        for (name, data) in files {
+            writer
+                .append(name, data.len() as u64, modified, *data)
+                .await
+                .unwrap();
+        }
+        writer.finish().await.unwrap();
+
+        out
+    }
+
+    #[test]
+    fn test_entry_names() {
+        let mut names = EntryNames::default();
+
+        assert_eq!(names.unique("a.txt"), "a.txt");
+        assert_eq!(names.unique("a.txt"), "a (1).txt");
+        assert_eq!(names.unique("a.txt"), "a (2).txt");
+        assert_eq!(names.unique("../b"), ".._b");
+        assert_eq!(names.unique(".hidden"), ".hidden");
+        assert_eq!(names.unique(".hidden"), ".hidden (1)");
+    }
+
+    #[test]
+    fn test_pax_record() {
+        let record = pax_record("path", "a");
+        assert_eq!(record, b"9 path=a\n");
+
+        let value = "x".repeat(90);
+        let record = String::from_utf8(pax_record("path", &value)).unwrap();
+        assert_eq!(record.len().to_string(), record.split(' ').next().unwrap());
+    }
+
+    #[test]
+    fn test_dos_date_time() {
+        let time = Utc.with_ymd_and_hms(2024, 5, 17, 13, 45, 30).unwrap();
+        assert_eq!(
+            dos_date_time(time),
+            (13 << 11 | 45 << 5 | 15, 44 << 9 | 5 << 5 | 17),
+        );
+
+        let time = Utc.with_ymd_and_hms(1970, 1, 1, 0, 0, 0).unwrap();
+        assert_eq!(dos_date_time(time), (0, 1 << 5 | 1));
+    }
+
+    #[test(tokio::test)]
+    async fn test_tar() {
+        let long_name = "n".repeat(150);
+        let out = archive(
+            ArchiveFormat::Tar,
+            &[("hello.txt", b"hello world"), (&long_name, b"")],
+        )
+        .await;
+
+        assert_eq!(out.len() % 512, 0);
+        assert_eq!(&out[..9], b"hello.txt");
+        assert_eq!(&out[124..135], b"00000000013");
+        assert_eq!(&out[257..263], b"ustar\0");
+        assert_eq!(&out[512..523], b"hello world");
+
+        // Pax header, its record, then the entry itself
+        assert_eq!(out[1024 + 156], b'x');
+        let record = format!("160 path={long_name}\n");
+        assert_eq!(&out[1536..1536 + record.len()], record.as_bytes());
+        assert_eq!(out[2048 + 156], b'0');
+
+        assert!(out[2560..].iter().all(|&b| b == 0));
+        assert_eq!(out.len(), 2560 + 1024);
+    }
+
+    #[test(tokio::test)]
+    async fn test_zip() {
+        let out = archive(
+            ArchiveFormat::Zip,
+            &[("a.txt", b"hello"), ("b.txt", b"world!")],
+        )
+        .await;
+
+        assert_eq!(&out[..4], &0x04034b50u32.to_le_bytes());
+        assert_eq!(&out[30..35], b"a.txt");
+        assert_eq!(&out[35..40], b"hello");
+        assert_eq!(&out[44..48], &crc32fast::hash(b"hello").to_le_bytes(),);
+
+        let end = &out[out.len() - 22..];
+        assert_eq!(&end[..4], &0x06054b50u32.to_le_bytes());
+        assert_eq!(u16::from_le_bytes([end[10], end[11]]), 2);
+
+        let central_len =
+            u32::from_le_bytes(end[12..16].try_into().unwrap()) as usize;
+        let central_start =
+            u32::from_le_bytes(end[16..20].try_into().unwrap()) as usize;
+        assert_eq!(central_start + central_len, out.len() - 22);
+
+        let second = &out[central_start + 46 + 5..];
+        assert_eq!(&second[..4], &0x02014b50u32.to_le_bytes());
+        let offset = u32::from_le_bytes(second[42..46].try_into().unwrap());
+        assert_eq!(offset as usize, 30 + 5 + 5 + 16);
+        assert_eq!(&second[46..51], b"b.txt");
+    }
+
+    #[test(tokio::test)]
+    async fn test_short_reader() {
+        let mut out = Vec::new();
+        let mut writer = ArchiveWriter::new(ArchiveFormat::Zip, &mut out);
+
+        let res = writer.append("a", 10, Utc::now(), b"abc".as_slice()).await;
+        assert!(res.is_err());
+    }
+}
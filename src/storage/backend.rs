@@ -0,0 +1,536 @@
+use std::{
+    fs::Metadata,
+    io::{self, ErrorKind},
+    path::{Path, PathBuf},
+    pin::Pin,
+    sync::Arc,
+    task::{Context, Poll},
+    time::Instant,
+};
+
+use futures_util::future::BoxFuture;
+use tokio::{
+    fs::{copy, create_dir_all, metadata, read_dir, remove_file, rename, File},
+    io::{AsyncRead, AsyncSeek, AsyncWrite, AsyncWriteExt},
+    task::spawn_blocking,
+};
+
+use super::selector::{DirSelector, InFlight};
+use crate::config::{DirSelection, StorageConfig};
+
+/// Dir created in each data dir for the files being written, when no temp
+/// dir is configured.
+pub const TEMP_SUBDIR: &'static str = "tmp";
+
+/// Suffix of the files not yet complete, left behind if the server stopped
+/// while writing them.
+const INCOMPLETE_SUFFIX: &'static str = "-incomplete";
+
+/// A readable and seekable stored file.
+pub trait StorageRead: AsyncRead + AsyncSeek + Send + Unpin {}
+
+impl<T: AsyncRead + AsyncSeek + Send + Unpin> StorageRead for T {}
+
+/// A file being written, that only becomes visible once persisted.
+pub trait StorageWrite: AsyncWrite + Send + Unpin {
+    fn persist(self: Box<Self>) -> BoxFuture<'static, io::Result<()>>;
+
+    fn discard(self: Box<Self>) -> BoxFuture<'static, io::Result<()>>;
+}
+
+/// The place where the object files are kept. Missing files are reported
+/// with [`io::ErrorKind::NotFound`].
+pub trait Storage: Send + Sync {
+    /// Opens the file for reading, returning it along with its size.
+    fn open<'a>(
+        &'a self,
+        name: &'a str,
+    ) -> BoxFuture<'a, io::Result<(Box<dyn StorageRead>, u64)>>;
+
+    fn create<'a>(
+        &'a self,
+        name: &'a str,
+    ) -> BoxFuture<'a, io::Result<Box<dyn StorageWrite>>>;
+
+    fn delete<'a>(&'a self, name: &'a str) -> BoxFuture<'a, io::Result<()>>;
+
+    /// Returns the size of the file.
+    fn stat<'a>(&'a self, name: &'a str) -> BoxFuture<'a, io::Result<u64>>;
+
+    /// Returns the names of every stored file.
+    fn list(&self) -> BoxFuture<'_, io::Result<Vec<String>>>;
+}
+
+/// Stores the files in local directories, possibly in different disks. New
+/// files go to the directory picked by the [`DirSelection`] strategy, among
+/// the ones with at least `min_free_space` bytes available. Files are
+/// written to a temporary directory and moved once complete, so partial
+/// files are never visible.
+/// Without a shared temp dir, each data dir has its own [`TEMP_SUBDIR`], so
+/// the files are always renamed and never copied.
+pub struct LocalStorage {
+    data_dirs: Vec<PathBuf>,
+    temp_dir: Option<PathBuf>,
+    min_free_space: u64,
+    selector: Arc<DirSelector>,
+}
+
+impl LocalStorage {
+    pub fn new(
+        data_dirs: Vec<PathBuf>,
+        temp_dir: impl Into<Option<PathBuf>>,
+        min_free_space: u64,
+    ) -> Self {
+        assert!(!data_dirs.is_empty(), "at least one data dir is required");
+
+        let selector =
+            DirSelector::new(DirSelection::default(), data_dirs.len());
+
+        Self {
+            data_dirs,
+            temp_dir: temp_dir.into(),
+            min_free_space,
+            selector: Arc::new(selector),
+        }
+    }
+
+    pub fn with_dir_selection(mut self, selection: DirSelection) -> Self {
+        self.selector =
+            Arc::new(DirSelector::new(selection, self.data_dirs.len()));
+        self
+    }
+
+    pub fn from_config(cfg: &StorageConfig) -> Self {
+        Self::new(
+            cfg.data_dirs
+                .iter()
+                .map(|dir| PathBuf::from(dir.as_str()))
+                .collect(),
+            cfg.temp_dir.as_ref().map(|dir| PathBuf::from(dir.as_str())),
+            cfg.min_free_space,
+        )
+        .with_dir_selection(cfg.dir_selection)
+    }
+
+    fn temp_dir(&self, data_dir: &Path) -> PathBuf {
+        match &self.temp_dir {
+            Some(dir) => dir.clone(),
+            None => data_dir.join(TEMP_SUBDIR),
+        }
+    }
+
+    /// Creates the temp dirs and deletes the incomplete files left behind
+    /// by an earlier run. Must be done before anything is written, since
+    /// the files being written would be deleted too.
+    pub async fn prepare(&self) -> io::Result<()> {
+        let mut removed = 0;
+
+        for data_dir in &self.data_dirs {
+            let temp_dir = self.temp_dir(data_dir);
+            create_dir_all(&temp_dir).await?;
+
+            if !same_file_system(&temp_dir, data_dir)? {
+                tracing::warn!(
+                    target: "object_fs",
+                    temp_dir = %temp_dir.display(),
+                    data_dir = %data_dir.display(),
+                    "temp dir is in another file system than the data dir, \
+                    new files will be copied instead of renamed",
+                );
+            }
+
+            // Copies interrupted while moving across file systems are left
+            // in the data dir
+            removed += remove_incomplete(data_dir).await?;
+        }
+
+        match &self.temp_dir {
+            Some(temp_dir) => removed += remove_incomplete(temp_dir).await?,
+            None => {
+                for data_dir in &self.data_dirs {
+                    let temp_dir = data_dir.join(TEMP_SUBDIR);
+                    removed += remove_incomplete(&temp_dir).await?;
+                }
+            }
+        }
+
+        if removed > 0 {
+            tracing::info!(
+                target: "object_fs",
+                removed,
+                "deleted stale incomplete files",
+            );
+        }
+
+        Ok(())
+    }
+
+    /// Probes the data dirs for the file.
+    async fn find(&self, name: &str) -> io::Result<(PathBuf, Metadata)> {
+        for dir in &self.data_dirs {
+            let path = dir.join(name);
+
+            match metadata(&path).await {
+                Ok(meta) => return Ok((path, meta)),
+                Err(error) if error.kind() == ErrorKind::NotFound => {}
+                Err(error) => return Err(error),
+            }
+        }
+
+        Err(ErrorKind::NotFound.into())
+    }
+
+    /// Returns the index of the data dir for a new file.
+    async fn choose_dir(&self) -> io::Result<usize> {
+        let count = self.data_dirs.len();
+
+        if count == 1 {
+            return Ok(0);
+        }
+
+        let dirs = self.data_dirs.clone();
+        let free = spawn_blocking(move || {
+            dirs.iter()
+                .map(|dir| free_space(dir).unwrap_or(0))
+                .collect::<Vec<_>>()
+        })
+        .await?;
+
+        let candidates = (0..count)
+            .filter(|&i| free[i] >= self.min_free_space)
+            .collect::<Vec<_>>();
+
+        if candidates.is_empty() {
+            return Ok((0..count).max_by_key(|&i| free[i]).unwrap_or_default());
+        }
+        Ok(self.selector.select(&candidates))
+    }
+}
+
+impl Storage for LocalStorage {
+    fn open<'a>(
+        &'a self,
+        name: &'a str,
+    ) -> BoxFuture<'a, io::Result<(Box<dyn StorageRead>, u64)>> {
+        Box::pin(async move {
+            let (path, _) = self.find(name).await?;
+            let file = File::open(path).await?;
+            let size = file.metadata().await?.len();
+
+            Ok((Box::new(file) as Box<dyn StorageRead>, size))
+        })
+    }
+
+    fn create<'a>(
+        &'a self,
+        name: &'a str,
+    ) -> BoxFuture<'a, io::Result<Box<dyn StorageWrite>>> {
+        Box::pin(async move {
+            let index = self.choose_dir().await?;
+            let dir = &self.data_dirs[index];
+            let in_flight = self.selector.start(index);
+
+            // Unique, so writes of the same name never share a temp file
+            let temp_path = self.temp_dir(dir).join(format!(
+                "{name}.{:016x}{INCOMPLETE_SUFFIX}",
+                rand::random::<u64>(),
+            ));
+
+            let start = Instant::now();
+            let file = File::create(&temp_path).await?;
+            in_flight.record_latency(start.elapsed());
+
+            Ok(Box::new(LocalWrite {
+                file,
+                temp_path,
+                path: dir.join(name),
+                stale_paths: self
+                    .data_dirs
+                    .iter()
+                    .filter(|&other| other != dir)
+                    .map(|other| other.join(name))
+                    .collect(),
+                in_flight,
+            }) as Box<dyn StorageWrite>)
+        })
+    }
+
+    fn delete<'a>(&'a self, name: &'a str) -> BoxFuture<'a, io::Result<()>> {
+        Box::pin(async move {
+            let (path, _) = self.find(name).await?;
+            remove_file(path).await
+        })
+    }
+
+    fn stat<'a>(&'a self, name: &'a str) -> BoxFuture<'a, io::Result<u64>> {
+        Box::pin(
+            async move { self.find(name).await.map(|(_, meta)| meta.len()) },
+        )
+    }
+
+    fn list(&self) -> BoxFuture<'_, io::Result<Vec<String>>> {
+        Box::pin(async move {
+            let mut names = Vec::new();
+
+            for dir in &self.data_dirs {
+                let mut entries = read_dir(dir).await?;
+
+                while let Some(entry) = entries.next_entry().await? {
+                    if !entry.file_type().await?.is_file() {
+                        continue;
+                    }
+                    if let Ok(name) = entry.file_name().into_string() {
+                        names.push(name);
+                    }
+                }
+            }
+
+            names.sort_unstable();
+            names.dedup();
+
+            Ok(names)
+        })
+    }
+}
+
+/// Deletes the incomplete files directly inside `dir`, returning how many.
+async fn remove_incomplete(dir: &Path) -> io::Result<usize> {
+    let mut entries = read_dir(dir).await?;
+    let mut removed = 0;
+
+    while let Some(entry) = entries.next_entry().await? {
+        let is_incomplete = entry
+            .file_name()
+            .to_str()
+            .is_some_and(|name| name.ends_with(INCOMPLETE_SUFFIX));
+
+        if is_incomplete && entry.file_type().await?.is_file() {
+            remove_file(entry.path()).await?;
+            removed += 1;
+        }
+    }
+
+    Ok(removed)
+}
+
+#[cfg(unix)]
+fn same_file_system(a: &Path, b: &Path) -> io::Result<bool> {
+    use std::os::unix::fs::MetadataExt;
+
+    Ok(std::fs::metadata(a)?.dev() == std::fs::metadata(b)?.dev())
+}
+
+#[cfg(not(unix))]
+fn same_file_system(_a: &Path, _b: &Path) -> io::Result<bool> {
+    Ok(true)
+}
+
+/// Returns the space available to unprivileged users in the file system of
+/// `path`.
+#[cfg(unix)]
+pub fn free_space(path: &Path) -> io::Result<u64> {
+    use std::{ffi::CString, mem::MaybeUninit, os::unix::ffi::OsStrExt};
+
+    let path = CString::new(path.as_os_str().as_bytes())?;
+    let mut stat = MaybeUninit::<libc::statvfs>::uninit();
+
+    // SAFETY: `path` is a valid C string and `stat` is only read after
+    // being filled by a successful call
+    let stat = unsafe {
+        if libc::statvfs(path.as_ptr(), stat.as_mut_ptr()) != 0 {
+            return Err(io::Error::last_os_error());
+        }
+        stat.assume_init()
+    };
+
+    Ok((stat.f_bavail as u64).saturating_mul(stat.f_frsize as u64))
+}
+
+#[cfg(not(unix))]
+pub fn free_space(_path: &Path) -> io::Result<u64> {
+    Ok(u64::MAX)
+}
+
+struct LocalWrite {
+    file: File,
+    temp_path: PathBuf,
+    path: PathBuf,
+    /// Where older versions of the file may be, in the other data dirs.
+    stale_paths: Vec<PathBuf>,
+    in_flight: InFlight,
+}
+
+impl AsyncWrite for LocalWrite {
+    #[inline]
+    fn poll_write(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        Pin::new(&mut self.file).poll_write(cx, buf)
+    }
+
+    #[inline]
+    fn poll_flush(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.file).poll_flush(cx)
+    }
+
+    #[inline]
+    fn poll_shutdown(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.file).poll_shutdown(cx)
+    }
+}
+
+impl StorageWrite for LocalWrite {
+    fn persist(self: Box<Self>) -> BoxFuture<'static, io::Result<()>> {
+        Box::pin(async move {
+            let LocalWrite {
+                mut file,
+                temp_path,
+                path,
+                stale_paths,
+                in_flight,
+            } = *self;
+
+            let start = Instant::now();
+            file.flush().await?;
+            drop(file);
+
+            if let Err(error) = move_file(&temp_path, &path).await {
+                let _ = remove_file(&temp_path).await;
+                return Err(error);
+            }
+            in_flight.record_latency(start.elapsed());
+
+            for stale_path in stale_paths {
+                match remove_file(&stale_path).await {
+                    Err(error) if error.kind() != ErrorKind::NotFound => {
+                        return Err(error);
+                    }
+                    _ => {}
+                }
+            }
+
+            Ok(())
+        })
+    }
+
+    fn discard(self: Box<Self>) -> BoxFuture<'static, io::Result<()>> {
+        Box::pin(async move {
+            let LocalWrite {
+                file, temp_path, ..
+            } = *self;
+            drop(file);
+
+            remove_file(&temp_path).await
+        })
+    }
+}
+
+/// Renames the file, falling back to a copy when the data dir is in another
+/// file system than the temp dir.
+async fn move_file(from: &Path, to: &Path) -> io::Result<()> {
+    match rename(from, to).await {
+        Err(error) if error.kind() == ErrorKind::CrossesDevices => {
+            let mut incomplete = to.as_os_str().to_owned();
+            incomplete.push(INCOMPLETE_SUFFIX);
+
+            copy(from, &incomplete).await?;
+            rename(&incomplete, to).await?;
+            remove_file(from).await
+        }
+        res => res,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io::ErrorKind;
+
+    use test_log::test;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    use super::{LocalStorage, Storage, TEMP_SUBDIR};
+
+    #[test(tokio::test)]
+    async fn test_multiple_data_dirs() {
+        let dirs = [
+            tempfile::tempdir().unwrap(),
+            tempfile::tempdir().unwrap(),
+            tempfile::tempdir().unwrap(),
+        ];
+        let temp_dir = tempfile::tempdir().unwrap();
+
+        let storage = LocalStorage::new(
+            dirs.iter().map(|dir| dir.path().to_owned()).collect(),
+            temp_dir.path().to_owned(),
+            0,
+        );
+
+        for i in 0..6 {
+            let mut file = storage.create(&i.to_string()).await.unwrap();
+            file.write_all(&[i as u8; 16]).await.unwrap();
+            file.persist().await.unwrap();
+        }
+
+        // Overwriting must not leave the older version behind
+        for _ in 0..3 {
+            let mut file = storage.create("0").await.unwrap();
+            file.write_all(b"updated").await.unwrap();
+            file.persist().await.unwrap();
+        }
+
+        for dir in &dirs {
+            let count = std::fs::read_dir(dir.path()).unwrap().count();
+            assert!(count >= 1, "files were not spread across data dirs");
+        }
+
+        let (mut file, size) = storage.open("0").await.unwrap();
+        let mut buf = Vec::new();
+        file.read_to_end(&mut buf).await.unwrap();
+        assert_eq!(buf, b"updated");
+        assert_eq!(size, 7);
+
+        let names = storage.list().await.unwrap();
+        assert_eq!(names, ["0", "1", "2", "3", "4", "5"]);
+
+        for i in 0..6 {
+            storage.delete(&i.to_string()).await.unwrap();
+
+            let res = storage.stat(&i.to_string()).await;
+            assert!(matches!(res, Err(e) if e.kind() == ErrorKind::NotFound));
+        }
+    }
+
+    #[test(tokio::test)]
+    async fn test_prepare() {
+        let data_dir = tempfile::tempdir().unwrap();
+        let storage =
+            LocalStorage::new(vec![data_dir.path().to_owned()], None, 0);
+
+        let temp_dir = data_dir.path().join(TEMP_SUBDIR);
+        std::fs::create_dir(&temp_dir).unwrap();
+        std::fs::write(temp_dir.join("a-incomplete"), b"partial").unwrap();
+        std::fs::write(data_dir.path().join("b-incomplete"), b"partial")
+            .unwrap();
+        std::fs::write(data_dir.path().join("c"), b"complete").unwrap();
+
+        storage.prepare().await.unwrap();
+
+        assert_eq!(std::fs::read_dir(&temp_dir).unwrap().count(), 0);
+        assert_eq!(storage.list().await.unwrap(), ["c"]);
+
+        let mut file = storage.create("d").await.unwrap();
+        file.write_all(b"new").await.unwrap();
+        file.persist().await.unwrap();
+
+        assert_eq!(storage.stat("d").await.unwrap(), 3);
+        assert_eq!(std::fs::read_dir(&temp_dir).unwrap().count(), 0);
+    }
+}
@@ -0,0 +1,222 @@
+use std::{
+    collections::{BTreeMap, HashMap},
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Mutex,
+    },
+    time::{Duration, Instant},
+};
+
+use serde::{Deserialize, Serialize};
+use uuid::Uuid;
+
+use super::Object;
+
+/// Keeps the most recently read objects for up to `ttl`, so downloads of
+/// the same files don't query the database every time.
+pub struct ObjectCache {
+    capacity: usize,
+    ttl: Duration,
+    state: Mutex<CacheState>,
+    hits: AtomicU64,
+    misses: AtomicU64,
+}
+
+#[derive(Default)]
+struct CacheState {
+    entries: HashMap<Uuid, CacheEntry>,
+    /// Ids by the time they were last used, the first is evicted when full.
+    recency: BTreeMap<u64, Uuid>,
+    clock: u64,
+}
+
+struct CacheEntry {
+    object: Object,
+    inserted_at: Instant,
+    used_at: u64,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct CacheStats {
+    pub capacity: usize,
+    pub entries: usize,
+    pub hits: u64,
+    pub misses: u64,
+    /// Zero until the cache is used.
+    pub hit_rate: f64,
+}
+
+impl CacheState {
+    fn tick(&mut self) -> u64 {
+        self.clock += 1;
+        self.clock
+    }
+
+    fn remove(&mut self, id: Uuid) {
+        if let Some(entry) = self.entries.remove(&id) {
+            self.recency.remove(&entry.used_at);
+        }
+    }
+}
+
+impl ObjectCache {
+    pub fn new(capacity: usize, ttl: Duration) -> Self {
+        Self {
+            capacity,
+            ttl,
+            state: Mutex::default(),
+            hits: AtomicU64::new(0),
+            misses: AtomicU64::new(0),
+        }
+    }
+
+    pub fn get(&self, id: Uuid) -> Option<Object> {
+        let mut state = self.state.lock().unwrap();
+        let used_at = state.tick();
+
+        let object = match state.entries.get_mut(&id) {
+            Some(entry) if entry.inserted_at.elapsed() < self.ttl => {
+                let previous = entry.used_at;
+                entry.used_at = used_at;
+                let object = entry.object.clone();
+
+                state.recency.remove(&previous);
+                state.recency.insert(used_at, id);
+                Some(object)
+            }
+            Some(..) => {
+                state.remove(id);
+                None
+            }
+            None => None,
+        };
+
+        let counter = if object.is_some() {
+            &self.hits
+        } else {
+            &self.misses
+        };
+        counter.fetch_add(1, Ordering::Relaxed);
+
+        object
+    }
+
+    pub fn insert(&self, object: Object) {
+        if self.capacity == 0 {
+            return;
+        }
+
+        let mut state = self.state.lock().unwrap();
+        let id = object.id;
+        state.remove(id);
+
+        while state.entries.len() >= self.capacity {
+            let Some((_, oldest)) = state.recency.pop_first() else {
+                break;
+            };
+            state.entries.remove(&oldest);
+        }
+
+        let used_at = state.tick();
+        state.recency.insert(used_at, id);
+        state.entries.insert(
+            id,
+            CacheEntry {
+                object,
+                inserted_at: Instant::now(),
+                used_at,
+            },
+        );
+    }
+
+    /// Drops the object, so the next read gets it from the database.
+    pub fn invalidate(&self, id: Uuid) {
+        self.state.lock().unwrap().remove(id);
+    }
+
+    pub fn stats(&self) -> CacheStats {
+        let entries = self.state.lock().unwrap().entries.len();
+        let hits = self.hits.load(Ordering::Relaxed);
+        let misses = self.misses.load(Ordering::Relaxed);
+
+        let hit_rate = match hits + misses {
+            0 => 0.0,
+            total => hits as f64 / total as f64,
+        };
+
+        CacheStats {
+            capacity: self.capacity,
+            entries,
+            hits,
+            misses,
+            hit_rate,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use chrono::Utc;
+    use test_log::test;
+    use uuid::Uuid;
+
+    use crate::storage::{Object, ObjectData};
+
+    use super::ObjectCache;
+
+    fn object() -> Object {
+        Object {
+            id: Uuid::new_v4(),
+            user_id: Uuid::new_v4(),
+            created_at: Utc::now(),
+            updated_at: Utc::now(),
+            expires_at: None,
+            download_count: 0,
+            max_downloads: None,
+            public: false,
+            data: ObjectData {
+                name: "file.txt".into(),
+                mime_type: "text/plain".into(),
+                size: 0,
+                checksum_256: [0; 32],
+            },
+        }
+    }
+
+    #[test]
+    fn test_lru_eviction() {
+        let cache = ObjectCache::new(2, Duration::from_secs(60));
+        let (a, b, c) = (object(), object(), object());
+
+        cache.insert(a.clone());
+        cache.insert(b.clone());
+        assert_eq!(cache.get(a.id), Some(a.clone()));
+
+        // `b` is the least recently used
+        cache.insert(c.clone());
+        assert_eq!(cache.get(b.id), None);
+        assert_eq!(cache.get(a.id), Some(a.clone()));
+        assert_eq!(cache.get(c.id), Some(c.clone()));
+
+        cache.invalidate(a.id);
+        assert_eq!(cache.get(a.id), None);
+
+        let stats = cache.stats();
+        assert_eq!(stats.entries, 1);
+        assert_eq!(stats.hits, 3);
+        assert_eq!(stats.misses, 2);
+        assert_eq!(stats.hit_rate, 0.6);
+    }
+
+    #[test]
+    fn test_ttl() {
+        let cache = ObjectCache::new(2, Duration::ZERO);
+        let a = object();
+
+        cache.insert(a.clone());
+        assert_eq!(cache.get(a.id), None);
+        assert_eq!(cache.stats().entries, 0);
+    }
+}
@@ -0,0 +1,99 @@
+use std::sync::{Arc, Mutex};
+
+use super::manager::ObjectError;
+
+/// SHA-256 the client expects an upload to have. Clients streaming large
+/// files can only send it in the trailers, once the whole body was read.
+#[derive(Debug, Clone, Default)]
+pub struct ExpectedChecksum {
+    required: bool,
+    value: Arc<Mutex<Option<Received>>>,
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Received {
+    Valid([u8; 32]),
+    Invalid,
+}
+
+impl ExpectedChecksum {
+    /// Accepts uploads whatever their checksum is.
+    pub fn none() -> Self {
+        Self::default()
+    }
+
+    /// Expects the checksum known before the upload.
+    pub fn known(checksum: [u8; 32]) -> Self {
+        Self {
+            required: true,
+            value: Arc::new(Mutex::new(Some(Received::Valid(checksum)))),
+        }
+    }
+
+    /// Expects a checksum sent later with [`ExpectedChecksum::set`].
+    pub fn pending() -> Self {
+        Self {
+            required: true,
+            value: Arc::default(),
+        }
+    }
+
+    /// Sets the hex encoded checksum, invalid ones are never matched.
+    pub fn set(&self, hex_checksum: &str) {
+        let mut checksum = [0; 32];
+        let received =
+            match hex::decode_to_slice(hex_checksum.trim(), &mut checksum) {
+                Ok(()) => Received::Valid(checksum),
+                Err(..) => Received::Invalid,
+            };
+
+        *self.value.lock().unwrap() = Some(received);
+    }
+
+    pub fn verify(&self, checksum: &[u8; 32]) -> Result<(), ObjectError> {
+        match *self.value.lock().unwrap() {
+            Some(Received::Valid(expected)) if expected == *checksum => Ok(()),
+            Some(..) => Err(ObjectError::ChecksumMismatch),
+            None if self.required => Err(ObjectError::ChecksumMissing),
+            None => Ok(()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use sha2::{Digest, Sha256};
+    use test_log::test;
+
+    use crate::storage::manager::ObjectError;
+
+    use super::ExpectedChecksum;
+
+    #[test]
+    fn test_verify() {
+        let checksum: [u8; 32] = Sha256::digest(b"data").into();
+        let other: [u8; 32] = Sha256::digest(b"other").into();
+
+        assert!(ExpectedChecksum::none().verify(&checksum).is_ok());
+        assert!(ExpectedChecksum::known(checksum).verify(&checksum).is_ok());
+        assert!(matches!(
+            ExpectedChecksum::known(other).verify(&checksum),
+            Err(ObjectError::ChecksumMismatch),
+        ));
+
+        let expected = ExpectedChecksum::pending();
+        assert!(matches!(
+            expected.verify(&checksum),
+            Err(ObjectError::ChecksumMissing),
+        ));
+
+        expected.clone().set(&hex::encode(checksum));
+        assert!(expected.verify(&checksum).is_ok());
+
+        expected.set("not hex");
+        assert!(matches!(
+            expected.verify(&checksum),
+            Err(ObjectError::ChecksumMismatch),
+        ));
+    }
+}
@@ -0,0 +1,209 @@
+use axum::http::{header, HeaderMap};
+use chrono::{DateTime, Utc};
+
+use crate::utils::fmt::fmt_hex;
+
+use super::Object;
+
+/// Strong entity tag of the object, derived from its content checksum.
+pub fn etag(object: &Object) -> String {
+    format!("\"{}\"", fmt_hex(&object.data.checksum_256))
+}
+
+/// Formats the date in the IMF-fixdate format used by HTTP headers, such as
+/// `Sun, 06 Nov 1994 08:49:37 GMT`.
+pub fn fmt_http_date(date: &DateTime<Utc>) -> String {
+    date.format("%a, %d %b %Y %H:%M:%S GMT").to_string()
+}
+
+/// Evaluates `If-None-Match` and `If-Modified-Since`, returning `true` if
+/// the client copy is still valid. `If-Modified-Since` is ignored when
+/// `If-None-Match` is present (RFC 9110, section 13.2.2), or when it is in
+/// the future, since the client clock can't be trusted then.
+pub fn is_not_modified(headers: &HeaderMap, object: &Object) -> bool {
+    if let Some(if_none_match) = headers.get(header::IF_NONE_MATCH) {
+        let Ok(if_none_match) = if_none_match.to_str() else {
+            return false;
+        };
+
+        return etag_list_matches(if_none_match, &etag(object));
+    }
+
+    headers
+        .get(header::IF_MODIFIED_SINCE)
+        .and_then(|v| v.to_str().ok())
+        .and_then(parse_http_date)
+        .filter(|since| *since <= Utc::now())
+        .is_some_and(|since| object.updated_at.timestamp() <= since.timestamp())
+}
+
+/// Evaluates `If-Range`, returning `true` if the `Range` of the request can
+/// be honored, since the client copy is still the current one. Otherwise
+/// the whole file is sent, so resumed downloads don't mix two versions of
+/// it. Entity tags are compared strongly and dates must match exactly
+/// (RFC 9110, section 13.1.5).
+pub fn if_range_matches(headers: &HeaderMap, object: &Object) -> bool {
+    let Some(if_range) = headers.get(header::IF_RANGE) else {
+        return true;
+    };
+    let Ok(if_range) = if_range.to_str() else {
+        return false;
+    };
+    let if_range = if_range.trim();
+
+    if if_range.starts_with('"') || if_range.starts_with("W/") {
+        // Weak tags never match
+        return if_range == etag(object);
+    }
+
+    parse_http_date(if_range)
+        .is_some_and(|date| date.timestamp() == object.updated_at.timestamp())
+}
+
+/// Weak comparison of `etag` against a list of entity tags.
+fn etag_list_matches(list: &str, etag: &str) -> bool {
+    list.split(',').map(str::trim).any(|candidate| {
+        candidate == "*" || candidate.trim_start_matches("W/") == etag
+    })
+}
+
+pub fn parse_http_date(s: &str) -> Option<DateTime<Utc>> {
+    DateTime::parse_from_rfc2822(s)
+        .ok()
+        .map(|date| date.with_timezone(&Utc))
+}
+
+#[cfg(test)]
+mod tests {
+    use axum::http::{header, HeaderMap, HeaderValue};
+    use chrono::{DateTime, TimeDelta, Utc};
+    use test_log::test;
+    use uuid::Uuid;
+
+    use crate::storage::{Object, ObjectData};
+
+    use super::{
+        etag, fmt_http_date, if_range_matches, is_not_modified, parse_http_date,
+    };
+
+    fn object() -> Object {
+        let updated_at = DateTime::from_timestamp(784111777, 0).unwrap();
+
+        Object {
+            id: Uuid::new_v4(),
+            user_id: Uuid::new_v4(),
+            created_at: updated_at,
+            updated_at,
+            expires_at: None,
+            download_count: 0,
+            max_downloads: None,
+            public: false,
+            data: ObjectData {
+                name: "file.txt".into(),
+                mime_type: "text/plain".into(),
+                size: 0,
+                checksum_256: [7; 32],
+            },
+        }
+    }
+
+    fn headers(pairs: &[(header::HeaderName, &str)]) -> HeaderMap {
+        pairs
+            .iter()
+            .map(|(k, v)| (k.clone(), HeaderValue::from_str(v).unwrap()))
+            .collect()
+    }
+
+    #[test]
+    fn test_if_none_match() {
+        let object = object();
+        let etag = etag(&object);
+
+        let cases = [
+            (etag.clone(), true),
+            (format!("W/{etag}"), true),
+            (format!("\"other\", {etag}"), true),
+            ("*".into(), true),
+            ("\"other\"".into(), false),
+        ];
+
+        for (value, expected) in cases {
+            let headers = headers(&[(header::IF_NONE_MATCH, &value)]);
+            assert_eq!(is_not_modified(&headers, &object), expected, "{value}");
+        }
+    }
+
+    #[test]
+    fn test_if_modified_since() {
+        let mut object = object();
+
+        let date = "Sun, 06 Nov 1994 08:49:37 GMT";
+        let headers = headers(&[(header::IF_MODIFIED_SINCE, date)]);
+        assert!(is_not_modified(&headers, &object));
+
+        object.updated_at += TimeDelta::seconds(1);
+        assert!(!is_not_modified(&headers, &object));
+    }
+
+    #[test]
+    fn test_if_range() {
+        let mut object = object();
+        let etag = etag(&object);
+        let date = fmt_http_date(&object.updated_at);
+
+        assert!(if_range_matches(&HeaderMap::new(), &object));
+
+        let cases = [
+            (etag.clone(), true),
+            (format!("W/{etag}"), false),
+            ("\"other\"".into(), false),
+            (date.clone(), true),
+            ("Sun, 06 Nov 1994 08:49:36 GMT".into(), false),
+            ("not a date".into(), false),
+        ];
+
+        for (value, expected) in cases {
+            let headers = headers(&[(header::IF_RANGE, &value)]);
+            assert_eq!(
+                if_range_matches(&headers, &object),
+                expected,
+                "{value}"
+            );
+        }
+
+        // Changed after the client fetched the first bytes
+        object.updated_at += TimeDelta::seconds(1);
+        let headers = headers(&[(header::IF_RANGE, &date)]);
+        assert!(!if_range_matches(&headers, &object));
+    }
+
+    #[test]
+    fn test_http_date() {
+        let date = DateTime::from_timestamp(784111777, 0).unwrap();
+        let formatted = fmt_http_date(&date);
+
+        assert_eq!(formatted, "Sun, 06 Nov 1994 08:49:37 GMT");
+        assert_eq!(parse_http_date(&formatted), Some(date));
+    }
+
+    #[test]
+    fn test_if_modified_since_future() {
+        let mut object = object();
+        object.updated_at = Utc::now();
+
+        let date = fmt_http_date(&(Utc::now() + TimeDelta::days(1)));
+        let headers = headers(&[(header::IF_MODIFIED_SINCE, &date)]);
+        assert!(!is_not_modified(&headers, &object));
+    }
+
+    #[test]
+    fn test_if_none_match_precedence() {
+        let object = object();
+
+        let headers = headers(&[
+            (header::IF_NONE_MATCH, "\"other\""),
+            (header::IF_MODIFIED_SINCE, "Sun, 06 Nov 1994 08:49:37 GMT"),
+        ]);
+        assert!(!is_not_modified(&headers, &object));
+    }
+}
@@ -0,0 +1,238 @@
+use std::{
+    collections::{BTreeMap, HashMap},
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Mutex,
+    },
+};
+
+use bytes::Bytes;
+use serde::{Deserialize, Serialize};
+use uuid::Uuid;
+
+/// Keeps the uncompressed content of the most recently downloaded small
+/// files in memory, so popular files are not read from a slow storage every
+/// time. Files bigger than `max_file_size` are never kept, and the least
+/// recently used ones are evicted once the contents exceed `capacity`
+/// bytes.
+pub struct ContentCache {
+    capacity: u64,
+    max_file_size: u64,
+    state: Mutex<ContentState>,
+    hits: AtomicU64,
+    misses: AtomicU64,
+}
+
+#[derive(Default)]
+struct ContentState {
+    entries: HashMap<Uuid, ContentEntry>,
+    /// Ids by the time they were last used, the first is evicted when full.
+    recency: BTreeMap<u64, Uuid>,
+    clock: u64,
+    size: u64,
+    /// Bumped by every invalidation, so contents read before one are not
+    /// inserted after it.
+    epoch: u64,
+}
+
+struct ContentEntry {
+    data: Bytes,
+    used_at: u64,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ContentCacheStats {
+    pub capacity: u64,
+    pub max_file_size: u64,
+    pub entries: usize,
+    /// Bytes kept in memory.
+    pub size: u64,
+    pub hits: u64,
+    pub misses: u64,
+    /// Zero until the cache is used.
+    pub hit_rate: f64,
+}
+
+impl ContentState {
+    fn tick(&mut self) -> u64 {
+        self.clock += 1;
+        self.clock
+    }
+
+    fn remove(&mut self, id: Uuid) {
+        if let Some(entry) = self.entries.remove(&id) {
+            self.recency.remove(&entry.used_at);
+            self.size -= entry.data.len() as u64;
+        }
+    }
+}
+
+impl ContentCache {
+    pub fn new(capacity: u64, max_file_size: u64) -> Self {
+        Self {
+            capacity,
+            max_file_size: max_file_size.min(capacity),
+            state: Mutex::default(),
+            hits: AtomicU64::new(0),
+            misses: AtomicU64::new(0),
+        }
+    }
+
+    /// Whether files of `size` bytes can be kept.
+    #[inline]
+    pub fn fits(&self, size: u64) -> bool {
+        size <= self.max_file_size
+    }
+
+    #[inline]
+    pub fn max_file_size(&self) -> u64 {
+        self.max_file_size
+    }
+
+    pub fn get(&self, id: Uuid) -> Option<Bytes> {
+        let mut state = self.state.lock().unwrap();
+        let used_at = state.tick();
+
+        let data = state.entries.get_mut(&id).map(|entry| {
+            let previous = entry.used_at;
+            entry.used_at = used_at;
+            (previous, entry.data.clone())
+        });
+        if let Some((previous, _)) = data {
+            state.recency.remove(&previous);
+            state.recency.insert(used_at, id);
+        }
+
+        let counter = if data.is_some() {
+            &self.hits
+        } else {
+            &self.misses
+        };
+        counter.fetch_add(1, Ordering::Relaxed);
+
+        data.map(|(_, data)| data)
+    }
+
+    /// Current epoch, to be given to [`Self::insert`] along with the
+    /// contents read after it.
+    pub fn epoch(&self) -> u64 {
+        self.state.lock().unwrap().epoch
+    }
+
+    /// Keeps the content of the file, unless it is too big or an
+    /// invalidation happened since `epoch`, as it may be outdated.
+    pub fn insert(&self, id: Uuid, data: Bytes, epoch: u64) {
+        let len = data.len() as u64;
+        if !self.fits(len) {
+            return;
+        }
+
+        let mut state = self.state.lock().unwrap();
+        if state.epoch != epoch {
+            return;
+        }
+        state.remove(id);
+
+        while state.size + len > self.capacity {
+            let Some((_, oldest)) = state.recency.pop_first() else {
+                break;
+            };
+            if let Some(entry) = state.entries.remove(&oldest) {
+                state.size -= entry.data.len() as u64;
+            }
+        }
+
+        let used_at = state.tick();
+        state.recency.insert(used_at, id);
+        state.entries.insert(id, ContentEntry { data, used_at });
+        state.size += len;
+    }
+
+    /// Drops the content of the file, which was deleted or replaced.
+    pub fn invalidate(&self, id: Uuid) {
+        let mut state = self.state.lock().unwrap();
+        state.epoch += 1;
+        state.remove(id);
+    }
+
+    pub fn stats(&self) -> ContentCacheStats {
+        let (entries, size) = {
+            let state = self.state.lock().unwrap();
+            (state.entries.len(), state.size)
+        };
+        let hits = self.hits.load(Ordering::Relaxed);
+        let misses = self.misses.load(Ordering::Relaxed);
+
+        let hit_rate = match hits + misses {
+            0 => 0.0,
+            total => hits as f64 / total as f64,
+        };
+
+        ContentCacheStats {
+            capacity: self.capacity,
+            max_file_size: self.max_file_size,
+            entries,
+            size,
+            hits,
+            misses,
+            hit_rate,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use bytes::Bytes;
+    use test_log::test;
+    use uuid::Uuid;
+
+    use super::ContentCache;
+
+    #[test]
+    fn test_lru_eviction() {
+        let cache = ContentCache::new(10, 4);
+        let (a, b, c) = (Uuid::new_v4(), Uuid::new_v4(), Uuid::new_v4());
+        let data = Bytes::from_static(b"1234");
+
+        cache.insert(a, data.clone(), cache.epoch());
+        cache.insert(b, data.clone(), cache.epoch());
+        assert_eq!(cache.get(a), Some(data.clone()));
+
+        // `b` is the least recently used
+        cache.insert(c, data.clone(), cache.epoch());
+        assert_eq!(cache.get(b), None);
+        assert_eq!(cache.get(a), Some(data.clone()));
+        assert_eq!(cache.get(c), Some(data.clone()));
+
+        // Too big
+        cache.insert(b, Bytes::from_static(b"12345"), cache.epoch());
+        assert_eq!(cache.get(b), None);
+
+        let stats = cache.stats();
+        assert_eq!(stats.entries, 2);
+        assert_eq!(stats.size, 8);
+        assert_eq!(stats.hits, 3);
+        assert_eq!(stats.misses, 2);
+        assert_eq!(stats.hit_rate, 0.6);
+    }
+
+    #[test]
+    fn test_invalidate() {
+        let cache = ContentCache::new(10, 4);
+        let (a, b) = (Uuid::new_v4(), Uuid::new_v4());
+        let data = Bytes::from_static(b"1234");
+
+        cache.insert(a, data.clone(), cache.epoch());
+        let epoch = cache.epoch();
+        cache.invalidate(a);
+        assert_eq!(cache.get(a), None);
+        assert_eq!(cache.stats().size, 0);
+
+        // Read before the invalidation
+        cache.insert(b, data.clone(), epoch);
+        assert_eq!(cache.get(b), None);
+
+        cache.insert(b, data.clone(), cache.epoch());
+        assert_eq!(cache.get(b), Some(data));
+    }
+}
@@ -0,0 +1,110 @@
+use std::fmt::Write;
+
+/// Formats the `Content-Disposition` header of a download (RFC 6266). The
+/// quoted `filename` holds an ASCII fallback, while `filename*` carries the
+/// exact name when it can't be represented in ASCII.
+pub fn content_disposition(name: &str) -> String {
+    let name = sanitize_file_name(name);
+
+    let fallback: String = name
+        .chars()
+        .map(|c| match c {
+            '"' | '\\' => '_',
+            c if c.is_ascii() => c,
+            _ => '_',
+        })
+        .collect();
+
+    let mut header = format!("attachment; filename=\"{fallback}\"");
+
+    if fallback != name {
+        header.push_str("; filename*=UTF-8''");
+        for b in name.bytes() {
+            if is_attr_char(b) {
+                header.push(b as char);
+            } else {
+                let _ = write!(header, "%{b:02X}");
+            }
+        }
+    }
+
+    header
+}
+
+/// Removes control characters, that could break the header apart, and path
+/// separators, so the name can't point outside the download directory.
+pub fn sanitize_file_name(name: &str) -> String {
+    let name: String = name
+        .chars()
+        .filter(|c| !c.is_control())
+        .map(|c| if matches!(c, '/' | '\\') { '_' } else { c })
+        .collect();
+
+    let name = name.trim();
+    if name.is_empty() || name == "." || name == ".." {
+        return "file".into();
+    }
+
+    name.to_owned()
+}
+
+/// Characters allowed unencoded in an extended parameter value (RFC 8187).
+#[inline]
+const fn is_attr_char(b: u8) -> bool {
+    b.is_ascii_alphanumeric()
+        || matches!(
+            b,
+            b'!' | b'#'
+                | b'$'
+                | b'&'
+                | b'+'
+                | b'-'
+                | b'.'
+                | b'^'
+                | b'_'
+                | b'`'
+                | b'|'
+                | b'~'
+        )
+}
+
+#[cfg(test)]
+mod tests {
+    use test_log::test;
+
+    use super::content_disposition;
+
+    #[test]
+    fn test_plain_name() {
+        assert_eq!(
+            content_disposition("report 2024, final.pdf"),
+            "attachment; filename=\"report 2024, final.pdf\"",
+        );
+    }
+
+    #[test]
+    fn test_unicode_name() {
+        assert_eq!(
+            content_disposition("relatório ünïcode.txt"),
+            "attachment; filename=\"relat_rio _n_code.txt\"; \
+            filename*=UTF-8''relat%C3%B3rio%20%C3%BCn%C3%AFcode.txt",
+        );
+    }
+
+    #[test]
+    fn test_unsafe_name() {
+        assert_eq!(
+            content_disposition("a\"b.txt\r\nSet-Cookie: x=y"),
+            "attachment; filename=\"a_b.txtSet-Cookie: x=y\"; \
+            filename*=UTF-8''a%22b.txtSet-Cookie%3A%20x%3Dy",
+        );
+        assert_eq!(
+            content_disposition("../../etc/passwd"),
+            "attachment; filename=\".._.._etc_passwd\"",
+        );
+        assert_eq!(
+            content_disposition("\r\n"),
+            "attachment; filename=\"file\"",
+        );
+    }
+}
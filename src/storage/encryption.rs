@@ -0,0 +1,893 @@
+use std::{
+    future::poll_fn,
+    io::{self, ErrorKind, SeekFrom},
+    pin::Pin,
+    task::{ready, Context, Poll},
+};
+
+use futures_util::future::BoxFuture;
+use ring::{
+    aead::{Aad, LessSafeKey, Nonce, UnboundKey, AES_256_GCM, NONCE_LEN},
+    rand::{SecureRandom, SystemRandom},
+};
+use sha2::{Digest, Sha256};
+use tokio::io::{
+    copy, AsyncRead, AsyncReadExt, AsyncSeek, AsyncSeekExt, AsyncWrite,
+    AsyncWriteExt, ReadBuf,
+};
+
+use super::backend::{Storage, StorageRead, StorageWrite};
+
+const MAGIC: [u8; 8] = *b"DLENC\0\0\x01";
+/// Bytes of plaintext sealed together, the unit decrypted to serve a read.
+const CHUNK_SIZE: u32 = 64 * 1024;
+/// Bigger chunks are refused when reading, so a corrupted header can't make
+/// the server allocate anything large.
+const MAX_CHUNK_SIZE: u32 = 16 * 1024 * 1024;
+const TAG_LEN: usize = 16;
+const KEY_LEN: usize = 32;
+const KEY_ID_LEN: usize = 8;
+const NONCE_PREFIX_LEN: usize = 8;
+
+const HEADER_LEN: usize = MAGIC.len()
+    + 4
+    + KEY_ID_LEN
+    + NONCE_LEN
+    + KEY_LEN
+    + TAG_LEN
+    + NONCE_PREFIX_LEN;
+
+/// Key encrypting the per-file data keys, never the data itself.
+pub struct MasterKey {
+    id: [u8; KEY_ID_LEN],
+    key: LessSafeKey,
+}
+
+impl MasterKey {
+    pub fn new(bytes: &[u8; KEY_LEN]) -> Self {
+        let hash = Sha256::digest(bytes);
+
+        Self {
+            id: hash[..KEY_ID_LEN].try_into().unwrap(),
+            key: LessSafeKey::new(
+                UnboundKey::new(&AES_256_GCM, bytes).unwrap(),
+            ),
+        }
+    }
+
+    /// Short fingerprint of the key, stored in the files it wrapped the key
+    /// of.
+    pub fn id(&self) -> String {
+        hex::encode(self.id)
+    }
+}
+
+/// The master key used to encrypt new files, along with the previous ones
+/// still needed to read the files encrypted before a rotation.
+pub struct MasterKeys {
+    pub current: MasterKey,
+    pub previous: Vec<MasterKey>,
+}
+
+impl MasterKeys {
+    fn find(&self, id: &[u8; KEY_ID_LEN]) -> Option<&MasterKey> {
+        std::iter::once(&self.current)
+            .chain(&self.previous)
+            .find(|key| &key.id == id)
+    }
+}
+
+/// What [`EncryptedStorage::migrate`] did to a file.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Migration {
+    Unchanged,
+    /// The file was stored in plain text.
+    Encrypted,
+    /// The data key was wrapped by a previous master key.
+    Rewrapped,
+}
+
+/// Encrypts the files of the inner storage with AES-256-GCM. Every file
+/// gets its own random data key, kept in its header wrapped by the master
+/// key. The data is sealed in chunks, so a read at any offset only needs to
+/// decrypt the chunks it covers.
+///
+/// Files stored before the encryption was enabled are read as they are.
+pub struct EncryptedStorage<S> {
+    inner: S,
+    keys: MasterKeys,
+    rng: SystemRandom,
+}
+
+impl<S: Storage> EncryptedStorage<S> {
+    pub fn new(inner: S, keys: MasterKeys) -> Self {
+        Self {
+            inner,
+            keys,
+            rng: SystemRandom::new(),
+        }
+    }
+
+    /// Opens the file, returning it positioned after the header and the
+    /// header, or at the start if the file is not encrypted.
+    async fn open_raw(
+        &self,
+        name: &str,
+    ) -> io::Result<(Box<dyn StorageRead>, u64, Option<Header>)> {
+        let (mut file, file_size) = self.inner.open(name).await?;
+
+        if file_size >= HEADER_LEN as u64 {
+            let mut buf = [0u8; HEADER_LEN];
+            file.read_exact(&mut buf).await?;
+
+            if let Some(header) = Header::decode(&buf) {
+                return Ok((file, file_size, Some(header)));
+            }
+            file.rewind().await?;
+        }
+
+        Ok((file, file_size, None))
+    }
+
+    fn unwrap_key(&self, header: &Header) -> io::Result<[u8; KEY_LEN]> {
+        let master = self.keys.find(&header.key_id).ok_or_else(|| {
+            io::Error::new(
+                ErrorKind::InvalidData,
+                format!(
+                    "file encrypted with unknown master key `{}`",
+                    hex::encode(header.key_id)
+                ),
+            )
+        })?;
+
+        let mut wrapped = header.wrapped_key;
+        let key = master
+            .key
+            .open_in_place(
+                Nonce::assume_unique_for_key(header.wrap_nonce),
+                Aad::from(header.aad()),
+                &mut wrapped,
+            )
+            .map_err(|_| invalid_data("data key failed authentication"))?;
+
+        Ok(key.try_into().unwrap())
+    }
+
+    /// Creates a header wrapping `data_key` with the current master key.
+    fn wrap_key(
+        &self,
+        data_key: &[u8; KEY_LEN],
+        chunk_size: u32,
+        nonce_prefix: [u8; NONCE_PREFIX_LEN],
+    ) -> io::Result<Header> {
+        let mut header = Header {
+            chunk_size,
+            key_id: self.keys.current.id,
+            wrap_nonce: [0; NONCE_LEN],
+            wrapped_key: [0; KEY_LEN + TAG_LEN],
+            nonce_prefix,
+        };
+        self.fill(&mut header.wrap_nonce)?;
+        let nonce = Nonce::assume_unique_for_key(header.wrap_nonce);
+        let aad = Aad::from(header.aad());
+
+        let (key, tag) = header.wrapped_key.split_at_mut(KEY_LEN);
+        key.copy_from_slice(data_key);
+        let sealed = self
+            .keys
+            .current
+            .key
+            .seal_in_place_separate_tag(nonce, aad, key)
+            .map_err(|_| invalid_data("failed to wrap data key"))?;
+        tag.copy_from_slice(sealed.as_ref());
+
+        Ok(header)
+    }
+
+    fn fill(&self, buf: &mut [u8]) -> io::Result<()> {
+        self.rng
+            .fill(buf)
+            .map_err(|_| io::Error::other("failed to generate random bytes"))
+    }
+
+    /// Encrypts the file if it is stored in plain text, or wraps its data
+    /// key again with the current master key if it was wrapped by a previous
+    /// one. Only the header is rewritten in that case, the data is copied as
+    /// it is.
+    ///
+    /// Files updated while they are migrated would be reverted, so it must
+    /// not run along with the server.
+    pub async fn migrate(&self, name: &str) -> io::Result<Migration> {
+        let (mut file, _, header) = self.open_raw(name).await?;
+
+        let Some(header) = header else {
+            let mut writer = self.create(name).await?;
+            if let Err(error) = copy(&mut file, &mut writer).await {
+                let _ = writer.discard().await;
+                return Err(error);
+            }
+            writer.persist().await?;
+
+            return Ok(Migration::Encrypted);
+        };
+
+        if header.key_id == self.keys.current.id {
+            return Ok(Migration::Unchanged);
+        }
+
+        let data_key = self.unwrap_key(&header)?;
+        let header =
+            self.wrap_key(&data_key, header.chunk_size, header.nonce_prefix)?;
+
+        let mut writer = self.inner.create(name).await?;
+        let res = async {
+            writer.write_all(&header.encode()).await?;
+            copy(&mut file, &mut writer).await
+        }
+        .await;
+        if let Err(error) = res {
+            let _ = writer.discard().await;
+            return Err(error);
+        }
+        writer.persist().await?;
+
+        Ok(Migration::Rewrapped)
+    }
+}
+
+impl<S: Storage> Storage for EncryptedStorage<S> {
+    fn open<'a>(
+        &'a self,
+        name: &'a str,
+    ) -> BoxFuture<'a, io::Result<(Box<dyn StorageRead>, u64)>> {
+        Box::pin(async move {
+            let (file, file_size, header) = self.open_raw(name).await?;
+            let Some(header) = header else {
+                return Ok((file, file_size));
+            };
+
+            if header.chunk_size == 0 || header.chunk_size > MAX_CHUNK_SIZE {
+                return Err(invalid_data("invalid chunk size"));
+            }
+            let data_key = self.unwrap_key(&header)?;
+            let size = plain_size(file_size, header.chunk_size as u64)?;
+
+            let reader = EncryptedRead {
+                inner: file,
+                key: data_key_of(&data_key),
+                nonce_prefix: header.nonce_prefix,
+                chunk_size: header.chunk_size as u64,
+                size,
+                pos: 0,
+                inner_pos: Some(HEADER_LEN as u64),
+                state: ReadState::Idle,
+                buf: Vec::new(),
+                filled: 0,
+                chunk: Vec::new(),
+                chunk_index: None,
+            };
+
+            Ok((Box::new(reader) as Box<dyn StorageRead>, size))
+        })
+    }
+
+    fn create<'a>(
+        &'a self,
+        name: &'a str,
+    ) -> BoxFuture<'a, io::Result<Box<dyn StorageWrite>>> {
+        Box::pin(async move {
+            let mut data_key = [0u8; KEY_LEN];
+            self.fill(&mut data_key)?;
+            let mut nonce_prefix = [0u8; NONCE_PREFIX_LEN];
+            self.fill(&mut nonce_prefix)?;
+
+            let header = self.wrap_key(&data_key, CHUNK_SIZE, nonce_prefix)?;
+            let inner = self.inner.create(name).await?;
+
+            Ok(Box::new(EncryptedWrite {
+                inner,
+                key: data_key_of(&data_key),
+                nonce_prefix,
+                chunk_size: CHUNK_SIZE as usize,
+                index: 0,
+                plain: Vec::with_capacity(CHUNK_SIZE as usize),
+                out: header.encode().to_vec(),
+                out_pos: 0,
+                finished: false,
+            }) as Box<dyn StorageWrite>)
+        })
+    }
+
+    #[inline]
+    fn delete<'a>(&'a self, name: &'a str) -> BoxFuture<'a, io::Result<()>> {
+        self.inner.delete(name)
+    }
+
+    fn stat<'a>(&'a self, name: &'a str) -> BoxFuture<'a, io::Result<u64>> {
+        Box::pin(async move { self.open(name).await.map(|(_, size)| size) })
+    }
+
+    #[inline]
+    fn list(&self) -> BoxFuture<'_, io::Result<Vec<String>>> {
+        self.inner.list()
+    }
+}
+
+/// Layout, in order: magic, chunk size, master key id, wrap nonce, wrapped
+/// data key and tag, data nonce prefix.
+struct Header {
+    chunk_size: u32,
+    key_id: [u8; KEY_ID_LEN],
+    wrap_nonce: [u8; NONCE_LEN],
+    wrapped_key: [u8; KEY_LEN + TAG_LEN],
+    nonce_prefix: [u8; NONCE_PREFIX_LEN],
+}
+
+impl Header {
+    fn encode(&self) -> [u8; HEADER_LEN] {
+        let mut buf = [0u8; HEADER_LEN];
+        let mut offset = 0;
+
+        for field in [
+            &MAGIC[..],
+            &self.chunk_size.to_le_bytes(),
+            &self.key_id,
+            &self.wrap_nonce,
+            &self.wrapped_key,
+            &self.nonce_prefix,
+        ] {
+            buf[offset..offset + field.len()].copy_from_slice(field);
+            offset += field.len();
+        }
+
+        buf
+    }
+
+    fn decode(buf: &[u8; HEADER_LEN]) -> Option<Self> {
+        let rest = buf.strip_prefix(&MAGIC)?;
+        let (chunk_size, rest) = rest.split_at(4);
+        let (key_id, rest) = rest.split_at(KEY_ID_LEN);
+        let (wrap_nonce, rest) = rest.split_at(NONCE_LEN);
+        let (wrapped_key, nonce_prefix) = rest.split_at(KEY_LEN + TAG_LEN);
+
+        Some(Self {
+            chunk_size: u32::from_le_bytes(chunk_size.try_into().ok()?),
+            key_id: key_id.try_into().ok()?,
+            wrap_nonce: wrap_nonce.try_into().ok()?,
+            wrapped_key: wrapped_key.try_into().ok()?,
+            nonce_prefix: nonce_prefix.try_into().ok()?,
+        })
+    }
+
+    /// The header fields authenticated along with the data key.
+    fn aad(&self) -> [u8; MAGIC.len() + 4 + KEY_ID_LEN + NONCE_PREFIX_LEN] {
+        let mut aad = [0u8; MAGIC.len() + 4 + KEY_ID_LEN + NONCE_PREFIX_LEN];
+        aad[..8].copy_from_slice(&MAGIC);
+        aad[8..12].copy_from_slice(&self.chunk_size.to_le_bytes());
+        aad[12..20].copy_from_slice(&self.key_id);
+        aad[20..].copy_from_slice(&self.nonce_prefix);
+        aad
+    }
+}
+
+fn data_key_of(bytes: &[u8; KEY_LEN]) -> LessSafeKey {
+    LessSafeKey::new(UnboundKey::new(&AES_256_GCM, bytes).unwrap())
+}
+
+/// Chunks are numbered by their position, so they can't be reordered, and
+/// only the last one is sealed as such, so the file can't be truncated at a
+/// chunk boundary.
+fn chunk_nonce(prefix: &[u8; NONCE_PREFIX_LEN], index: u32) -> Nonce {
+    let mut nonce = [0u8; NONCE_LEN];
+    nonce[..NONCE_PREFIX_LEN].copy_from_slice(prefix);
+    nonce[NONCE_PREFIX_LEN..].copy_from_slice(&index.to_be_bytes());
+    Nonce::assume_unique_for_key(nonce)
+}
+
+#[inline]
+fn chunk_aad(last: bool) -> Aad<[u8; 1]> {
+    Aad::from([last as u8])
+}
+
+/// The last chunk is always shorter than the others, even empty, so every
+/// file ends with one.
+fn plain_size(file_size: u64, chunk_size: u64) -> io::Result<u64> {
+    let body = file_size - HEADER_LEN as u64;
+    let sealed_chunk = chunk_size + TAG_LEN as u64;
+
+    let rem = body % sealed_chunk;
+    if rem < TAG_LEN as u64 {
+        return Err(invalid_data("encrypted file is truncated"));
+    }
+
+    Ok(body / sealed_chunk * chunk_size + rem - TAG_LEN as u64)
+}
+
+fn invalid_data(message: &'static str) -> io::Error {
+    io::Error::new(ErrorKind::InvalidData, message)
+}
+
+struct EncryptedWrite {
+    inner: Box<dyn StorageWrite>,
+    key: LessSafeKey,
+    nonce_prefix: [u8; NONCE_PREFIX_LEN],
+    chunk_size: usize,
+    index: u32,
+    /// Plain text of the chunk being filled.
+    plain: Vec<u8>,
+    /// Sealed bytes not yet written to the inner file.
+    out: Vec<u8>,
+    out_pos: usize,
+    finished: bool,
+}
+
+impl EncryptedWrite {
+    fn seal(&mut self, last: bool) -> io::Result<()> {
+        self.out.clear();
+        self.out_pos = 0;
+        self.out.extend_from_slice(&self.plain);
+        self.plain.clear();
+
+        let tag = self
+            .key
+            .seal_in_place_separate_tag(
+                chunk_nonce(&self.nonce_prefix, self.index),
+                chunk_aad(last),
+                &mut self.out,
+            )
+            .map_err(|_| invalid_data("failed to seal chunk"))?;
+        self.out.extend_from_slice(tag.as_ref());
+
+        self.index = self
+            .index
+            .checked_add(1)
+            .ok_or_else(|| invalid_data("file too large to be encrypted"))?;
+
+        Ok(())
+    }
+
+    fn poll_drain(&mut self, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        while self.out_pos < self.out.len() {
+            let n = ready!(Pin::new(&mut self.inner)
+                .poll_write(cx, &self.out[self.out_pos..]))?;
+            if n == 0 {
+                return Poll::Ready(Err(ErrorKind::WriteZero.into()));
+            }
+            self.out_pos += n;
+        }
+
+        Poll::Ready(Ok(()))
+    }
+
+    /// Seals and writes the last chunk.
+    fn poll_finish(&mut self, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        ready!(self.poll_drain(cx))?;
+
+        if !self.finished {
+            self.seal(true)?;
+            self.finished = true;
+            ready!(self.poll_drain(cx))?;
+        }
+
+        Pin::new(&mut self.inner).poll_flush(cx)
+    }
+}
+
+impl AsyncWrite for EncryptedWrite {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = self.get_mut();
+        if this.finished {
+            return Poll::Ready(Err(io::Error::other("write after shutdown")));
+        }
+
+        ready!(this.poll_drain(cx))?;
+
+        let n = buf.len().min(this.chunk_size - this.plain.len());
+        this.plain.extend_from_slice(&buf[..n]);
+
+        // Written out by the next call
+        if this.plain.len() == this.chunk_size {
+            this.seal(false)?;
+        }
+
+        Poll::Ready(Ok(n))
+    }
+
+    fn poll_flush(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+        ready!(this.poll_drain(cx))?;
+        Pin::new(&mut this.inner).poll_flush(cx)
+    }
+
+    fn poll_shutdown(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+        ready!(this.poll_finish(cx))?;
+        Pin::new(&mut this.inner).poll_shutdown(cx)
+    }
+}
+
+impl StorageWrite for EncryptedWrite {
+    fn persist(self: Box<Self>) -> BoxFuture<'static, io::Result<()>> {
+        Box::pin(async move {
+            let mut this = *self;
+            poll_fn(|cx| this.poll_finish(cx)).await?;
+            this.inner.persist().await
+        })
+    }
+
+    fn discard(self: Box<Self>) -> BoxFuture<'static, io::Result<()>> {
+        self.inner.discard()
+    }
+}
+
+enum ReadState {
+    Idle,
+    Seeking(u64),
+    Reading(u64),
+}
+
+struct EncryptedRead {
+    inner: Box<dyn StorageRead>,
+    key: LessSafeKey,
+    nonce_prefix: [u8; NONCE_PREFIX_LEN],
+    chunk_size: u64,
+    /// Plain text size.
+    size: u64,
+    /// Plain text position.
+    pos: u64,
+    /// Position of the inner file, unknown while it is being seeked.
+    inner_pos: Option<u64>,
+    state: ReadState,
+    /// Sealed chunk being read.
+    buf: Vec<u8>,
+    filled: usize,
+    /// Last decrypted chunk.
+    chunk: Vec<u8>,
+    chunk_index: Option<u64>,
+}
+
+impl EncryptedRead {
+    #[inline]
+    fn last_index(&self) -> u64 {
+        self.size / self.chunk_size
+    }
+
+    fn sealed_range(&self, index: u64) -> (u64, usize) {
+        let plain_len = if index < self.last_index() {
+            self.chunk_size
+        } else {
+            self.size % self.chunk_size
+        };
+        let offset =
+            HEADER_LEN as u64 + index * (self.chunk_size + TAG_LEN as u64);
+
+        (offset, plain_len as usize + TAG_LEN)
+    }
+
+    fn open_chunk(&mut self, index: u64) -> io::Result<()> {
+        let last = index == self.last_index();
+        let nonce_index = index
+            .try_into()
+            .map_err(|_| invalid_data("encrypted file has too many chunks"))?;
+
+        let plain_len = self
+            .key
+            .open_in_place(
+                chunk_nonce(&self.nonce_prefix, nonce_index),
+                chunk_aad(last),
+                &mut self.buf,
+            )
+            .map_err(|_| invalid_data("encrypted chunk failed authentication"))?
+            .len();
+
+        self.buf.truncate(plain_len);
+        std::mem::swap(&mut self.buf, &mut self.chunk);
+        self.chunk_index = Some(index);
+
+        Ok(())
+    }
+}
+
+impl AsyncRead for EncryptedRead {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+
+        loop {
+            if this.pos >= this.size || buf.remaining() == 0 {
+                return Poll::Ready(Ok(()));
+            }
+
+            let index = this.pos / this.chunk_size;
+            if this.chunk_index == Some(index) {
+                let start = (this.pos - index * this.chunk_size) as usize;
+                let n = buf.remaining().min(this.chunk.len() - start);
+
+                buf.put_slice(&this.chunk[start..start + n]);
+                this.pos += n as u64;
+                return Poll::Ready(Ok(()));
+            }
+
+            match this.state {
+                ReadState::Idle => {
+                    let (offset, len) = this.sealed_range(index);
+
+                    if this.inner_pos == Some(offset) {
+                        this.buf.resize(len, 0);
+                        this.filled = 0;
+                        this.state = ReadState::Reading(index);
+                    } else {
+                        this.inner_pos = None;
+                        Pin::new(&mut this.inner)
+                            .start_seek(SeekFrom::Start(offset))?;
+                        this.state = ReadState::Seeking(index);
+                    }
+                }
+                ReadState::Seeking(index) => {
+                    let pos =
+                        ready!(Pin::new(&mut this.inner).poll_complete(cx))?;
+                    this.inner_pos = Some(pos);
+
+                    // Seeks made meanwhile are handled by the next loop
+                    let (offset, len) = this.sealed_range(index);
+                    if pos == offset {
+                        this.buf.resize(len, 0);
+                        this.filled = 0;
+                        this.state = ReadState::Reading(index);
+                    } else {
+                        this.state = ReadState::Idle;
+                    }
+                }
+                ReadState::Reading(index) => {
+                    let mut read = ReadBuf::new(&mut this.buf[this.filled..]);
+                    ready!(Pin::new(&mut this.inner).poll_read(cx, &mut read))?;
+
+                    let n = read.filled().len();
+                    if n == 0 {
+                        this.state = ReadState::Idle;
+                        return Poll::Ready(Err(invalid_data(
+                            "encrypted file is truncated",
+                        )));
+                    }
+                    this.filled += n;
+                    this.inner_pos = this.inner_pos.map(|pos| pos + n as u64);
+
+                    if this.filled == this.buf.len() {
+                        this.state = ReadState::Idle;
+                        this.open_chunk(index)?;
+                    }
+                }
+            }
+        }
+    }
+}
+
+impl AsyncSeek for EncryptedRead {
+    fn start_seek(self: Pin<&mut Self>, position: SeekFrom) -> io::Result<()> {
+        let this = self.get_mut();
+
+        let pos = match position {
+            SeekFrom::Start(pos) => Some(pos),
+            SeekFrom::End(offset) => this.size.checked_add_signed(offset),
+            SeekFrom::Current(offset) => this.pos.checked_add_signed(offset),
+        };
+        this.pos = pos.ok_or_else(|| {
+            io::Error::new(
+                ErrorKind::InvalidInput,
+                "invalid seek to a negative or overflowing position",
+            )
+        })?;
+
+        Ok(())
+    }
+
+    #[inline]
+    fn poll_complete(
+        self: Pin<&mut Self>,
+        _cx: &mut Context<'_>,
+    ) -> Poll<io::Result<u64>> {
+        Poll::Ready(Ok(self.pos))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io::{ErrorKind, SeekFrom};
+
+    use rand::RngCore;
+    use tempfile::TempDir;
+    use test_log::test;
+    use tokio::io::{AsyncReadExt, AsyncSeekExt, AsyncWriteExt};
+
+    use crate::storage::backend::{LocalStorage, Storage};
+
+    use super::{
+        EncryptedStorage, MasterKey, MasterKeys, Migration, CHUNK_SIZE,
+        HEADER_LEN,
+    };
+
+    fn storage(
+        current: [u8; 32],
+        previous: &[[u8; 32]],
+    ) -> (EncryptedStorage<LocalStorage>, TempDir, TempDir) {
+        let data_dir = tempfile::tempdir().unwrap();
+        let temp_dir = tempfile::tempdir().unwrap();
+
+        (
+            EncryptedStorage::new(
+                local(&data_dir, &temp_dir),
+                MasterKeys {
+                    current: MasterKey::new(&current),
+                    previous: previous.iter().map(MasterKey::new).collect(),
+                },
+            ),
+            data_dir,
+            temp_dir,
+        )
+    }
+
+    fn local(data_dir: &TempDir, temp_dir: &TempDir) -> LocalStorage {
+        LocalStorage::new(
+            vec![data_dir.path().to_owned()],
+            temp_dir.path().to_owned(),
+            0,
+        )
+    }
+
+    fn random(len: usize) -> Vec<u8> {
+        let mut data = vec![0u8; len];
+        rand::thread_rng().fill_bytes(&mut data);
+        data
+    }
+
+    async fn write(storage: &impl Storage, name: &str, data: &[u8]) {
+        let mut file = storage.create(name).await.unwrap();
+        // Uneven writes, to cross the chunk boundaries
+        for part in data.chunks(10_000) {
+            file.write_all(part).await.unwrap();
+        }
+        file.persist().await.unwrap();
+    }
+
+    async fn read(storage: &impl Storage, name: &str) -> Vec<u8> {
+        let (mut file, size) = storage.open(name).await.unwrap();
+        let mut buf = Vec::new();
+        file.read_to_end(&mut buf).await.unwrap();
+        assert_eq!(size, buf.len() as u64);
+        buf
+    }
+
+    #[test(tokio::test)]
+    async fn test_roundtrip() {
+        let (storage, data_dir, _temp_dir) = storage([1; 32], &[]);
+        let chunk = CHUNK_SIZE as usize;
+
+        for len in [0, 1, chunk - 1, chunk, chunk + 1, chunk * 3 + chunk / 2] {
+            let data = random(len);
+            write(&storage, "file", &data).await;
+
+            assert_eq!(read(&storage, "file").await, data);
+            assert_eq!(storage.stat("file").await.unwrap(), len as u64);
+
+            // Nothing of the plain text reaches the disk
+            let raw = std::fs::read(data_dir.path().join("file")).unwrap();
+            if len >= 16 {
+                assert!(!raw.windows(16).any(|w| w == &data[..16]));
+            }
+            assert!(raw.len() >= HEADER_LEN + len);
+        }
+    }
+
+    #[test(tokio::test)]
+    async fn test_seek() {
+        let (storage, _data_dir, _temp_dir) = storage([1; 32], &[]);
+        let data = random(CHUNK_SIZE as usize * 4 + 123);
+        write(&storage, "file", &data).await;
+
+        let (mut file, _) = storage.open("file").await.unwrap();
+        for start in [200_000, 10, CHUNK_SIZE as usize - 5, data.len() - 50] {
+            file.seek(SeekFrom::Start(start as u64)).await.unwrap();
+
+            let mut buf = vec![0u8; 40];
+            file.read_exact(&mut buf).await.unwrap();
+            assert_eq!(buf, data[start..start + 40]);
+        }
+
+        let pos = file.seek(SeekFrom::End(-3)).await.unwrap();
+        assert_eq!(pos, data.len() as u64 - 3);
+        let mut buf = Vec::new();
+        file.read_to_end(&mut buf).await.unwrap();
+        assert_eq!(buf, data[data.len() - 3..]);
+
+        assert!(file
+            .seek(SeekFrom::Current(-(data.len() as i64) - 1))
+            .await
+            .is_err());
+    }
+
+    #[test(tokio::test)]
+    async fn test_tampering() {
+        let (storage, data_dir, _temp_dir) = storage([1; 32], &[]);
+        let data = random(CHUNK_SIZE as usize * 2 + 10);
+        write(&storage, "file", &data).await;
+
+        let path = data_dir.path().join("file");
+        let raw = std::fs::read(&path).unwrap();
+
+        let mut flipped = raw.clone();
+        flipped[HEADER_LEN + 100] ^= 1;
+        std::fs::write(&path, &flipped).unwrap();
+
+        let (mut file, _) = storage.open("file").await.unwrap();
+        let err = file.read_to_end(&mut Vec::new()).await.unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::InvalidData);
+
+        // Cut right after the second chunk, that was not sealed as the last
+        let sealed_chunk = CHUNK_SIZE as usize + 16;
+        std::fs::write(&path, &raw[..HEADER_LEN + sealed_chunk * 2]).unwrap();
+
+        let err = storage.open("file").await.err().unwrap();
+        assert_eq!(err.kind(), ErrorKind::InvalidData);
+
+        // Cut within the last chunk
+        std::fs::write(&path, &raw[..raw.len() - 1]).unwrap();
+
+        let (mut file, _) = storage.open("file").await.unwrap();
+        let err = file.read_to_end(&mut Vec::new()).await.unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::InvalidData);
+    }
+
+    #[test(tokio::test)]
+    async fn test_migrate() {
+        let (old, data_dir, temp_dir) = storage([1; 32], &[]);
+        let data = random(100_000);
+        write(&old, "encrypted", &data).await;
+        write(&local(&data_dir, &temp_dir), "plain", &data).await;
+
+        let storage = EncryptedStorage::new(
+            local(&data_dir, &temp_dir),
+            MasterKeys {
+                current: MasterKey::new(&[2; 32]),
+                previous: vec![MasterKey::new(&[1; 32])],
+            },
+        );
+
+        // Readable before the migration, thanks to the previous key
+        assert_eq!(read(&storage, "plain").await, data);
+        assert_eq!(read(&storage, "encrypted").await, data);
+
+        let migration = storage.migrate("plain").await.unwrap();
+        assert_eq!(migration, Migration::Encrypted);
+        let migration = storage.migrate("encrypted").await.unwrap();
+        assert_eq!(migration, Migration::Rewrapped);
+        let migration = storage.migrate("encrypted").await.unwrap();
+        assert_eq!(migration, Migration::Unchanged);
+
+        // The previous key is no longer needed
+        let storage = EncryptedStorage::new(
+            local(&data_dir, &temp_dir),
+            MasterKeys {
+                current: MasterKey::new(&[2; 32]),
+                previous: Vec::new(),
+            },
+        );
+        assert_eq!(read(&storage, "plain").await, data);
+        assert_eq!(read(&storage, "encrypted").await, data);
+
+        let err = old.open("encrypted").await.err().unwrap();
+        assert_eq!(err.kind(), ErrorKind::InvalidData);
+    }
+}
@@ -0,0 +1,104 @@
+use std::{
+    collections::HashSet,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
+use uuid::Uuid;
+
+/// Uploads in progress with an idempotency key. The key is only mapped to
+/// the created object once the upload finishes, so a retry arriving before
+/// that must not start a second upload.
+pub struct IdempotencyKeys {
+    ttl: Duration,
+    in_flight: Mutex<HashSet<(Uuid, String)>>,
+}
+
+impl IdempotencyKeys {
+    /// Finished uploads are replayed for `ttl`.
+    pub fn new(ttl: Duration) -> Self {
+        Self {
+            ttl,
+            in_flight: Mutex::default(),
+        }
+    }
+
+    #[inline]
+    pub fn ttl(&self) -> Duration {
+        self.ttl
+    }
+
+    /// Marks the `key` of `owner` as in flight until the returned guard is
+    /// dropped, or returns `None` if it already is.
+    pub fn begin(
+        self: &Arc<Self>,
+        owner: Uuid,
+        key: String,
+    ) -> Option<IdempotencyGuard> {
+        let entry = (owner, key);
+
+        if !self.in_flight.lock().unwrap().insert(entry.clone()) {
+            return None;
+        }
+
+        Some(IdempotencyGuard {
+            keys: self.clone(),
+            entry,
+        })
+    }
+}
+
+pub struct IdempotencyGuard {
+    keys: Arc<IdempotencyKeys>,
+    entry: (Uuid, String),
+}
+
+impl IdempotencyGuard {
+    #[inline]
+    pub fn owner(&self) -> Uuid {
+        self.entry.0
+    }
+
+    #[inline]
+    pub fn key(&self) -> &str {
+        &self.entry.1
+    }
+}
+
+impl Drop for IdempotencyGuard {
+    fn drop(&mut self) {
+        self.keys.in_flight.lock().unwrap().remove(&self.entry);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{sync::Arc, time::Duration};
+
+    use test_log::test;
+    use uuid::Uuid;
+
+    use super::IdempotencyKeys;
+
+    #[test]
+    fn test_in_flight() {
+        let keys = Arc::new(IdempotencyKeys::new(Duration::from_secs(60)));
+        let owner = Uuid::new_v4();
+
+        let guard = keys.begin(owner, "key".into()).unwrap();
+        assert_eq!(guard.owner(), owner);
+        assert_eq!(guard.key(), "key");
+
+        assert!(
+            keys.begin(owner, "key".into()).is_none(),
+            "key began twice while in flight",
+        );
+        assert!(keys.begin(Uuid::new_v4(), "key".into()).is_some());
+
+        drop(guard);
+        assert!(
+            keys.begin(owner, "key".into()).is_some(),
+            "key still in flight after the guard was dropped",
+        );
+    }
+}
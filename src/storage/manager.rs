@@ -1,22 +1,37 @@
 use std::{
-    io::{self, ErrorKind},
-    path::PathBuf,
+    collections::HashSet,
+    io::{self, Cursor, ErrorKind, SeekFrom},
+    ops::Range,
+    sync::{Arc, Mutex},
     time::Instant,
 };
 
+use async_compression::tokio::{
+    bufread::{GzipDecoder, ZstdDecoder},
+    write::{GzipEncoder, ZstdEncoder},
+};
 use axum::http::StatusCode;
 use bytes::Bytes;
 use futures_util::{Stream, StreamExt};
-use sha2::Sha256;
-use tokio::{
-    fs::{remove_file, rename, File},
-    io::{AsyncRead, AsyncWrite, AsyncWriteExt, BufReader, BufWriter},
+use sha2::{Digest, Sha256};
+use tokio::io::{
+    copy, sink, AsyncRead, AsyncReadExt, AsyncSeekExt, AsyncWrite,
+    AsyncWriteExt, BufReader, BufWriter,
 };
 use tracing::instrument;
 use uuid::Uuid;
 
+use super::{
+    backend::{LocalStorage, Storage, StorageRead},
+    checksum::ExpectedChecksum,
+    content_cache::ContentCache,
+    encryption::{EncryptedStorage, MasterKeys},
+    sniff::ContentTypeFilter,
+};
 use crate::{
-    config::StorageConfig,
+    config::{
+        Compression, ContentTypeCheck, StorageConfig, DEFAULT_MAX_NAME_LEN,
+    },
     utils::{
         crypto::HashStream,
         fmt::{fmt_hex, fmt_since},
@@ -29,6 +44,23 @@ pub enum ObjectError {
     IoError(#[from] io::Error),
     #[error("file not found")]
     NotFound,
+    #[error("file is larger than the limit of {0} bytes")]
+    TooLarge(u64),
+    #[error("no space left to store the file")]
+    StorageFull,
+    /// The object exists, but its file is not in the storage.
+    #[error("the stored file of the object is missing")]
+    Missing,
+    #[error("the uploaded file does not match the expected checksum")]
+    ChecksumMismatch,
+    #[error("the announced checksum trailer was not sent")]
+    ChecksumMissing,
+    #[error("storing the file would exceed the quota of the user")]
+    QuotaExceeded,
+    #[error("files of type `{0}` are not accepted")]
+    UnsupportedMediaType(String),
+    #[error("another write to the file is in progress")]
+    WriteInProgress,
 }
 
 impl ObjectError {
@@ -37,6 +69,16 @@ impl ObjectError {
         match self {
             ObjectError::IoError(..) => StatusCode::INTERNAL_SERVER_ERROR,
             ObjectError::NotFound => StatusCode::NOT_FOUND,
+            ObjectError::TooLarge(..) => StatusCode::PAYLOAD_TOO_LARGE,
+            ObjectError::StorageFull => StatusCode::INSUFFICIENT_STORAGE,
+            ObjectError::Missing => StatusCode::INTERNAL_SERVER_ERROR,
+            ObjectError::ChecksumMismatch => StatusCode::BAD_REQUEST,
+            ObjectError::ChecksumMissing => StatusCode::BAD_REQUEST,
+            ObjectError::QuotaExceeded => StatusCode::PAYLOAD_TOO_LARGE,
+            ObjectError::UnsupportedMediaType(..) => {
+                StatusCode::UNSUPPORTED_MEDIA_TYPE
+            }
+            ObjectError::WriteInProgress => StatusCode::CONFLICT,
         }
     }
 
@@ -45,53 +87,322 @@ impl ObjectError {
         match self {
             ObjectError::IoError(..) => 1,
             ObjectError::NotFound => 2,
+            ObjectError::TooLarge(..) => 3,
+            ObjectError::StorageFull => 4,
+            ObjectError::Missing => 5,
+            ObjectError::ChecksumMismatch => 6,
+            ObjectError::ChecksumMissing => 7,
+            ObjectError::QuotaExceeded => 8,
+            ObjectError::UnsupportedMediaType(..) => 9,
+            ObjectError::WriteInProgress => 10,
+        }
+    }
+
+    /// Whether the same operation may succeed if tried again shortly.
+    pub fn is_transient(&self) -> bool {
+        match self {
+            ObjectError::IoError(error) => is_transient_io(error),
+            _ => false,
         }
     }
 }
 
+/// Whether the failed IO operation may succeed if tried again shortly.
+pub fn is_transient_io(error: &io::Error) -> bool {
+    matches!(
+        error.kind(),
+        io::ErrorKind::Interrupted
+            | io::ErrorKind::TimedOut
+            | io::ErrorKind::WouldBlock
+            | io::ErrorKind::ResourceBusy
+    )
+}
+
 pub struct ObjectManager {
-    data_dir: PathBuf,
-    temp_dir: PathBuf,
+    storage: Box<dyn Storage>,
+    compression: Option<Compression>,
+    content_type_check: ContentTypeCheck,
+    content_type_filter: ContentTypeFilter,
+    default_content_type: String,
+    max_name_len: usize,
+    max_upload_size: u64,
+    content_cache: Option<ContentCache>,
+    writes: Arc<WriteLocks>,
+}
+
+/// Ids of the objects being written, so concurrent writes to the same one
+/// are rejected instead of racing.
+#[derive(Default)]
+struct WriteLocks(Mutex<HashSet<Uuid>>);
+
+/// Keeps an object locked for writes until dropped.
+pub struct WriteGuard {
+    locks: Arc<WriteLocks>,
+    id: Uuid,
+}
+
+impl Drop for WriteGuard {
+    fn drop(&mut self) {
+        self.locks.0.lock().unwrap().remove(&self.id);
+    }
 }
 
 impl ObjectManager {
-    pub fn new(cfg: &StorageConfig) -> Self {
+    /// Stores the objects in the data dirs of `cfg`, encrypted when the
+    /// master keys are given.
+    pub fn new(cfg: &StorageConfig, master_keys: Option<MasterKeys>) -> Self {
+        let storage = LocalStorage::from_config(cfg);
+
+        let manager = match master_keys {
+            Some(keys) => Self::with_storage(
+                EncryptedStorage::new(storage, keys),
+                cfg.compression,
+            ),
+            None => Self::with_storage(storage, cfg.compression),
+        }
+        .with_content_type_check(cfg.content_type_check)
+        .with_content_type_filter(ContentTypeFilter::new(
+            cfg.allowed_content_types.clone(),
+            cfg.denied_content_types.clone(),
+        ))
+        .with_default_content_type(cfg.default_content_type.clone())
+        .with_max_name_len(cfg.max_name_len)
+        .with_max_upload_size(cfg.max_upload_size);
+
+        if cfg.content_cache_size > 0 {
+            manager.with_content_cache(ContentCache::new(
+                cfg.content_cache_size,
+                cfg.content_cache_max_file_size,
+            ))
+        } else {
+            manager
+        }
+    }
+
+    pub fn with_storage(
+        storage: impl Storage + 'static,
+        compression: Option<Compression>,
+    ) -> Self {
         Self {
-            data_dir: PathBuf::from(cfg.data_dir.as_str()),
-            temp_dir: PathBuf::from(cfg.temp_dir.as_str()),
+            storage: Box::new(storage),
+            compression,
+            content_type_check: ContentTypeCheck::default(),
+            content_type_filter: ContentTypeFilter::default(),
+            default_content_type: mime::OCTET_STREAM.to_string(),
+            max_name_len: DEFAULT_MAX_NAME_LEN,
+            max_upload_size: 0,
+            content_cache: None,
+            writes: Arc::default(),
+        }
+    }
+
+    pub fn with_content_type_check(mut self, check: ContentTypeCheck) -> Self {
+        self.content_type_check = check;
+        self
+    }
+
+    #[inline]
+    pub fn content_type_check(&self) -> ContentTypeCheck {
+        self.content_type_check
+    }
+
+    pub fn with_content_type_filter(
+        mut self,
+        filter: ContentTypeFilter,
+    ) -> Self {
+        self.content_type_filter = filter;
+        self
+    }
+
+    #[inline]
+    pub fn content_type_filter(&self) -> &ContentTypeFilter {
+        &self.content_type_filter
+    }
+
+    pub fn with_default_content_type(mut self, content_type: String) -> Self {
+        self.default_content_type = content_type;
+        self
+    }
+
+    /// Type of the files without one, either stored or detected.
+    #[inline]
+    pub fn default_content_type(&self) -> &str {
+        &self.default_content_type
+    }
+
+    /// The stored `content_type`, or the default one if it is empty.
+    pub fn content_type_or_default<'a>(
+        &'a self,
+        content_type: &'a str,
+    ) -> &'a str {
+        if content_type.trim().is_empty() {
+            &self.default_content_type
+        } else {
+            content_type
+        }
+    }
+
+    pub fn with_max_name_len(mut self, max_name_len: usize) -> Self {
+        self.max_name_len = max_name_len;
+        self
+    }
+
+    #[inline]
+    pub fn max_name_len(&self) -> usize {
+        self.max_name_len
+    }
+
+    /// Zero for no limit.
+    pub fn with_max_upload_size(mut self, max_upload_size: u64) -> Self {
+        self.max_upload_size = max_upload_size;
+        self
+    }
+
+    #[inline]
+    pub fn max_upload_size(&self) -> u64 {
+        self.max_upload_size
+    }
+
+    /// Serves the downloads of small files from `cache` once read.
+    pub fn with_content_cache(mut self, cache: ContentCache) -> Self {
+        self.content_cache = Some(cache);
+        self
+    }
+
+    #[inline]
+    pub fn content_cache(&self) -> Option<&ContentCache> {
+        self.content_cache.as_ref()
+    }
+
+    /// Locks the object for writes until the returned guard is dropped, or
+    /// fails with [`ObjectError::WriteInProgress`] if it already is. The
+    /// file of an existing object must only be replaced or deleted under
+    /// this lock, held until its entry is updated as well.
+    pub fn lock_write(&self, id: Uuid) -> Result<WriteGuard, ObjectError> {
+        if !self.writes.0.lock().unwrap().insert(id) {
+            return Err(ObjectError::WriteInProgress);
         }
+
+        Ok(WriteGuard {
+            locks: self.writes.clone(),
+            id,
+        })
     }
 }
 
+/// The compression used to store an object is kept as an extension of its
+/// file name, so it can be changed without migrating older objects.
+fn object_name(id: &str, compression: Option<Compression>) -> String {
+    match compression {
+        Some(compression) => format!("{id}.{}", compression.extension()),
+        None => id.to_string(),
+    }
+}
+
+/// Inverse of [`object_name`], returning [`None`] for files that were not
+/// stored by the manager.
+fn parse_object_name(name: &str) -> Option<Uuid> {
+    let id = Compression::VARIANTS
+        .iter()
+        .flatten()
+        .find_map(|compression| {
+            name.strip_suffix(compression.extension())?
+                .strip_suffix('.')
+        })
+        .unwrap_or(name);
+
+    Uuid::try_parse(id)
+        .ok()
+        .filter(|parsed| parsed.to_string() == id)
+}
+
 impl ObjectManager {
-    #[instrument(target = "object_fs", name = "store", skip(self, stream))]
+    /// Tells apart the failures of a store the client can act upon.
+    fn store_error(&self, error: io::Error) -> ObjectError {
+        if error.get_ref().is_some_and(|inner| inner.is::<OverQuota>()) {
+            return ObjectError::QuotaExceeded;
+        }
+
+        match error.kind() {
+            ErrorKind::FileTooLarge => {
+                ObjectError::TooLarge(self.max_upload_size)
+            }
+            ErrorKind::StorageFull | ErrorKind::QuotaExceeded => {
+                ObjectError::StorageFull
+            }
+            _ => error.into(),
+        }
+    }
+
+    /// Stores the object, returning its uncompressed size and checksum.
     pub async fn store(
         &self,
         id: Uuid,
+        mime_type: &str,
+        stream: impl Stream<Item = Result<Bytes, io::Error>> + Unpin,
+    ) -> Result<(u64, [u8; 32]), ObjectError> {
+        self.store_checked(
+            id,
+            mime_type,
+            stream,
+            &ExpectedChecksum::none(),
+            None,
+        )
+        .await
+    }
+
+    /// Stores the object only if its checksum is the `expected` one, once
+    /// the whole stream was read, and it fits in the `quota` bytes left to
+    /// its owner. Otherwise the file is discarded, keeping the previous one
+    /// if any.
+    #[instrument(
+        target = "object_fs",
+        name = "store",
+        skip(self, stream, expected)
+    )]
+    pub async fn store_checked(
+        &self,
+        id: Uuid,
+        mime_type: &str,
         stream: impl Stream<Item = Result<Bytes, io::Error>> + Unpin,
+        expected: &ExpectedChecksum,
+        quota: Option<u64>,
     ) -> Result<(u64, [u8; 32]), ObjectError> {
-        let mut stream = HashStream::<_, Sha256>::new(stream);
+        let stream = limit_size(stream, self.max_upload_size);
+        let mut stream =
+            HashStream::<_, Sha256>::new(limit_quota(stream, quota));
+
+        let compression = self
+            .compression
+            .filter(|_| Compression::is_worth_for(mime_type));
 
         let start = Instant::now();
 
         tracing::info!(target: "object_fs", "starting store");
 
-        let id = id.to_string();
-        let temp_dir = self.temp_dir.join(format!("{id}-incomplete"));
+        let key = id.to_string();
+        let name = object_name(&key, compression);
 
-        let file = File::create(&temp_dir).await.inspect_err(|error| {
-            tracing::error!(
-                target: "object_fs",
-                %error,
-                path = ?temp_dir,
-                took = %fmt_since(start),
-                "create file failed",
-            );
-        })?;
+        let file = self
+            .storage
+            .create(&name)
+            .await
+            .inspect_err(|error| {
+                tracing::error!(
+                    target: "object_fs",
+                    %error,
+                    %name,
+                    took = %fmt_since(start),
+                    "create file failed",
+                );
+            })
+            .map_err(|error| self.store_error(error))?;
 
         let mut file = BufWriter::with_capacity(1024 * 1024, file);
 
-        let size = match copy_impl(&mut stream, &mut file).await {
+        let size = match copy_compressed(&mut stream, &mut file, compression)
+            .await
+        {
             Ok(v) => v,
             Err(error) => {
                 tracing::warn!(
@@ -101,48 +412,83 @@ impl ObjectManager {
                     "interrupted by IO",
                 );
 
-                let _ = remove_file(&temp_dir).await.map_err(|error| {
+                let _ = file.into_inner().discard().await.map_err(|error| {
                     tracing::error!(
                         target: "object_fs",
                         %error,
-                        path = ?temp_dir,
+                        %name,
                         took = %fmt_since(start),
                         "delete file after IO interruption failed",
                     );
                 });
 
-                return Err(error.into());
+                return Err(self.store_error(error));
             }
         };
 
-        let def_dir = self.data_dir.join(&id);
+        let hash: [u8; 32] = stream.hash_into();
 
-        if let Err(error) = rename(&temp_dir, &def_dir).await {
-            tracing::error!(
+        if let Err(error) = expected.verify(&hash) {
+            tracing::warn!(
                 target: "object_fs",
                 %error,
                 took = %fmt_since(start),
-                "move file failed",
+                "rejected by checksum",
             );
 
-            let _ = remove_file(&temp_dir).await.map_err(|error| {
+            let _ = file.into_inner().discard().await.map_err(|error| {
                 tracing::error!(
                     target: "object_fs",
                     %error,
-                    path = ?temp_dir,
+                    %name,
                     took = %fmt_since(start),
-                    "delete file after move failed",
+                    "delete file after checksum mismatch failed",
                 );
             });
 
-            return Err(error.into());
+            return Err(error);
         }
 
-        let hash: [u8; 32] = stream.hash_into();
+        if let Err(error) = file.into_inner().persist().await {
+            tracing::error!(
+                target: "object_fs",
+                %error,
+                %name,
+                took = %fmt_since(start),
+                "persist file failed",
+            );
+
+            return Err(self.store_error(error));
+        }
+        if let Some(cache) = &self.content_cache {
+            cache.invalidate(id);
+        }
+
+        // The object may have been stored with another compression before
+        for other in Compression::VARIANTS {
+            if other == compression {
+                continue;
+            }
+
+            let name = object_name(&key, other);
+            match self.storage.delete(&name).await {
+                Err(error) if error.kind() != ErrorKind::NotFound => {
+                    tracing::error!(
+                        target: "object_fs",
+                        %error,
+                        %name,
+                        took = %fmt_since(start),
+                        "delete outdated file failed",
+                    );
+                }
+                _ => {}
+            }
+        }
 
         tracing::info!(
             target: "object_fs",
             took = %fmt_since(start),
+            compression = ?compression,
             written_bytes = size,
             hash = %fmt_hex(&hash),
             "finished store",
@@ -151,59 +497,173 @@ impl ObjectManager {
         Ok((size, hash))
     }
 
+    /// Fetches the object, transparently decompressing it. Small objects
+    /// are served from the content cache, if any, once read.
     #[instrument(target = "object_fs", name = "fetch", skip(self))]
     pub async fn fetch(
         &self,
         id: Uuid,
-    ) -> Result<impl AsyncRead + Unpin, ObjectError> {
+    ) -> Result<Box<dyn AsyncRead + Send + Unpin>, ObjectError> {
+        let Some(cache) = &self.content_cache else {
+            let (file, file_size, compression) = self.open(id).await?;
+            return Ok(decompress(file, Some(file_size), compression));
+        };
+
+        if let Some(data) = cache.get(id) {
+            tracing::info!(target: "object_fs", "fetched from content cache");
+            return Ok(Box::new(Cursor::new(data)));
+        }
+
+        let epoch = cache.epoch();
+        let (file, file_size, compression) = self.open(id).await?;
+        let mut reader = decompress(file, Some(file_size), compression);
+
+        // Files stored compressed are only bigger once decompressed
+        if !cache.fits(file_size) {
+            return Ok(reader);
+        }
+
+        let mut buf = Vec::with_capacity(file_size as usize);
+        (&mut reader)
+            .take(cache.max_file_size() + 1)
+            .read_to_end(&mut buf)
+            .await?;
+
+        if !cache.fits(buf.len() as u64) {
+            return Ok(Box::new(Cursor::new(buf).chain(reader)));
+        }
+
+        let data = Bytes::from(buf);
+        cache.insert(id, data.clone(), epoch);
+        Ok(Box::new(Cursor::new(data)))
+    }
+
+    /// Fetches the uncompressed bytes of the object within `range`. Objects
+    /// stored uncompressed are seeked, compressed ones have to be decoded
+    /// from the start, unless they are in the content cache.
+    #[instrument(target = "object_fs", name = "fetch_range", skip(self))]
+    pub async fn fetch_range(
+        &self,
+        id: Uuid,
+        range: Range<u64>,
+    ) -> Result<impl AsyncRead + Send + Unpin, ObjectError> {
+        let cached =
+            self.content_cache.as_ref().and_then(|cache| cache.get(id));
+        if let Some(data) = cached {
+            tracing::info!(target: "object_fs", "fetched from content cache");
+
+            let len = data.len() as u64;
+            let range =
+                range.start.min(len) as usize..range.end.min(len) as usize;
+            return Ok(Box::new(Cursor::new(data.slice(range)))
+                as Box<dyn AsyncRead + Send + Unpin>);
+        }
+
+        let (mut file, file_size, compression) = self.open(id).await?;
+        let len = range.end.saturating_sub(range.start);
+
+        if compression.is_none() {
+            file.seek(SeekFrom::Start(range.start)).await?;
+
+            let reader = decompress(file, Some(len), None);
+            return Ok(
+                Box::new(reader.take(len)) as Box<dyn AsyncRead + Send + Unpin>
+            );
+        }
+
+        let mut reader = decompress(file, Some(file_size), compression);
+        copy(&mut (&mut reader).take(range.start), &mut sink()).await?;
+
+        Ok(Box::new(reader.take(len)) as Box<dyn AsyncRead + Send + Unpin>)
+    }
+
+    /// Opens the stored file of the object, whatever compression was used
+    /// to store it.
+    async fn open(
+        &self,
+        id: Uuid,
+    ) -> Result<(Box<dyn StorageRead>, u64, Option<Compression>), ObjectError>
+    {
         let start = Instant::now();
 
         tracing::info!(target: "object_fs", "starting fetch");
 
         let id = id.to_string();
-        let path = self.data_dir.join(&id);
 
-        let file = File::open(&path).await.map_err(|error| {
-            if error.kind() == ErrorKind::NotFound {
-                ObjectError::NotFound
-            } else {
-                tracing::error!(
-                    target: "object_fs",
-                    %error,
-                    took = %fmt_since(start),
-                    path = ?path,
-                    "open file failed",
-                );
-                ObjectError::IoError(error)
+        let mut opened = None;
+        for compression in Compression::VARIANTS {
+            let name = object_name(&id, compression);
+
+            match self.storage.open(&name).await {
+                Ok((file, file_size)) => {
+                    opened = Some((file, file_size, compression));
+                    break;
+                }
+                Err(error) if error.kind() == ErrorKind::NotFound => {}
+                Err(error) => {
+                    tracing::error!(
+                        target: "object_fs",
+                        %error,
+                        took = %fmt_since(start),
+                        %name,
+                        "open file failed",
+                    );
+                    return Err(ObjectError::IoError(error));
+                }
             }
-        })?;
-
-        let file_size = file
-            .metadata()
-            .await
-            .map(|meta| meta.len())
-            .inspect_err(|error| {
-                tracing::error!(
-                    target: "object_fs",
-                    %error,
-                    took = %fmt_since(start),
-                    path = ?path,
-                    "fetch file metadata failed",
-                );
-            })
-            .ok();
-
-        debug_assert_ne!(file_size, None);
+        }
+        let (file, file_size, compression) =
+            opened.ok_or(ObjectError::NotFound)?;
 
         tracing::info!(
             target: "object_fs",
             took = %fmt_since(start),
+            compression = ?compression,
             "fetched file stream",
         );
 
-        let buf_cap = buffer_cap(file_size) as usize;
+        Ok((file, file_size, compression))
+    }
+
+    /// Lists the ids of the stored objects, along with the names of the files
+    /// that do not belong to any object.
+    pub async fn list(&self) -> Result<(Vec<Uuid>, Vec<String>), ObjectError> {
+        let mut ids = Vec::new();
+        let mut unknown = Vec::new();
+
+        for name in self.storage.list().await? {
+            match parse_object_name(&name) {
+                Some(id) => ids.push(id),
+                None => unknown.push(name),
+            }
+        }
+
+        Ok((ids, unknown))
+    }
+
+    /// Reads the whole object, returning its uncompressed size and checksum.
+    /// The stored file is always read, bypassing the content cache.
+    pub async fn checksum(
+        &self,
+        id: Uuid,
+    ) -> Result<(u64, [u8; 32]), ObjectError> {
+        let (file, file_size, compression) = self.open(id).await?;
+        let mut reader = decompress(file, Some(file_size), compression);
+
+        let mut hasher = Sha256::new();
+        let mut buf = vec![0; 64 * 1024];
+        let mut size = 0;
+
+        loop {
+            let n = reader.read(&mut buf).await?;
+            if n == 0 {
+                break;
+            }
+            hasher.update(&buf[..n]);
+            size += n as u64;
+        }
 
-        Ok(BufReader::with_capacity(buf_cap, file))
+        Ok((size, hasher.finalize().into()))
     }
 
     #[instrument(target = "object_fs", name = "delete", skip(self))]
@@ -212,28 +672,60 @@ impl ObjectManager {
 
         tracing::info!(target: "object_fs", "starting delete");
 
-        let id = id.to_string();
-        let path = self.data_dir.join(&id);
+        if let Some(cache) = &self.content_cache {
+            cache.invalidate(id);
+        }
+
+        let key = id.to_string();
+        let mut deleted = false;
+
+        for compression in Compression::VARIANTS {
+            let name = object_name(&key, compression);
+
+            match self.storage.delete(&name).await {
+                Ok(()) => deleted = true,
+                Err(error) if error.kind() == ErrorKind::NotFound => {}
+                Err(error) => {
+                    tracing::error!(
+                        target: "object_fs",
+                        %error,
+                        took = %fmt_since(start),
+                        %name,
+                        "delete file failed",
+                    );
+                    return Err(ObjectError::IoError(error));
+                }
+            }
+        }
 
-        remove_file(&path).await.map_err(|error| {
+        if !deleted {
             tracing::error!(
                 target: "object_fs",
-                %error,
                 took = %fmt_since(start),
-                path = ?path,
-                "delete file failed",
+                "delete file failed: not found",
             );
-            if error.kind() == ErrorKind::NotFound {
-                ObjectError::NotFound
-            } else {
-                ObjectError::IoError(error)
-            }
-        })?;
+            return Err(ObjectError::NotFound);
+        }
 
         Ok(())
     }
 }
 
+fn decompress(
+    file: Box<dyn StorageRead>,
+    size: Option<u64>,
+    compression: Option<Compression>,
+) -> Box<dyn AsyncRead + Send + Unpin> {
+    let buf_cap = buffer_cap(size) as usize;
+    let reader = BufReader::with_capacity(buf_cap, file);
+
+    match compression {
+        None => Box::new(reader),
+        Some(Compression::Gzip) => Box::new(GzipDecoder::new(reader)),
+        Some(Compression::Zstd) => Box::new(ZstdDecoder::new(reader)),
+    }
+}
+
 #[inline]
 const fn buffer_cap(file_size: Option<u64>) -> u64 {
     const DEFAULT_BUFFER_CAP: u64 = 8 * 1024;
@@ -253,6 +745,87 @@ const fn buffer_cap(file_size: Option<u64>) -> u64 {
     }
 }
 
+async fn copy_compressed<S, W>(
+    stream: &mut S,
+    writer: &mut W,
+    compression: Option<Compression>,
+) -> io::Result<u64>
+where
+    S: Stream<Item = Result<Bytes, io::Error>> + Unpin,
+    W: AsyncWrite + Unpin,
+{
+    match compression {
+        None => copy_impl(stream, writer).await,
+        Some(Compression::Gzip) => {
+            let mut writer = GzipEncoder::new(writer);
+            let n = copy_impl(stream, &mut writer).await?;
+            writer.shutdown().await?;
+            Ok(n)
+        }
+        Some(Compression::Zstd) => {
+            let mut writer = ZstdEncoder::new(writer);
+            let n = copy_impl(stream, &mut writer).await?;
+            writer.shutdown().await?;
+            Ok(n)
+        }
+    }
+}
+
+/// Fails the stream with [`ErrorKind::FileTooLarge`] once it goes over
+/// `max_size` bytes, zero meaning no limit.
+fn limit_size<S>(
+    stream: S,
+    max_size: u64,
+) -> impl Stream<Item = Result<Bytes, io::Error>> + Unpin
+where
+    S: Stream<Item = Result<Bytes, io::Error>> + Unpin,
+{
+    let mut total = 0u64;
+
+    stream.map(move |chunk| {
+        let chunk = chunk?;
+        total += chunk.len() as u64;
+
+        if max_size != 0 && total > max_size {
+            return Err(io::Error::new(
+                ErrorKind::FileTooLarge,
+                format!("upload is larger than {max_size} bytes"),
+            ));
+        }
+        Ok(chunk)
+    })
+}
+
+/// Marks the errors of [`limit_quota`], told apart from the other
+/// [`ErrorKind::QuotaExceeded`] errors, which are disk quotas.
+#[derive(Debug, thiserror::Error)]
+#[error("upload is larger than the {0} bytes left in the quota")]
+struct OverQuota(u64);
+
+/// Fails the stream once it goes over the `quota` bytes left to the owner of
+/// the object, [`None`] meaning no quota.
+fn limit_quota<S>(
+    stream: S,
+    quota: Option<u64>,
+) -> impl Stream<Item = Result<Bytes, io::Error>> + Unpin
+where
+    S: Stream<Item = Result<Bytes, io::Error>> + Unpin,
+{
+    let mut total = 0u64;
+
+    stream.map(move |chunk| {
+        let chunk = chunk?;
+        total += chunk.len() as u64;
+
+        match quota {
+            Some(quota) if total > quota => {
+                Err(io::Error::new(ErrorKind::QuotaExceeded, OverQuota(quota)))
+            }
+            _ => Ok(chunk),
+        }
+    })
+}
+
 pub(super) async fn copy_impl<S, W>(
     stream: &mut S,
     writer: &mut W,
@@ -301,14 +874,24 @@ mod tests {
     }
 
     fn repository() -> (ObjectManager, TempHolder) {
+        compressed_repository(None)
+    }
+
+    fn compressed_repository(
+        compression: Option<Compression>,
+    ) -> (ObjectManager, TempHolder) {
         let data_dir = tempfile::tempdir().unwrap();
         let temp_dir = tempfile::tempdir().unwrap();
 
         (
-            ObjectManager {
-                data_dir: data_dir.path().to_owned(),
-                temp_dir: temp_dir.path().to_owned(),
-            },
+            ObjectManager::with_storage(
+                LocalStorage::new(
+                    vec![data_dir.path().to_owned()],
+                    temp_dir.path().to_owned(),
+                    0,
+                ),
+                compression,
+            ),
             TempHolder { data_dir, temp_dir },
         )
     }
@@ -344,15 +927,13 @@ mod tests {
         (ReaderStream::with_capacity(file, 8192), hash)
     }
 
-    #[test(tokio::test)]
-    async fn test_store() {
+    async fn store_and_fetch(repo: ObjectManager, holder: TempHolder) {
         const SIZE: usize = 3;
 
-        let (repo, holder) = repository();
-
         let (reader, reader_hash) = create_rand_file(&holder, SIZE).await;
         let id = Uuid::new_v4();
-        let (written, store_hash) = repo.store(id, reader).await.unwrap();
+        let (written, store_hash) =
+            repo.store(id, "text/plain", reader).await.unwrap();
 
         assert!(
             reader_hash.iter().eq(store_hash.iter()),
@@ -383,6 +964,369 @@ mod tests {
         );
     }
 
+    #[test(tokio::test)]
+    async fn test_store() {
+        let (repo, holder) = repository();
+        store_and_fetch(repo, holder).await;
+    }
+
+    #[test(tokio::test)]
+    async fn test_store_gzip() {
+        let (repo, holder) = compressed_repository(Some(Compression::Gzip));
+        store_and_fetch(repo, holder).await;
+    }
+
+    #[test(tokio::test)]
+    async fn test_store_zstd() {
+        let (repo, holder) = compressed_repository(Some(Compression::Zstd));
+        store_and_fetch(repo, holder).await;
+    }
+
+    #[test(tokio::test)]
+    async fn test_store_change_compression() {
+        let (mut repo, holder) = repository();
+
+        let id = Uuid::new_v4();
+        let (reader, _) = create_rand_file(&holder, 1).await;
+        repo.store(id, "text/plain", reader).await.unwrap();
+
+        repo.compression = Some(Compression::Zstd);
+        let (reader, reader_hash) = create_rand_file(&holder, 1).await;
+        repo.store(id, "text/plain", reader).await.unwrap();
+
+        let res = repo.storage.stat(&object_name(&id.to_string(), None)).await;
+        assert!(
+            matches!(res, Err(e) if e.kind() == ErrorKind::NotFound),
+            "expected the uncompressed file to be deleted",
+        );
+
+        let mut reader =
+            HashRead::<_, Sha256>::new(repo.fetch(id).await.unwrap());
+        let mut dev_null = File::from_std(tempfile::tempfile().unwrap());
+        copy(&mut reader, &mut dev_null).await.unwrap();
+
+        let fetch_hash: [u8; 32] = reader.hash_into();
+        assert_eq!(reader_hash, fetch_hash);
+    }
+
+    #[test(tokio::test)]
+    async fn test_store_too_large() {
+        let (repo, holder) = repository();
+        let repo = repo.with_max_upload_size(1000 * 1000);
+
+        let id = Uuid::new_v4();
+        let (reader, _) = create_rand_file(&holder, 2).await;
+        let res = repo.store(id, "text/plain", reader).await;
+        assert!(
+            matches!(res, Err(ObjectError::TooLarge(1_000_000))),
+            "expected the upload to be rejected, got {res:?}",
+        );
+        assert!(
+            matches!(repo.fetch(id).await, Err(ObjectError::NotFound)),
+            "expected the partial file to be discarded",
+        );
+
+        let (reader, _) = create_rand_file(&holder, 1).await;
+        repo.store(id, "text/plain", reader).await.unwrap();
+    }
+
+    #[test(tokio::test)]
+    async fn test_store_over_quota() {
+        let (repo, holder) = repository();
+        let id = Uuid::new_v4();
+        let none = ExpectedChecksum::none();
+
+        let (reader, hash) = create_rand_file(&holder, 1).await;
+        repo.store_checked(id, "text/plain", reader, &none, Some(1000 * 1000))
+            .await
+            .unwrap();
+
+        // The stored file is kept when the replacement goes over the quota
+        let (reader, _) = create_rand_file(&holder, 2).await;
+        let res = repo
+            .store_checked(id, "text/plain", reader, &none, Some(1000 * 1000))
+            .await;
+        assert!(
+            matches!(res, Err(ObjectError::QuotaExceeded)),
+            "expected the upload to be rejected, got {res:?}",
+        );
+        assert_eq!(res.unwrap_err().status_code().as_u16(), 413);
+        assert_eq!(repo.checksum(id).await.unwrap().1, hash);
+
+        // Disk quotas are still reported as a full storage
+        let stream = futures_util::stream::iter([Err(io::Error::from(
+            ErrorKind::QuotaExceeded,
+        ))]);
+        let res = repo.store(Uuid::new_v4(), "text/plain", stream).await;
+        assert!(
+            matches!(res, Err(ObjectError::StorageFull)),
+            "expected storage full error, got {res:?}",
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_store_full() {
+        let (repo, _holder) = repository();
+
+        let stream = futures_util::stream::iter([
+            Ok(Bytes::from_static(b"partial")),
+            Err(io::Error::from(ErrorKind::StorageFull)),
+        ]);
+        let res = repo.store(Uuid::new_v4(), "text/plain", stream).await;
+
+        assert!(
+            matches!(res, Err(ObjectError::StorageFull)),
+            "expected storage full error, got {res:?}",
+        );
+        assert_eq!(res.unwrap_err().status_code().as_u16(), 507);
+    }
+
+    #[test(tokio::test)]
+    async fn test_concurrent_store() {
+        let (repo, holder) = repository();
+        let id = Uuid::new_v4();
+
+        // Both are written at once, chunk by chunk
+        let chunked = |byte: u8| {
+            let chunks = (0..64).map(move |_| {
+                Ok::<_, io::Error>(Bytes::from(vec![byte; 1024]))
+            });
+            Box::pin(futures_util::stream::iter(chunks).then(|chunk| async {
+                tokio::task::yield_now().await;
+                chunk
+            }))
+        };
+
+        let (a, b) = tokio::join!(
+            repo.store(id, "text/plain", chunked(b'a')),
+            repo.store(id, "text/plain", chunked(b'b')),
+        );
+        a.unwrap();
+        b.unwrap();
+
+        let mut buf = Vec::new();
+        repo.fetch(id)
+            .await
+            .unwrap()
+            .read_to_end(&mut buf)
+            .await
+            .unwrap();
+        assert_eq!(buf.len(), 64 * 1024);
+        assert!(
+            buf.iter().all(|&b| b == buf[0]),
+            "the stored file mixes both writes",
+        );
+
+        let temp_files = std::fs::read_dir(holder.temp_dir.path()).unwrap();
+        assert_eq!(temp_files.count(), 0);
+    }
+
+    #[test]
+    fn test_lock_write() {
+        let (repo, _holder) = repository();
+        let (id, other) = (Uuid::new_v4(), Uuid::new_v4());
+
+        let write = repo.lock_write(id).unwrap();
+        assert!(matches!(
+            repo.lock_write(id),
+            Err(ObjectError::WriteInProgress),
+        ));
+        let _other = repo.lock_write(other).unwrap();
+
+        drop(write);
+        repo.lock_write(id).unwrap();
+    }
+
+    #[test(tokio::test)]
+    async fn test_store_checked() {
+        let (repo, holder) = repository();
+        let id = Uuid::new_v4();
+
+        let (reader, hash) = create_rand_file(&holder, 1).await;
+        let expected = ExpectedChecksum::known(hash);
+        repo.store_checked(id, "text/plain", reader, &expected, None)
+            .await
+            .unwrap();
+
+        // The stored file is kept when the replacement doesn't match
+        let (reader, _) = create_rand_file(&holder, 1).await;
+        let res = repo
+            .store_checked(id, "text/plain", reader, &expected, None)
+            .await;
+        assert!(
+            matches!(res, Err(ObjectError::ChecksumMismatch)),
+            "expected the upload to be rejected, got {res:?}",
+        );
+        assert_eq!(repo.checksum(id).await.unwrap().1, hash);
+
+        let (reader, _) = create_rand_file(&holder, 1).await;
+        let res = repo
+            .store_checked(
+                Uuid::new_v4(),
+                "text/plain",
+                reader,
+                &ExpectedChecksum::pending(),
+                None,
+            )
+            .await;
+        assert!(
+            matches!(res, Err(ObjectError::ChecksumMissing)),
+            "expected the upload to be rejected, got {res:?}",
+        );
+    }
+
+    /// Run with `cargo test --release -- --ignored --nocapture bench_`
+    #[test(tokio::test)]
+    #[ignore = "benchmark"]
+    async fn bench_compression_throughput() {
+        const SIZE: usize = 64;
+
+        for compression in Compression::VARIANTS {
+            let (repo, holder) = compressed_repository(compression);
+            let id = Uuid::new_v4();
+
+            let (reader, _) = create_rand_file(&holder, SIZE).await;
+            let start = Instant::now();
+            repo.store(id, "text/plain", reader).await.unwrap();
+            let write_secs = start.elapsed().as_secs_f64();
+
+            let mut reader = repo.fetch(id).await.unwrap();
+            let mut dev_null = File::from_std(tempfile::tempfile().unwrap());
+            let start = Instant::now();
+            copy(&mut reader, &mut dev_null).await.unwrap();
+            let read_secs = start.elapsed().as_secs_f64();
+
+            println!(
+                "{compression:?}: write {:.1} MB/s, read {:.1} MB/s",
+                SIZE as f64 / write_secs,
+                SIZE as f64 / read_secs,
+            );
+        }
+    }
+
+    #[test(tokio::test)]
+    async fn test_list_and_checksum() {
+        let (repo, holder) = compressed_repository(Some(Compression::Gzip));
+
+        let plain_id = Uuid::new_v4();
+        let (reader, plain_hash) = create_rand_file(&holder, 1).await;
+        repo.store(plain_id, "image/png", reader).await.unwrap();
+
+        let gzip_id = Uuid::new_v4();
+        let (reader, gzip_hash) = create_rand_file(&holder, 1).await;
+        repo.store(gzip_id, "text/plain", reader).await.unwrap();
+
+        std::fs::write(holder.data_dir.path().join("unknown"), b"").unwrap();
+
+        let (mut ids, unknown) = repo.list().await.unwrap();
+        ids.sort();
+        let mut expected = vec![plain_id, gzip_id];
+        expected.sort();
+
+        assert_eq!(ids, expected);
+        assert_eq!(unknown, ["unknown"]);
+
+        let (size, hash) = repo.checksum(plain_id).await.unwrap();
+        assert_eq!(size, 1000 * 1000);
+        assert_eq!(hash, plain_hash);
+
+        let (size, hash) = repo.checksum(gzip_id).await.unwrap();
+        assert_eq!(size, 1000 * 1000);
+        assert_eq!(hash, gzip_hash);
+    }
+
+    #[test(tokio::test)]
+    async fn test_fetch_range() {
+        let data: Vec<u8> = (0..100_000).map(|i| (i % 251) as u8).collect();
+
+        for compression in Compression::VARIANTS {
+            let (repo, _holder) = compressed_repository(compression);
+
+            let id = Uuid::new_v4();
+            let stream = futures_util::stream::iter([Ok::<_, io::Error>(
+                Bytes::from(data.clone()),
+            )]);
+            repo.store(id, "text/plain", stream).await.unwrap();
+
+            for range in [0..10, 1234..56789, 99_990..100_000] {
+                let mut reader =
+                    repo.fetch_range(id, range.clone()).await.unwrap();
+
+                let mut buf = Vec::new();
+                reader.read_to_end(&mut buf).await.unwrap();
+                assert_eq!(
+                    buf,
+                    data[range.start as usize..range.end as usize],
+                    "range {range:?} mismatch with {compression:?}",
+                );
+            }
+        }
+    }
+
+    #[test(tokio::test)]
+    async fn test_content_cache() {
+        let (repo, _holder) = compressed_repository(Some(Compression::Zstd));
+        let repo = &repo.with_content_cache(ContentCache::new(1000, 100));
+
+        let read = move |id| async move {
+            let mut buf = Vec::new();
+            let mut reader = repo.fetch(id).await.unwrap();
+            reader.read_to_end(&mut buf).await.unwrap();
+            buf
+        };
+        let store = move |id, data: &'static [u8]| {
+            let stream = futures_util::stream::iter([Ok::<_, io::Error>(
+                Bytes::from_static(data),
+            )]);
+            repo.store(id, "text/plain", stream)
+        };
+
+        let (small, large) = (Uuid::new_v4(), Uuid::new_v4());
+        store(small, b"small file").await.unwrap();
+        store(large, &[b'a'; 1000]).await.unwrap();
+
+        assert_eq!(read(small).await, b"small file");
+        assert_eq!(read(small).await, b"small file");
+        // Stored smaller than the limit, but bigger once decompressed
+        assert_eq!(read(large).await, [b'a'; 1000]);
+        assert_eq!(read(large).await, [b'a'; 1000]);
+
+        let mut buf = Vec::new();
+        let mut reader = repo.fetch_range(small, 6..10).await.unwrap();
+        reader.read_to_end(&mut buf).await.unwrap();
+        assert_eq!(buf, b"file");
+
+        let stats = repo.content_cache().unwrap().stats();
+        assert_eq!((stats.entries, stats.size), (1, 10));
+        assert_eq!((stats.hits, stats.misses), (2, 3));
+
+        // Replaced and deleted files are never served from the cache
+        store(small, b"replaced").await.unwrap();
+        assert_eq!(read(small).await, b"replaced");
+
+        repo.delete(small).await.unwrap();
+        assert!(matches!(
+            repo.fetch(small).await,
+            Err(ObjectError::NotFound)
+        ));
+        assert_eq!(repo.content_cache().unwrap().stats().entries, 0);
+    }
+
+    #[test]
+    fn test_parse_object_name() {
+        let id = Uuid::new_v4();
+
+        for compression in Compression::VARIANTS {
+            let name = object_name(&id.to_string(), compression);
+            assert_eq!(parse_object_name(&name), Some(id));
+        }
+
+        assert_eq!(parse_object_name("unknown"), None);
+        assert_eq!(parse_object_name(&format!("{id}.tar")), None);
+        assert_eq!(parse_object_name(&format!("{id}-incomplete")), None);
+        assert_eq!(parse_object_name(&id.simple().to_string()), None);
+    }
+
     #[test(tokio::test)]
     async fn test_delete() {
         const SIZE: usize = 1;
@@ -398,7 +1342,7 @@ mod tests {
         );
 
         let (reader, _) = create_rand_file(&holder, SIZE).await;
-        repo.store(id, reader).await.unwrap();
+        repo.store(id, "text/plain", reader).await.unwrap();
 
         repo.fetch(id).await.expect("could not fetch created file");
         repo.delete(id)
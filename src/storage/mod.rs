@@ -3,9 +3,30 @@ use serde::{Deserialize, Serialize};
 use sqlx::{ColumnIndex, Decode, FromRow, Row, Type};
 use uuid::Uuid;
 
+pub mod archive;
+pub mod backend;
+pub mod cache;
+pub mod checksum;
+pub mod conditional;
+pub mod content_cache;
+pub mod disposition;
+pub mod encryption;
+pub mod idempotency;
 pub mod manager;
+pub mod name;
+pub mod progress;
+pub mod quota;
+pub mod range;
 pub mod repository;
+pub mod resume;
 pub mod routes;
+pub mod scrub;
+pub mod selector;
+pub mod sniff;
+pub mod sweeper;
+pub mod tag;
+pub mod throttle;
+pub mod timeout;
 
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
 #[serde(deny_unknown_fields)]
@@ -14,6 +35,14 @@ pub struct Object {
     pub user_id: Uuid,
     pub created_at: DateTime<Utc>,
     pub updated_at: DateTime<Utc>,
+    #[serde(default)]
+    pub expires_at: Option<DateTime<Utc>>,
+    #[serde(default)]
+    pub download_count: u64,
+    #[serde(default)]
+    pub max_downloads: Option<u64>,
+    #[serde(default)]
+    pub public: bool,
     pub data: ObjectData,
 }
 
@@ -59,6 +88,36 @@ where
                 )
             })?;
 
+        let expires_at: Option<i64> = row.try_get("expires_at")?;
+        let expires_at = expires_at
+            .map(|expires_at| {
+                DateTime::from_timestamp_millis(expires_at).ok_or_else(|| {
+                    sqlx::Error::Decode(
+                        "parse `expires_at` field gone wrong".into(),
+                    )
+                })
+            })
+            .transpose()?;
+
+        let download_count: i64 = row.try_get("download_count")?;
+        let download_count = download_count.try_into().map_err(|_| {
+            sqlx::Error::Decode("parse `download_count` out of range".into())
+        })?;
+
+        let max_downloads: Option<i64> = row.try_get("max_downloads")?;
+        let max_downloads = max_downloads
+            .map(|v| {
+                v.try_into().map_err(|_| {
+                    sqlx::Error::Decode(
+                        "parse `max_downloads` out of range".into(),
+                    )
+                })
+            })
+            .transpose()?;
+
+        let public: i64 = row.try_get("public")?;
+        let public = public != 0;
+
         let name: String = row.try_get("name")?;
         let mime_type: String = row.try_get("mime_type")?;
 
@@ -79,6 +138,10 @@ where
             user_id,
             created_at,
             updated_at,
+            expires_at,
+            download_count,
+            max_downloads,
+            public,
             data: ObjectData {
                 name,
                 mime_type,
@@ -89,6 +152,15 @@ where
     }
 }
 
+/// Per-object settings chosen when the object is created.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ObjectOptions {
+    pub expires_at: Option<DateTime<Utc>>,
+    pub max_downloads: Option<u64>,
+    /// Whether the object can be read without authorization.
+    pub public: bool,
+}
+
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
 #[serde(deny_unknown_fields)]
 pub struct ObjectData {
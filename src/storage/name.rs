@@ -0,0 +1,52 @@
+use unicode_normalization::UnicodeNormalization;
+
+use crate::errors::{FieldViolation, ValidationError};
+
+/// Normalizes an object name to NFC, so the same name is always stored with
+/// the same bytes, and checks it fits in `max_len` bytes.
+pub fn normalize_name(
+    field: &'static str,
+    name: &str,
+    max_len: usize,
+) -> Result<String, ValidationError> {
+    let name: String = name.nfc().collect();
+
+    if name.len() > max_len {
+        return Err(ValidationError(vec![FieldViolation::new(
+            field,
+            "length",
+            format!(
+                "must have at most {max_len} bytes once normalized, got {}",
+                name.len(),
+            ),
+        )]));
+    }
+
+    Ok(name)
+}
+
+#[cfg(test)]
+mod tests {
+    use test_log::test;
+
+    use super::normalize_name;
+
+    #[test]
+    fn test_normalize_name() {
+        // `e` followed by a combining acute accent
+        let name = normalize_name("name", "re\u{301}sume\u{301}.pdf", 255);
+        assert_eq!(name.unwrap(), "r\u{e9}sum\u{e9}.pdf");
+    }
+
+    #[test]
+    fn test_name_too_long() {
+        assert!(normalize_name("name", &"a".repeat(255), 255).is_ok());
+
+        let err = normalize_name("name", &"a".repeat(256), 255).unwrap_err();
+        assert_eq!(err.0[0].field, "name");
+        assert_eq!(err.0[0].rule, "length");
+
+        let combining = format!("a{}", "\u{301}".repeat(1000));
+        assert!(normalize_name("name", &combining, 255).is_err());
+    }
+}
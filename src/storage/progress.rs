@@ -0,0 +1,141 @@
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+};
+
+use tokio::sync::watch;
+use uuid::Uuid;
+
+struct Upload {
+    owner: Option<Uuid>,
+    sender: watch::Sender<u64>,
+}
+
+/// Bytes received by the uploads in progress, so clients can follow them
+/// while the request body is still being sent.
+#[derive(Default)]
+pub struct UploadProgress {
+    uploads: Mutex<HashMap<Uuid, Upload>>,
+}
+
+impl UploadProgress {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Publishes the progress of the upload `id` until the returned tracker
+    /// is dropped. A previous upload with the same id stops being reported.
+    pub fn start(
+        self: &Arc<Self>,
+        id: Uuid,
+        owner: Option<Uuid>,
+    ) -> ProgressTracker {
+        let (sender, _) = watch::channel(0);
+
+        self.uploads.lock().unwrap().insert(
+            id,
+            Upload {
+                owner,
+                sender: sender.clone(),
+            },
+        );
+
+        ProgressTracker {
+            progress: self.clone(),
+            id,
+            sender,
+        }
+    }
+
+    /// Returns the owner of the upload `id` and a receiver of the number of
+    /// bytes received so far. The receiver is closed once the upload ends.
+    pub fn subscribe(
+        &self,
+        id: Uuid,
+    ) -> Option<(Option<Uuid>, watch::Receiver<u64>)> {
+        self.uploads
+            .lock()
+            .unwrap()
+            .get(&id)
+            .map(|upload| (upload.owner, upload.sender.subscribe()))
+    }
+}
+
+pub struct ProgressTracker {
+    progress: Arc<UploadProgress>,
+    id: Uuid,
+    sender: watch::Sender<u64>,
+}
+
+impl ProgressTracker {
+    #[inline]
+    pub fn add(&self, bytes: usize) {
+        self.sender
+            .send_modify(|received| *received += bytes as u64);
+    }
+}
+
+impl Drop for ProgressTracker {
+    fn drop(&mut self) {
+        let mut uploads = self.progress.uploads.lock().unwrap();
+
+        let is_current = uploads
+            .get(&self.id)
+            .is_some_and(|upload| upload.sender.same_channel(&self.sender));
+        if is_current {
+            uploads.remove(&self.id);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use test_log::test;
+    use uuid::Uuid;
+
+    use super::UploadProgress;
+
+    #[test(tokio::test)]
+    async fn test_progress() {
+        let progress = Arc::new(UploadProgress::new());
+        let id = Uuid::new_v4();
+        let owner = Some(Uuid::new_v4());
+
+        assert!(progress.subscribe(id).is_none());
+
+        let tracker = progress.start(id, owner);
+        let (got_owner, mut rx) = progress.subscribe(id).unwrap();
+        assert_eq!(got_owner, owner);
+
+        tracker.add(10);
+        tracker.add(5);
+        rx.changed().await.unwrap();
+        assert_eq!(*rx.borrow_and_update(), 15);
+
+        drop(tracker);
+        assert!(
+            rx.changed().await.is_err(),
+            "receiver not closed after the upload ended",
+        );
+        assert!(progress.subscribe(id).is_none());
+    }
+
+    #[test(tokio::test)]
+    async fn test_progress_replaced() {
+        let progress = Arc::new(UploadProgress::new());
+        let id = Uuid::new_v4();
+
+        let old = progress.start(id, None);
+        let new = progress.start(id, None);
+        drop(old);
+
+        let (_, rx) = progress
+            .subscribe(id)
+            .expect("ending an old upload removed the current one");
+
+        new.add(3);
+        assert_eq!(*rx.borrow(), 3);
+    }
+}
@@ -0,0 +1,366 @@
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex as StdMutex},
+};
+
+use serde::Serialize;
+use sqlx::Sqlite;
+use tokio::sync::{Mutex, OwnedMutexGuard};
+use uuid::Uuid;
+
+use crate::{
+    auth::Permission,
+    config::{QuotaConfig, UserRole},
+    errors::DownloaderError,
+    user::{repository::UserRepository, User},
+};
+
+use super::{
+    manager::ObjectError,
+    repository::{ObjectRepository, RepositoryError},
+};
+
+/// Bytes stored by a user, out of its quota.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+pub struct QuotaUsage {
+    pub used: u64,
+    /// [`None`] when the user has no quota.
+    pub quota: Option<u64>,
+}
+
+/// Limits the bytes each user may store. The usage is the sum of the size
+/// of the objects of the user, so it can't drift from what is stored.
+pub struct Quotas {
+    cfg: QuotaConfig,
+    users: UserRepository<Sqlite>,
+    objects: ObjectRepository<Sqlite>,
+    locks: UserLocks,
+}
+
+/// The bytes a user can still store, held until the write charged to it is
+/// saved. The writes of a user with a quota run one at a time, so they
+/// can't each see the same remaining bytes and together go over it.
+pub struct QuotaReservation<'a> {
+    remaining: Option<u64>,
+    _lock: Option<UserLock<'a>>,
+}
+
+impl QuotaReservation<'_> {
+    /// [`None`] if the user has no quota.
+    #[inline]
+    pub fn remaining(&self) -> Option<u64> {
+        self.remaining
+    }
+}
+
+#[derive(Default)]
+struct UserLocks(StdMutex<HashMap<Uuid, Arc<Mutex<()>>>>);
+
+impl UserLocks {
+    async fn lock(&self, user_id: Uuid) -> UserLock<'_> {
+        let mutex = self.0.lock().unwrap().entry(user_id).or_default().clone();
+
+        UserLock {
+            locks: self,
+            guard: Some(mutex.lock_owned().await),
+        }
+    }
+}
+
+/// Forgets the locks nobody holds or waits for once released.
+struct UserLock<'a> {
+    locks: &'a UserLocks,
+    guard: Option<OwnedMutexGuard<()>>,
+}
+
+impl Drop for UserLock<'_> {
+    fn drop(&mut self) {
+        drop(self.guard.take());
+        self.locks
+            .0
+            .lock()
+            .unwrap()
+            .retain(|_, mutex| Arc::strong_count(mutex) > 1);
+    }
+}
+
+impl Quotas {
+    pub fn new(
+        cfg: QuotaConfig,
+        users: UserRepository<Sqlite>,
+        objects: ObjectRepository<Sqlite>,
+    ) -> Self {
+        Self {
+            cfg,
+            users,
+            objects,
+            locks: UserLocks::default(),
+        }
+    }
+
+    fn limit(&self, quota: Option<u64>, permission: Permission) -> Option<u64> {
+        let quota = quota.unwrap_or_else(|| {
+            self.cfg
+                .roles
+                .get(&UserRole::of(permission))
+                .copied()
+                .unwrap_or(self.cfg.user_quota)
+        });
+
+        Some(quota).filter(|&quota| quota > 0)
+    }
+
+    /// The quota set for the user, or else the one of its role.
+    #[inline]
+    pub fn limit_of(&self, user: &User) -> Option<u64> {
+        self.limit(user.quota, user.permission)
+    }
+
+    pub async fn usage(
+        &self,
+        user: &User,
+    ) -> Result<QuotaUsage, RepositoryError> {
+        Ok(QuotaUsage {
+            used: self.objects.usage(user.id).await?,
+            quota: self.limit_of(user),
+        })
+    }
+
+    /// Reserves how many bytes the user can still store once the `freed`
+    /// ones are, waiting for the other writes charged to it. Fails if the
+    /// user is no longer stored, as nothing should be charged to it.
+    pub async fn reserve(
+        &self,
+        user_id: Uuid,
+        freed: u64,
+    ) -> Result<QuotaReservation<'_>, DownloaderError> {
+        let user = self.users.get(user_id).await?;
+        let Some(quota) = self.limit_of(&user) else {
+            return Ok(QuotaReservation {
+                remaining: None,
+                _lock: None,
+            });
+        };
+
+        let lock = self.locks.lock(user_id).await;
+        let used = self.objects.usage(user_id).await?;
+
+        Ok(QuotaReservation {
+            remaining: Some(quota.saturating_sub(used.saturating_sub(freed))),
+            _lock: Some(lock),
+        })
+    }
+
+    /// Fails with [`ObjectError::QuotaExceeded`] unless `size` more bytes
+    /// fit in the quota of the user, reserving them otherwise.
+    pub async fn check_fits(
+        &self,
+        user_id: Uuid,
+        size: u64,
+    ) -> Result<QuotaReservation<'_>, DownloaderError> {
+        let reservation = self.reserve(user_id, 0).await?;
+        match reservation.remaining {
+            Some(remaining) if size > remaining => {
+                Err(ObjectError::QuotaExceeded.into())
+            }
+            _ => Ok(reservation),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{collections::HashMap, time::Duration};
+
+    use sha2::{Digest, Sha256};
+    use sqlx::{migrate, SqlitePool};
+    use test_log::test;
+    use uuid::Uuid;
+
+    use crate::{
+        auth::Permission,
+        config::{QuotaConfig, UserRole},
+        errors::DownloaderError,
+        storage::{
+            manager::ObjectError, repository::ObjectRepository, ObjectData,
+            ObjectOptions,
+        },
+        user::{repository::UserRepository, UserData, UserError},
+    };
+
+    use super::{QuotaUsage, Quotas};
+
+    fn object_data(size: u64) -> ObjectData {
+        ObjectData {
+            name: Uuid::new_v4().to_string(),
+            mime_type: "text/plain".into(),
+            size,
+            checksum_256: Sha256::digest(Uuid::new_v4()).into(),
+        }
+    }
+
+    #[test(tokio::test)]
+    async fn test_quotas() {
+        let db = SqlitePool::connect("sqlite::memory:").await.unwrap();
+        migrate!().run(&db).await.unwrap();
+
+        let users = UserRepository::new(db.clone(), 4);
+        let objects = ObjectRepository::new(db);
+        let cfg = QuotaConfig {
+            user_quota: 1000,
+            roles: HashMap::from([(UserRole::Admin, 0)]),
+        };
+        let quotas = Quotas::new(cfg, users.clone(), objects.clone());
+
+        let user = users
+            .create(
+                Permission::UNPRIVILEGED,
+                UserData {
+                    username: Uuid::new_v4().to_string(),
+                    password: Uuid::new_v4().to_string(),
+                },
+            )
+            .await
+            .unwrap();
+
+        for size in [300, 200] {
+            objects
+                .create(
+                    Uuid::new_v4(),
+                    user.id,
+                    object_data(size),
+                    ObjectOptions::default(),
+                )
+                .await
+                .unwrap();
+        }
+
+        assert_eq!(
+            quotas.usage(&user).await.unwrap(),
+            QuotaUsage {
+                used: 500,
+                quota: Some(1000),
+            },
+        );
+        let (quotas, user_id) = (&quotas, user.id);
+        let remaining = move |freed| async move {
+            quotas.reserve(user_id, freed).await.unwrap().remaining()
+        };
+        assert_eq!(remaining(0).await, Some(500));
+        assert_eq!(remaining(300).await, Some(800));
+
+        // Overridden below the usage
+        let user = users.update_quota(user.id, Some(400)).await.unwrap();
+        assert_eq!(quotas.limit_of(&user), Some(400));
+        assert_eq!(remaining(0).await, Some(0));
+
+        let user = users.update_quota(user.id, Some(0)).await.unwrap();
+        assert_eq!(quotas.limit_of(&user), None);
+        assert_eq!(remaining(0).await, None);
+
+        // Nothing is charged to unknown users
+        let res = quotas
+            .reserve(Uuid::new_v4(), 0)
+            .await
+            .map(|r| r.remaining());
+        assert!(
+            matches!(res, Err(DownloaderError::User(UserError::NotFound))),
+            "expected user not found error, got {res:?}",
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_concurrent_reservations() {
+        let db = SqlitePool::connect("sqlite::memory:").await.unwrap();
+        migrate!().run(&db).await.unwrap();
+
+        let users = UserRepository::new(db.clone(), 4);
+        let objects = ObjectRepository::new(db);
+        let cfg = QuotaConfig {
+            user_quota: 1000,
+            roles: HashMap::new(),
+        };
+        let quotas = Quotas::new(cfg, users.clone(), objects.clone());
+
+        let user = users
+            .create(
+                Permission::UNPRIVILEGED,
+                UserData {
+                    username: Uuid::new_v4().to_string(),
+                    password: Uuid::new_v4().to_string(),
+                },
+            )
+            .await
+            .unwrap();
+
+        let first = quotas.reserve(user.id, 0).await.unwrap();
+        assert_eq!(first.remaining(), Some(1000));
+
+        // Waits until the first write is saved
+        let second = quotas.reserve(user.id, 0);
+        tokio::pin!(second);
+        let waited =
+            tokio::time::timeout(Duration::from_millis(50), &mut second).await;
+        assert!(waited.is_err(), "second reservation did not wait");
+
+        objects
+            .create(
+                Uuid::new_v4(),
+                user.id,
+                object_data(600),
+                ObjectOptions::default(),
+            )
+            .await
+            .unwrap();
+        drop(first);
+
+        let second = second.await.unwrap();
+        assert_eq!(second.remaining(), Some(400));
+        drop(second);
+        assert!(quotas.locks.0.lock().unwrap().is_empty());
+    }
+
+    #[test(tokio::test)]
+    async fn test_check_fits() {
+        let db = SqlitePool::connect("sqlite::memory:").await.unwrap();
+        migrate!().run(&db).await.unwrap();
+
+        let users = UserRepository::new(db.clone(), 4);
+        let objects = ObjectRepository::new(db);
+        let cfg = QuotaConfig {
+            user_quota: 1000,
+            roles: HashMap::new(),
+        };
+        let quotas = Quotas::new(cfg, users.clone(), objects.clone());
+
+        let user = users
+            .create(
+                Permission::UNPRIVILEGED,
+                UserData {
+                    username: Uuid::new_v4().to_string(),
+                    password: Uuid::new_v4().to_string(),
+                },
+            )
+            .await
+            .unwrap();
+        objects
+            .create(
+                Uuid::new_v4(),
+                user.id,
+                object_data(600),
+                ObjectOptions::default(),
+            )
+            .await
+            .unwrap();
+
+        quotas.check_fits(user.id, 400).await.unwrap();
+        let res = quotas.check_fits(user.id, 401).await.map(|_| ());
+        assert!(
+            matches!(
+                res,
+                Err(DownloaderError::Object(ObjectError::QuotaExceeded))
+            ),
+            "expected quota exceeded error, got {res:?}",
+        );
+    }
+}
@@ -0,0 +1,318 @@
+use std::ops::Range;
+
+use axum::http::{header, HeaderMap};
+use rand::RngCore;
+
+/// Most ranges served by a single response. Requests with more get the
+/// whole object, so a client can't make the server seek through a file
+/// thousands of times.
+pub const MAX_RANGES: usize = 16;
+
+/// The part of an object requested with the `Range` header.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum ByteRange {
+    /// The whole object. Also used for invalid ranges, which can be ignored
+    /// (RFC 9110, section 14.2).
+    Full,
+    /// Bytes from `start` up to, but not including, `end`.
+    Partial(Range<u64>),
+    /// Several disjoint ranges, in order, sent as `multipart/byteranges`.
+    Multiple(Vec<Range<u64>>),
+    /// Every range starts past the end of the object.
+    Unsatisfiable,
+}
+
+/// Parses the `bytes` ranges of an object with `size` bytes. Overlapping
+/// and adjacent ranges are coalesced, and the unsatisfiable ones dropped.
+pub fn parse_range(headers: &HeaderMap, size: u64) -> ByteRange {
+    let Some(value) = headers.get(header::RANGE) else {
+        return ByteRange::Full;
+    };
+    let Ok(value) = value.to_str() else {
+        return ByteRange::Full;
+    };
+
+    let Some((unit, specs)) = value.split_once('=') else {
+        return ByteRange::Full;
+    };
+    if !unit.trim().eq_ignore_ascii_case("bytes") {
+        return ByteRange::Full;
+    }
+
+    let specs = specs
+        .split(',')
+        .map(str::trim)
+        .filter(|spec| !spec.is_empty())
+        .collect::<Vec<_>>();
+    if specs.is_empty() || specs.len() > MAX_RANGES {
+        return ByteRange::Full;
+    }
+
+    let mut ranges = Vec::with_capacity(specs.len());
+    for spec in specs {
+        match parse_spec(spec, size) {
+            ByteRange::Partial(range) => ranges.push(range),
+            ByteRange::Unsatisfiable => {}
+            _ => return ByteRange::Full,
+        }
+    }
+
+    let mut ranges = coalesce(ranges);
+    match ranges.len() {
+        0 => ByteRange::Unsatisfiable,
+        1 => ByteRange::Partial(ranges.remove(0)),
+        _ => ByteRange::Multiple(ranges),
+    }
+}
+
+/// Parses a single range, [`ByteRange::Full`] meaning it is invalid.
+fn parse_spec(spec: &str, size: u64) -> ByteRange {
+    let Some((start, end)) = spec.split_once('-') else {
+        return ByteRange::Full;
+    };
+
+    match (parse_pos(start), parse_pos(end)) {
+        // bytes=start-end
+        (Some(start), Some(end)) if start <= end => {
+            if start >= size {
+                return ByteRange::Unsatisfiable;
+            }
+            ByteRange::Partial(start..size.min(end.saturating_add(1)))
+        }
+        // bytes=start-
+        (Some(start), None) if end.is_empty() => {
+            if start >= size {
+                return ByteRange::Unsatisfiable;
+            }
+            ByteRange::Partial(start..size)
+        }
+        // bytes=-suffix_len
+        (None, Some(suffix_len)) if start.is_empty() => {
+            if suffix_len == 0 || size == 0 {
+                return ByteRange::Unsatisfiable;
+            }
+            ByteRange::Partial(size.saturating_sub(suffix_len)..size)
+        }
+        _ => ByteRange::Full,
+    }
+}
+
+/// Sorts the ranges, merging the ones that overlap or are adjacent.
+fn coalesce(mut ranges: Vec<Range<u64>>) -> Vec<Range<u64>> {
+    ranges.sort_by_key(|range| range.start);
+
+    let mut merged: Vec<Range<u64>> = Vec::with_capacity(ranges.len());
+    for range in ranges {
+        match merged.last_mut() {
+            Some(last) if range.start <= last.end => {
+                last.end = last.end.max(range.end);
+            }
+            _ => merged.push(range),
+        }
+    }
+    merged
+}
+
+/// Parses a non-empty run of digits, unlike [`str::parse`] that also
+/// accepts a leading `+`.
+fn parse_pos(s: &str) -> Option<u64> {
+    if s.is_empty() || !s.bytes().all(|b| b.is_ascii_digit()) {
+        return None;
+    }
+    s.parse().ok()
+}
+
+/// Formats the `Content-Range` of a partial response.
+pub fn content_range(range: &Range<u64>, size: u64) -> String {
+    format!("bytes {}-{}/{size}", range.start, range.end - 1)
+}
+
+/// The framing of a `multipart/byteranges` body (RFC 9110, section 14.6),
+/// each part being preceded by its headers.
+pub struct MultipartRanges {
+    boundary: String,
+    parts: Vec<(Range<u64>, String)>,
+}
+
+impl MultipartRanges {
+    /// `content_type` is the one of the object, sent in every part.
+    pub fn new(ranges: Vec<Range<u64>>, content_type: &str, size: u64) -> Self {
+        let mut bytes = [0u8; 16];
+        rand::thread_rng().fill_bytes(&mut bytes);
+        let boundary = hex::encode(bytes);
+
+        let parts = ranges
+            .into_iter()
+            .enumerate()
+            .map(|(i, range)| {
+                // The delimiter of every part but the first ends the last one
+                let header = format!(
+                    "{}--{boundary}\r\n\
+                    Content-Type: {content_type}\r\n\
+                    Content-Range: {}\r\n\r\n",
+                    if i == 0 { "" } else { "\r\n" },
+                    content_range(&range, size),
+                );
+                (range, header)
+            })
+            .collect();
+
+        Self { boundary, parts }
+    }
+
+    pub fn content_type(&self) -> String {
+        format!("multipart/byteranges; boundary={}", self.boundary)
+    }
+
+    /// The ranges in order, each with the headers sent before it.
+    pub fn parts(&self) -> &[(Range<u64>, String)] {
+        &self.parts
+    }
+
+    /// Sent after the last part.
+    pub fn trailer(&self) -> String {
+        format!("\r\n--{}--\r\n", self.boundary)
+    }
+
+    /// Length of the whole body, parts included.
+    pub fn content_length(&self) -> u64 {
+        let parts = self
+            .parts
+            .iter()
+            .map(|(range, header)| {
+                header.len() as u64 + range.end - range.start
+            })
+            .sum::<u64>();
+
+        parts + self.trailer().len() as u64
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use axum::http::{header, HeaderMap, HeaderValue};
+
+    use super::{
+        content_range, parse_range, ByteRange, MultipartRanges, MAX_RANGES,
+    };
+
+    fn parse(value: &'static str, size: u64) -> ByteRange {
+        let mut headers = HeaderMap::new();
+        headers.insert(header::RANGE, HeaderValue::from_static(value));
+
+        parse_range(&headers, size)
+    }
+
+    #[test]
+    fn test_parse_range() {
+        assert_eq!(parse_range(&HeaderMap::new(), 100), ByteRange::Full);
+
+        assert_eq!(parse("bytes=0-9", 100), ByteRange::Partial(0..10));
+        assert_eq!(parse("bytes=10-", 100), ByteRange::Partial(10..100));
+        assert_eq!(parse("bytes=-10", 100), ByteRange::Partial(90..100));
+        assert_eq!(parse("bytes=-500", 100), ByteRange::Partial(0..100));
+        assert_eq!(parse("bytes=90-500", 100), ByteRange::Partial(90..100));
+        assert_eq!(parse("Bytes=0-0", 100), ByteRange::Partial(0..1));
+    }
+
+    #[test]
+    fn test_parse_range_unsatisfiable() {
+        assert_eq!(parse("bytes=100-", 100), ByteRange::Unsatisfiable);
+        assert_eq!(parse("bytes=100-200", 100), ByteRange::Unsatisfiable);
+        assert_eq!(parse("bytes=-0", 100), ByteRange::Unsatisfiable);
+        assert_eq!(parse("bytes=0-", 0), ByteRange::Unsatisfiable);
+    }
+
+    #[test]
+    fn test_parse_range_ignored() {
+        assert_eq!(parse("items=0-9", 100), ByteRange::Full);
+        assert_eq!(parse("bytes=9-0", 100), ByteRange::Full);
+        assert_eq!(parse("bytes=a-b", 100), ByteRange::Full);
+        assert_eq!(parse("bytes=-", 100), ByteRange::Full);
+        assert_eq!(parse("bytes=+1-2", 100), ByteRange::Full);
+    }
+
+    #[test]
+    fn test_parse_multiple_ranges() {
+        assert_eq!(
+            parse("bytes=0-9, 20-29", 100),
+            ByteRange::Multiple(vec![0..10, 20..30]),
+        );
+        assert_eq!(
+            parse("bytes=50-59,0-9,-5", 100),
+            ByteRange::Multiple(vec![0..10, 50..60, 95..100]),
+        );
+        // Unsatisfiable ranges are dropped
+        assert_eq!(
+            parse("bytes=0-9,200-,20-29", 100),
+            ByteRange::Multiple(vec![0..10, 20..30]),
+        );
+        assert_eq!(parse("bytes=0-9,200-", 100), ByteRange::Partial(0..10));
+        assert_eq!(parse("bytes=200-,300-", 100), ByteRange::Unsatisfiable);
+        // A single invalid range invalidates the header
+        assert_eq!(parse("bytes=0-9,a-b", 100), ByteRange::Full);
+    }
+
+    #[test]
+    fn test_coalesce_ranges() {
+        assert_eq!(parse("bytes=0-9,5-19", 100), ByteRange::Partial(0..20));
+        assert_eq!(parse("bytes=0-9,10-19", 100), ByteRange::Partial(0..20));
+        assert_eq!(
+            parse("bytes=0-9,2-3,30-39,35-", 100),
+            ByteRange::Multiple(vec![0..10, 30..100]),
+        );
+    }
+
+    #[test]
+    fn test_max_ranges() {
+        let mut headers = HeaderMap::new();
+        let specs = (0..=MAX_RANGES)
+            .map(|i| format!("{}-{}", i * 10, i * 10))
+            .collect::<Vec<_>>();
+        headers.insert(
+            header::RANGE,
+            format!("bytes={}", specs.join(",")).parse().unwrap(),
+        );
+        assert_eq!(parse_range(&headers, 1000), ByteRange::Full);
+    }
+
+    #[test]
+    fn test_multipart_ranges() {
+        let multipart =
+            MultipartRanges::new(vec![0..2, 5..6], "text/plain", 10);
+        let boundary = multipart
+            .content_type()
+            .strip_prefix("multipart/byteranges; boundary=")
+            .unwrap()
+            .to_owned();
+
+        let mut body = String::new();
+        let data = "0123456789";
+        for (range, header) in multipart.parts() {
+            body.push_str(header);
+            body.push_str(&data[range.start as usize..range.end as usize]);
+        }
+        body.push_str(&multipart.trailer());
+
+        assert_eq!(
+            body,
+            format!(
+                "--{boundary}\r\n\
+                Content-Type: text/plain\r\n\
+                Content-Range: bytes 0-1/10\r\n\r\n\
+                01\r\n\
+                --{boundary}\r\n\
+                Content-Type: text/plain\r\n\
+                Content-Range: bytes 5-5/10\r\n\r\n\
+                5\r\n\
+                --{boundary}--\r\n"
+            ),
+        );
+        assert_eq!(multipart.content_length(), body.len() as u64);
+    }
+
+    #[test]
+    fn test_content_range() {
+        assert_eq!(content_range(&(0..10), 100), "bytes 0-9/100");
+    }
+}
@@ -1,9 +1,20 @@
+use std::sync::Arc;
+
 use axum::http::StatusCode;
-use chrono::Utc;
-use sqlx::{Database, Encode, Executor, FromRow, IntoArguments, Pool, Type};
+use chrono::{DateTime, Utc};
+use futures_util::{stream, Stream, TryStreamExt};
+use sqlx::{
+    Database, Encode, Executor, FromRow, IntoArguments, Pool, Sqlite, Type,
+};
 use uuid::Uuid;
 
-use super::{Object, ObjectData};
+use crate::{errors::sqlx_status_code, utils::singleflight::Singleflight};
+
+use super::{
+    cache::ObjectCache,
+    tag::{Tag, Tags},
+    Object, ObjectData, ObjectOptions,
+};
 
 pub const MAX_LIMIT: u32 = 100;
 
@@ -13,8 +24,13 @@ pub enum RepositoryError {
     NotFound(Uuid),
     #[error("the provided limit {0} is beyond the maximum of {MAX_LIMIT}")]
     LimitOutOfRange(u32),
+    #[error("object `{0}` reached its maximum downloads")]
+    DownloadLimitReached(Uuid),
     #[error("sqlx error: {0}")]
     Sqlx(sqlx::Error),
+    /// The error of a call shared by concurrent requests.
+    #[error(transparent)]
+    Shared(Arc<RepositoryError>),
 }
 
 impl RepositoryError {
@@ -23,7 +39,9 @@ impl RepositoryError {
         match self {
             RepositoryError::NotFound(..) => StatusCode::NOT_FOUND,
             RepositoryError::LimitOutOfRange(..) => StatusCode::BAD_REQUEST,
-            RepositoryError::Sqlx(..) => StatusCode::INTERNAL_SERVER_ERROR,
+            RepositoryError::DownloadLimitReached(..) => StatusCode::GONE,
+            RepositoryError::Sqlx(e) => sqlx_status_code(e),
+            RepositoryError::Shared(e) => e.status_code(),
         }
     }
 
@@ -33,12 +51,31 @@ impl RepositoryError {
             RepositoryError::NotFound(..) => 1,
             RepositoryError::LimitOutOfRange(..) => 2,
             RepositoryError::Sqlx(..) => 3,
+            RepositoryError::DownloadLimitReached(..) => 4,
+            RepositoryError::Shared(e) => e.custom_code(),
+        }
+    }
+
+    /// Takes back the error of a shared call, keeping `NotFound` as is so
+    /// it can still be matched.
+    fn unshare(error: Arc<RepositoryError>) -> Self {
+        match Arc::try_unwrap(error) {
+            Ok(error) => error,
+            Err(error) => match *error {
+                RepositoryError::NotFound(id) => RepositoryError::NotFound(id),
+                _ => RepositoryError::Shared(error),
+            },
         }
     }
 }
 
+/// Lookups of the same object running at once, sharing a single query.
+type Lookups = Singleflight<Uuid, Result<Object, Arc<RepositoryError>>>;
+
 pub struct ObjectRepository<DB: Database> {
     db: Pool<DB>,
+    cache: Option<Arc<ObjectCache>>,
+    lookups: Arc<Lookups>,
 }
 
 impl<DB: Database> Clone for ObjectRepository<DB> {
@@ -46,13 +83,36 @@ impl<DB: Database> Clone for ObjectRepository<DB> {
     fn clone(&self) -> Self {
         Self {
             db: self.db.clone(),
+            cache: self.cache.clone(),
+            lookups: self.lookups.clone(),
         }
     }
 }
 
 impl<DB: Database> ObjectRepository<DB> {
     pub fn new(db: Pool<DB>) -> ObjectRepository<DB> {
-        ObjectRepository { db }
+        ObjectRepository {
+            db,
+            cache: None,
+            lookups: Arc::default(),
+        }
+    }
+
+    /// Keeps the objects read by [`Self::get_cached`] in `cache`.
+    pub fn with_cache(mut self, cache: ObjectCache) -> Self {
+        self.cache = Some(Arc::new(cache));
+        self
+    }
+
+    #[inline]
+    pub fn cache(&self) -> Option<&ObjectCache> {
+        self.cache.as_deref()
+    }
+
+    fn invalidate(&self, id: Uuid) {
+        if let Some(cache) = &self.cache {
+            cache.invalidate(id);
+        }
     }
 }
 
@@ -61,8 +121,11 @@ where
     DB: Database,
     for<'a> <DB as sqlx::Database>::Arguments<'a>: IntoArguments<'a, DB>,
     for<'a> &'a Pool<DB>: Executor<'a, Database = DB>,
+    for<'c> &'c mut DB::Connection: Executor<'c, Database = DB>,
 
     for<'r> Object: FromRow<'r, DB::Row>,
+    for<'r> (String, String): FromRow<'r, DB::Row>,
+    for<'r> (i64,): FromRow<'r, DB::Row>,
 
     for<'e> &'e [u8]: Encode<'e, DB>,
     for<'e> &'e [u8]: Type<DB>,
@@ -70,28 +133,88 @@ where
     for<'e> i64: Encode<'e, DB>,
     i64: Type<DB>,
 
+    for<'e> Option<i64>: Encode<'e, DB>,
+    Option<i64>: Type<DB>,
+
     for<'e> String: Encode<'e, DB>,
     String: Type<DB>,
+
+    for<'e> &'e str: Encode<'e, DB>,
+    for<'e> &'e str: Type<DB>,
+
+    for<'e> Option<&'e str>: Encode<'e, DB>,
+    for<'e> Option<&'e str>: Type<DB>,
+
+    for<'e> Option<&'e [u8]>: Encode<'e, DB>,
+    for<'e> Option<&'e [u8]>: Type<DB>,
 {
-    pub async fn get(&self, id: Uuid) -> Result<Object, RepositoryError> {
-        sqlx::query_as("SELECT * FROM object WHERE id = $1")
-            .bind(id.into_bytes().as_slice())
-            .fetch_optional(&self.db)
+    /// Checks that the database can be reached.
+    pub async fn ping(&self) -> Result<(), RepositoryError> {
+        sqlx::query("SELECT 1")
+            .execute(&self.db)
             .await
             .map_err(|error| {
-                tracing::error!(
-                    %error,
-                    "got sqlx error while retrieving object",
-                );
+                tracing::error!(%error, "got sqlx error while pinging database");
                 RepositoryError::Sqlx(error)
-            })?
-            .ok_or(RepositoryError::NotFound(id))
+            })?;
+
+        Ok(())
     }
 
+    /// Expired objects are reported as not found, even if the sweeper did not
+    /// remove them yet.
+    pub async fn get(&self, id: Uuid) -> Result<Object, RepositoryError> {
+        sqlx::query_as(
+            "SELECT * FROM object WHERE id = $1 \
+            AND (expires_at IS NULL OR expires_at > $2)",
+        )
+        .bind(id.into_bytes().as_slice())
+        .bind(Utc::now().timestamp_millis())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while retrieving object");
+            RepositoryError::Sqlx(error)
+        })?
+        .ok_or(RepositoryError::NotFound(id))
+    }
+
+    /// Same as [`Self::get`], but may be answered by the cache with a stale
+    /// `download_count`. The expiration is still checked on every call.
+    /// Concurrent lookups of the same object share a single query, so a
+    /// file downloaded by many clients at once doesn't flood the database.
+    pub async fn get_cached(
+        &self,
+        id: Uuid,
+    ) -> Result<Object, RepositoryError> {
+        if let Some(cache) = &self.cache {
+            if let Some(object) = cache.get(id) {
+                if object.expires_at.is_some_and(|at| at <= Utc::now()) {
+                    cache.invalidate(id);
+                    return Err(RepositoryError::NotFound(id));
+                }
+                return Ok(object);
+            }
+        }
+
+        self.lookups
+            .run(id, || async move {
+                let object = self.get(id).await.map_err(Arc::new)?;
+                if let Some(cache) = &self.cache {
+                    cache.insert(object.clone());
+                }
+                Ok(object)
+            })
+            .await
+            .map_err(RepositoryError::unshare)
+    }
+
+    /// Lists the objects, only the ones with the `tag` if given.
     pub async fn get_all(
         &self,
         limit: u32,
         offset: u32,
+        tag: Option<&Tag>,
     ) -> Result<Vec<Object>, RepositoryError> {
         if limit > MAX_LIMIT {
             return Err(RepositoryError::LimitOutOfRange(limit));
@@ -99,10 +222,16 @@ where
 
         sqlx::query_as(
             "SELECT * FROM object WHERE rowid > $1 \
-            ORDER BY rowid LIMIT $2",
+            AND (expires_at IS NULL OR expires_at > $2) \
+            AND ($4 IS NULL OR EXISTS (SELECT 1 FROM object_tag \
+            WHERE object_id = object.id AND key = $4 AND value = $5)) \
+            ORDER BY rowid LIMIT $3",
         )
         .bind(offset as i64)
+        .bind(Utc::now().timestamp_millis())
         .bind(limit as i64)
+        .bind(tag.map(|tag| tag.key.as_str()))
+        .bind(tag.map(|tag| tag.value.as_str()))
         .fetch_all(&self.db)
         .await
         .map_err(|error| {
@@ -114,11 +243,13 @@ where
         })
     }
 
+    /// Lists the objects of the user, only the ones with the `tag` if given.
     pub async fn get_by_user(
         &self,
         user_id: Uuid,
         limit: u32,
         offset: u32,
+        tag: Option<&Tag>,
     ) -> Result<Vec<Object>, RepositoryError> {
         if limit > MAX_LIMIT {
             return Err(RepositoryError::LimitOutOfRange(limit));
@@ -126,11 +257,17 @@ where
 
         sqlx::query_as(
             "SELECT * FROM object WHERE user_id = $1 \
-            ORDER BY rowid LIMIT $2 OFFSET $3",
+            AND (expires_at IS NULL OR expires_at > $2) \
+            AND ($5 IS NULL OR EXISTS (SELECT 1 FROM object_tag \
+            WHERE object_id = object.id AND key = $5 AND value = $6)) \
+            ORDER BY rowid LIMIT $3 OFFSET $4",
         )
         .bind(user_id.into_bytes().as_slice())
+        .bind(Utc::now().timestamp_millis())
         .bind(limit as i64)
         .bind(offset as i64)
+        .bind(tag.map(|tag| tag.key.as_str()))
+        .bind(tag.map(|tag| tag.value.as_str()))
         .fetch_all(&self.db)
         .await
         .map_err(|error| {
@@ -142,11 +279,127 @@ where
         })
     }
 
+    /// Lists up to `limit` objects ordered by id, starting after the id
+    /// `after`. Only the ones of `user_id` and with the `tag`, if given.
+    pub async fn get_page_after(
+        &self,
+        user_id: Option<Uuid>,
+        after: Option<Uuid>,
+        tag: Option<&Tag>,
+        limit: u32,
+    ) -> Result<Vec<Object>, RepositoryError> {
+        if limit > MAX_LIMIT {
+            return Err(RepositoryError::LimitOutOfRange(limit));
+        }
+
+        sqlx::query_as(
+            "SELECT * FROM object WHERE ($1 IS NULL OR user_id = $1) \
+            AND ($2 IS NULL OR id > $2) \
+            AND (expires_at IS NULL OR expires_at > $3) \
+            AND ($5 IS NULL OR EXISTS (SELECT 1 FROM object_tag \
+            WHERE object_id = object.id AND key = $5 AND value = $6)) \
+            ORDER BY id LIMIT $4",
+        )
+        .bind(user_id.as_ref().map(|id| id.as_bytes().as_slice()))
+        .bind(after.as_ref().map(|id| id.as_bytes().as_slice()))
+        .bind(Utc::now().timestamp_millis())
+        .bind(limit as i64)
+        .bind(tag.map(|tag| tag.key.as_str()))
+        .bind(tag.map(|tag| tag.value.as_str()))
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while retrieving objects after id",
+            );
+            RepositoryError::Sqlx(error)
+        })
+    }
+
+    /// Sums the size of the objects of the user. Expired objects count until
+    /// the sweeper removes their files.
+    pub async fn usage(&self, user_id: Uuid) -> Result<u64, RepositoryError> {
+        let (usage,): (i64,) = sqlx::query_as(
+            "SELECT COALESCE(SUM(size), 0) FROM object WHERE user_id = $1",
+        )
+        .bind(user_id.into_bytes().as_slice())
+        .fetch_one(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while summing user objects size",
+            );
+            RepositoryError::Sqlx(error)
+        })?;
+
+        Ok(usage.max(0) as u64)
+    }
+
+    /// Lists up to `limit` objects whose expiration date has passed, oldest
+    /// expiration first.
+    pub async fn get_expired(
+        &self,
+        limit: u32,
+    ) -> Result<Vec<Object>, RepositoryError> {
+        if limit > MAX_LIMIT {
+            return Err(RepositoryError::LimitOutOfRange(limit));
+        }
+
+        sqlx::query_as(
+            "SELECT * FROM object WHERE expires_at <= $1 \
+            ORDER BY expires_at LIMIT $2",
+        )
+        .bind(Utc::now().timestamp_millis())
+        .bind(limit as i64)
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while retrieving expired objects",
+            );
+            RepositoryError::Sqlx(error)
+        })
+    }
+
+    /// Lists up to `limit` objects with ids greater than `after`, including
+    /// expired ones, ordered by id. Used to walk over every object.
+    pub async fn get_after(
+        &self,
+        after: Option<Uuid>,
+        limit: u32,
+    ) -> Result<Vec<Object>, RepositoryError> {
+        if limit > MAX_LIMIT {
+            return Err(RepositoryError::LimitOutOfRange(limit));
+        }
+
+        // The nil uuid is never assigned to objects
+        let after = after.map(|id| id.into_bytes()).unwrap_or_default();
+
+        sqlx::query_as(
+            "SELECT * FROM object WHERE id > $1 ORDER BY id LIMIT $2",
+        )
+        .bind(after.as_slice())
+        .bind(limit as i64)
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while retrieving multiple objects",
+            );
+            RepositoryError::Sqlx(error)
+        })
+    }
+
     pub async fn create(
         &self,
         id: Uuid,
         user_id: Uuid,
         data: ObjectData,
+        options: ObjectOptions,
     ) -> Result<Object, RepositoryError> {
         let now_ms = Utc::now().timestamp_millis();
 
@@ -155,17 +408,30 @@ where
                 format!("encode `size`: out of range").into(),
             ))
         })?;
+        let max_downloads: Option<i64> = options
+            .max_downloads
+            .map(|v| v.try_into())
+            .transpose()
+            .map_err(|_| {
+                RepositoryError::Sqlx(sqlx::Error::Decode(
+                    format!("encode `max_downloads`: out of range").into(),
+                ))
+            })?;
 
         sqlx::query_as(
             "INSERT INTO object \
-            (id, user_id, created_at, updated_at, name, mime_type, size, checksum_256) \
-            VALUES ($1, $2, $3, $4, $5, $6, $7, $8) \
+            (id, user_id, created_at, updated_at, expires_at, max_downloads, \
+            public, name, mime_type, size, checksum_256) \
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) \
             RETURNING *",
         )
         .bind(id.into_bytes().as_slice())
         .bind(user_id.into_bytes().as_slice())
         .bind(now_ms)
         .bind(now_ms)
+        .bind(options.expires_at.map(|v| v.timestamp_millis()))
+        .bind(max_downloads)
+        .bind(options.public as i64)
         .bind(data.name)
         .bind(data.mime_type)
         .bind(size)
@@ -178,6 +444,59 @@ where
         })
     }
 
+    /// Atomically counts a download of the object. Fails without counting it
+    /// with [`RepositoryError::DownloadLimitReached`] if the object already
+    /// reached its maximum downloads.
+    pub async fn increment_download_count(
+        &self,
+        id: Uuid,
+    ) -> Result<Object, RepositoryError> {
+        let object: Option<Object> = sqlx::query_as(
+            "UPDATE object SET download_count = download_count + 1 \
+            WHERE id = $1 \
+            AND (max_downloads IS NULL OR download_count < max_downloads) \
+            RETURNING *",
+        )
+        .bind(id.into_bytes().as_slice())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while incrementing object download count",
+            );
+            RepositoryError::Sqlx(error)
+        })?;
+
+        let Some(object) = object else {
+            // Nothing was updated, either because the object is gone or
+            // because its count is already at the maximum
+            let exists: Option<(i64,)> =
+                sqlx::query_as("SELECT 1 FROM object WHERE id = $1")
+                    .bind(id.into_bytes().as_slice())
+                    .fetch_optional(&self.db)
+                    .await
+                    .map_err(|error| {
+                        tracing::error!(
+                            %error,
+                            "got sqlx error while retrieving object",
+                        );
+                        RepositoryError::Sqlx(error)
+                    })?;
+
+            return Err(match exists {
+                Some(_) => RepositoryError::DownloadLimitReached(id),
+                None => RepositoryError::NotFound(id),
+            });
+        };
+
+        // Keeps the cached count fresh
+        if let Some(cache) = &self.cache {
+            cache.insert(object.clone());
+        }
+        Ok(object)
+    }
+
     pub async fn update(
         &self,
         id: Uuid,
@@ -186,7 +505,7 @@ where
         let now = Utc::now();
         let now_ms = now.timestamp_millis();
 
-        sqlx::query_as(
+        let object = sqlx::query_as(
             "UPDATE object \
             SET updated_at = $1, name = $2, mime_type = $3, \
             size = $4, checksum_256 = $5 \
@@ -204,7 +523,10 @@ where
             tracing::error!(%error, "got sqlx error while updating object");
             RepositoryError::Sqlx(error)
         })?
-        .ok_or(RepositoryError::NotFound(id))
+        .ok_or(RepositoryError::NotFound(id))?;
+
+        self.invalidate(id);
+        Ok(object)
     }
 
     pub async fn update_info(
@@ -216,7 +538,7 @@ where
         let now = Utc::now();
         let now_ms = now.timestamp_millis();
 
-        sqlx::query_as(
+        let object = sqlx::query_as(
             "UPDATE object \
             SET updated_at = $1, name = $2, mime_type = $3
             WHERE id = $4 RETURNING *",
@@ -231,32 +553,385 @@ where
             tracing::error!(%error, "got sqlx error while updating object");
             RepositoryError::Sqlx(error)
         })?
-        .ok_or(RepositoryError::NotFound(id))
+        .ok_or(RepositoryError::NotFound(id))?;
+
+        self.invalidate(id);
+        Ok(object)
+    }
+
+    /// Gives the object to another user. `updated_at` is kept, since the
+    /// content did not change.
+    pub async fn transfer(
+        &self,
+        id: Uuid,
+        user_id: Uuid,
+    ) -> Result<Object, RepositoryError> {
+        let object = sqlx::query_as(
+            "UPDATE object SET user_id = $1 WHERE id = $2 RETURNING *",
+        )
+        .bind(user_id.into_bytes().as_slice())
+        .bind(id.into_bytes().as_slice())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while transferring object",
+            );
+            RepositoryError::Sqlx(error)
+        })?
+        .ok_or(RepositoryError::NotFound(id))?;
+
+        self.invalidate(id);
+        Ok(object)
+    }
+
+    /// Gives every object of `from` to `to`, returning the moved objects.
+    pub async fn transfer_all(
+        &self,
+        from: Uuid,
+        to: Uuid,
+    ) -> Result<Vec<Object>, RepositoryError> {
+        let objects: Vec<Object> = sqlx::query_as(
+            "UPDATE object SET user_id = $1 WHERE user_id = $2 RETURNING *",
+        )
+        .bind(to.into_bytes().as_slice())
+        .bind(from.into_bytes().as_slice())
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while transferring user objects",
+            );
+            RepositoryError::Sqlx(error)
+        })?;
+
+        for object in &objects {
+            self.invalidate(object.id);
+        }
+        Ok(objects)
     }
 
     pub async fn delete(&self, id: Uuid) -> Result<Object, RepositoryError> {
-        sqlx::query_as("DELETE FROM object WHERE id = $1 RETURNING *")
+        let object = sqlx::query_as(
+            "DELETE FROM object WHERE id = $1 RETURNING *",
+        )
+        .bind(id.into_bytes().as_slice())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while deleting object");
+            RepositoryError::Sqlx(error)
+        })?
+        .ok_or(RepositoryError::NotFound(id))?;
+
+        self.invalidate(id);
+        Ok(object)
+    }
+
+    pub async fn get_tags(&self, id: Uuid) -> Result<Tags, RepositoryError> {
+        let tags: Vec<(String, String)> = sqlx::query_as(
+            "SELECT key, value FROM object_tag WHERE object_id = $1",
+        )
+        .bind(id.into_bytes().as_slice())
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while retrieving object tags");
+            RepositoryError::Sqlx(error)
+        })?;
+
+        Ok(tags.into_iter().collect())
+    }
+
+    /// Replaces every tag of the object with `tags`, so setting the same
+    /// tags twice leaves the object as it was.
+    pub async fn set_tags(
+        &self,
+        id: Uuid,
+        tags: &Tags,
+    ) -> Result<(), RepositoryError> {
+        let map_err = |error| {
+            tracing::error!(%error, "got sqlx error while setting object tags");
+            RepositoryError::Sqlx(error)
+        };
+
+        let mut tx = self.db.begin().await.map_err(map_err)?;
+
+        let _: (i64,) = sqlx::query_as("SELECT 1 FROM object WHERE id = $1")
+            .bind(id.into_bytes().as_slice())
+            .fetch_optional(&mut *tx)
+            .await
+            .map_err(map_err)?
+            .ok_or(RepositoryError::NotFound(id))?;
+
+        sqlx::query("DELETE FROM object_tag WHERE object_id = $1")
+            .bind(id.into_bytes().as_slice())
+            .execute(&mut *tx)
+            .await
+            .map_err(map_err)?;
+
+        for (key, value) in tags {
+            sqlx::query(
+                "INSERT INTO object_tag (object_id, key, value) \
+                VALUES ($1, $2, $3)",
+            )
+            .bind(id.into_bytes().as_slice())
+            .bind(key.as_str())
+            .bind(value.as_str())
+            .execute(&mut *tx)
+            .await
+            .map_err(map_err)?;
+        }
+
+        tx.commit().await.map_err(map_err)
+    }
+
+    pub async fn delete_tags(&self, id: Uuid) -> Result<(), RepositoryError> {
+        sqlx::query("DELETE FROM object_tag WHERE object_id = $1")
+            .bind(id.into_bytes().as_slice())
+            .execute(&self.db)
+            .await
+            .map_err(|error| {
+                tracing::error!(
+                    %error,
+                    "got sqlx error while deleting object tags",
+                );
+                RepositoryError::Sqlx(error)
+            })?;
+
+        Ok(())
+    }
+
+    /// Returns the object uploaded by `owner` with the idempotency `key`,
+    /// unless the key or the object expired or the object was deleted.
+    pub async fn get_by_idempotency_key(
+        &self,
+        owner: Uuid,
+        key: &str,
+    ) -> Result<Option<Object>, RepositoryError> {
+        let now_ms = Utc::now().timestamp_millis();
+
+        sqlx::query_as(
+            "SELECT object.* FROM idempotency_key \
+            JOIN object ON object.id = idempotency_key.object_id \
+            WHERE idempotency_key.owner = $1 AND idempotency_key.key = $2 \
+            AND idempotency_key.expires_at > $3 \
+            AND (object.expires_at IS NULL OR object.expires_at > $3)",
+        )
+        .bind(owner.into_bytes().as_slice())
+        .bind(key)
+        .bind(now_ms)
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while retrieving idempotency key",
+            );
+            RepositoryError::Sqlx(error)
+        })
+    }
+
+    /// Maps the idempotency `key` of `owner` to `object_id` until
+    /// `expires_at`, replacing any previous mapping.
+    pub async fn save_idempotency_key(
+        &self,
+        owner: Uuid,
+        key: &str,
+        object_id: Uuid,
+        expires_at: DateTime<Utc>,
+    ) -> Result<(), RepositoryError> {
+        sqlx::query(
+            "INSERT OR REPLACE INTO idempotency_key \
+            (owner, key, object_id, created_at, expires_at) \
+            VALUES ($1, $2, $3, $4, $5)",
+        )
+        .bind(owner.into_bytes().as_slice())
+        .bind(key)
+        .bind(object_id.into_bytes().as_slice())
+        .bind(Utc::now().timestamp_millis())
+        .bind(expires_at.timestamp_millis())
+        .execute(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while saving idempotency key");
+            RepositoryError::Sqlx(error)
+        })?;
+
+        Ok(())
+    }
+
+    pub async fn delete_expired_idempotency_keys(
+        &self,
+    ) -> Result<(), RepositoryError> {
+        sqlx::query("DELETE FROM idempotency_key WHERE expires_at <= $1")
+            .bind(Utc::now().timestamp_millis())
+            .execute(&self.db)
+            .await
+            .map_err(|error| {
+                tracing::error!(
+                    %error,
+                    "got sqlx error while deleting expired idempotency keys",
+                );
+                RepositoryError::Sqlx(error)
+            })?;
+
+        Ok(())
+    }
+
+    /// Saves the upload link `id` for the data of `object_id`, usable once
+    /// until `expires_at`.
+    pub async fn create_upload_link(
+        &self,
+        id: Uuid,
+        object_id: Uuid,
+        expires_at: DateTime<Utc>,
+    ) -> Result<(), RepositoryError> {
+        sqlx::query(
+            "INSERT INTO upload_link (id, object_id, created_at, expires_at) \
+            VALUES ($1, $2, $3, $4)",
+        )
+        .bind(id.into_bytes().as_slice())
+        .bind(object_id.into_bytes().as_slice())
+        .bind(Utc::now().timestamp_millis())
+        .bind(expires_at.timestamp_millis())
+        .execute(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while creating upload link");
+            RepositoryError::Sqlx(error)
+        })?;
+
+        Ok(())
+    }
+
+    /// Marks the upload link `id` of `object_id` as used. Returns false if
+    /// it does not exist, expired or was already used, so concurrent uploads
+    /// with the same link can't both succeed.
+    pub async fn use_upload_link(
+        &self,
+        id: Uuid,
+        object_id: Uuid,
+    ) -> Result<bool, RepositoryError> {
+        let now_ms = Utc::now().timestamp_millis();
+
+        let used: Option<(i64,)> = sqlx::query_as(
+            "UPDATE upload_link SET used_at = $1 \
+            WHERE id = $2 AND object_id = $3 \
+            AND used_at IS NULL AND expires_at > $1 \
+            RETURNING used_at",
+        )
+        .bind(now_ms)
+        .bind(id.into_bytes().as_slice())
+        .bind(object_id.into_bytes().as_slice())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while using upload link");
+            RepositoryError::Sqlx(error)
+        })?;
+
+        Ok(used.is_some())
+    }
+
+    /// Makes the upload link `id` usable again, after the upload it was
+    /// used for failed.
+    pub async fn release_upload_link(
+        &self,
+        id: Uuid,
+    ) -> Result<(), RepositoryError> {
+        sqlx::query("UPDATE upload_link SET used_at = NULL WHERE id = $1")
             .bind(id.into_bytes().as_slice())
-            .fetch_optional(&self.db)
+            .execute(&self.db)
             .await
             .map_err(|error| {
-                tracing::error!(%error, "got sqlx error while deleting object");
+                tracing::error!(
+                    %error,
+                    "got sqlx error while releasing upload link",
+                );
                 RepositoryError::Sqlx(error)
-            })?
-            .ok_or(RepositoryError::NotFound(id))
+            })?;
+
+        Ok(())
+    }
+
+    pub async fn delete_expired_upload_links(
+        &self,
+    ) -> Result<(), RepositoryError> {
+        sqlx::query("DELETE FROM upload_link WHERE expires_at <= $1")
+            .bind(Utc::now().timestamp_millis())
+            .execute(&self.db)
+            .await
+            .map_err(|error| {
+                tracing::error!(
+                    %error,
+                    "got sqlx error while deleting expired upload links",
+                );
+                RepositoryError::Sqlx(error)
+            })?;
+
+        Ok(())
+    }
+}
+
+impl ObjectRepository<Sqlite> {
+    /// Streams every object ordered by id, only the ones of `user_id` and
+    /// with the `tag` if given. They are read `MAX_LIMIT` at a time, so the
+    /// memory used does not grow with their number, and no connection is
+    /// held while the client reads them.
+    pub fn stream(
+        &self,
+        user_id: Option<Uuid>,
+        tag: Option<Tag>,
+    ) -> impl Stream<Item = Result<Object, RepositoryError>> + Send + 'static
+    {
+        let repo = self.clone();
+
+        // `None` once the last batch was read
+        stream::try_unfold(Some(None), move |after: Option<Option<Uuid>>| {
+            let (repo, tag) = (repo.clone(), tag.clone());
+            async move {
+                let Some(after) = after else {
+                    return Ok(None);
+                };
+
+                let batch = repo
+                    .get_page_after(user_id, after, tag.as_ref(), MAX_LIMIT)
+                    .await?;
+                let next = (batch.len() == MAX_LIMIT as usize)
+                    .then(|| batch.last().map(|object| object.id));
+
+                let batch = stream::iter(
+                    batch.into_iter().map(Ok::<_, RepositoryError>),
+                );
+                Ok::<_, RepositoryError>(Some((batch, next)))
+            }
+        })
+        .try_flatten()
     }
 }
 
 #[cfg(test)]
 mod tests {
+    use std::time::Duration;
+
+    use chrono::{TimeDelta, Utc};
+    use futures_util::TryStreamExt;
     use sha2::{Digest, Sha256};
     use sqlx::{migrate, Pool, Sqlite};
     use test_log::test;
     use uuid::Uuid;
 
-    use crate::storage::{repository::RepositoryError, ObjectData};
+    use crate::storage::{
+        cache::ObjectCache,
+        repository::RepositoryError,
+        tag::{Tag, Tags},
+        ObjectData, ObjectOptions,
+    };
 
-    use super::ObjectRepository;
+    use super::{ObjectRepository, MAX_LIMIT};
 
     fn rand_string() -> String {
         Uuid::new_v4().to_string()
@@ -313,10 +988,12 @@ mod tests {
             let data = rand_data();
 
             datas.push((id, data.clone()));
-            repo.create(id, Uuid::new_v4(), data).await.unwrap();
+            repo.create(id, Uuid::new_v4(), data, ObjectOptions::default())
+                .await
+                .unwrap();
         }
 
-        let all_data = repo.get_all(SIZE as u32, 0).await.unwrap();
+        let all_data = repo.get_all(SIZE as u32, 0, None).await.unwrap();
 
         assert!(
             all_data.into_iter().map(|v| (v.id, v.data)).eq(datas),
@@ -337,14 +1014,16 @@ mod tests {
             let data = rand_data();
 
             datas.push((id, data.clone()));
-            repo.create(id, Uuid::new_v4(), data).await.unwrap();
+            repo.create(id, Uuid::new_v4(), data, ObjectOptions::default())
+                .await
+                .unwrap();
         }
 
         let mut all_data = Vec::new();
 
         for i in 0..(SIZE / CHUNK_SIZE) {
             let chunk = repo
-                .get_all(CHUNK_SIZE as u32, (CHUNK_SIZE * i) as u32)
+                .get_all(CHUNK_SIZE as u32, (CHUNK_SIZE * i) as u32, None)
                 .await
                 .unwrap();
 
@@ -371,20 +1050,63 @@ mod tests {
             let data = rand_data();
 
             datas.push((id, data.clone()));
-            repo.create(id, user_id, data).await.unwrap();
+            repo.create(id, user_id, data, ObjectOptions::default())
+                .await
+                .unwrap();
         }
 
         for _ in 0..3 {
-            repo.create(Uuid::new_v4(), Uuid::new_v4(), rand_data())
-                .await
-                .unwrap();
+            repo.create(
+                Uuid::new_v4(),
+                Uuid::new_v4(),
+                rand_data(),
+                ObjectOptions::default(),
+            )
+            .await
+            .unwrap();
         }
 
-        let all_data = repo.get_by_user(user_id, SIZE as u32, 0).await.unwrap();
+        let all_data = repo
+            .get_by_user(user_id, SIZE as u32, 0, None)
+            .await
+            .unwrap();
 
         assert!(all_data.into_iter().map(|v| (v.id, v.data)).eq(datas));
     }
 
+    #[test(tokio::test)]
+    async fn test_usage() {
+        let repo = repository().await;
+        let user_id = Uuid::new_v4();
+
+        assert_eq!(repo.usage(user_id).await.unwrap(), 0);
+
+        let mut total = 0;
+        for _ in 0..5 {
+            let data = rand_data();
+            total += data.size;
+
+            repo.create(
+                Uuid::new_v4(),
+                user_id,
+                data,
+                ObjectOptions::default(),
+            )
+            .await
+            .unwrap();
+        }
+        repo.create(
+            Uuid::new_v4(),
+            Uuid::new_v4(),
+            rand_data(),
+            ObjectOptions::default(),
+        )
+        .await
+        .unwrap();
+
+        assert_eq!(repo.usage(user_id).await.unwrap(), total);
+    }
+
     #[test(tokio::test)]
     async fn test_get_by_user_offset() {
         const SIZE: usize = 28;
@@ -400,7 +1122,9 @@ mod tests {
             let data = rand_data();
 
             datas.push((id, data.clone()));
-            repo.create(id, user_id, data).await.unwrap();
+            repo.create(id, user_id, data, ObjectOptions::default())
+                .await
+                .unwrap();
         }
 
         let mut all_data = Vec::new();
@@ -411,6 +1135,7 @@ mod tests {
                     user_id,
                     CHUNK_SIZE as u32,
                     (CHUNK_SIZE * i) as u32,
+                    None,
                 )
                 .await
                 .unwrap();
@@ -430,7 +1155,10 @@ mod tests {
         let id = Uuid::new_v4();
         let user_id = Uuid::new_v4();
 
-        let old_obj = repo.create(id, user_id, data.clone()).await.unwrap();
+        let old_obj = repo
+            .create(id, user_id, data.clone(), ObjectOptions::default())
+            .await
+            .unwrap();
         assert_eq!(
             data, old_obj.data,
             "created data mismatches the provided one",
@@ -449,7 +1177,12 @@ mod tests {
 
         let data = rand_data();
         let obj = repo
-            .create(Uuid::new_v4(), Uuid::new_v4(), rand_data())
+            .create(
+                Uuid::new_v4(),
+                Uuid::new_v4(),
+                rand_data(),
+                ObjectOptions::default(),
+            )
             .await
             .unwrap();
         let id = obj.id;
@@ -476,7 +1209,12 @@ mod tests {
 
         let data = rand_data();
         let mut old_obj = repo
-            .create(Uuid::new_v4(), Uuid::new_v4(), data.clone())
+            .create(
+                Uuid::new_v4(),
+                Uuid::new_v4(),
+                data.clone(),
+                ObjectOptions::default(),
+            )
             .await
             .unwrap();
 
@@ -512,7 +1250,9 @@ mod tests {
         );
 
         let data = rand_data();
-        repo.create(id, Uuid::new_v4(), data.clone()).await.unwrap();
+        repo.create(id, Uuid::new_v4(), data.clone(), ObjectOptions::default())
+            .await
+            .unwrap();
 
         let obj = repo.delete(id).await.unwrap();
         assert_eq!(data, obj.data, "fetched data mismatches the created one");
@@ -523,4 +1263,416 @@ mod tests {
             "expected `ObjectError::NotFound` while fetching deleted object",
         )
     }
+
+    #[test(tokio::test)]
+    async fn test_expired() {
+        let repo = repository().await;
+
+        let id = Uuid::new_v4();
+        let options = ObjectOptions {
+            expires_at: Some(Utc::now() - TimeDelta::seconds(1)),
+            ..Default::default()
+        };
+        repo.create(id, Uuid::new_v4(), rand_data(), options)
+            .await
+            .unwrap();
+
+        let options = ObjectOptions {
+            expires_at: Some(Utc::now() + TimeDelta::hours(1)),
+            ..Default::default()
+        };
+        let alive = repo
+            .create(Uuid::new_v4(), Uuid::new_v4(), rand_data(), options)
+            .await
+            .unwrap();
+
+        let res = repo.get(id).await;
+        assert!(
+            matches!(res, Err(RepositoryError::NotFound(id2)) if id2 == id),
+            "expected `ObjectError::NotFound` while fetching expired object",
+        );
+        assert_eq!(repo.get(alive.id).await.unwrap(), alive);
+
+        let expired = repo.get_expired(10).await.unwrap();
+        assert!(expired.into_iter().map(|v| v.id).eq([id]));
+
+        let all_data = repo.get_all(10, 0, None).await.unwrap();
+        assert_eq!(all_data, vec![alive]);
+    }
+
+    #[test(tokio::test)]
+    async fn test_get_after() {
+        const SIZE: usize = 11;
+        const CHUNK_SIZE: u32 = 4;
+
+        let repo = repository().await;
+        let mut ids = Vec::with_capacity(SIZE);
+
+        for i in 0..SIZE {
+            let id = Uuid::new_v4();
+            // Expired objects must be walked over too
+            let options = ObjectOptions {
+                expires_at: (i % 2 == 0)
+                    .then(|| Utc::now() - TimeDelta::seconds(1)),
+                ..Default::default()
+            };
+
+            ids.push(id);
+            repo.create(id, Uuid::new_v4(), rand_data(), options)
+                .await
+                .unwrap();
+        }
+        ids.sort();
+
+        let mut walked = Vec::with_capacity(SIZE);
+        let mut after = None;
+        loop {
+            let objects = repo.get_after(after, CHUNK_SIZE).await.unwrap();
+            let Some(last) = objects.last() else {
+                break;
+            };
+
+            after = Some(last.id);
+            walked.extend(objects.into_iter().map(|v| v.id));
+        }
+
+        assert_eq!(walked, ids, "walked ids mismatch the created ones");
+    }
+
+    #[test(tokio::test)]
+    async fn test_increment_download_count() {
+        let repo = repository().await;
+
+        let options = ObjectOptions {
+            max_downloads: Some(2),
+            ..Default::default()
+        };
+        let obj = repo
+            .create(Uuid::new_v4(), Uuid::new_v4(), rand_data(), options)
+            .await
+            .unwrap();
+        assert_eq!(obj.download_count, 0);
+        assert_eq!(obj.max_downloads, Some(2));
+
+        for i in 1..=2 {
+            let obj = repo.increment_download_count(obj.id).await.unwrap();
+            assert_eq!(obj.download_count, i);
+        }
+        assert!(
+            matches!(
+                repo.increment_download_count(obj.id).await,
+                Err(RepositoryError::DownloadLimitReached(id)) if id == obj.id,
+            ),
+            "download counted beyond `max_downloads`",
+        );
+
+        let obj = repo.get(obj.id).await.unwrap();
+        assert_eq!(obj.download_count, 2);
+
+        let id = Uuid::new_v4();
+        assert!(
+            matches!(
+                repo.increment_download_count(id).await,
+                Err(RepositoryError::NotFound(id2)) if id2 == id,
+            ),
+            "expected not found error while counting a missing object",
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_transfer() {
+        let repo = repository().await;
+        let (from, to) = (Uuid::new_v4(), Uuid::new_v4());
+
+        let mut ids = Vec::new();
+        for _ in 0..3 {
+            let obj = repo
+                .create(
+                    Uuid::new_v4(),
+                    from,
+                    rand_data(),
+                    ObjectOptions::default(),
+                )
+                .await
+                .unwrap();
+            ids.push(obj.id);
+        }
+
+        let obj = repo.transfer(ids[0], to).await.unwrap();
+        assert_eq!(obj.user_id, to);
+        assert_eq!(repo.get(ids[0]).await.unwrap().user_id, to);
+
+        let moved = repo.transfer_all(from, to).await.unwrap();
+        let mut moved: Vec<_> = moved.into_iter().map(|obj| obj.id).collect();
+        moved.sort();
+        let mut expected = ids[1..].to_vec();
+        expected.sort();
+        assert_eq!(moved, expected);
+
+        assert!(repo
+            .get_by_user(from, 10, 0, None)
+            .await
+            .unwrap()
+            .is_empty());
+        assert_eq!(repo.get_by_user(to, 10, 0, None).await.unwrap().len(), 3);
+
+        let id = Uuid::new_v4();
+        assert!(matches!(
+            repo.transfer(id, to).await,
+            Err(RepositoryError::NotFound(v)) if v == id,
+        ));
+    }
+
+    #[test(tokio::test)]
+    async fn test_idempotency_key() {
+        let repo = repository().await;
+        let (owner, key) = (Uuid::new_v4(), rand_string());
+
+        let obj = repo
+            .create(
+                Uuid::new_v4(),
+                owner,
+                rand_data(),
+                ObjectOptions::default(),
+            )
+            .await
+            .unwrap();
+
+        assert!(repo
+            .get_by_idempotency_key(owner, &key)
+            .await
+            .unwrap()
+            .is_none());
+
+        let expires_at = Utc::now() + TimeDelta::hours(1);
+        repo.save_idempotency_key(owner, &key, obj.id, expires_at)
+            .await
+            .unwrap();
+
+        let found = repo.get_by_idempotency_key(owner, &key).await.unwrap();
+        assert_eq!(found, Some(obj.clone()));
+
+        // Keys are scoped by owner
+        let other = repo
+            .get_by_idempotency_key(Uuid::new_v4(), &key)
+            .await
+            .unwrap();
+        assert!(other.is_none());
+
+        let expires_at = Utc::now() - TimeDelta::seconds(1);
+        repo.save_idempotency_key(owner, &key, obj.id, expires_at)
+            .await
+            .unwrap();
+        assert!(repo
+            .get_by_idempotency_key(owner, &key)
+            .await
+            .unwrap()
+            .is_none());
+
+        repo.delete_expired_idempotency_keys().await.unwrap();
+    }
+
+    #[test(tokio::test)]
+    async fn test_stream() {
+        let repo = repository().await;
+        let user_id = Uuid::new_v4();
+
+        // Spans several batches
+        let size = MAX_LIMIT as usize * 2 + 5;
+        let mut ids = Vec::with_capacity(size);
+        for _ in 0..size {
+            let obj = repo
+                .create(
+                    Uuid::new_v4(),
+                    user_id,
+                    rand_data(),
+                    ObjectOptions::default(),
+                )
+                .await
+                .unwrap();
+            ids.push(obj.id);
+        }
+        let other = repo
+            .create(
+                Uuid::new_v4(),
+                Uuid::new_v4(),
+                rand_data(),
+                ObjectOptions::default(),
+            )
+            .await
+            .unwrap();
+        ids.sort();
+
+        let streamed = repo
+            .stream(Some(user_id), None)
+            .map_ok(|obj| obj.id)
+            .try_collect::<Vec<_>>()
+            .await
+            .unwrap();
+        assert_eq!(streamed, ids);
+
+        let all = repo.stream(None, None).try_collect::<Vec<_>>().await;
+        let all = all.unwrap();
+        assert_eq!(all.len(), size + 1);
+        assert!(all.iter().any(|obj| obj.id == other.id));
+    }
+
+    #[test(tokio::test)]
+    async fn test_upload_link() {
+        let repo = repository().await;
+        let (id, object_id) = (Uuid::new_v4(), Uuid::new_v4());
+
+        assert!(!repo.use_upload_link(id, object_id).await.unwrap());
+
+        let expires_at = Utc::now() + TimeDelta::hours(1);
+        repo.create_upload_link(id, object_id, expires_at)
+            .await
+            .unwrap();
+
+        // Links are bound to their object
+        assert!(!repo.use_upload_link(id, Uuid::new_v4()).await.unwrap());
+
+        assert!(repo.use_upload_link(id, object_id).await.unwrap());
+        assert!(!repo.use_upload_link(id, object_id).await.unwrap());
+
+        // Released links can be used again
+        repo.release_upload_link(id).await.unwrap();
+        assert!(repo.use_upload_link(id, object_id).await.unwrap());
+
+        let id = Uuid::new_v4();
+        let expires_at = Utc::now() - TimeDelta::seconds(1);
+        repo.create_upload_link(id, object_id, expires_at)
+            .await
+            .unwrap();
+        assert!(!repo.use_upload_link(id, object_id).await.unwrap());
+
+        repo.delete_expired_upload_links().await.unwrap();
+    }
+
+    #[test(tokio::test)]
+    async fn test_create_public() {
+        let repo = repository().await;
+
+        let options = ObjectOptions {
+            public: true,
+            ..Default::default()
+        };
+        let obj = repo
+            .create(Uuid::new_v4(), Uuid::new_v4(), rand_data(), options)
+            .await
+            .unwrap();
+        assert!(obj.public);
+
+        let obj = repo.get(obj.id).await.unwrap();
+        assert!(obj.public);
+    }
+
+    #[test(tokio::test)]
+    async fn test_tags() {
+        let repo = repository().await;
+        let user_id = Uuid::new_v4();
+
+        let mut ids = Vec::new();
+        for _ in 0..3 {
+            let obj = repo
+                .create(
+                    Uuid::new_v4(),
+                    user_id,
+                    rand_data(),
+                    ObjectOptions::default(),
+                )
+                .await
+                .unwrap();
+            ids.push(obj.id);
+        }
+        assert!(repo.get_tags(ids[0]).await.unwrap().is_empty());
+
+        let tags: Tags = [
+            ("project".into(), "downloader".into()),
+            ("kind".into(), "report".into()),
+        ]
+        .into();
+        repo.set_tags(ids[0], &tags).await.unwrap();
+        repo.set_tags(ids[0], &tags).await.unwrap();
+        assert_eq!(repo.get_tags(ids[0]).await.unwrap(), tags);
+
+        let other: Tags = [("project".into(), "other".into())].into();
+        repo.set_tags(ids[1], &other).await.unwrap();
+
+        let tag: Tag = "project:downloader".parse().unwrap();
+        let tagged = repo.get_all(10, 0, Some(&tag)).await.unwrap();
+        assert_eq!(tagged.len(), 1);
+        assert_eq!(tagged[0].id, ids[0]);
+
+        let tagged =
+            repo.get_by_user(user_id, 10, 0, Some(&tag)).await.unwrap();
+        assert_eq!(tagged.len(), 1);
+        let tagged = repo
+            .get_by_user(Uuid::new_v4(), 10, 0, Some(&tag))
+            .await
+            .unwrap();
+        assert!(tagged.is_empty());
+
+        // Setting replaces every previous tag
+        repo.set_tags(ids[0], &other).await.unwrap();
+        assert_eq!(repo.get_tags(ids[0]).await.unwrap(), other);
+        assert!(repo.get_all(10, 0, Some(&tag)).await.unwrap().is_empty());
+
+        repo.delete_tags(ids[1]).await.unwrap();
+        assert!(repo.get_tags(ids[1]).await.unwrap().is_empty());
+
+        repo.delete(ids[0]).await.unwrap();
+        assert!(repo.get_tags(ids[0]).await.unwrap().is_empty());
+
+        let id = Uuid::new_v4();
+        assert!(matches!(
+            repo.set_tags(id, &tags).await,
+            Err(RepositoryError::NotFound(v)) if v == id,
+        ));
+    }
+
+    #[test(tokio::test)]
+    async fn test_get_cached() {
+        let repo = repository()
+            .await
+            .with_cache(ObjectCache::new(10, Duration::from_secs(60)));
+
+        let obj = repo
+            .create(
+                Uuid::new_v4(),
+                Uuid::new_v4(),
+                rand_data(),
+                ObjectOptions::default(),
+            )
+            .await
+            .unwrap();
+
+        assert_eq!(repo.get_cached(obj.id).await.unwrap(), obj);
+        assert_eq!(repo.get_cached(obj.id).await.unwrap(), obj);
+
+        let counted = repo.increment_download_count(obj.id).await.unwrap();
+        let cached = repo.get_cached(obj.id).await.unwrap();
+        assert_eq!(cached, counted);
+        assert_eq!(cached.download_count, 1);
+
+        let updated = repo
+            .update_info(obj.id, rand_string(), rand_mime())
+            .await
+            .unwrap();
+        assert_eq!(repo.get_cached(obj.id).await.unwrap(), updated);
+
+        let to = Uuid::new_v4();
+        repo.transfer_all(obj.user_id, to).await.unwrap();
+        assert_eq!(repo.get_cached(obj.id).await.unwrap().user_id, to);
+
+        repo.delete(obj.id).await.unwrap();
+        assert!(matches!(
+            repo.get_cached(obj.id).await,
+            Err(RepositoryError::NotFound(..)),
+        ));
+
+        let stats = repo.cache().unwrap().stats();
+        assert_eq!(stats.hits, 2);
+        assert_eq!(stats.misses, 4);
+    }
 }
@@ -0,0 +1,225 @@
+use std::{
+    future::Future,
+    io,
+    ops::Range,
+    pin::Pin,
+    task::{ready, Context, Poll},
+};
+
+use tokio::io::{AsyncRead, ReadBuf};
+
+use crate::utils::retry::Backoff;
+
+use super::manager::is_transient_io;
+
+enum State<R, Fut> {
+    Reading(R),
+    Reopening(Pin<Box<Fut>>),
+}
+
+/// Reads `range` of a stored file, reopening it where it stopped when a read
+/// fails with a transient error, so a hiccup of the storage doesn't cut a
+/// download that already sent part of the file. The file is reopened at
+/// most `backoff.retries` times over the whole read, waiting as the backoff
+/// tells before each attempt.
+pub struct ResumableReader<R, F, Fut> {
+    state: State<R, Fut>,
+    reopen: F,
+    /// Next byte of the file to be read.
+    offset: u64,
+    end: u64,
+    backoff: Backoff,
+    attempt: u32,
+}
+
+impl<R, F, Fut> ResumableReader<R, F, Fut>
+where
+    F: FnMut(Range<u64>) -> Fut,
+    Fut: Future<Output = io::Result<R>>,
+{
+    /// Wraps `reader`, opened at the start of `range`. `reopen` opens the
+    /// rest of the range, and must fail if the file is no longer the same.
+    pub fn new(
+        reader: R,
+        range: Range<u64>,
+        backoff: Backoff,
+        reopen: F,
+    ) -> Self {
+        Self {
+            state: State::Reading(reader),
+            reopen,
+            offset: range.start,
+            end: range.end,
+            backoff,
+            attempt: 0,
+        }
+    }
+}
+
+impl<R, F, Fut> AsyncRead for ResumableReader<R, F, Fut>
+where
+    R: AsyncRead + Unpin,
+    F: FnMut(Range<u64>) -> Fut + Unpin,
+    Fut: Future<Output = io::Result<R>>,
+{
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+
+        loop {
+            match &mut this.state {
+                State::Reading(reader) => {
+                    let filled = buf.filled().len();
+
+                    match ready!(Pin::new(reader).poll_read(cx, buf)) {
+                        Ok(()) => {
+                            this.offset += (buf.filled().len() - filled) as u64;
+                            return Poll::Ready(Ok(()));
+                        }
+                        Err(error)
+                            if this.attempt < this.backoff.retries
+                                && this.offset < this.end
+                                && is_transient_io(&error) =>
+                        {
+                            let delay = this.backoff.delay(this.attempt);
+                            tracing::warn!(
+                                target: "object_fs",
+                                %error,
+                                offset = this.offset,
+                                attempt = this.attempt + 1,
+                                ?delay,
+                                "read interrupted, resuming",
+                            );
+
+                            this.attempt += 1;
+                            let reopen = (this.reopen)(this.offset..this.end);
+                            this.state =
+                                State::Reopening(Box::pin(async move {
+                                    tokio::time::sleep(delay).await;
+                                    reopen.await
+                                }));
+                        }
+                        Err(error) => return Poll::Ready(Err(error)),
+                    }
+                }
+                State::Reopening(fut) => {
+                    let reader = ready!(fut.as_mut().poll(cx))?;
+                    this.state = State::Reading(reader);
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        io::{self, ErrorKind},
+        pin::Pin,
+        sync::{Arc, Mutex},
+        task::{Context, Poll},
+        time::Duration,
+    };
+
+    use test_log::test;
+    use tokio::io::{AsyncRead, AsyncReadExt, ReadBuf};
+
+    use crate::utils::retry::Backoff;
+
+    use super::ResumableReader;
+
+    /// Reads `data` from `offset`, failing with `error` once `fail_at` is
+    /// reached.
+    struct FlakyReader {
+        data: Arc<Vec<u8>>,
+        offset: usize,
+        fail_at: Option<usize>,
+        error: ErrorKind,
+    }
+
+    impl AsyncRead for FlakyReader {
+        fn poll_read(
+            mut self: Pin<&mut Self>,
+            _cx: &mut Context<'_>,
+            buf: &mut ReadBuf<'_>,
+        ) -> Poll<io::Result<()>> {
+            if self.fail_at == Some(self.offset) {
+                return Poll::Ready(Err(self.error.into()));
+            }
+
+            let end = self
+                .fail_at
+                .unwrap_or(self.data.len())
+                .min(self.offset + 7)
+                .min(self.offset + buf.remaining());
+            buf.put_slice(&self.data[self.offset..end]);
+            self.offset = end;
+
+            Poll::Ready(Ok(()))
+        }
+    }
+
+    fn reader(
+        data: &Arc<Vec<u8>>,
+        error: ErrorKind,
+        retries: u32,
+    ) -> (impl AsyncRead + Unpin, Arc<Mutex<Vec<u64>>>) {
+        let reopened = Arc::new(Mutex::new(Vec::new()));
+        let first = FlakyReader {
+            data: data.clone(),
+            offset: 0,
+            fail_at: Some(10),
+            error,
+        };
+
+        let reopen = {
+            let (data, reopened) = (data.clone(), reopened.clone());
+            move |range: std::ops::Range<u64>| {
+                reopened.lock().unwrap().push(range.start);
+                let reader = FlakyReader {
+                    data: data.clone(),
+                    offset: range.start as usize,
+                    // Fails again right away the first time
+                    fail_at: (reopened.lock().unwrap().len() == 1)
+                        .then_some(range.start as usize),
+                    error,
+                };
+                async move { Ok(reader) }
+            }
+        };
+
+        let backoff = Backoff::new(retries, Duration::from_millis(1));
+        let len = data.len() as u64;
+        (
+            ResumableReader::new(first, 0..len, backoff, reopen),
+            reopened,
+        )
+    }
+
+    #[test(tokio::test)]
+    async fn test_resume() {
+        let data = Arc::new((0..100u8).collect::<Vec<_>>());
+
+        let (mut resumable, reopened) = reader(&data, ErrorKind::TimedOut, 2);
+        let mut buf = Vec::new();
+        resumable.read_to_end(&mut buf).await.unwrap();
+
+        assert_eq!(buf, *data);
+        assert_eq!(*reopened.lock().unwrap(), [10, 10]);
+
+        // Out of retries
+        let (mut resumable, _) = reader(&data, ErrorKind::TimedOut, 1);
+        let err = resumable.read_to_end(&mut Vec::new()).await.unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::TimedOut);
+
+        // Permanent errors are never resumed
+        let (mut resumable, reopened) =
+            reader(&data, ErrorKind::PermissionDenied, 2);
+        let err = resumable.read_to_end(&mut Vec::new()).await.unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::PermissionDenied);
+        assert!(reopened.lock().unwrap().is_empty());
+    }
+}
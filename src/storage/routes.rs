@@ -1,44 +1,317 @@
-use std::{io, sync::Arc};
+use std::{
+    collections::HashSet,
+    convert::Infallible,
+    io,
+    net::SocketAddr,
+    ops::Range,
+    pin::Pin,
+    sync::Arc,
+    task::{ready, Poll},
+    time::Duration,
+};
 
 use axum::{
-    body::Body,
-    extract::{multipart::MultipartError, Multipart, Path, Request},
-    http::{header, HeaderValue},
-    response::Response,
-    routing, Extension, Router,
+    body::{Body, HttpBody},
+    extract::{
+        multipart::MultipartError, ConnectInfo, Multipart, Path, Request,
+    },
+    http::{header, HeaderMap, StatusCode},
+    response::{
+        sse::{Event, KeepAlive, Sse},
+        IntoResponse, Response,
+    },
+    Extension,
 };
 use bytes::Bytes;
-use futures_util::{Stream, TryStreamExt};
+use chrono::{DateTime, TimeDelta, Utc};
+use futures_util::{stream, Stream, StreamExt, TryStreamExt};
 use serde::{Deserialize, Serialize};
 use sqlx::Sqlite;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite};
 use tokio_util::io::ReaderStream;
 use tracing::Instrument;
 use uuid::Uuid;
 
 use crate::{
-    auth::{axum::Authorization, AuthError, Token},
-    errors::{DownloaderError, HttpError},
-    storage::ObjectData,
-    utils::extractors::{Json, Query},
+    auth::{
+        axum::{Authorization, OptionalAuthorization},
+        repository::TokenRepository,
+        routes::file_token_sharer,
+        AuthError, FileToken, Permission, Token,
+    },
+    config::{ContentTypeCheck, RoutesConfig},
+    errors::{DownloaderError, FieldViolation, HttpError, ValidationError},
+    storage::{ObjectData, ObjectOptions},
+    user::{repository::UserRepository, UserError},
+    utils::{
+        audit::{Actor, AuditAction, AuditEvent, AuditLogger},
+        clock::checked_add,
+        extractors::{Json, JsonStream, Query},
+        openapi::{ApiRouter, Content, RouteSpec, Schema},
+        retry::Backoff,
+        webhook::{WebhookEvent, WebhookEventKind, Webhooks},
+    },
+};
+
+use super::{
+    archive::{
+        ArchiveFormat, ArchiveStatus, ArchiveWriter, EntryNames, ManifestEntry,
+        MANIFEST_NAME,
+    },
+    cache::{CacheStats, ObjectCache},
+    checksum::ExpectedChecksum,
+    conditional::{etag, fmt_http_date, if_range_matches, is_not_modified},
+    content_cache::{ContentCache, ContentCacheStats},
+    disposition::content_disposition,
+    idempotency::{IdempotencyGuard, IdempotencyKeys},
+    manager::{ObjectError, ObjectManager},
+    name::normalize_name,
+    progress::{ProgressTracker, UploadProgress},
+    quota::Quotas,
+    range::{content_range, parse_range, ByteRange, MultipartRanges},
+    repository::{ObjectRepository, RepositoryError, MAX_LIMIT},
+    resume::ResumableReader,
+    sniff::{essence, is_compatible, is_generic, peek, sniff},
+    tag::{validate_tags, Tag, Tags},
+    throttle::{Throttle, ThrottledReader},
+    timeout::{DeadlineReader, DownloadTimeouts},
+    Object,
 };
 
-use super::{manager::ObjectManager, repository::ObjectRepository, Object};
+/// Number of seconds after the upload until the object expires.
+pub const EXPIRES_IN_HEADER: &'static str = "x-expires-in";
+/// Number of downloads after which the object can no longer be downloaded.
+pub const MAX_DOWNLOADS_HEADER: &'static str = "x-max-downloads";
+/// Whether the object can be read without authorization.
+pub const PUBLIC_HEADER: &'static str = "x-public";
+/// Client chosen id used to follow the progress of a new upload, since the
+/// object id is only known once it finishes.
+pub const UPLOAD_ID_HEADER: &'static str = "x-upload-id";
+/// Client chosen key making retries of an upload return the object created
+/// by the first attempt.
+pub const IDEMPOTENCY_KEY_HEADER: &'static str = "idempotency-key";
+pub const MAX_IDEMPOTENCY_KEY_LEN: usize = 255;
+/// Hex encoded SHA-256 the uploaded file must have, either sent before the
+/// body or as a trailer announced by the `Trailer` header.
+///
+/// Downloads send the checksum of the whole file in it, only on full (200)
+/// responses. Partial (206) ones omit it, since the body can't be verified
+/// against it.
+pub const CHECKSUM_HEADER: &'static str = "x-checksum-sha256";
+
+pub const MAX_BULK_DELETE: usize = MAX_LIMIT as usize;
+const BULK_DELETE_CONCURRENCY: usize = 8;
 
-pub fn file_routes<S>(router: Router<S>) -> Router<S>
+pub const MAX_ARCHIVE_FILES: usize = MAX_LIMIT as usize;
+/// Bytes of the archive buffered ahead of the client.
+const ARCHIVE_BUFFER_SIZE: usize = 64 * 1024;
+
+const GET_ALL_FILES: RouteSpec = RouteSpec::get("/", "Lists the files")
+    .auth()
+    .query(Schema::of::<ListFilesQueryData>())
+    .response(Content::JsonList(Schema::of::<Object>()))
+    .errors(&[1002, 1003, 4009]);
+const GET_FILES_BY_USER: RouteSpec =
+    RouteSpec::get("/user/:user_id", "Lists the files of a user")
+        .auth()
+        .query(Schema::of::<ListFilesQueryData>())
+        .response(Content::JsonList(Schema::of::<Object>()))
+        .errors(&[1002, 1003, 4009]);
+const STREAM_ALL_FILES: RouteSpec =
+    RouteSpec::get("/stream", "Lists every file, streaming the array")
+        .auth()
+        .query(Schema::of::<StreamFilesQueryData>())
+        .response(Content::JsonList(Schema::of::<Object>()))
+        .errors(&[1003, 4009]);
+const STREAM_FILES_BY_USER: RouteSpec = RouteSpec::get(
+    "/user/:user_id/stream",
+    "Lists every file of a user, streaming the array",
+)
+.auth()
+.query(Schema::of::<StreamFilesQueryData>())
+.response(Content::JsonList(Schema::of::<Object>()))
+.errors(&[1003, 4009]);
+const GET_CACHE_STATS: RouteSpec =
+    RouteSpec::get("/cache/stats", "Stats of the file caches")
+        .auth()
+        .response(Content::Json(Schema::Named("CacheStatsResponseData")))
+        .errors(&[4009]);
+const GET_FILE: RouteSpec = RouteSpec::get("/:id", "Gets a file")
+    .optional_auth()
+    .response(Content::Json(Schema::of::<Object>()))
+    .errors(&[1001, 1003, 4009]);
+const DOWNLOAD_FILE: RouteSpec =
+    RouteSpec::get("/:id/data", "Downloads the data of a file")
+        .optional_auth()
+        .response(Content::Binary("application/octet-stream"))
+        .errors(&[1001, 1003, 1004, 2002, 2005, 4009, 99003, 99005]);
+const DOWNLOAD_FILE_NAMED: RouteSpec = RouteSpec::get(
+    "/:id/data/:name",
+    "Downloads the data of a file, with the name in the path",
+)
+.optional_auth()
+.response(Content::Binary("application/octet-stream"))
+.errors(&[1001, 1003, 1004, 2002, 2005, 4009, 99003, 99005]);
+const GET_FILE_TAGS: RouteSpec =
+    RouteSpec::get("/:id/tags", "Gets the tags of a file")
+        .auth()
+        .response(Content::Json(Schema::of::<FileTagsData>()))
+        .errors(&[1001, 1003, 4009]);
+const DOWNLOAD_ARCHIVE: RouteSpec = RouteSpec::post(
+    "/archive",
+    "Downloads the listed files in a single archive",
+)
+.auth()
+.query(Schema::of::<ArchiveQueryData>())
+.request(Content::JsonList(Schema::Uuid))
+.response(Content::Binary("application/octet-stream"))
+.errors(&[1003, 4009, 5001]);
+const TRANSFER_FILES: RouteSpec =
+    RouteSpec::post("/transfer", "Transfers files to another user")
+        .auth()
+        .request(Content::Json(Schema::of::<TransferFilesRequestData>()))
+        .response(Content::JsonList(Schema::Named("TransferResult")))
+        .errors(&[1003, 3001, 4009, 5001]);
+const UPDATE_FILE: RouteSpec =
+    RouteSpec::put("/:id", "Updates the name and type of a file")
+        .auth()
+        .request(Content::Json(Schema::of::<UpdateFileRequestData>()))
+        .response(Content::Json(Schema::of::<Object>()))
+        .errors(&[1001, 1003, 4009, 5001]);
+const SET_FILE_TAGS: RouteSpec =
+    RouteSpec::put("/:id/tags", "Replaces the tags of a file")
+        .auth()
+        .request(Content::Json(Schema::of::<FileTagsData>()))
+        .response(Content::Json(Schema::of::<FileTagsData>()))
+        .errors(&[1001, 1003, 4009, 5001]);
+const SHARE_FILE: RouteSpec =
+    RouteSpec::post("/:id/share", "Creates a link to read a file")
+        .auth()
+        .request(Content::Json(Schema::of::<ShareFileRequestData>()))
+        .response(Content::Json(Schema::of::<ShareFileResponseData>()))
+        .errors(&[1001, 1003, 4001, 4002, 4009, 4010, 5001]);
+const TRANSFER_FILE: RouteSpec =
+    RouteSpec::post("/:id/transfer", "Transfers a file to another user")
+        .auth()
+        .request(Content::Json(Schema::of::<TransferFileRequestData>()))
+        .response(Content::Json(Schema::of::<Object>()))
+        .errors(&[1001, 1003, 2008, 3001, 4009]);
+const UPLOAD_FILE: RouteSpec =
+    RouteSpec::post("/", "Uploads a file, sent as the body")
+        .auth()
+        .query(Schema::of::<PostFileRequestData>())
+        .request(Content::Binary("application/octet-stream"))
+        .response(Content::Json(Schema::of::<Object>()))
+        .errors(&[
+            1003, 2001, 2003, 2004, 2006, 2007, 2008, 2009, 5001, 99003, 99004,
+        ]);
+const UPLOAD_FILE_MULTIPART: RouteSpec =
+    RouteSpec::post("/multipart", "Uploads a file, sent in a form")
+        .auth()
+        .request(Content::Multipart)
+        .response(Content::Json(Schema::of::<Object>()))
+        .errors(&[
+            1003, 2001, 2003, 2004, 2006, 2007, 2008, 2009, 5001, 99001, 99002,
+            99003, 99004, 101000,
+        ]);
+const UPDATE_FILE_DATA: RouteSpec =
+    RouteSpec::put("/:id/data", "Replaces the data of a file")
+        .auth()
+        .query(Schema::of::<PostFileRequestData>())
+        .request(Content::Binary("application/octet-stream"))
+        .response(Content::Json(Schema::of::<Object>()))
+        .errors(&[
+            1001, 1003, 2001, 2003, 2004, 2006, 2007, 2008, 2009, 2010, 4009,
+            5001, 99003,
+        ]);
+const UPDATE_FILE_DATA_MULTIPART: RouteSpec = RouteSpec::put(
+    "/:id/multipart",
+    "Replaces the data of a file, sent in a form",
+)
+.auth()
+.request(Content::Multipart)
+.response(Content::Json(Schema::of::<Object>()))
+.errors(&[
+    1001, 1003, 2001, 2003, 2004, 2006, 2007, 2008, 2009, 2010, 4009, 5001,
+    99001, 99002, 99003, 101000,
+]);
+const UPLOAD_PROGRESS: RouteSpec =
+    RouteSpec::get("/:id/upload/progress", "Follows the progress of an upload")
+        .auth()
+        .response(Content::EventStream)
+        .errors(&[4009]);
+const CREATE_UPLOAD_LINK: RouteSpec = RouteSpec::post(
+    "/upload-link",
+    "Creates a link to upload a file without an account",
+)
+.auth()
+.request(Content::Json(Schema::of::<UploadLinkRequestData>()))
+.response(Content::Json(Schema::of::<UploadLinkResponseData>()))
+.errors(&[1003, 4001, 4002, 4009, 5001]);
+const DELETE_FILES: RouteSpec =
+    RouteSpec::post("/delete", "Deletes the listed files")
+        .auth()
+        .request(Content::JsonList(Schema::Uuid))
+        .response(Content::JsonList(Schema::Named("DeleteResult")))
+        .errors(&[1003, 4009, 5001]);
+const DELETE_FILE: RouteSpec = RouteSpec::delete("/:id", "Deletes a file")
+    .auth()
+    .response(Content::Json(Schema::of::<Object>()))
+    .errors(&[1001, 1003, 2001, 4009]);
+
+pub fn file_routes<S>(api: ApiRouter<S>, routes: &RoutesConfig) -> ApiRouter<S>
 where
     S: Clone + Send + Sync + 'static,
 {
-    router
-        .route("/", routing::get(get_all_files))
-        .route("/user/:user_id", routing::get(get_files_by_user))
-        .route("/:id", routing::get(get_file))
-        .route("/:id/data", routing::get(download_file))
-        .route("/", routing::post(upload_file))
-        .route("/multipart", routing::post(upload_file_multipart))
-        .route("/:id", routing::put(update_file))
-        .route("/:id/data", routing::put(update_file_data))
-        .route("/:id/multipart", routing::put(update_file_data_multipart))
-        .route("/:id", routing::delete(delete_file))
+    let mut api = api
+        .route(GET_ALL_FILES, get_all_files)
+        .route(GET_FILES_BY_USER, get_files_by_user)
+        .route(STREAM_ALL_FILES, stream_all_files)
+        .route(STREAM_FILES_BY_USER, stream_files_by_user)
+        .route(GET_CACHE_STATS, get_cache_stats)
+        .route(GET_FILE, get_file)
+        .route(DOWNLOAD_FILE, download_file)
+        .route(DOWNLOAD_FILE_NAMED, download_file_named)
+        .route(GET_FILE_TAGS, get_file_tags)
+        .route(DOWNLOAD_ARCHIVE, download_archive)
+        .route(TRANSFER_FILES, transfer_files)
+        .route(UPDATE_FILE, update_file)
+        .route(SET_FILE_TAGS, set_file_tags)
+        .route(SHARE_FILE, share_file)
+        .route(TRANSFER_FILE, transfer_file);
+
+    if routes.upload {
+        api = api
+            .route(UPLOAD_FILE, upload_file)
+            // The uploads are limited by the object manager instead, while
+            // they are streamed
+            .route_unlimited(UPLOAD_FILE_MULTIPART, upload_file_multipart)
+            .route(UPDATE_FILE_DATA, update_file_data)
+            .route_unlimited(
+                UPDATE_FILE_DATA_MULTIPART,
+                update_file_data_multipart,
+            )
+            .route(UPLOAD_PROGRESS, upload_progress)
+            .route(CREATE_UPLOAD_LINK, create_upload_link);
+    } else {
+        api = api
+            .disabled(UPLOAD_FILE)
+            .disabled(UPLOAD_FILE_MULTIPART)
+            .disabled(UPDATE_FILE_DATA)
+            .disabled(UPDATE_FILE_DATA_MULTIPART)
+            .disabled(UPLOAD_PROGRESS)
+            .disabled(CREATE_UPLOAD_LINK);
+    }
+
+    if routes.delete {
+        api = api
+            .route(DELETE_FILES, delete_files)
+            .route(DELETE_FILE, delete_file);
+    } else {
+        api = api.disabled(DELETE_FILES).disabled(DELETE_FILE);
+    }
+
+    api
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -49,11 +322,21 @@ pub struct PostFileRequestData {
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 #[serde(deny_unknown_fields)]
-pub struct PaginationData {
+pub struct StreamFilesQueryData {
+    /// Only lists the files with this `key:value` tag.
+    pub tag: Option<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ListFilesQueryData {
     #[serde(default = "default_pagination_limit")]
     pub limit: u32,
     #[serde(default = "default_pagination_offset")]
     pub offset: u32,
+    /// Only lists the files with this `key:value` tag.
+    #[serde(default)]
+    pub tag: Option<String>,
 }
 
 const fn default_pagination_limit() -> u32 {
@@ -71,16 +354,126 @@ pub struct UpdateFileRequestData {
     pub mime_type: String,
 }
 
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct FileTagsData {
+    pub tags: Tags,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ShareFileRequestData {
+    pub permission: Option<Permission>,
+    pub duration: Option<u64>,
+    /// When the link starts working, the duration is counted from it.
+    pub not_before: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ShareFileResponseData {
+    pub url: String,
+    pub token: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub not_before: Option<DateTime<Utc>>,
+    pub expires_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct UploadLinkRequestData {
+    pub name: String,
+    pub mime_type: Option<String>,
+    /// Seconds the link can be used for.
+    pub duration: Option<u64>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct UploadLinkResponseData {
+    /// The pre-created file, empty until the link is used.
+    pub file: Object,
+    /// Where the data is `PUT` once, with its `name` query parameter.
+    pub url: String,
+    pub token: String,
+    pub expires_at: DateTime<Utc>,
+}
+
+/// Stats of the object cache, along with the ones of the content cache.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CacheStatsResponseData {
+    #[serde(flatten)]
+    pub objects: CacheStats,
+    pub content: ContentCacheStats,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum DeleteStatus {
+    Deleted,
+    NotFound,
+    Forbidden,
+    Failed,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DeleteResult {
+    pub id: Uuid,
+    pub status: DeleteStatus,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct TransferFileRequestData {
+    /// The new owner.
+    pub user_id: Uuid,
+}
+
+/// Either lists the files to transfer, or the user to transfer every file
+/// of.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct TransferFilesRequestData {
+    /// The new owner.
+    pub user_id: Uuid,
+    #[serde(default)]
+    pub ids: Vec<Uuid>,
+    #[serde(default)]
+    pub from_user_id: Option<Uuid>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum TransferStatus {
+    Transferred,
+    NotFound,
+    /// The file doesn't fit in the quota of the receiver.
+    QuotaExceeded,
+    Failed,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TransferResult {
+    pub id: Uuid,
+    pub status: TransferStatus,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ArchiveQueryData {
+    #[serde(default)]
+    pub format: ArchiveFormat,
+}
+
 pub async fn get_all_files(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
-    Query(data): Query<PaginationData>,
+    Query(data): Query<ListFilesQueryData>,
 ) -> Result<Json<Vec<Object>>, DownloaderError> {
     if !token.can_read_all() {
         return Err(AuthError::AccessDenied.into());
     }
+    let tag = data.tag.as_deref().map(str::parse::<Tag>).transpose()?;
 
-    repo.get_all(data.limit, data.offset)
+    repo.get_all(data.limit, data.offset, tag.as_ref())
         .await
         .map(Json)
         .map_err(DownloaderError::Repository)
@@ -90,7 +483,7 @@ pub async fn get_files_by_user(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
     Path(user_id): Path<Uuid>,
-    Query(data): Query<PaginationData>,
+    Query(data): Query<ListFilesQueryData>,
 ) -> Result<Json<Vec<Object>>, DownloaderError> {
     let can_access = token.can_read_all()
         || match token {
@@ -102,120 +495,507 @@ pub async fn get_files_by_user(
         return Err(AuthError::AccessDenied.into());
     }
 
-    repo.get_by_user(user_id, data.limit, data.offset)
+    let tag = data.tag.as_deref().map(str::parse::<Tag>).transpose()?;
+
+    repo.get_by_user(user_id, data.limit, data.offset, tag.as_ref())
         .await
         .map(Json)
         .map_err(DownloaderError::Repository)
 }
 
-pub async fn get_file(
+/// Same as [`get_all_files`], with every file at once, ordered by id. The
+/// array is streamed as it is read from the database.
+pub async fn stream_all_files(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
-    Path(id): Path<Uuid>,
-) -> Result<Json<Object>, DownloaderError> {
-    let object = repo.get(id).await?;
+    Query(data): Query<StreamFilesQueryData>,
+) -> Result<impl IntoResponse, DownloaderError> {
+    if !token.can_read_all() {
+        return Err(AuthError::AccessDenied.into());
+    }
+    let tag = data.tag.as_deref().map(str::parse::<Tag>).transpose()?;
+
+    Ok(JsonStream(repo.stream(None, tag)))
+}
 
+/// Same as [`get_files_by_user`], with every file at once, ordered by id.
+/// The array is streamed as it is read from the database.
+pub async fn stream_files_by_user(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Path(user_id): Path<Uuid>,
+    Query(data): Query<StreamFilesQueryData>,
+) -> Result<impl IntoResponse, DownloaderError> {
     let can_access = token.can_read_all()
-        || (object.user_id
-            == match token {
-                Token::User(user_token) => user_token.user_id,
-                _ => Uuid::nil(),
-            });
+        || match token {
+            Token::User(user_token) => user_token.user_id == user_id,
+            _ => false,
+        };
 
     if !can_access {
         return Err(AuthError::AccessDenied.into());
     }
 
+    let tag = data.tag.as_deref().map(str::parse::<Tag>).transpose()?;
+
+    Ok(JsonStream(repo.stream(Some(user_id), tag)))
+}
+
+/// Reports how often the downloads were answered by the object and the
+/// content caches, zeros for the disabled ones.
+pub async fn get_cache_stats(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(manager): Extension<Arc<ObjectManager>>,
+) -> Result<Json<CacheStatsResponseData>, DownloaderError> {
+    if !token.permission().contains(Permission::ADMIN) {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    Ok(Json(CacheStatsResponseData {
+        objects: repo.cache().map(ObjectCache::stats).unwrap_or_default(),
+        content: manager
+            .content_cache()
+            .map(ContentCache::stats)
+            .unwrap_or_default(),
+    }))
+}
+
+pub async fn get_file(
+    OptionalAuthorization(token): OptionalAuthorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Path(id): Path<Uuid>,
+) -> Result<Json<Object>, DownloaderError> {
+    let object = repo.get(id).await?;
+    check_read_access(token.as_ref(), &object)?;
+
     Ok(Json(object))
 }
 
-pub async fn download_file(
+/// Tags are only shown to the owner, even if the object is public.
+pub async fn get_file_tags(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Path(id): Path<Uuid>,
+) -> Result<Json<FileTagsData>, DownloaderError> {
+    let object = repo.get(id).await?;
+    check_owner_read_access(&token, &object)?;
+
+    let tags = repo.get_tags(id).await?;
+    Ok(Json(FileTagsData { tags }))
+}
+
+/// Replaces every tag of the file.
+pub async fn set_file_tags(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Path(id): Path<Uuid>,
+    Json(data): Json<FileTagsData>,
+) -> Result<Json<FileTagsData>, DownloaderError> {
+    validate_tags(&data.tags)?;
+    check_write_access(&token, &repo, id).await?;
+
+    repo.set_tags(id, &data.tags).await?;
+    Ok(Json(data))
+}
+
+pub async fn download_file(
+    OptionalAuthorization(token): OptionalAuthorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
     Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(throttle): Extension<Arc<Throttle>>,
+    Extension(timeouts): Extension<DownloadTimeouts>,
+    Extension(backoff): Extension<Backoff>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
     Path(id): Path<Uuid>,
+    headers: HeaderMap,
 ) -> Result<Response, DownloaderError> {
-    let object = repo.get(id).await?;
+    let actor = Actor::new(token.as_ref(), connect_info.as_ref());
+    let res = download_file_internal(
+        token.as_ref(),
+        &repo,
+        &manager,
+        &throttle,
+        &timeouts,
+        &backoff,
+        actor,
+        id,
+        None,
+        &headers,
+    )
+    .await;
 
-    let can_access = token.can_read_all()
-        || (object.user_id
-            == match token {
-                Token::User(user_token) => user_token.user_id,
-                _ => Uuid::nil(),
-            });
+    audit.record(AuditEvent::new(
+        AuditAction::ReadFile,
+        actor,
+        Some(id),
+        &res,
+    ));
 
-    if !can_access {
-        return Err(AuthError::AccessDenied.into());
+    res
+}
+
+/// Same as [`download_file`], with the name of the file at the end of the
+/// url, so clients save it under the right name. The file is still looked
+/// up by its id, and the name must match the stored one.
+pub async fn download_file_named(
+    OptionalAuthorization(token): OptionalAuthorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(throttle): Extension<Arc<Throttle>>,
+    Extension(timeouts): Extension<DownloadTimeouts>,
+    Extension(backoff): Extension<Backoff>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Path((id, name)): Path<(Uuid, String)>,
+    headers: HeaderMap,
+) -> Result<Response, DownloaderError> {
+    let actor = Actor::new(token.as_ref(), connect_info.as_ref());
+    let res = download_file_internal(
+        token.as_ref(),
+        &repo,
+        &manager,
+        &throttle,
+        &timeouts,
+        &backoff,
+        actor,
+        id,
+        Some(&name),
+        &headers,
+    )
+    .await;
+
+    audit.record(AuditEvent::new(
+        AuditAction::ReadFile,
+        actor,
+        Some(id),
+        &res,
+    ));
+
+    res
+}
+
+async fn download_file_internal(
+    token: Option<&Token>,
+    repo: &ObjectRepository<Sqlite>,
+    manager: &Arc<ObjectManager>,
+    throttle: &Throttle,
+    timeouts: &DownloadTimeouts,
+    backoff: &Backoff,
+    actor: Actor,
+    id: Uuid,
+    name: Option<&str>,
+    headers: &HeaderMap,
+) -> Result<Response, DownloaderError> {
+    // The download count may be stale, but it is checked again when counted
+    let object = backoff
+        .retry(
+            || async move {
+                let object = timeouts.metadata(repo.get_cached(id)).await??;
+                Ok::<_, DownloaderError>(object)
+            },
+            DownloaderError::is_transient,
+        )
+        .await?;
+    check_read_access(token, &object)?;
+
+    // Only checked once the access is, so the name of a file can't be
+    // guessed without being allowed to read it
+    if name.is_some_and(|name| name != object.data.name) {
+        return Err(ObjectError::NotFound.into());
     }
 
-    let reader = manager.fetch(id).await?;
+    let etag = etag(&object);
+    let last_modified = fmt_http_date(&object.updated_at);
+    let content_type = manager
+        .content_type_or_default(&object.data.mime_type)
+        .to_owned();
 
-    Response::builder()
-        .header(header::CONTENT_TYPE, object.data.mime_type)
+    if is_not_modified(headers, &object) {
+        return Response::builder()
+            .status(StatusCode::NOT_MODIFIED)
+            .header(header::ETAG, etag)
+            .header(header::LAST_MODIFIED, last_modified)
+            .body(Body::empty())
+            .map_err(DownloaderError::from);
+    }
+
+    // Every request to a limited object is counted, so ranges would let a
+    // single download consume the whole limit
+    let accepts_ranges = object.max_downloads.is_none();
+    let range = if accepts_ranges && if_range_matches(headers, &object) {
+        parse_range(headers, object.data.size)
+    } else {
+        ByteRange::Full
+    };
+
+    let (status, range, multipart) = match range {
+        ByteRange::Full => (StatusCode::OK, None, None),
+        ByteRange::Partial(range) => {
+            (StatusCode::PARTIAL_CONTENT, Some(range), None)
+        }
+        ByteRange::Multiple(ranges) => {
+            let multipart =
+                MultipartRanges::new(ranges, &content_type, object.data.size);
+            (StatusCode::PARTIAL_CONTENT, None, Some(multipart))
+        }
+        ByteRange::Unsatisfiable => {
+            return Response::builder()
+                .status(StatusCode::RANGE_NOT_SATISFIABLE)
+                .header(
+                    header::CONTENT_RANGE,
+                    format!("bytes */{}", object.data.size),
+                )
+                .body(Body::empty())
+                .map_err(DownloaderError::from);
+        }
+    };
+
+    let buckets = throttle.buckets(actor.ip, token);
+    let len = match (&range, &multipart) {
+        (Some(range), _) => range.end - range.start,
+        (None, Some(multipart)) => multipart.content_length(),
+        (None, None) => object.data.size,
+    };
+    let max_rate = buckets.iter().map(|bucket| bucket.rate()).min();
+    let deadline = timeouts.stream(len, max_rate);
+
+    let reopen = {
+        let (repo, manager) = (repo.clone(), manager.clone());
+        let checksum = object.data.checksum_256;
+
+        move |range: Range<u64>| {
+            let (repo, manager) = (repo.clone(), manager.clone());
+            async move {
+                reopen_stored_file(&repo, &manager, id, checksum, range).await
+            }
+        }
+    };
+
+    // Nothing was sent to the client yet, so opening the file can be retried
+    let open_range = |range: Range<u64>| {
+        let reopen = reopen.clone();
+        async move {
+            let file: Box<dyn AsyncRead + Send + Unpin> = Box::new(
+                backoff
+                    .retry(
+                        || {
+                            timeouts.first_byte(
+                                manager.fetch_range(id, range.clone()),
+                            )
+                        },
+                        ObjectError::is_transient,
+                    )
+                    .await
+                    .map_err(|error| stored_file_error(id, error))?,
+            );
+
+            Ok::<_, DownloaderError>(ResumableReader::new(
+                file, range, *backoff, reopen,
+            ))
+        }
+    };
+
+    let file: Box<dyn AsyncRead + Send + Unpin> = match (&range, &multipart) {
+        (Some(range), _) => Box::new(open_range(range.clone()).await?),
+        // Every range is opened before the response starts, there are at
+        // most `MAX_RANGES` of them
+        (None, Some(multipart)) => {
+            let mut body: Box<dyn AsyncRead + Send + Unpin> =
+                Box::new(tokio::io::empty());
+            for (range, header) in multipart.parts() {
+                let part = open_range(range.clone()).await?;
+                body = Box::new(
+                    body.chain(io::Cursor::new(header.clone())).chain(part),
+                );
+            }
+            Box::new(body.chain(io::Cursor::new(multipart.trailer())))
+        }
+        (None, None) => {
+            let file: Box<dyn AsyncRead + Send + Unpin> = Box::new(
+                backoff
+                    .retry(
+                        || timeouts.first_byte(manager.fetch(id)),
+                        ObjectError::is_transient,
+                    )
+                    .await
+                    .map_err(|error| stored_file_error(id, error))?,
+            );
+
+            Box::new(ResumableReader::new(
+                file,
+                0..object.data.size,
+                *backoff,
+                reopen,
+            ))
+        }
+    };
+
+    let body = Body::from_stream(ReaderStream::new(DeadlineReader::new(
+        ThrottledReader::new(file, buckets),
+        deadline,
+    )));
+
+    // Only counted once the file is opened, so failed downloads don't
+    // consume the limit. Download managers split a file into several
+    // ranges, only the one at the start counts as a download.
+    let start = match (&range, &multipart) {
+        (Some(range), _) => range.start,
+        (None, Some(multipart)) => multipart.parts()[0].0.start,
+        (None, None) => 0,
+    };
+    if start == 0 {
+        repo.increment_download_count(id).await?;
+    }
+
+    let mut builder = Response::builder()
+        .status(status)
         .header(
             header::CONTENT_DISPOSITION,
-            format!("attachment; filename=\"{}\"", object.data.name),
+            content_disposition(&object.data.name),
         )
-        .header(header::CONTENT_LENGTH, object.data.size.to_string())
-        .body(Body::from_stream(ReaderStream::new(reader)))
-        .map_err(DownloaderError::from)
+        .header(
+            header::ACCEPT_RANGES,
+            if accepts_ranges { "bytes" } else { "none" },
+        )
+        .header(header::ETAG, etag)
+        .header(header::LAST_MODIFIED, last_modified);
+
+    builder = match (&range, &multipart) {
+        (Some(range), _) => builder
+            .header(header::CONTENT_TYPE, content_type)
+            .header(
+                header::CONTENT_LENGTH,
+                (range.end - range.start).to_string(),
+            )
+            .header(
+                header::CONTENT_RANGE,
+                content_range(range, object.data.size),
+            ),
+        (None, Some(multipart)) => builder
+            .header(header::CONTENT_TYPE, multipart.content_type())
+            .header(
+                header::CONTENT_LENGTH,
+                multipart.content_length().to_string(),
+            ),
+        (None, None) => builder
+            .header(header::CONTENT_TYPE, content_type)
+            .header(header::CONTENT_LENGTH, object.data.size.to_string())
+            .header(CHECKSUM_HEADER, hex::encode(object.data.checksum_256)),
+    };
+
+    builder.body(body).map_err(DownloaderError::from)
 }
 
 pub async fn upload_file(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
     Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(quotas): Extension<Arc<Quotas>>,
+    Extension(progress): Extension<Arc<UploadProgress>>,
+    Extension(idempotency): Extension<Arc<IdempotencyKeys>>,
+    Extension(webhooks): Extension<Webhooks>,
     Query(PostFileRequestData { name }): Query<PostFileRequestData>,
     req: Request,
 ) -> Result<Json<Object>, DownloaderError> {
-    let (stream, mime_type) = extract_request_body_file(req);
+    let guard =
+        match begin_upload(&token, req.headers(), &repo, &idempotency).await? {
+            IdempotentUpload::Replay(object) => return Ok(Json(object)),
+            IdempotentUpload::Start(guard) => guard,
+        };
 
-    post_file_internal(token, repo, manager, stream, name, mime_type)
-        .await
-        .map(Json)
+    let options = extract_object_options(req.headers())?;
+    let expected = extract_expected_checksum(req.headers())?;
+    let tracker = extract_upload_id(req.headers())?
+        .map(|upload_id| progress.start(upload_id, token_owner(&token)));
+
+    let (stream, mime_type) = extract_request_body_file(req, expected.clone());
+    let stream = track_progress(stream, tracker);
+
+    let user_id = token_owner(&token);
+    let object = post_file_internal(
+        token,
+        repo.clone(),
+        manager,
+        quotas,
+        stream,
+        name,
+        mime_type,
+        options,
+        expected,
+    )
+    .await?;
+
+    finish_upload(&repo, &idempotency, guard, &object).await;
+    webhooks.send(WebhookEvent::new(
+        WebhookEventKind::FileCreated,
+        object.id,
+        user_id,
+    ));
+    Ok(Json(object))
 }
 
 pub async fn upload_file_multipart(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
     Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(quotas): Extension<Arc<Quotas>>,
+    Extension(progress): Extension<Arc<UploadProgress>>,
+    Extension(idempotency): Extension<Arc<IdempotencyKeys>>,
+    Extension(webhooks): Extension<Webhooks>,
+    headers: HeaderMap,
     mut multipart: Multipart,
 ) -> Result<Json<Object>, DownloaderError> {
+    let guard =
+        match begin_upload(&token, &headers, &repo, &idempotency).await? {
+            IdempotentUpload::Replay(object) => return Ok(Json(object)),
+            IdempotentUpload::Start(guard) => guard,
+        };
+
+    let options = extract_object_options(&headers)?;
+    let expected = extract_checksum_header(&headers)?;
+    let tracker = extract_upload_id(&headers)?
+        .map(|upload_id| progress.start(upload_id, token_owner(&token)));
+
     let (stream, name, mime_type) =
         extract_multipart_file(&mut multipart).await?;
+    let stream = track_progress(stream, tracker);
 
-    post_file_internal(token, repo, manager, stream, name, mime_type)
-        .await
-        .map(Json)
+    let user_id = token_owner(&token);
+    let object = post_file_internal(
+        token,
+        repo.clone(),
+        manager,
+        quotas,
+        stream,
+        name,
+        mime_type,
+        options,
+        expected,
+    )
+    .await?;
+
+    finish_upload(&repo, &idempotency, guard, &object).await;
+    webhooks.send(WebhookEvent::new(
+        WebhookEventKind::FileCreated,
+        object.id,
+        user_id,
+    ));
+    Ok(Json(object))
 }
 
 pub async fn update_file(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(manager): Extension<Arc<ObjectManager>>,
     Path(id): Path<Uuid>,
     Json(data): Json<UpdateFileRequestData>,
 ) -> Result<Json<Object>, DownloaderError> {
-    // Placed before to avoid unecessary database queries in case the
-    // write permission is missing
-    if !token.can_write_owned() {
-        return Err(AuthError::AccessDenied.into());
-    }
-
-    let can_access = match &token {
-        Token::User(user_token) => {
-            let obj = repo.get(id).await?;
-
-            obj.user_id == user_token.user_id || token.can_write_all()
-        }
-        Token::File(file_token) => file_token.file_id == id,
-        Token::Server => true,
-    };
-
-    if !can_access {
-        return Err(AuthError::AccessDenied.into());
-    }
+    let name = normalize_name("name", &data.name, manager.max_name_len())?;
+    check_write_access(&token, &repo, id).await?;
 
-    let obj = repo.update_info(id, data.name, data.mime_type).await?;
+    let obj = repo.update_info(id, name, data.mime_type).await?;
     Ok(Json(obj))
 }
 
@@ -223,63 +1003,78 @@ pub async fn update_file_data(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
     Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(quotas): Extension<Arc<Quotas>>,
+    Extension(progress): Extension<Arc<UploadProgress>>,
     Path(id): Path<Uuid>,
     Query(PostFileRequestData { name }): Query<PostFileRequestData>,
     req: Request,
 ) -> Result<Json<Object>, DownloaderError> {
-    let (stream, mime_type) = extract_request_body_file(req);
-    // pin_mut!(reader);
+    let expected = extract_expected_checksum(req.headers())?;
+    let (stream, mime_type) = extract_request_body_file(req, expected.clone());
 
-    update_file_internal(token, repo, manager, id, stream, name, mime_type)
-        .await
-        .map(Json)
+    update_file_internal(
+        token, repo, manager, quotas, progress, id, stream, name, mime_type,
+        expected,
+    )
+    .await
+    .map(Json)
 }
 
 pub async fn update_file_data_multipart(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
     Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(quotas): Extension<Arc<Quotas>>,
+    Extension(progress): Extension<Arc<UploadProgress>>,
     Path(id): Path<Uuid>,
+    headers: HeaderMap,
     mut multipart: Multipart,
 ) -> Result<Json<Object>, DownloaderError> {
+    let expected = extract_checksum_header(&headers)?;
     let (stream, name, mime_type) =
         extract_multipart_file(&mut multipart).await?;
-    // pin_mut!(reader);
 
-    update_file_internal(token, repo, manager, id, stream, name, mime_type)
-        .await
-        .map(Json)
+    update_file_internal(
+        token, repo, manager, quotas, progress, id, stream, name, mime_type,
+        expected,
+    )
+    .await
+    .map(Json)
 }
 
 pub async fn delete_file(
     Authorization(token): Authorization,
     Extension(repo): Extension<ObjectRepository<Sqlite>>,
     Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(audit): Extension<AuditLogger>,
+    Extension(webhooks): Extension<Webhooks>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
     Path(id): Path<Uuid>,
 ) -> Result<Json<Object>, DownloaderError> {
-    // Placed before to avoid unecessary database queries in case the
-    // write permission is missing
-    if !token.can_write_owned() {
-        return Err(AuthError::AccessDenied.into());
-    }
-
-    let can_access = match &token {
-        Token::User(user_token) => {
-            let obj = repo.get(id).await?;
-
-            obj.user_id == user_token.user_id || token.can_write_all()
-        }
-        Token::File(file_token) => file_token.file_id == id,
-        Token::Server => true,
-    };
-
-    if !can_access {
-        return Err(AuthError::AccessDenied.into());
+    let res = async {
+        check_write_access(&token, &repo, id).await?;
+        let write = manager.lock_write(id)?;
+        let obj = repo.delete(id).await?;
+        Ok::<_, DownloaderError>((obj, write))
     }
+    .await;
 
-    let obj = repo.delete(id).await?;
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    audit.record(AuditEvent::new(
+        AuditAction::DeleteFile,
+        actor,
+        Some(id),
+        &res,
+    ));
+    let (obj, write) = res?;
+    webhooks.send(WebhookEvent::new(
+        WebhookEventKind::FileDeleted,
+        id,
+        actor.user_id,
+    ));
 
     tokio::spawn(async move {
+        let _write = write;
         manager
             .delete(id)
             .instrument(tracing::span!(
@@ -292,29 +1087,788 @@ pub async fn delete_file(
     Ok(Json(obj))
 }
 
-async fn extract_multipart_file<'a>(
-    multipart: &'a mut Multipart,
-) -> Result<
-    (
-        futures_util::stream::MapErr<
-            axum::extract::multipart::Field<'a>,
-            impl FnMut(MultipartError) -> io::Error,
-        >,
-        String,
-        String,
-    ),
-    DownloaderError,
-> {
-    let field =
-        multipart
-            .next_field()
-            .await?
-            .ok_or(HttpError::InvalidFormLength {
-                expected: 1,
-                got: 0,
-            })?;
-
-    let name = field
+/// Deletes multiple objects, reporting the outcome of each one instead of
+/// failing the whole request.
+pub async fn delete_files(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(audit): Extension<AuditLogger>,
+    Extension(webhooks): Extension<Webhooks>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Json(ids): Json<Vec<Uuid>>,
+) -> Result<Json<Vec<DeleteResult>>, DownloaderError> {
+    if ids.len() > MAX_BULK_DELETE {
+        return Err(RepositoryError::LimitOutOfRange(ids.len() as u32).into());
+    }
+
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    let (token, repo, manager, audit, webhooks) =
+        (&token, &repo, &manager, &audit, &webhooks);
+
+    let results = stream::iter(ids)
+        .map(|id| async move {
+            let res = delete_file_internal(token, repo, manager, id).await;
+            audit.record(AuditEvent::new(
+                AuditAction::DeleteFile,
+                actor,
+                Some(id),
+                &res,
+            ));
+
+            if res.is_ok() {
+                webhooks.send(WebhookEvent::new(
+                    WebhookEventKind::FileDeleted,
+                    id,
+                    actor.user_id,
+                ));
+            }
+
+            let status = match res {
+                Ok(()) => DeleteStatus::Deleted,
+                Err(DownloaderError::Repository(
+                    RepositoryError::NotFound(..),
+                )) => DeleteStatus::NotFound,
+                Err(DownloaderError::Auth(AuthError::AccessDenied)) => {
+                    DeleteStatus::Forbidden
+                }
+                Err(..) => DeleteStatus::Failed,
+            };
+
+            DeleteResult { id, status }
+        })
+        .buffered(BULK_DELETE_CONCURRENCY)
+        .collect()
+        .await;
+
+    Ok(Json(results))
+}
+
+/// Streams the files as a single archive assembled on the fly. Files that
+/// can't be read are left out, the manifest entry lists what happened to
+/// each one of them.
+pub async fn download_archive(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(throttle): Extension<Arc<Throttle>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Query(data): Query<ArchiveQueryData>,
+    Json(mut ids): Json<Vec<Uuid>>,
+) -> Result<Response, DownloaderError> {
+    // A repeated file would be read and counted as a download again
+    let mut seen = HashSet::with_capacity(ids.len());
+    ids.retain(|id| seen.insert(*id));
+
+    if ids.len() > MAX_ARCHIVE_FILES {
+        return Err(RepositoryError::LimitOutOfRange(ids.len() as u32).into());
+    }
+
+    let mut objects = Vec::with_capacity(ids.len());
+    for id in ids {
+        let res = match repo.get(id).await {
+            Ok(object) => check_read_access(Some(&token), &object)
+                .map(|_| object)
+                .map_err(DownloaderError::from),
+            Err(error) => Err(error.into()),
+        };
+        objects.push((id, res));
+    }
+
+    let size = objects
+        .iter()
+        .filter_map(|(_, res)| res.as_ref().ok())
+        .map(|object| object.data.size)
+        .sum();
+    // One more entry for the manifest
+    if !data.format.can_hold(objects.len() + 1, size) {
+        return Err(ValidationError(vec![FieldViolation::new(
+            "format",
+            "size",
+            "the files are too large for a zip archive, use tar instead",
+        )])
+        .into());
+    }
+
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    let buckets = throttle.buckets(actor.ip, Some(&token));
+    let (writer, reader) = tokio::io::duplex(ARCHIVE_BUFFER_SIZE);
+
+    tokio::spawn(
+        async move {
+            let res = write_archive(
+                data.format,
+                writer,
+                objects,
+                &repo,
+                &manager,
+                &audit,
+                actor,
+            )
+            .await;
+
+            // Also fails when the client goes away before the end
+            if let Err(error) = res {
+                tracing::warn!(
+                    target: "storage::routes::archive",
+                    %error,
+                    "archive stream interrupted",
+                );
+            }
+        }
+        .instrument(tracing::span!(tracing::Level::WARN, "write_archive")),
+    );
+
+    Response::builder()
+        .header(header::CONTENT_TYPE, data.format.content_type())
+        .header(
+            header::CONTENT_DISPOSITION,
+            content_disposition(&format!("files.{}", data.format.extension())),
+        )
+        .body(Body::from_stream(ReaderStream::new(ThrottledReader::new(
+            reader, buckets,
+        ))))
+        .map_err(DownloaderError::from)
+}
+
+async fn write_archive(
+    format: ArchiveFormat,
+    writer: impl AsyncWrite + Unpin,
+    objects: Vec<(Uuid, Result<Object, DownloaderError>)>,
+    repo: &ObjectRepository<Sqlite>,
+    manager: &ObjectManager,
+    audit: &AuditLogger,
+    actor: Actor,
+) -> io::Result<()> {
+    let mut archive = ArchiveWriter::new(format, writer);
+    let mut manifest = Vec::with_capacity(objects.len());
+
+    // Reserved first so the manifest is always found at the same place
+    let mut names = EntryNames::default();
+    let manifest_name = names.unique(MANIFEST_NAME);
+
+    for (id, res) in objects {
+        let res = match res {
+            Ok(object) => open_archive_entry(repo, manager, object).await,
+            Err(error) => Err(error),
+        };
+        audit.record(AuditEvent::new(
+            AuditAction::ReadFile,
+            actor,
+            Some(id),
+            &res,
+        ));
+
+        let (object, reader) = match res {
+            Ok(opened) => opened,
+            Err(error) => {
+                let status = match error {
+                    DownloaderError::Repository(RepositoryError::NotFound(
+                        ..,
+                    ))
+                    | DownloaderError::Object(ObjectError::NotFound) => {
+                        ArchiveStatus::NotFound
+                    }
+                    DownloaderError::Auth(..)
+                    | DownloaderError::Repository(
+                        RepositoryError::DownloadLimitReached(..),
+                    ) => ArchiveStatus::Forbidden,
+                    _ => ArchiveStatus::Failed,
+                };
+                manifest.push(ManifestEntry {
+                    id,
+                    name: None,
+                    status,
+                });
+                continue;
+            }
+        };
+
+        let name = names.unique(&object.data.name);
+        archive
+            .append(&name, object.data.size, object.updated_at, reader)
+            .await?;
+
+        manifest.push(ManifestEntry {
+            id,
+            name: Some(name),
+            status: ArchiveStatus::Included,
+        });
+    }
+
+    let manifest = serde_json::to_vec_pretty(&manifest)?;
+    archive
+        .append(
+            &manifest_name,
+            manifest.len() as u64,
+            Utc::now(),
+            manifest.as_slice(),
+        )
+        .await?;
+
+    archive.finish().await
+}
+
+async fn open_archive_entry(
+    repo: &ObjectRepository<Sqlite>,
+    manager: &ObjectManager,
+    object: Object,
+) -> Result<(Object, impl AsyncRead + Send + Unpin), DownloaderError> {
+    let reader = manager
+        .fetch(object.id)
+        .await
+        .map_err(|error| stored_file_error(object.id, error))?;
+
+    // Counted like a download, once the file is opened
+    repo.increment_download_count(object.id).await?;
+
+    Ok((object, reader))
+}
+
+/// Opens the rest of a download whose read failed, as long as the file was
+/// not replaced since, or the client would get a mix of both.
+async fn reopen_stored_file(
+    repo: &ObjectRepository<Sqlite>,
+    manager: &ObjectManager,
+    id: Uuid,
+    checksum: [u8; 32],
+    range: Range<u64>,
+) -> io::Result<Box<dyn AsyncRead + Send + Unpin>> {
+    let object = repo.get(id).await.map_err(io::Error::other)?;
+    if object.data.checksum_256 != checksum {
+        return Err(io::Error::other(
+            "the file was replaced while downloading",
+        ));
+    }
+
+    match manager.fetch_range(id, range).await {
+        Ok(reader) => Ok(Box::new(reader)),
+        Err(ObjectError::IoError(error)) => Err(error),
+        Err(error) => Err(io::Error::other(error)),
+    }
+}
+
+/// Reports the file of an existing object missing from the storage as a
+/// failure of the server, unlike objects that don't exist.
+fn stored_file_error(id: Uuid, error: ObjectError) -> ObjectError {
+    match error {
+        ObjectError::NotFound => {
+            tracing::error!(
+                target: "object_fs",
+                %id,
+                "stored file of an existing object is missing",
+            );
+            ObjectError::Missing
+        }
+        error => error,
+    }
+}
+
+/// Gives the file to another user, so it is kept when its owner leaves.
+pub async fn transfer_file(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(quotas): Extension<Arc<Quotas>>,
+    Extension(audit): Extension<AuditLogger>,
+    Extension(webhooks): Extension<Webhooks>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Path(id): Path<Uuid>,
+    Json(data): Json<TransferFileRequestData>,
+) -> Result<Json<Object>, DownloaderError> {
+    let res = async {
+        check_transfer_access(&token, &user_repo, data.user_id).await?;
+        transfer_within_quota(&repo, &quotas, id, data.user_id).await
+    }
+    .await;
+
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    audit.record(AuditEvent::new(
+        AuditAction::TransferFile,
+        actor,
+        Some(id),
+        &res,
+    ));
+    if res.is_ok() {
+        webhooks.send(
+            WebhookEvent::new(
+                WebhookEventKind::FileTransferred,
+                id,
+                actor.user_id,
+            )
+            .with_to_user(data.user_id),
+        );
+    }
+
+    res.map(Json)
+}
+
+/// Transfers the listed files, or every file of `from_user_id`, reporting
+/// the outcome of each one.
+pub async fn transfer_files(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Extension(quotas): Extension<Arc<Quotas>>,
+    Extension(audit): Extension<AuditLogger>,
+    Extension(webhooks): Extension<Webhooks>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Json(data): Json<TransferFilesRequestData>,
+) -> Result<Json<Vec<TransferResult>>, DownloaderError> {
+    if data.ids.len() > MAX_BULK_DELETE {
+        return Err(
+            RepositoryError::LimitOutOfRange(data.ids.len() as u32).into()
+        );
+    }
+    if data.ids.is_empty() == data.from_user_id.is_none() {
+        return Err(ValidationError(vec![FieldViolation::new(
+            "ids",
+            "exclusive",
+            "either `ids` or `from_user_id` must be given",
+        )])
+        .into());
+    }
+
+    check_transfer_access(&token, &user_repo, data.user_id).await?;
+
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    let record = |id, res: &Result<(), DownloaderError>| {
+        audit.record(AuditEvent::new(
+            AuditAction::TransferFile,
+            actor,
+            Some(id),
+            res,
+        ));
+        if res.is_ok() {
+            webhooks.send(
+                WebhookEvent::new(
+                    WebhookEventKind::FileTransferred,
+                    id,
+                    actor.user_id,
+                )
+                .with_to_user(data.user_id),
+            );
+        }
+    };
+
+    if let Some(from_user_id) = data.from_user_id {
+        // All of them or none, so they must fit at once
+        let _reservation = if from_user_id != data.user_id {
+            let size = repo.usage(from_user_id).await?;
+            Some(quotas.check_fits(data.user_id, size).await?)
+        } else {
+            None
+        };
+        let moved = repo.transfer_all(from_user_id, data.user_id).await?;
+
+        let results = moved
+            .into_iter()
+            .map(|object| {
+                record(object.id, &Ok(()));
+                TransferResult {
+                    id: object.id,
+                    status: TransferStatus::Transferred,
+                }
+            })
+            .collect();
+
+        return Ok(Json(results));
+    }
+
+    let mut results = Vec::with_capacity(data.ids.len());
+    for id in data.ids {
+        let res = transfer_within_quota(&repo, &quotas, id, data.user_id)
+            .await
+            .map(|_| ());
+        record(id, &res);
+
+        let status = match res {
+            Ok(()) => TransferStatus::Transferred,
+            Err(DownloaderError::Repository(RepositoryError::NotFound(..))) => {
+                TransferStatus::NotFound
+            }
+            Err(DownloaderError::Object(ObjectError::QuotaExceeded)) => {
+                TransferStatus::QuotaExceeded
+            }
+            Err(..) => TransferStatus::Failed,
+        };
+        results.push(TransferResult { id, status });
+    }
+
+    Ok(Json(results))
+}
+
+/// Gives the object to `user_id`, unless it doesn't fit in its quota.
+async fn transfer_within_quota(
+    repo: &ObjectRepository<Sqlite>,
+    quotas: &Quotas,
+    id: Uuid,
+    user_id: Uuid,
+) -> Result<Object, DownloaderError> {
+    let object = repo.get(id).await?;
+    let _reservation = if object.user_id != user_id {
+        Some(quotas.check_fits(user_id, object.data.size).await?)
+    } else {
+        None
+    };
+
+    repo.transfer(id, user_id)
+        .await
+        .map_err(DownloaderError::from)
+}
+
+/// Only admins can transfer files, and only to users that exist.
+async fn check_transfer_access(
+    token: &Token,
+    user_repo: &UserRepository<Sqlite>,
+    user_id: Uuid,
+) -> Result<(), DownloaderError> {
+    if !token.permission().contains(Permission::ADMIN) {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    match user_repo.get(user_id).await {
+        Ok(..) => Ok(()),
+        Err(UserError::NotFound) => {
+            Err(ValidationError(vec![FieldViolation::new(
+                "user_id",
+                "exists",
+                "the user does not exist",
+            )])
+            .into())
+        }
+        Err(error) => Err(error.into()),
+    }
+}
+
+async fn delete_file_internal(
+    token: &Token,
+    repo: &ObjectRepository<Sqlite>,
+    manager: &ObjectManager,
+    id: Uuid,
+) -> Result<(), DownloaderError> {
+    check_write_access(token, repo, id).await?;
+    let _write = manager.lock_write(id)?;
+
+    repo.delete(id).await?;
+
+    match manager.delete(id).await {
+        Ok(()) | Err(ObjectError::NotFound) => Ok(()),
+        Err(error) => {
+            tracing::error!(
+                target: "storage::routes::delete",
+                %error,
+                %id,
+                "delete object file failed after deleting its entry",
+            );
+            Err(error.into())
+        }
+    }
+}
+
+async fn check_write_access(
+    token: &Token,
+    repo: &ObjectRepository<Sqlite>,
+    id: Uuid,
+) -> Result<(), DownloaderError> {
+    // Placed before to avoid unecessary database queries in case the
+    // write permission is missing. Upload links only upload the data.
+    if !token.can_write_owned() || token.is_upload_link() {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    let can_access = match token {
+        Token::User(user_token) => {
+            let obj = repo.get(id).await?;
+
+            obj.user_id == user_token.user_id || token.can_write_all()
+        }
+        Token::File(file_token) => file_token.file_id == id,
+        Token::Server => true,
+        Token::Service(..) => token.can_write_all(),
+    };
+
+    if !can_access {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    Ok(())
+}
+
+/// Public objects can be read by anyone, private ones only by their owner
+/// or tokens allowed to read them.
+fn check_read_access(
+    token: Option<&Token>,
+    object: &Object,
+) -> Result<(), AuthError> {
+    if object.public {
+        return Ok(());
+    }
+    let token = token.ok_or(AuthError::AuthorizationRequired)?;
+
+    check_owner_read_access(token, object)
+}
+
+/// Checks the object can be read by `token` without it being public.
+fn check_owner_read_access(
+    token: &Token,
+    object: &Object,
+) -> Result<(), AuthError> {
+    let can_access = token.can_read_all()
+        || match token {
+            Token::User(user_token) => object.user_id == user_token.user_id,
+            Token::File(file_token) => {
+                file_token.upload_link_id.is_none()
+                    && file_token.file_id == object.id
+            }
+            Token::Server => true,
+            // Covered by the read all permission
+            Token::Service(..) => false,
+        };
+
+    if !can_access {
+        return Err(AuthError::AccessDenied);
+    }
+
+    Ok(())
+}
+
+/// Creates a download link for the file that does not require any other
+/// authorization.
+pub async fn share_file(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(token_repo): Extension<Arc<TokenRepository>>,
+    Extension(audit): Extension<AuditLogger>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Path(id): Path<Uuid>,
+    Json(data): Json<ShareFileRequestData>,
+) -> Result<Json<ShareFileResponseData>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    let res = share_file_internal(&token, &repo, &token_repo, id, data).await;
+
+    audit.record(AuditEvent::new(
+        AuditAction::IssueToken,
+        actor,
+        Some(id),
+        &res,
+    ));
+
+    res.map(Json)
+}
+
+async fn share_file_internal(
+    token: &Token,
+    repo: &ObjectRepository<Sqlite>,
+    token_repo: &TokenRepository,
+    id: Uuid,
+    data: ShareFileRequestData,
+) -> Result<ShareFileResponseData, DownloaderError> {
+    let permission = data.permission.unwrap_or(Permission::SINGLE_FILE_R);
+    let duration = Duration::from_secs(data.duration.unwrap_or(3600));
+
+    // Any other permission would reach files besides the shared one
+    if !Permission::SINGLE_FILE_RW.contains(permission) {
+        return Err(ValidationError(vec![FieldViolation::new(
+            "permission",
+            "scope",
+            "share links can only grant access to the shared file",
+        )])
+        .into());
+    }
+
+    let object = repo.get(id).await?;
+    let shared_by = file_token_sharer(token, &object, permission)?;
+
+    let now = Utc::now();
+    let not_before = data.not_before.filter(|not_before| *not_before > now);
+
+    // Links starting later would outlive any other credential
+    let max = token_repo.max_token_duration();
+    if let (Some(not_before), Some(horizon)) =
+        (not_before, checked_add(now, max))
+    {
+        if not_before > horizon {
+            return Err(ValidationError(vec![FieldViolation::new(
+                "not_before",
+                "max",
+                format!("must be at most {}s from now", max.as_secs()),
+            )])
+            .into());
+        }
+    }
+
+    // Rejects durations over the max before they are added to the date
+    let token = token_repo
+        .generate_file_token(id, not_before, duration, shared_by, permission)?;
+    let expires_at = checked_add(not_before.unwrap_or(now), duration)
+        .ok_or(AuthError::TokenExpirationTooLong { got: duration, max })?;
+
+    Ok(ShareFileResponseData {
+        url: format!("/api/file/{id}/data?token={token}"),
+        token,
+        not_before,
+        expires_at,
+    })
+}
+
+/// Pre-creates an empty file and returns a link that uploads its data once,
+/// without any other authorization.
+pub async fn create_upload_link(
+    Authorization(token): Authorization,
+    Extension(repo): Extension<ObjectRepository<Sqlite>>,
+    Extension(manager): Extension<Arc<ObjectManager>>,
+    Extension(quotas): Extension<Arc<Quotas>>,
+    Extension(token_repo): Extension<Arc<TokenRepository>>,
+    Extension(audit): Extension<AuditLogger>,
+    Extension(webhooks): Extension<Webhooks>,
+    connect_info: Option<ConnectInfo<SocketAddr>>,
+    Json(data): Json<UploadLinkRequestData>,
+) -> Result<Json<UploadLinkResponseData>, DownloaderError> {
+    let actor = Actor::new(Some(&token), connect_info.as_ref());
+    let res = create_upload_link_internal(
+        &token,
+        &repo,
+        manager,
+        quotas,
+        &token_repo,
+        data,
+    )
+    .await;
+
+    audit.record(AuditEvent::new(
+        AuditAction::IssueToken,
+        actor,
+        res.as_ref().ok().map(|data| data.file.id),
+        &res,
+    ));
+    let data = res?;
+    webhooks.send(WebhookEvent::new(
+        WebhookEventKind::FileCreated,
+        data.file.id,
+        actor.user_id,
+    ));
+
+    Ok(Json(data))
+}
+
+async fn create_upload_link_internal(
+    token: &Token,
+    repo: &ObjectRepository<Sqlite>,
+    manager: Arc<ObjectManager>,
+    quotas: Arc<Quotas>,
+    token_repo: &TokenRepository,
+    data: UploadLinkRequestData,
+) -> Result<UploadLinkResponseData, DownloaderError> {
+    let duration = Duration::from_secs(data.duration.unwrap_or(3600));
+    // Checked before the file is created, so it is not left behind
+    if !token.can_share() || !matches!(token, Token::User(..)) {
+        return Err(AuthError::AccessDenied.into());
+    }
+    let max = token_repo.max_token_duration();
+    if duration > max {
+        return Err(
+            AuthError::TokenExpirationTooLong { got: duration, max }.into()
+        );
+    }
+
+    let file = post_file_internal(
+        token.clone(),
+        repo.clone(),
+        manager,
+        quotas,
+        stream::empty::<Result<Bytes, io::Error>>(),
+        data.name,
+        data.mime_type.unwrap_or_default(),
+        ObjectOptions::default(),
+        ExpectedChecksum::none(),
+    )
+    .await?;
+    let id = file.id;
+    let shared_by =
+        file_token_sharer(token, &file, Permission::SINGLE_FILE_RW)?;
+
+    let link_id = Uuid::new_v4();
+    let token = token_repo
+        .generate_upload_link_token(id, link_id, duration, shared_by)?;
+    let expires_at = Utc::now() + duration;
+    repo.create_upload_link(link_id, id, expires_at).await?;
+
+    Ok(UploadLinkResponseData {
+        url: format!("/api/file/{id}/data?token={token}"),
+        file,
+        token,
+        expires_at,
+    })
+}
+
+/// Streams the number of bytes received by the upload `id` as server-sent
+/// events, until it finishes. `id` is the object id for data updates or the
+/// `x-upload-id` header value for new uploads.
+pub async fn upload_progress(
+    Authorization(token): Authorization,
+    Extension(progress): Extension<Arc<UploadProgress>>,
+    Path(id): Path<Uuid>,
+) -> Result<Sse<impl Stream<Item = Result<Event, Infallible>>>, DownloaderError>
+{
+    let (owner, receiver) = progress
+        .subscribe(id)
+        .ok_or(RepositoryError::NotFound(id))?;
+
+    let can_access = token.can_read_all()
+        || match &token {
+            Token::User(user_token) => owner == Some(user_token.user_id),
+            Token::File(file_token) => file_token.file_id == id,
+            Token::Server => true,
+            Token::Service(..) => false,
+        };
+    if !can_access {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    let events = stream::unfold(Some(receiver), |receiver| async move {
+        let mut receiver = receiver?;
+
+        // Fails once the upload ended and the tracker was dropped
+        let (name, received, receiver) = match receiver.changed().await {
+            Ok(()) => {
+                let received = *receiver.borrow_and_update();
+                ("progress", received, Some(receiver))
+            }
+            Err(_) => ("done", *receiver.borrow(), None),
+        };
+
+        let event = Event::default().event(name).data(received.to_string());
+        Some((Ok::<_, Infallible>(event), receiver))
+    });
+
+    Ok(Sse::new(events).keep_alive(KeepAlive::default()))
+}
+
+async fn extract_multipart_file<'a>(
+    multipart: &'a mut Multipart,
+) -> Result<
+    (
+        futures_util::stream::MapErr<
+            axum::extract::multipart::Field<'a>,
+            impl FnMut(MultipartError) -> io::Error,
+        >,
+        String,
+        String,
+    ),
+    DownloaderError,
+> {
+    let field =
+        multipart
+            .next_field()
+            .await?
+            .ok_or(HttpError::InvalidFormLength {
+                expected: 1,
+                got: 0,
+            })?;
+
+    let name = field
         .file_name()
         .ok_or(HttpError::InvalidFormBoundary)?
         .to_string();
@@ -330,26 +1884,307 @@ async fn extract_multipart_file<'a>(
     Ok((field_stream, name, mime_type))
 }
 
+/// Detects the type of the upload out of its first bytes, handling a
+/// mismatch with the declared one as configured, and rejects the types
+/// not accepted by the content type filter.
+async fn check_content_type(
+    manager: &ObjectManager,
+    stream: impl Stream<Item = Result<Bytes, io::Error>> + Unpin,
+    mut mime_type: String,
+) -> Result<
+    (impl Stream<Item = Result<Bytes, io::Error>> + Unpin, String),
+    DownloaderError,
+> {
+    let check = manager.content_type_check();
+    let (head, stream) = peek(stream).await.map_err(ObjectError::from)?;
+
+    let sniffed = sniff(&head);
+
+    // Nothing was declared, the content tells the type unless unknown
+    if essence(&mime_type).is_empty() {
+        mime_type =
+            if head.is_empty() || sniffed == mime::OCTET_STREAM.essence_str() {
+                manager.default_content_type().to_owned()
+            } else {
+                sniffed.to_owned()
+            };
+    }
+    let compatible = is_compatible(&mime_type, sniffed);
+
+    match check {
+        ContentTypeCheck::Trust => {}
+        ContentTypeCheck::Correct => {
+            let unknown =
+                essence(&mime_type) == mime::OCTET_STREAM.essence_str();
+            if !compatible || unknown {
+                mime_type = sniffed.to_owned();
+            }
+        }
+        ContentTypeCheck::Reject => {
+            if !compatible {
+                return Err(ValidationError(vec![FieldViolation::new(
+                    "mime_type",
+                    "content",
+                    format!(
+                        "declared `{mime_type}` does not match the content, \
+                        detected as `{sniffed}`",
+                    ),
+                )])
+                .into());
+            }
+        }
+    }
+
+    // The detected type is checked as well, as the declared one may be
+    // trusted, unless it is too generic to tell anything
+    let filter = manager.content_type_filter();
+    if !filter.permits(&mime_type) {
+        return Err(
+            ObjectError::UnsupportedMediaType(essence(&mime_type)).into()
+        );
+    }
+    if !is_generic(sniffed) && !filter.permits(sniffed) {
+        return Err(
+            ObjectError::UnsupportedMediaType(sniffed.to_owned()).into()
+        );
+    }
+
+    Ok((stream, mime_type))
+}
+
+fn extract_upload_id(headers: &HeaderMap) -> Result<Option<Uuid>, HttpError> {
+    headers
+        .get(UPLOAD_ID_HEADER)
+        .map(|value| {
+            value
+                .to_str()
+                .ok()
+                .and_then(|v| Uuid::parse_str(v.trim()).ok())
+                .ok_or(HttpError::InvalidHeader(UPLOAD_ID_HEADER))
+        })
+        .transpose()
+}
+
+fn extract_checksum_header(
+    headers: &HeaderMap,
+) -> Result<ExpectedChecksum, HttpError> {
+    let Some(value) = headers.get(CHECKSUM_HEADER) else {
+        return Ok(ExpectedChecksum::none());
+    };
+
+    let mut checksum = [0; 32];
+    value
+        .to_str()
+        .ok()
+        .and_then(|v| hex::decode_to_slice(v.trim(), &mut checksum).ok())
+        .map(|_| ExpectedChecksum::known(checksum))
+        .ok_or(HttpError::InvalidHeader(CHECKSUM_HEADER))
+}
+
+/// Like [`extract_checksum_header`], also expecting the checksum in the
+/// trailers when announced by the `Trailer` header.
+fn extract_expected_checksum(
+    headers: &HeaderMap,
+) -> Result<ExpectedChecksum, HttpError> {
+    if headers.contains_key(CHECKSUM_HEADER) {
+        return extract_checksum_header(headers);
+    }
+
+    let announced = headers
+        .get_all(header::TRAILER)
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(','))
+        .any(|name| name.trim().eq_ignore_ascii_case(CHECKSUM_HEADER));
+
+    Ok(if announced {
+        ExpectedChecksum::pending()
+    } else {
+        ExpectedChecksum::none()
+    })
+}
+
+fn extract_idempotency_key(
+    headers: &HeaderMap,
+) -> Result<Option<String>, HttpError> {
+    headers
+        .get(IDEMPOTENCY_KEY_HEADER)
+        .map(|value| {
+            value
+                .to_str()
+                .ok()
+                .map(str::trim)
+                .filter(|key| {
+                    (1..=MAX_IDEMPOTENCY_KEY_LEN).contains(&key.len())
+                })
+                .map(str::to_owned)
+                .ok_or(HttpError::InvalidHeader(IDEMPOTENCY_KEY_HEADER))
+        })
+        .transpose()
+}
+
+enum IdempotentUpload {
+    /// A previous upload with the same idempotency key created the object.
+    Replay(Object),
+    /// The guard is present when the upload has an idempotency key.
+    Start(Option<IdempotencyGuard>),
+}
+
+/// Checks the idempotency key of a new upload, if any. Retries of an upload
+/// still in progress are rejected as a conflict.
+async fn begin_upload(
+    token: &Token,
+    headers: &HeaderMap,
+    repo: &ObjectRepository<Sqlite>,
+    idempotency: &Arc<IdempotencyKeys>,
+) -> Result<IdempotentUpload, DownloaderError> {
+    let Some(key) = extract_idempotency_key(headers)? else {
+        return Ok(IdempotentUpload::Start(None));
+    };
+    // Only users can upload, the others are rejected later on
+    let Some(owner) = token_owner(token) else {
+        return Ok(IdempotentUpload::Start(None));
+    };
+
+    let guard = idempotency
+        .begin(owner, key)
+        .ok_or(HttpError::IdempotencyKeyInUse)?;
+
+    match repo.get_by_idempotency_key(owner, guard.key()).await? {
+        Some(object) => Ok(IdempotentUpload::Replay(object)),
+        None => Ok(IdempotentUpload::Start(Some(guard))),
+    }
+}
+
+/// Maps the idempotency key of a finished upload to the created object.
+async fn finish_upload(
+    repo: &ObjectRepository<Sqlite>,
+    idempotency: &IdempotencyKeys,
+    guard: Option<IdempotencyGuard>,
+    object: &Object,
+) {
+    let Some(guard) = guard else {
+        return;
+    };
+    let expires_at = Utc::now() + idempotency.ttl();
+
+    // The object was created anyway, only a retry would duplicate it
+    if let Err(error) = repo
+        .save_idempotency_key(guard.owner(), guard.key(), object.id, expires_at)
+        .await
+    {
+        tracing::error!(
+            target: "storage::routes::post",
+            %error,
+            id = %object.id,
+            "save idempotency key failed",
+        );
+    }
+}
+
+/// Reports the size of every chunk read from `stream` to `tracker`, which is
+/// dropped along with the stream when the upload ends.
+fn track_progress(
+    stream: impl Stream<Item = Result<Bytes, io::Error>> + Unpin,
+    tracker: Option<ProgressTracker>,
+) -> impl Stream<Item = Result<Bytes, io::Error>> + Unpin {
+    stream.inspect_ok(move |chunk| {
+        if let Some(tracker) = &tracker {
+            tracker.add(chunk.len());
+        }
+    })
+}
+
+#[inline]
+fn token_owner(token: &Token) -> Option<Uuid> {
+    match token {
+        Token::User(user_token) => Some(user_token.user_id),
+        _ => None,
+    }
+}
+
+fn extract_object_options(
+    headers: &HeaderMap,
+) -> Result<ObjectOptions, HttpError> {
+    let expires_at = headers
+        .get(EXPIRES_IN_HEADER)
+        .map(|value| {
+            value
+                .to_str()
+                .ok()
+                .and_then(|v| v.trim().parse::<u32>().ok())
+                .filter(|&v| v > 0)
+                .map(|v| Utc::now() + TimeDelta::seconds(v.into()))
+                .ok_or(HttpError::InvalidHeader(EXPIRES_IN_HEADER))
+        })
+        .transpose()?;
+
+    let max_downloads = headers
+        .get(MAX_DOWNLOADS_HEADER)
+        .map(|value| {
+            value
+                .to_str()
+                .ok()
+                .and_then(|v| v.trim().parse::<u64>().ok())
+                .filter(|&v| v > 0)
+                .ok_or(HttpError::InvalidHeader(MAX_DOWNLOADS_HEADER))
+        })
+        .transpose()?;
+
+    let public = headers
+        .get(PUBLIC_HEADER)
+        .map(|value| match value.as_bytes() {
+            b"true" | b"1" => Ok(true),
+            b"false" | b"0" => Ok(false),
+            _ => Err(HttpError::InvalidHeader(PUBLIC_HEADER)),
+        })
+        .transpose()?
+        .unwrap_or(false);
+
+    Ok(ObjectOptions {
+        expires_at,
+        max_downloads,
+        public,
+    })
+}
+
+/// Streams the data of the body, setting the expected checksum sent in its
+/// trailers.
 fn extract_request_body_file(
     req: Request,
-) -> (
-    futures_util::stream::MapErr<
-        axum::body::BodyDataStream,
-        impl FnMut(axum::Error) -> io::Error,
-    >,
-    String,
-) {
+    expected: ExpectedChecksum,
+) -> (impl Stream<Item = Result<Bytes, io::Error>> + Unpin, String) {
+    // Left empty when missing, so the type is detected from the content
     let mime_type = req
         .headers()
         .get(header::CONTENT_TYPE)
-        .unwrap_or(&HeaderValue::from_static(mime::OCTET_STREAM.as_str()))
-        .to_str()
-        .unwrap_or(mime::OCTET_STREAM.as_str())
+        .map(|value| value.to_str().unwrap_or(mime::OCTET_STREAM.as_str()))
+        .unwrap_or_default()
         .to_string();
 
-    let stream = req.into_body().into_data_stream();
-    let stream =
-        stream.map_err(|err| io::Error::new(io::ErrorKind::Other, err));
+    let mut body = req.into_body();
+    let stream = stream::poll_fn(move |cx| loop {
+        let frame = match ready!(Pin::new(&mut body).poll_frame(cx)) {
+            Some(Ok(frame)) => frame,
+            Some(Err(err)) => {
+                let err = io::Error::new(io::ErrorKind::Other, err);
+                return Poll::Ready(Some(Err(err)));
+            }
+            None => return Poll::Ready(None),
+        };
+
+        match frame.into_data() {
+            Ok(data) => return Poll::Ready(Some(Ok(data))),
+            Err(frame) => {
+                let checksum = frame
+                    .trailers_ref()
+                    .and_then(|trailers| trailers.get(CHECKSUM_HEADER));
+                if let Some(checksum) = checksum {
+                    expected.set(checksum.to_str().unwrap_or_default());
+                }
+            }
+        }
+    });
 
     (stream, mime_type)
 }
@@ -358,9 +2193,12 @@ async fn post_file_internal(
     token: Token,
     repo: ObjectRepository<Sqlite>,
     manager: Arc<ObjectManager>,
+    quotas: Arc<Quotas>,
     stream: impl Stream<Item = Result<Bytes, io::Error>> + Unpin,
     name: String,
     mime_type: String,
+    options: ObjectOptions,
+    expected: ExpectedChecksum,
 ) -> Result<Object, DownloaderError> {
     if !token.can_write_owned() {
         return Err(AuthError::AccessDenied.into());
@@ -369,9 +2207,24 @@ async fn post_file_internal(
         Token::User(user_token) => user_token,
         _ => return Err(AuthError::AccessDenied.into()),
     };
+    let name = normalize_name("name", &name, manager.max_name_len())?;
+
+    let (stream, mime_type) =
+        check_content_type(&manager, stream, mime_type).await?;
+
+    // Held until the entry is created, so it counts in the usage
+    let reservation = quotas.reserve(token.user_id, 0).await?;
 
     let id = Uuid::new_v4();
-    let (size, checksum_256) = manager.store(id, stream).await?;
+    let (size, checksum_256) = manager
+        .store_checked(
+            id,
+            &mime_type,
+            stream,
+            &expected,
+            reservation.remaining(),
+        )
+        .await?;
 
     let data = ObjectData {
         name,
@@ -380,7 +2233,7 @@ async fn post_file_internal(
         checksum_256,
     };
 
-    match repo.create(id, token.user_id, data).await {
+    match repo.create(id, token.user_id, data, options).await {
         Ok(v) => Ok(v),
         Err(error) => {
             tracing::error!(
@@ -404,54 +2257,137 @@ async fn post_file_internal(
     }
 }
 
+/// An upload link marked as used, released again when dropped unless the
+/// upload went through, so an interrupted upload can be retried.
+struct SpentUploadLink {
+    repo: ObjectRepository<Sqlite>,
+    id: Option<Uuid>,
+}
+
+impl SpentUploadLink {
+    async fn spend(
+        repo: &ObjectRepository<Sqlite>,
+        id: Uuid,
+        object_id: Uuid,
+    ) -> Result<Self, DownloaderError> {
+        if !repo.use_upload_link(id, object_id).await? {
+            return Err(AuthError::RevokedToken.into());
+        }
+
+        Ok(Self {
+            repo: repo.clone(),
+            id: Some(id),
+        })
+    }
+
+    fn keep(mut self) {
+        self.id = None;
+    }
+
+    async fn release(mut self) {
+        if let Some(id) = self.id.take() {
+            let _ = self.repo.release_upload_link(id).await;
+        }
+    }
+}
+
+impl Drop for SpentUploadLink {
+    fn drop(&mut self) {
+        if let Some(id) = self.id.take() {
+            let repo = self.repo.clone();
+            tokio::spawn(async move {
+                let _ = repo.release_upload_link(id).await;
+            });
+        }
+    }
+}
+
 async fn update_file_internal(
     token: Token,
     repo: ObjectRepository<Sqlite>,
     manager: Arc<ObjectManager>,
+    quotas: Arc<Quotas>,
+    progress: Arc<UploadProgress>,
     id: Uuid,
     stream: impl Stream<Item = Result<Bytes, io::Error>> + Unpin,
     name: String,
     mime_type: String,
+    expected: ExpectedChecksum,
 ) -> Result<Object, DownloaderError> {
-    // Placed before to avoid unecessary database queries in case the
-    // write permission is missing
-    if !token.can_write_owned() {
-        return Err(AuthError::AccessDenied.into());
-    }
+    let name = normalize_name("name", &name, manager.max_name_len())?;
+    let upload_link_id = match &token {
+        Token::File(FileToken {
+            upload_link_id: Some(link_id),
+            file_id,
+            ..
+        }) if *file_id == id => Some(*link_id),
+        _ => {
+            check_write_access(&token, &repo, id).await?;
+            None
+        }
+    };
+    // Held until the entry is updated, so it matches the stored file
+    let _write = manager.lock_write(id)?;
 
-    let can_access = match &token {
-        Token::User(user_token) => {
-            let obj = repo.get(id).await?;
+    // Charged to the owner, whatever token updates the object, with the
+    // size of the replaced file freed
+    let obj = repo.get(id).await?;
+    let reservation = quotas.reserve(obj.user_id, obj.data.size).await?;
 
-            obj.user_id == user_token.user_id || token.can_write_all()
+    let tracker = progress.start(id, token_owner(&token));
+    let stream = track_progress(stream, Some(tracker));
+
+    let (stream, mime_type) =
+        check_content_type(&manager, stream, mime_type).await?;
+
+    // Spent only once the upload passed the checks, and given back if
+    // storing the data or updating the entry fails
+    let upload_link = match upload_link_id {
+        Some(link_id) => {
+            Some(SpentUploadLink::spend(&repo, link_id, id).await?)
         }
-        Token::File(file_token) => file_token.file_id == id,
-        Token::Server => true,
+        None => None,
     };
 
-    if !can_access {
-        return Err(AuthError::AccessDenied.into());
-    }
+    let updated = async {
+        let (size, checksum_256) = manager
+            .store_checked(
+                id,
+                &mime_type,
+                stream,
+                &expected,
+                reservation.remaining(),
+            )
+            .await?;
 
-    let (size, checksum_256) = manager.store(id, stream).await?;
+        repo.update(
+            id,
+            ObjectData {
+                name,
+                mime_type,
+                size,
+                checksum_256,
+            },
+        )
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                target: "storage::routes::update",
+                %error,
+                %id,
+                "update object entry failed after store",
+            );
+            DownloaderError::from(error)
+        })
+    }
+    .await;
 
-    repo.update(
-        id,
-        ObjectData {
-            name,
-            mime_type,
-            size,
-            checksum_256,
-        },
-    )
-    .await
-    .map_err(|error| {
-        tracing::error!(
-            target: "storage::routes::update",
-            %error,
-            %id,
-            "update object entry failed after store",
-        );
-        error.into()
-    })
+    // Kept only once the entry matches the stored data
+    if let Some(upload_link) = upload_link {
+        match &updated {
+            Ok(..) => upload_link.keep(),
+            Err(..) => upload_link.release().await,
+        }
+    }
+    updated
 }
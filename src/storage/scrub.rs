@@ -0,0 +1,231 @@
+use std::collections::HashSet;
+
+use sqlx::Sqlite;
+use uuid::Uuid;
+
+use crate::errors::DownloaderError;
+
+use super::{
+    manager::{ObjectError, ObjectManager},
+    repository::{ObjectRepository, MAX_LIMIT},
+};
+
+/// Differences found between the repository and the stored files.
+#[derive(Debug, Default, Clone, PartialEq, Eq)]
+pub struct ScrubReport {
+    /// Number of objects whose file was verified.
+    pub checked: u64,
+    /// Objects without a stored file.
+    pub missing: Vec<Uuid>,
+    /// Objects whose stored file does not match the recorded size or
+    /// checksum.
+    pub corrupted: Vec<Uuid>,
+    /// Stored files without an object.
+    pub orphans: Vec<Uuid>,
+    /// Files in the data dirs that were not stored by the server.
+    pub unknown: Vec<String>,
+}
+
+impl ScrubReport {
+    #[inline]
+    pub fn is_consistent(&self) -> bool {
+        self.missing.is_empty()
+            && self.corrupted.is_empty()
+            && self.orphans.is_empty()
+    }
+}
+
+/// Verifies every object against its stored file, recomputing checksums, and
+/// looks for stored files that belong to no object. Orphans are deleted when
+/// `delete_orphans` is set.
+///
+/// Files stored while the scrub runs may be reported as orphans before their
+/// object is created, so orphans must only be deleted while the server is
+/// not accepting uploads.
+pub async fn scrub(
+    repo: &ObjectRepository<Sqlite>,
+    manager: &ObjectManager,
+    delete_orphans: bool,
+) -> Result<ScrubReport, DownloaderError> {
+    let mut report = ScrubReport::default();
+
+    let (stored, unknown) = manager.list().await?;
+    report.unknown = unknown;
+
+    let mut known = HashSet::new();
+    let mut after = None;
+
+    loop {
+        let objects = repo.get_after(after, MAX_LIMIT).await?;
+        let Some(last) = objects.last() else {
+            break;
+        };
+        after = Some(last.id);
+
+        for object in objects {
+            let id = object.id;
+            known.insert(id);
+
+            match manager.checksum(id).await {
+                Ok((size, checksum)) => {
+                    report.checked += 1;
+
+                    if size != object.data.size
+                        || checksum != object.data.checksum_256
+                    {
+                        tracing::warn!(
+                            target: "storage::scrub",
+                            %id,
+                            size,
+                            expected_size = object.data.size,
+                            "stored file is corrupted",
+                        );
+                        report.corrupted.push(id);
+                    }
+                }
+                Err(ObjectError::NotFound) => {
+                    tracing::warn!(
+                        target: "storage::scrub",
+                        %id,
+                        "stored file is missing",
+                    );
+                    report.missing.push(id);
+                }
+                Err(ObjectError::IoError(error)) => {
+                    // Decompression errors of damaged files surface here
+                    tracing::warn!(
+                        target: "storage::scrub",
+                        %error,
+                        %id,
+                        "stored file could not be read",
+                    );
+                    report.corrupted.push(id);
+                }
+                Err(error) => return Err(error.into()),
+            }
+        }
+    }
+
+    for id in stored {
+        if known.contains(&id) {
+            continue;
+        }
+
+        tracing::warn!(
+            target: "storage::scrub",
+            %id,
+            "stored file has no object",
+        );
+        report.orphans.push(id);
+
+        if delete_orphans {
+            match manager.delete(id).await {
+                Ok(()) | Err(ObjectError::NotFound) => {
+                    tracing::info!(
+                        target: "storage::scrub",
+                        %id,
+                        "deleted orphan file",
+                    );
+                }
+                Err(error) => return Err(error.into()),
+            }
+        }
+    }
+
+    Ok(report)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io;
+
+    use bytes::Bytes;
+    use futures_util::stream;
+    use sqlx::{migrate, Pool, Sqlite};
+    use tempfile::TempDir;
+    use test_log::test;
+    use uuid::Uuid;
+
+    use crate::storage::{
+        backend::LocalStorage, manager::ObjectManager,
+        repository::ObjectRepository, ObjectData, ObjectOptions,
+    };
+
+    use super::scrub;
+
+    async fn setup() -> (ObjectRepository<Sqlite>, ObjectManager, [TempDir; 2])
+    {
+        let db = Pool::connect("sqlite::memory:").await.unwrap();
+        migrate!().run(&db).await.unwrap();
+
+        let data_dir = tempfile::tempdir().unwrap();
+        let temp_dir = tempfile::tempdir().unwrap();
+        let manager = ObjectManager::with_storage(
+            LocalStorage::new(
+                vec![data_dir.path().to_owned()],
+                temp_dir.path().to_owned(),
+                0,
+            ),
+            None,
+        );
+
+        (ObjectRepository::new(db), manager, [data_dir, temp_dir])
+    }
+
+    async fn store(manager: &ObjectManager, data: &'static [u8]) -> Uuid {
+        let id = Uuid::new_v4();
+        let stream =
+            stream::iter([Ok::<_, io::Error>(Bytes::from_static(data))]);
+
+        manager.store(id, "text/plain", stream).await.unwrap();
+        id
+    }
+
+    async fn create(
+        repo: &ObjectRepository<Sqlite>,
+        manager: &ObjectManager,
+        data: &'static [u8],
+    ) -> Uuid {
+        let id = store(manager, data).await;
+        let (size, checksum_256) = manager.checksum(id).await.unwrap();
+
+        let data = ObjectData {
+            name: "file.txt".into(),
+            mime_type: "text/plain".into(),
+            size,
+            checksum_256,
+        };
+        repo.create(id, Uuid::new_v4(), data, ObjectOptions::default())
+            .await
+            .unwrap();
+
+        id
+    }
+
+    #[test(tokio::test)]
+    async fn test_scrub() {
+        let (repo, manager, dirs) = setup().await;
+
+        create(&repo, &manager, b"healthy").await;
+
+        let corrupted = create(&repo, &manager, b"corrupted").await;
+        std::fs::write(dirs[0].path().join(corrupted.to_string()), b"other")
+            .unwrap();
+
+        let missing = create(&repo, &manager, b"missing").await;
+        manager.delete(missing).await.unwrap();
+
+        let orphan = store(&manager, b"orphan").await;
+
+        let report = scrub(&repo, &manager, false).await.unwrap();
+        assert_eq!(report.checked, 2);
+        assert_eq!(report.corrupted, [corrupted]);
+        assert_eq!(report.missing, [missing]);
+        assert_eq!(report.orphans, [orphan]);
+        assert!(!report.is_consistent());
+
+        scrub(&repo, &manager, true).await.unwrap();
+        let report = scrub(&repo, &manager, false).await.unwrap();
+        assert!(report.orphans.is_empty(), "orphan file was not deleted");
+    }
+}
@@ -0,0 +1,194 @@
+use std::{
+    sync::{
+        atomic::{AtomicU64, AtomicUsize, Ordering},
+        Arc,
+    },
+    time::Duration,
+};
+
+use rand::Rng;
+
+use crate::config::DirSelection;
+
+/// Chooses the data dir of each new file, keeping the number of files being
+/// written and the latency observed in each dir. Dirs are tried in turns
+/// whenever the strategy finds several equally good.
+pub struct DirSelector {
+    selection: DirSelection,
+    next: AtomicUsize,
+    dirs: Vec<DirStats>,
+}
+
+#[derive(Default)]
+struct DirStats {
+    in_flight: AtomicUsize,
+    /// Moving average in microseconds, zero until the first sample.
+    latency: AtomicU64,
+}
+
+impl DirSelector {
+    pub fn new(selection: DirSelection, dir_count: usize) -> Self {
+        Self {
+            selection,
+            next: AtomicUsize::new(0),
+            dirs: (0..dir_count).map(|_| DirStats::default()).collect(),
+        }
+    }
+
+    /// Returns one of the `candidates` dir indexes, which must not be empty.
+    pub fn select(&self, candidates: &[usize]) -> usize {
+        assert!(!candidates.is_empty(), "no candidate data dir");
+
+        let start = self.next.fetch_add(1, Ordering::Relaxed);
+        let in_turns = (0..candidates.len())
+            .map(|i| candidates[(start + i) % candidates.len()]);
+
+        match self.selection {
+            DirSelection::Random => {
+                let i = rand::thread_rng().gen_range(0..candidates.len());
+                candidates[i]
+            }
+            DirSelection::RoundRobin => candidates[start % candidates.len()],
+            DirSelection::LeastInFlight => in_turns
+                .min_by_key(|&dir| self.in_flight(dir))
+                .unwrap_or_default(),
+            // Dirs not measured yet come first, so every dir gets a sample
+            DirSelection::LatencyAware => in_turns
+                .min_by_key(|&dir| {
+                    self.dirs[dir].latency.load(Ordering::Relaxed)
+                })
+                .unwrap_or_default(),
+        }
+    }
+
+    /// Counts a file being written to the dir until the returned guard is
+    /// dropped.
+    pub fn start(self: &Arc<Self>, dir: usize) -> InFlight {
+        self.dirs[dir].in_flight.fetch_add(1, Ordering::Relaxed);
+
+        InFlight {
+            selector: self.clone(),
+            dir,
+        }
+    }
+
+    pub fn in_flight(&self, dir: usize) -> usize {
+        self.dirs[dir].in_flight.load(Ordering::Relaxed)
+    }
+
+    pub fn latency(&self, dir: usize) -> Duration {
+        Duration::from_micros(self.dirs[dir].latency.load(Ordering::Relaxed))
+    }
+
+    /// Adds a sample to the moving average of the dir, weighting it 1/8.
+    pub fn record_latency(&self, dir: usize, elapsed: Duration) {
+        let sample = (elapsed.as_micros() as u64).max(1);
+
+        let _ = self.dirs[dir].latency.fetch_update(
+            Ordering::Relaxed,
+            Ordering::Relaxed,
+            |average| match average {
+                0 => Some(sample),
+                average => Some((average * 7 + sample) / 8),
+            },
+        );
+    }
+}
+
+/// A file being written to a data dir.
+pub struct InFlight {
+    selector: Arc<DirSelector>,
+    dir: usize,
+}
+
+impl InFlight {
+    pub fn record_latency(&self, elapsed: Duration) {
+        self.selector.record_latency(self.dir, elapsed);
+    }
+}
+
+impl Drop for InFlight {
+    fn drop(&mut self) {
+        self.selector.dirs[self.dir]
+            .in_flight
+            .fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{sync::Arc, time::Duration};
+
+    use test_log::test;
+
+    use crate::config::DirSelection;
+
+    use super::DirSelector;
+
+    #[test]
+    fn test_round_robin() {
+        let selector = DirSelector::new(DirSelection::RoundRobin, 3);
+
+        let chosen = (0..6).map(|_| selector.select(&[0, 1, 2]));
+        assert_eq!(chosen.collect::<Vec<_>>(), [0, 1, 2, 0, 1, 2]);
+
+        let chosen = (0..4).map(|_| selector.select(&[0, 2]));
+        assert_eq!(chosen.collect::<Vec<_>>(), [0, 2, 0, 2]);
+    }
+
+    #[test]
+    fn test_least_in_flight() {
+        let selector =
+            Arc::new(DirSelector::new(DirSelection::LeastInFlight, 3));
+
+        let first = selector.start(0);
+        let second = selector.start(0);
+        let third = selector.start(1);
+        assert_eq!(selector.in_flight(0), 2);
+
+        for _ in 0..3 {
+            assert_eq!(selector.select(&[0, 1, 2]), 2);
+        }
+        assert_eq!(selector.select(&[0, 1]), 1);
+
+        drop((first, second, third));
+        assert_eq!(selector.in_flight(0), 0);
+
+        // Ties are broken in turns
+        let mut chosen = (0..3)
+            .map(|_| selector.select(&[0, 1, 2]))
+            .collect::<Vec<_>>();
+        chosen.sort_unstable();
+        assert_eq!(chosen, [0, 1, 2]);
+    }
+
+    #[test]
+    fn test_latency_aware() {
+        let selector = DirSelector::new(DirSelection::LatencyAware, 3);
+
+        selector.record_latency(0, Duration::from_millis(80));
+        selector.record_latency(1, Duration::from_millis(10));
+        // Unmeasured dirs are tried first
+        assert_eq!(selector.select(&[0, 1, 2]), 2);
+
+        selector.record_latency(2, Duration::from_millis(40));
+        assert_eq!(selector.select(&[0, 1, 2]), 1);
+
+        // The average follows the recent samples
+        for _ in 0..32 {
+            selector.record_latency(1, Duration::from_millis(160));
+        }
+        assert!(selector.latency(1) > Duration::from_millis(80));
+        assert_eq!(selector.select(&[0, 1, 2]), 2);
+        assert_eq!(selector.select(&[0, 1]), 0);
+    }
+
+    #[test]
+    fn test_random() {
+        let selector = DirSelector::new(DirSelection::Random, 4);
+
+        for _ in 0..32 {
+            assert!([1, 3].contains(&selector.select(&[1, 3])));
+        }
+    }
+}
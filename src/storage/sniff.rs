@@ -0,0 +1,412 @@
+use std::{fmt, io};
+
+use bytes::Bytes;
+use futures_util::{stream, Stream, StreamExt, TryStreamExt};
+use serde::{Deserialize, Serialize};
+
+/// Number of bytes taken into account to detect the content type.
+pub const SNIFF_LEN: usize = 512;
+
+const OCTET_STREAM: &str = "application/octet-stream";
+
+/// Types detected for many unrelated formats, that therefore never
+/// contradict the declared one.
+const GENERIC: &[&str] = &["text/plain", OCTET_STREAM, "application/zip"];
+
+/// Declared types that are valid for a detected one, besides itself.
+const ALIASES: &[(&str, &str)] = &[
+    ("application/x-gzip", "application/gzip"),
+    ("application/x-rar-compressed", "application/vnd.rar"),
+    ("application/ogg", "audio/ogg"),
+    ("application/ogg", "video/ogg"),
+    ("audio/mpeg", "audio/mp3"),
+    ("audio/wave", "audio/wav"),
+    ("audio/wave", "audio/x-wav"),
+    ("image/x-icon", "image/vnd.microsoft.icon"),
+    ("text/html", "application/xhtml+xml"),
+    ("text/xml", "application/xml"),
+    ("text/xml", "image/svg+xml"),
+    ("video/avi", "video/x-msvideo"),
+    ("video/mp4", "audio/mp4"),
+    ("video/mp4", "image/avif"),
+    ("video/mp4", "image/heic"),
+    ("video/mp4", "video/quicktime"),
+    ("video/webm", "audio/webm"),
+];
+
+/// Exact signatures at the start of the content.
+const SIGNATURES: &[(&[u8], &str)] = &[
+    (b"%PDF-", "application/pdf"),
+    (b"%!PS-Adobe-", "application/postscript"),
+    (b"\xFE\xFF", "text/plain"),
+    (b"\xFF\xFE", "text/plain"),
+    (b"\xEF\xBB\xBF", "text/plain"),
+    (b"GIF87a", "image/gif"),
+    (b"GIF89a", "image/gif"),
+    (b"\x89PNG\r\n\x1A\n", "image/png"),
+    (b"\xFF\xD8\xFF", "image/jpeg"),
+    (b"BM", "image/bmp"),
+    (b"\x00\x00\x01\x00", "image/x-icon"),
+    (b"ID3", "audio/mpeg"),
+    (b"OggS\x00", "application/ogg"),
+    (b"\x1A\x45\xDF\xA3", "video/webm"),
+    (b"wOFF", "font/woff"),
+    (b"wOF2", "font/woff2"),
+    (b"\x1F\x8B\x08", "application/x-gzip"),
+    (b"PK\x03\x04", "application/zip"),
+    (b"Rar!\x1A\x07", "application/x-rar-compressed"),
+    (b"7z\xBC\xAF\x27\x1C", "application/x-7z-compressed"),
+    (b"\x00asm", "application/wasm"),
+    (b"\x7FELF", "application/x-executable"),
+    (b"MZ", "application/vnd.microsoft.portable-executable"),
+];
+
+/// Tags that identify html content, matched case-insensitively and
+/// followed by a space or `>`.
+const HTML_TAGS: &[&[u8]] = &[
+    b"<!DOCTYPE HTML",
+    b"<HTML",
+    b"<HEAD",
+    b"<SCRIPT",
+    b"<IFRAME",
+    b"<H1",
+    b"<DIV",
+    b"<FONT",
+    b"<TABLE",
+    b"<A",
+    b"<STYLE",
+    b"<TITLE",
+    b"<B",
+    b"<BODY",
+    b"<BR",
+    b"<P",
+    b"<!--",
+];
+
+/// Detects the content type out of the first [`SNIFF_LEN`] bytes of `data`,
+/// following the same rules as browsers do (a subset of the WHATWG MIME
+/// sniffing standard). Falls back to `text/plain` or
+/// `application/octet-stream`.
+pub fn sniff(data: &[u8]) -> &'static str {
+    let data = &data[..data.len().min(SNIFF_LEN)];
+
+    let start = data
+        .iter()
+        .position(|b| !matches!(b, b'\t' | b'\n' | b'\x0C' | b'\r' | b' '))
+        .unwrap_or(data.len());
+    let trimmed = &data[start..];
+
+    for tag in HTML_TAGS {
+        let Some(prefix) = trimmed.get(..tag.len()) else {
+            continue;
+        };
+        if prefix.eq_ignore_ascii_case(tag)
+            && matches!(trimmed.get(tag.len()), Some(b' ' | b'>'))
+        {
+            return "text/html";
+        }
+    }
+    if trimmed.starts_with(b"<?xml") {
+        return "text/xml";
+    }
+
+    let is_binary = data
+        .iter()
+        .any(|&b| matches!(b, 0x00..=0x08 | 0x0B | 0x0E..=0x1A | 0x1C..=0x1F));
+
+    // Two byte signatures are too likely to start plain text
+    if let Some((_, mime_type)) = SIGNATURES
+        .iter()
+        .find(|(sig, _)| data.starts_with(sig) && (sig.len() > 2 || is_binary))
+    {
+        return mime_type;
+    }
+
+    if data.starts_with(b"RIFF") && data.len() >= 12 {
+        match &data[8..12] {
+            b"WEBP" => return "image/webp",
+            b"WAVE" => return "audio/wave",
+            b"AVI " => return "video/avi",
+            _ => {}
+        }
+    }
+    if data.get(4..8) == Some(b"ftyp") {
+        return "video/mp4";
+    }
+
+    if is_binary {
+        OCTET_STREAM
+    } else {
+        "text/plain"
+    }
+}
+
+/// Returns the lowercase type and subtype of `mime_type`, without its
+/// parameters.
+pub fn essence(mime_type: &str) -> String {
+    mime_type
+        .split(';')
+        .next()
+        .unwrap_or_default()
+        .trim()
+        .to_ascii_lowercase()
+}
+
+/// Whether the content detected as `sniffed` can be of the `declared` type.
+pub fn is_compatible(declared: &str, sniffed: &str) -> bool {
+    let declared = essence(declared);
+
+    declared == OCTET_STREAM
+        || declared == sniffed
+        || GENERIC.contains(&sniffed)
+        || ALIASES.iter().any(|&(a, b)| a == sniffed && b == declared)
+}
+
+/// Whether the detected type is shared by too many formats to tell
+/// anything about the content.
+#[inline]
+pub fn is_generic(sniffed: &str) -> bool {
+    GENERIC.contains(&sniffed)
+}
+
+/// A content type as written in the config, either exact, `type/*` or
+/// `*/*`. Parameters are ignored.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(try_from = "String", into = "String")]
+pub enum ContentTypePattern {
+    Any,
+    Type(String),
+    Exact(String),
+}
+
+impl ContentTypePattern {
+    pub fn matches(&self, mime_type: &str) -> bool {
+        let essence = essence(mime_type);
+
+        match self {
+            ContentTypePattern::Any => true,
+            ContentTypePattern::Type(kind) => essence
+                .split_once('/')
+                .is_some_and(|(other, _)| other == kind),
+            ContentTypePattern::Exact(exact) => essence == *exact,
+        }
+    }
+}
+
+impl TryFrom<String> for ContentTypePattern {
+    type Error = String;
+
+    fn try_from(value: String) -> Result<Self, Self::Error> {
+        let essence = essence(&value);
+        let invalid = || format!("invalid content type pattern `{value}`");
+
+        let (kind, subtype) = essence.split_once('/').ok_or_else(invalid)?;
+        let valid = |part: &str| {
+            !part.is_empty()
+                && part.bytes().all(|b| {
+                    b.is_ascii_alphanumeric() || b"!#$&-^_.+".contains(&b)
+                })
+        };
+
+        match (kind, subtype) {
+            ("*", "*") => Ok(ContentTypePattern::Any),
+            (kind, "*") if valid(kind) => {
+                Ok(ContentTypePattern::Type(kind.to_owned()))
+            }
+            (kind, subtype) if valid(kind) && valid(subtype) => {
+                Ok(ContentTypePattern::Exact(format!("{kind}/{subtype}")))
+            }
+            _ => Err(invalid()),
+        }
+    }
+}
+
+impl From<ContentTypePattern> for String {
+    fn from(value: ContentTypePattern) -> Self {
+        value.to_string()
+    }
+}
+
+impl fmt::Display for ContentTypePattern {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            ContentTypePattern::Any => f.write_str("*/*"),
+            ContentTypePattern::Type(kind) => write!(f, "{kind}/*"),
+            ContentTypePattern::Exact(exact) => f.write_str(exact),
+        }
+    }
+}
+
+/// The content types accepted by the uploads. Denied types are rejected
+/// even if allowed, and every type is allowed if none is.
+#[derive(Debug, Clone, Default)]
+pub struct ContentTypeFilter {
+    allowed: Vec<ContentTypePattern>,
+    denied: Vec<ContentTypePattern>,
+}
+
+impl ContentTypeFilter {
+    pub fn new(
+        allowed: Vec<ContentTypePattern>,
+        denied: Vec<ContentTypePattern>,
+    ) -> Self {
+        Self { allowed, denied }
+    }
+
+    pub fn permits(&self, mime_type: &str) -> bool {
+        let matches = |pattern: &ContentTypePattern| pattern.matches(mime_type);
+
+        !self.denied.iter().any(matches)
+            && (self.allowed.is_empty() || self.allowed.iter().any(matches))
+    }
+}
+
+/// Reads the first [`SNIFF_LEN`] bytes of `stream`, returning them along
+/// with a stream that still yields the whole content.
+pub async fn peek<S>(
+    mut stream: S,
+) -> io::Result<(
+    Vec<u8>,
+    impl Stream<Item = Result<Bytes, io::Error>> + Unpin,
+)>
+where
+    S: Stream<Item = Result<Bytes, io::Error>> + Unpin,
+{
+    let mut head = Vec::with_capacity(SNIFF_LEN);
+    let mut chunks = Vec::new();
+
+    while head.len() < SNIFF_LEN {
+        let Some(chunk) = stream.try_next().await? else {
+            break;
+        };
+
+        let take = chunk.len().min(SNIFF_LEN - head.len());
+        head.extend_from_slice(&chunk[..take]);
+        chunks.push(Ok(chunk));
+    }
+
+    Ok((head, stream::iter(chunks).chain(stream)))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io;
+
+    use bytes::Bytes;
+    use futures_util::{stream, TryStreamExt};
+    use test_log::test;
+
+    use super::{
+        is_compatible, peek, sniff, ContentTypeFilter, ContentTypePattern,
+        SNIFF_LEN,
+    };
+
+    #[test]
+    fn test_sniff() {
+        let cases: &[(&[u8], &str)] = &[
+            (b"\x89PNG\r\n\x1A\n\x00\x00\x00\x0DIHDR", "image/png"),
+            (b"\xFF\xD8\xFF\xE0\x00\x10JFIF", "image/jpeg"),
+            (b"GIF89a\x01\x00", "image/gif"),
+            (b"RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"),
+            (b"%PDF-1.7\n", "application/pdf"),
+            (b"\x7FELF\x02\x01\x01", "application/x-executable"),
+            (
+                b"MZ\x90\x00\x03",
+                "application/vnd.microsoft.portable-executable",
+            ),
+            (b"PK\x03\x04\x14\x00", "application/zip"),
+            (b"\x00\x00\x00\x18ftypmp42", "video/mp4"),
+            (b"  \n<!doctype html><html>", "text/html"),
+            (b"<p>hello</p>", "text/html"),
+            (b"<?xml version=\"1.0\"?>", "text/xml"),
+            (b"{\"key\": \"value\"}", "text/plain"),
+            (b"", "text/plain"),
+            (b"MZ is also a text", "text/plain"),
+            (b"\x00\x01\x02\x03", "application/octet-stream"),
+        ];
+
+        for (data, expected) in cases {
+            assert_eq!(sniff(data), *expected, "sniffing {data:?}");
+        }
+    }
+
+    #[test]
+    fn test_is_compatible() {
+        assert!(is_compatible("image/png", "image/png"));
+        assert!(is_compatible("IMAGE/PNG; q=1", "image/png"));
+        assert!(is_compatible("application/json", "text/plain"));
+        assert!(is_compatible("application/octet-stream", "image/png"));
+        assert!(is_compatible(
+            "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+            "application/zip",
+        ));
+        assert!(is_compatible("audio/mp4", "video/mp4"));
+        assert!(is_compatible("image/svg+xml", "text/xml"));
+
+        assert!(!is_compatible("image/png", "application/x-executable"));
+        assert!(!is_compatible("image/png", "image/jpeg"));
+        assert!(!is_compatible("text/plain", "text/html"));
+    }
+
+    #[test]
+    fn test_content_type_pattern() {
+        let pattern = |v: &str| ContentTypePattern::try_from(v.to_owned());
+
+        assert_eq!(pattern("*/*"), Ok(ContentTypePattern::Any));
+        assert_eq!(
+            pattern("Image/*"),
+            Ok(ContentTypePattern::Type("image".into())),
+        );
+        assert_eq!(
+            pattern("image/svg+xml; charset=utf-8"),
+            Ok(ContentTypePattern::Exact("image/svg+xml".into())),
+        );
+        for invalid in ["", "*", "image", "*/png", "image/", "im age/*"] {
+            assert!(pattern(invalid).is_err(), "{invalid:?} is invalid");
+        }
+
+        let image = pattern("image/*").unwrap();
+        assert!(image.matches("IMAGE/PNG; q=1"));
+        assert!(!image.matches("imagery/png"));
+        assert!(!image.matches("text/plain"));
+    }
+
+    #[test]
+    fn test_content_type_filter() {
+        let patterns = |v: &[&str]| {
+            v.iter()
+                .map(|v| ContentTypePattern::try_from(v.to_string()).unwrap())
+                .collect()
+        };
+
+        let all = ContentTypeFilter::default();
+        assert!(all.permits("application/x-executable"));
+
+        let filter = ContentTypeFilter::new(
+            patterns(&["image/*", "application/pdf"]),
+            patterns(&["image/svg+xml"]),
+        );
+        assert!(filter.permits("image/png"));
+        assert!(filter.permits("application/pdf"));
+        assert!(!filter.permits("image/svg+xml"));
+        assert!(!filter.permits("text/html"));
+
+        let denied = ContentTypeFilter::new(vec![], patterns(&["text/*"]));
+        assert!(denied.permits("image/png"));
+        assert!(!denied.permits("text/html"));
+    }
+
+    #[test(tokio::test)]
+    async fn test_peek() {
+        let data: Vec<u8> = (0..2000).map(|i| i as u8).collect();
+        let chunks = data
+            .chunks(100)
+            .map(|chunk| Ok::<_, io::Error>(Bytes::copy_from_slice(chunk)));
+
+        let (head, stream) = peek(stream::iter(chunks)).await.unwrap();
+        assert_eq!(head, data[..SNIFF_LEN]);
+
+        let content: Vec<Bytes> = stream.try_collect().await.unwrap();
+        assert_eq!(content.concat(), data);
+    }
+}
@@ -0,0 +1,78 @@
+use std::{sync::Arc, time::Duration};
+
+use sqlx::Sqlite;
+use tokio::time::MissedTickBehavior;
+
+use super::{
+    manager::{ObjectError, ObjectManager},
+    repository::{ObjectRepository, MAX_LIMIT},
+};
+
+/// Periodically removes the expired objects, both the repository entry and
+/// the stored file, along with the expired idempotency keys and upload
+/// links.
+pub fn spawn_expiration_sweeper(
+    repo: ObjectRepository<Sqlite>,
+    manager: Arc<ObjectManager>,
+    interval: Duration,
+) {
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(interval);
+        interval.set_missed_tick_behavior(MissedTickBehavior::Delay);
+
+        loop {
+            interval.tick().await;
+            sweep_expired(&repo, &manager).await;
+            let _ = repo.delete_expired_idempotency_keys().await;
+            let _ = repo.delete_expired_upload_links().await;
+        }
+    });
+}
+
+async fn sweep_expired(
+    repo: &ObjectRepository<Sqlite>,
+    manager: &ObjectManager,
+) {
+    loop {
+        let Ok(objects) = repo.get_expired(MAX_LIMIT).await else {
+            return;
+        };
+        let count = objects.len();
+
+        for object in objects {
+            let id = object.id;
+
+            if let Err(error) = repo.delete(id).await {
+                tracing::error!(
+                    target: "storage::sweeper",
+                    %error,
+                    %id,
+                    "delete expired object entry failed",
+                );
+                return;
+            }
+
+            match manager.delete(id).await {
+                Ok(()) | Err(ObjectError::NotFound) => {
+                    tracing::info!(
+                        target: "storage::sweeper",
+                        %id,
+                        "deleted expired object",
+                    );
+                }
+                Err(error) => {
+                    tracing::error!(
+                        target: "storage::sweeper",
+                        %error,
+                        %id,
+                        "delete expired object file failed",
+                    );
+                }
+            }
+        }
+
+        if count < MAX_LIMIT as usize {
+            return;
+        }
+    }
+}
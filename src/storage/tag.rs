@@ -0,0 +1,132 @@
+use std::{collections::BTreeMap, str::FromStr};
+
+use crate::errors::{FieldViolation, ValidationError};
+
+pub const MAX_TAGS: usize = 32;
+pub const MAX_TAG_KEY_LEN: usize = 64;
+pub const MAX_TAG_VALUE_LEN: usize = 256;
+
+/// Tags of an object, ordered by key.
+pub type Tags = BTreeMap<String, String>;
+
+/// A single `key:value` tag, as used to filter the listed objects.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Tag {
+    pub key: String,
+    pub value: String,
+}
+
+impl FromStr for Tag {
+    type Err = ValidationError;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let (key, value) = s.split_once(':').ok_or_else(|| {
+            ValidationError(vec![FieldViolation::new(
+                "tag",
+                "format",
+                "must be formatted as `key:value`",
+            )])
+        })?;
+
+        let mut violations = Vec::new();
+        check_tag("tag", key, value, &mut violations);
+        ValidationError::check(violations)?;
+
+        Ok(Self {
+            key: key.into(),
+            value: value.into(),
+        })
+    }
+}
+
+/// Checks that `tags` fit in the limits. Keys can't be empty nor contain a
+/// `:`, so any tag can be used as a filter.
+pub fn validate_tags(tags: &Tags) -> Result<(), ValidationError> {
+    let mut violations = Vec::new();
+
+    if tags.len() > MAX_TAGS {
+        violations.push(FieldViolation::new(
+            "tags",
+            "length",
+            format!("must have at most {MAX_TAGS} tags, got {}", tags.len()),
+        ));
+    }
+
+    for (key, value) in tags {
+        check_tag("tags", key, value, &mut violations);
+    }
+
+    ValidationError::check(violations)
+}
+
+fn check_tag(
+    field: &'static str,
+    key: &str,
+    value: &str,
+    violations: &mut Vec<FieldViolation>,
+) {
+    if key.is_empty() || key.contains(':') {
+        violations.push(FieldViolation::new(
+            field,
+            "key",
+            format!("key `{key}` must not be empty nor contain `:`"),
+        ));
+    } else if key.len() > MAX_TAG_KEY_LEN {
+        violations.push(FieldViolation::new(
+            field,
+            "key_length",
+            format!("keys must have at most {MAX_TAG_KEY_LEN} bytes"),
+        ));
+    }
+
+    if value.len() > MAX_TAG_VALUE_LEN {
+        violations.push(FieldViolation::new(
+            field,
+            "value_length",
+            format!(
+                "value of `{key}` must have at most {MAX_TAG_VALUE_LEN} bytes",
+            ),
+        ));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use test_log::test;
+
+    use super::{
+        validate_tags, Tag, Tags, MAX_TAGS, MAX_TAG_KEY_LEN, MAX_TAG_VALUE_LEN,
+    };
+
+    #[test]
+    fn test_parse_tag() {
+        let tag: Tag = "project:downloader:v2".parse().unwrap();
+        assert_eq!(tag.key, "project");
+        assert_eq!(tag.value, "downloader:v2");
+
+        let tag: Tag = "empty:".parse().unwrap();
+        assert_eq!(tag.value, "");
+
+        assert!("no-separator".parse::<Tag>().is_err());
+        assert!(":value".parse::<Tag>().is_err());
+    }
+
+    #[test]
+    fn test_validate_tags() {
+        let tags: Tags = [("key".into(), "value".into())].into();
+        assert!(validate_tags(&tags).is_ok());
+
+        let tags: Tags = (0..=MAX_TAGS)
+            .map(|i| (i.to_string(), String::new()))
+            .collect();
+        assert_eq!(validate_tags(&tags).unwrap_err().0[0].rule, "length");
+
+        let tags: Tags = [
+            ("k".repeat(MAX_TAG_KEY_LEN + 1), "value".into()),
+            ("key".into(), "v".repeat(MAX_TAG_VALUE_LEN + 1)),
+        ]
+        .into();
+        let err = validate_tags(&tags).unwrap_err();
+        assert_eq!(err.0.len(), 2);
+    }
+}
@@ -0,0 +1,330 @@
+use std::{
+    collections::HashMap,
+    future::Future,
+    hash::Hash,
+    io,
+    net::IpAddr,
+    pin::Pin,
+    sync::{Arc, Mutex, Weak},
+    task::{ready, Context, Poll},
+    time::Duration,
+};
+
+use pin_project_lite::pin_project;
+use tokio::{
+    io::{AsyncRead, ReadBuf},
+    time::{sleep_until, Instant, Sleep},
+};
+use uuid::Uuid;
+
+use crate::{
+    auth::{Permission, Token},
+    config::{ThrottleConfig, UserRole},
+};
+
+/// Smallest number of bytes worth waking a throttled download up for.
+const MIN_CHUNK: u64 = 8 * 1024;
+
+/// Token bucket refilled at `rate` bytes per second, holding at most one
+/// second worth of bytes.
+pub struct Bucket {
+    rate: u64,
+    state: Mutex<BucketState>,
+}
+
+struct BucketState {
+    // Negative when concurrent reads took more than what was available
+    tokens: f64,
+    updated: Instant,
+}
+
+impl Bucket {
+    pub fn new(rate: u64) -> Self {
+        Self {
+            rate,
+            state: Mutex::new(BucketState {
+                tokens: rate as f64,
+                updated: Instant::now(),
+            }),
+        }
+    }
+
+    pub fn rate(&self) -> u64 {
+        self.rate
+    }
+
+    /// Returns how many bytes can be read at `now`, or how long to wait
+    /// until some can.
+    fn available(&self, now: Instant) -> Result<u64, Duration> {
+        let mut state = self.state.lock().unwrap();
+        let rate = self.rate as f64;
+
+        let elapsed = now.saturating_duration_since(state.updated);
+        state.tokens = (state.tokens + elapsed.as_secs_f64() * rate).min(rate);
+        state.updated = state.updated.max(now);
+
+        if state.tokens >= 1.0 {
+            return Ok(state.tokens as u64);
+        }
+
+        let missing = MIN_CHUNK.min(self.rate) as f64 - state.tokens;
+        Err(Duration::from_secs_f64(missing / rate))
+    }
+
+    fn consume(&self, bytes: u64) {
+        self.state.lock().unwrap().tokens -= bytes as f64;
+    }
+}
+
+/// Hands out the bandwidth buckets of the downloads. Every download of the
+/// same client ip or user shares the same bucket, so opening more of them
+/// in parallel doesn't raise the limit.
+pub struct Throttle {
+    cfg: ThrottleConfig,
+    ips: Mutex<HashMap<IpAddr, Weak<Bucket>>>,
+    users: Mutex<HashMap<Uuid, Weak<Bucket>>>,
+}
+
+impl Throttle {
+    pub fn new(cfg: ThrottleConfig) -> Self {
+        Self {
+            cfg,
+            ips: Mutex::default(),
+            users: Mutex::default(),
+        }
+    }
+
+    /// Returns the buckets a download from `ip` authorized by `token` must
+    /// go through, none if it isn't limited.
+    pub fn buckets(
+        &self,
+        ip: Option<IpAddr>,
+        token: Option<&Token>,
+    ) -> Vec<Arc<Bucket>> {
+        let is_admin = token.is_some_and(|token| {
+            token.permission().contains(Permission::ADMIN)
+        });
+        if is_admin && self.cfg.exempt_admins {
+            return Vec::new();
+        }
+
+        let mut buckets = Vec::new();
+
+        if let Some(ip) = ip.filter(|_| self.cfg.ip_rate > 0) {
+            buckets.push(shared(&self.ips, ip, self.cfg.ip_rate));
+        }
+
+        if let Some(Token::User(user_token)) = token {
+            let role = UserRole::of(user_token.permission);
+            let rate = self
+                .cfg
+                .roles
+                .get(&role)
+                .copied()
+                .unwrap_or(self.cfg.user_rate);
+
+            if rate > 0 {
+                buckets.push(shared(&self.users, user_token.user_id, rate));
+            }
+        }
+
+        buckets
+    }
+}
+
+fn shared<K: Eq + Hash>(
+    buckets: &Mutex<HashMap<K, Weak<Bucket>>>,
+    key: K,
+    rate: u64,
+) -> Arc<Bucket> {
+    let mut buckets = buckets.lock().unwrap();
+
+    if let Some(bucket) = buckets.get(&key).and_then(Weak::upgrade) {
+        return bucket;
+    }
+
+    // Buckets are dropped along with their last download
+    buckets.retain(|_, bucket| bucket.strong_count() > 0);
+
+    let bucket = Arc::new(Bucket::new(rate));
+    buckets.insert(key, Arc::downgrade(&bucket));
+    bucket
+}
+
+pin_project! {
+    /// Reads no faster than every one of its buckets allows.
+    pub struct ThrottledReader<R> {
+        #[pin]
+        inner: R,
+        buckets: Vec<Arc<Bucket>>,
+        sleep: Pin<Box<Sleep>>,
+    }
+}
+
+impl<R> ThrottledReader<R> {
+    pub fn new(inner: R, buckets: Vec<Arc<Bucket>>) -> Self {
+        Self {
+            inner,
+            buckets,
+            sleep: Box::pin(sleep_until(Instant::now())),
+        }
+    }
+}
+
+impl<R: AsyncRead> AsyncRead for ThrottledReader<R> {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.project();
+
+        if this.buckets.is_empty() {
+            return this.inner.poll_read(cx, buf);
+        }
+
+        let allowed = loop {
+            let now = Instant::now();
+            let mut allowed = buf.remaining() as u64;
+            let mut wait = Duration::ZERO;
+
+            for bucket in this.buckets.iter() {
+                match bucket.available(now) {
+                    Ok(bytes) => allowed = allowed.min(bytes),
+                    Err(duration) => wait = wait.max(duration),
+                }
+            }
+
+            if wait.is_zero() {
+                break allowed as usize;
+            }
+
+            this.sleep.as_mut().reset(now + wait);
+            ready!(this.sleep.as_mut().poll(cx));
+        };
+
+        let mut limited = buf.take(allowed);
+        ready!(this.inner.poll_read(cx, &mut limited))?;
+        let read = limited.filled().len();
+
+        // SAFETY: the inner reader initialized these bytes
+        unsafe { buf.assume_init(read) };
+        buf.advance(read);
+
+        for bucket in this.buckets.iter() {
+            bucket.consume(read as u64);
+        }
+
+        Poll::Ready(Ok(()))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{net::IpAddr, sync::Arc, time::Duration};
+
+    use chrono::Utc;
+    use test_log::test;
+    use tokio::{io::AsyncReadExt, time::Instant};
+    use uuid::Uuid;
+
+    use crate::{
+        auth::{Permission, Token, UserToken},
+        config::{ThrottleConfig, UserRole},
+    };
+
+    use super::{Bucket, Throttle, ThrottledReader};
+
+    fn user_token(permission: Permission) -> Token {
+        Token::User(UserToken {
+            user_id: Uuid::new_v4(),
+            created_at: Utc::now(),
+            not_before: None,
+            expiration: Utc::now(),
+            issuer: "test".into(),
+            audience: "test".into(),
+            session_id: None,
+            api_key_id: None,
+            permission,
+            username: "user".into(),
+        })
+    }
+
+    #[test]
+    fn test_bucket_refill() {
+        let bucket = Bucket::new(1000);
+        let start = Instant::now();
+
+        assert_eq!(bucket.available(start), Ok(1000));
+        bucket.consume(1500);
+
+        let wait = bucket.available(start).unwrap_err();
+        assert_eq!(wait, Duration::from_millis(1500));
+
+        assert_eq!(bucket.available(start + wait), Ok(1000));
+    }
+
+    #[test]
+    fn test_buckets_shared() {
+        let throttle = Throttle::new(ThrottleConfig {
+            ip_rate: 1000,
+            user_rate: 2000,
+            ..Default::default()
+        });
+        let ip: IpAddr = "127.0.0.1".parse().unwrap();
+        let token = user_token(Permission::UNPRIVILEGED);
+
+        let first = throttle.buckets(Some(ip), Some(&token));
+        let second = throttle.buckets(Some(ip), Some(&token));
+        assert_eq!(first.len(), 2);
+        assert!(Arc::ptr_eq(&first[0], &second[0]));
+        assert!(Arc::ptr_eq(&first[1], &second[1]));
+
+        let other =
+            throttle.buckets(None, Some(&user_token(Permission::SHARE)));
+        assert_eq!(other.len(), 1);
+        assert!(!Arc::ptr_eq(&first[1], &other[0]));
+    }
+
+    #[test]
+    fn test_buckets_roles() {
+        let admin = user_token(Permission::ADMIN);
+        let ip: IpAddr = "127.0.0.1".parse().unwrap();
+
+        let throttle = Throttle::new(ThrottleConfig {
+            ip_rate: 1000,
+            user_rate: 2000,
+            ..Default::default()
+        });
+        assert!(throttle.buckets(Some(ip), Some(&admin)).is_empty());
+        assert!(throttle.buckets(Some(ip), Some(&Token::Server)).is_empty());
+        assert_eq!(throttle.buckets(Some(ip), None).len(), 1);
+
+        let throttle = Throttle::new(ThrottleConfig {
+            user_rate: 2000,
+            roles: [(UserRole::Unprivileged, 0)].into(),
+            exempt_admins: false,
+            ..Default::default()
+        });
+        assert_eq!(throttle.buckets(Some(ip), Some(&admin)).len(), 1);
+        assert!(throttle
+            .buckets(Some(ip), Some(&user_token(Permission::UNPRIVILEGED)))
+            .is_empty());
+    }
+
+    #[test(tokio::test)]
+    async fn test_throttled_reader() {
+        let data = vec![7u8; 64 * 1024];
+        let start = Instant::now();
+
+        let mut reader = ThrottledReader::new(
+            data.as_slice(),
+            vec![Arc::new(Bucket::new(32 * 1024))],
+        );
+        let mut read = Vec::new();
+        reader.read_to_end(&mut read).await.unwrap();
+
+        assert_eq!(read, data);
+        assert!(start.elapsed() >= Duration::from_millis(900));
+    }
+}
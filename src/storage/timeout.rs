@@ -0,0 +1,244 @@
+use std::{
+    future::Future,
+    io,
+    pin::Pin,
+    task::{Context, Poll},
+    time::Duration,
+};
+
+use pin_project_lite::pin_project;
+use tokio::{
+    io::{AsyncBufReadExt, AsyncRead, BufReader, ReadBuf},
+    time::{sleep, Sleep},
+};
+
+use crate::{config::NetConfig, errors::HttpError};
+
+use super::manager::ObjectError;
+
+/// Deadlines of the downloads. Reading the file info and the first bytes of
+/// the file must be quick, while streaming the file gets as long as its
+/// size takes at the minimum throughput, plus a grace period. `None`
+/// disables the respective one.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct DownloadTimeouts {
+    pub metadata: Option<Duration>,
+    pub first_byte: Option<Duration>,
+    /// Slowest download allowed to finish, in bytes per second.
+    pub min_throughput: Option<u64>,
+    pub grace: Duration,
+}
+
+impl DownloadTimeouts {
+    pub fn from_config(cfg: &NetConfig) -> Self {
+        Self {
+            metadata: Some(cfg.metadata_timeout).filter(|d| !d.is_zero()),
+            first_byte: Some(cfg.first_byte_timeout).filter(|d| !d.is_zero()),
+            min_throughput: Some(cfg.download_min_throughput)
+                .filter(|&rate| rate > 0),
+            grace: cfg.download_timeout_grace,
+        }
+    }
+
+    /// Runs `fut` within the metadata deadline.
+    pub async fn metadata<F: Future>(
+        &self,
+        fut: F,
+    ) -> Result<F::Output, HttpError> {
+        match self.metadata {
+            Some(timeout) => tokio::time::timeout(timeout, fut)
+                .await
+                .map_err(|_| HttpError::Timeout),
+            None => Ok(fut.await),
+        }
+    }
+
+    /// Waits for `open` and the first bytes of the file it opens within the
+    /// first byte deadline, so a stalled storage is noticed before anything
+    /// is sent. Running out of time fails as a transient error, so it can be
+    /// retried.
+    pub async fn first_byte<R, F>(
+        &self,
+        open: F,
+    ) -> Result<BufReader<R>, ObjectError>
+    where
+        R: AsyncRead + Unpin,
+        F: Future<Output = Result<R, ObjectError>>,
+    {
+        let fut = async {
+            let mut reader = BufReader::new(open.await?);
+            reader.fill_buf().await?;
+            Ok(reader)
+        };
+
+        match self.first_byte {
+            Some(timeout) => tokio::time::timeout(timeout, fut)
+                .await
+                .unwrap_or_else(|_| {
+                    Err(io::Error::new(
+                        io::ErrorKind::TimedOut,
+                        "first byte deadline exceeded",
+                    )
+                    .into())
+                }),
+            None => fut.await,
+        }
+    }
+
+    /// Returns how long streaming `len` bytes may take. Downloads throttled
+    /// below the minimum throughput get as long as the `max_rate` takes.
+    pub fn stream(&self, len: u64, max_rate: Option<u64>) -> Option<Duration> {
+        let rate = match max_rate {
+            Some(max_rate) => self.min_throughput?.min(max_rate),
+            None => self.min_throughput?,
+        };
+
+        let secs = len.div_ceil(rate.max(1));
+        Some(self.grace.saturating_add(Duration::from_secs(secs)))
+    }
+}
+
+pin_project! {
+    /// Fails the reads with [`io::ErrorKind::TimedOut`] once the deadline
+    /// passes, so stalled or too slow downloads are cut.
+    pub struct DeadlineReader<R> {
+        #[pin]
+        inner: R,
+        sleep: Option<Pin<Box<Sleep>>>,
+    }
+}
+
+impl<R> DeadlineReader<R> {
+    pub fn new(inner: R, timeout: Option<Duration>) -> Self {
+        Self {
+            inner,
+            sleep: timeout.map(|timeout| Box::pin(sleep(timeout))),
+        }
+    }
+}
+
+impl<R: AsyncRead> AsyncRead for DeadlineReader<R> {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.project();
+
+        if let Some(sleep) = this.sleep {
+            if sleep.as_mut().poll(cx).is_ready() {
+                return Poll::Ready(Err(io::Error::new(
+                    io::ErrorKind::TimedOut,
+                    "download deadline exceeded",
+                )));
+            }
+        }
+
+        this.inner.poll_read(cx, buf)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{io::ErrorKind, time::Duration};
+
+    use test_log::test;
+    use tokio::io::{duplex, AsyncReadExt, AsyncWriteExt};
+
+    use crate::{errors::HttpError, storage::manager::ObjectError};
+
+    use super::{DeadlineReader, DownloadTimeouts};
+
+    #[test]
+    fn test_stream_timeout() {
+        let timeouts = DownloadTimeouts {
+            metadata: None,
+            first_byte: None,
+            min_throughput: Some(1024),
+            grace: Duration::from_secs(30),
+        };
+
+        assert_eq!(timeouts.stream(0, None), Some(Duration::from_secs(30)));
+        assert_eq!(
+            timeouts.stream(10 * 1024 + 1, None),
+            Some(Duration::from_secs(41)),
+        );
+        // Throttled below the minimum throughput
+        assert_eq!(
+            timeouts.stream(10 * 1024, Some(512)),
+            Some(Duration::from_secs(50)),
+        );
+        assert_eq!(
+            timeouts.stream(10 * 1024, Some(4096)),
+            Some(Duration::from_secs(40)),
+        );
+
+        assert_eq!(DownloadTimeouts::default().stream(1024, None), None);
+    }
+
+    #[test(tokio::test)]
+    async fn test_metadata_timeout() {
+        let timeouts = DownloadTimeouts {
+            metadata: Some(Duration::from_millis(10)),
+            ..Default::default()
+        };
+
+        assert_eq!(timeouts.metadata(async { 1 }).await.unwrap(), 1);
+
+        let res = timeouts.metadata(std::future::pending::<()>()).await;
+        assert!(matches!(res, Err(HttpError::Timeout)));
+    }
+
+    #[test(tokio::test)]
+    async fn test_first_byte_timeout() {
+        let timeouts = DownloadTimeouts {
+            first_byte: Some(Duration::from_millis(50)),
+            ..Default::default()
+        };
+
+        let (mut writer, reader) = duplex(64);
+        writer.write_all(b"data").await.unwrap();
+        drop(writer);
+
+        let mut reader =
+            timeouts.first_byte(async { Ok(reader) }).await.unwrap();
+        let mut buf = Vec::new();
+        reader.read_to_end(&mut buf).await.unwrap();
+        assert_eq!(buf, b"data");
+
+        // Opened, but nothing to read while the writer is still open
+        let (_writer, reader) = duplex(64);
+        let error =
+            timeouts.first_byte(async { Ok(reader) }).await.unwrap_err();
+        assert!(error.is_transient(), "{error}");
+        assert!(matches!(
+            error,
+            ObjectError::IoError(error) if error.kind() == ErrorKind::TimedOut,
+        ));
+    }
+
+    #[test(tokio::test)]
+    async fn test_deadline_reader() {
+        let (mut writer, reader) = duplex(64);
+        let mut reader =
+            DeadlineReader::new(reader, Some(Duration::from_millis(50)));
+
+        writer.write_all(b"data").await.unwrap();
+        let mut buf = [0; 4];
+        reader.read_exact(&mut buf).await.unwrap();
+        assert_eq!(&buf, b"data");
+
+        // Stalled, the writer is still open
+        let err = reader.read(&mut buf).await.unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::TimedOut);
+
+        let (mut writer, reader) = duplex(64);
+        let mut reader = DeadlineReader::new(reader, None);
+        writer.write_all(b"data").await.unwrap();
+        drop(writer);
+
+        let mut buf = Vec::new();
+        reader.read_to_end(&mut buf).await.unwrap();
+        assert_eq!(buf, b"data");
+    }
+}
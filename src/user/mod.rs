@@ -1,14 +1,27 @@
+use std::ops::RangeInclusive;
+
 use axum::http::StatusCode;
 use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
 use sqlx::{ColumnIndex, Decode, FromRow, Row, Type};
 use uuid::Uuid;
 
-use crate::auth::Permission;
+use crate::{
+    auth::Permission,
+    config::UserRole,
+    errors::{sqlx_status_code, FieldViolation, ValidationError},
+};
 
 pub mod repository;
 pub mod routes;
 
+pub const USERNAME_LEN: RangeInclusive<usize> = 3..=32;
+/// bcrypt only takes the first 72 bytes of the password into account.
+pub const PASSWORD_LEN: RangeInclusive<usize> = 8..=72;
+pub const HASH_COST_RANGE: RangeInclusive<u32> = 4..=31;
+pub const MAX_LIMIT: u32 = 100;
+pub const API_KEY_NAME_LEN: RangeInclusive<usize> = 1..=64;
+
 #[derive(Debug, thiserror::Error)]
 pub enum UserError {
     #[error("user not found")]
@@ -23,6 +36,14 @@ pub enum UserError {
     BcryptCompareFailed,
     #[error("sqlx error: {0}")]
     Sqlx(sqlx::Error),
+    #[error("invite code is invalid, expired or already used")]
+    InvalidInvite,
+    #[error("the provided limit {0} is beyond the maximum of {MAX_LIMIT}")]
+    LimitOutOfRange(u32),
+    #[error("session not found")]
+    SessionNotFound,
+    #[error("api key not found")]
+    ApiKeyNotFound,
 }
 
 impl UserError {
@@ -34,7 +55,11 @@ impl UserError {
             UserError::PasswordMismatch => StatusCode::UNAUTHORIZED,
             UserError::BcryptHashFailed => StatusCode::INTERNAL_SERVER_ERROR,
             UserError::BcryptCompareFailed => StatusCode::INTERNAL_SERVER_ERROR,
-            UserError::Sqlx(..) => StatusCode::INTERNAL_SERVER_ERROR,
+            UserError::Sqlx(e) => sqlx_status_code(e),
+            UserError::InvalidInvite => StatusCode::FORBIDDEN,
+            UserError::LimitOutOfRange(..) => StatusCode::BAD_REQUEST,
+            UserError::SessionNotFound => StatusCode::NOT_FOUND,
+            UserError::ApiKeyNotFound => StatusCode::NOT_FOUND,
         }
     }
 
@@ -47,6 +72,10 @@ impl UserError {
             UserError::BcryptHashFailed => 4,
             UserError::BcryptCompareFailed => 5,
             UserError::Sqlx(..) => 6,
+            UserError::InvalidInvite => 7,
+            UserError::LimitOutOfRange(..) => 8,
+            UserError::SessionNotFound => 9,
+            UserError::ApiKeyNotFound => 10,
         }
     }
 }
@@ -58,12 +87,18 @@ pub struct User {
     pub updated_at: DateTime<Utc>,
     pub permission: Permission,
     pub username: String,
+    /// Bytes the user may store, overriding the quota of its role.
+    #[serde(default)]
+    pub quota: Option<u64>,
 }
 
 impl<'r, R: Row> FromRow<'r, R> for User
 where
     &'r str: ColumnIndex<R>,
 
+    Option<i64>: Decode<'r, R::Database>,
+    Option<i64>: Type<R::Database>,
+
     Vec<u8>: Decode<'r, R::Database>,
     Vec<u8>: Type<R::Database>,
 
@@ -109,12 +144,280 @@ where
 
         let username: String = row.try_get("username")?;
 
+        let quota: Option<i64> = row.try_get("quota")?;
+        let quota = quota
+            .map(|quota| {
+                quota.try_into().map_err(|_| {
+                    sqlx::Error::Decode("parse `quota` u64 out of range".into())
+                })
+            })
+            .transpose()?;
+
         Ok(Self {
             id,
             created_at,
             updated_at,
             permission,
             username,
+            quota,
+        })
+    }
+}
+
+/// Narrows down the listed users. Filters left out match every user.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize)]
+pub struct UserFilter {
+    /// Part of the username, matched ignoring ASCII case.
+    pub search: Option<String>,
+    pub role: Option<UserRole>,
+}
+
+/// A single-use code that allows signing up while open signup is disabled.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Invite {
+    pub code: String,
+    pub created_at: DateTime<Utc>,
+    pub expires_at: DateTime<Utc>,
+    pub created_by: Option<Uuid>,
+    pub permission: Permission,
+    pub used_at: Option<DateTime<Utc>>,
+    pub used_by: Option<Uuid>,
+}
+
+impl<'r, R: Row> FromRow<'r, R> for Invite
+where
+    &'r str: ColumnIndex<R>,
+
+    Vec<u8>: Decode<'r, R::Database>,
+    Vec<u8>: Type<R::Database>,
+
+    i64: Decode<'r, R::Database>,
+    i64: Type<R::Database>,
+
+    String: Decode<'r, R::Database>,
+    String: Type<R::Database>,
+{
+    fn from_row(row: &'r R) -> Result<Self, sqlx::Error> {
+        let code: String = row.try_get("code")?;
+
+        let created_at: i64 = row.try_get("created_at")?;
+        let created_at = DateTime::from_timestamp_millis(created_at)
+            .ok_or_else(|| {
+                sqlx::Error::Decode(
+                    "parse `created_at` field gone wrong".into(),
+                )
+            })?;
+
+        let expires_at: i64 = row.try_get("expires_at")?;
+        let expires_at = DateTime::from_timestamp_millis(expires_at)
+            .ok_or_else(|| {
+                sqlx::Error::Decode(
+                    "parse `expires_at` field gone wrong".into(),
+                )
+            })?;
+
+        let created_by: Option<Vec<u8>> = row.try_get("created_by")?;
+        let created_by = created_by
+            .map(|id| {
+                let id: [u8; 16] = id.try_into().map_err(|_| {
+                    sqlx::Error::Decode(
+                        "parse `created_by` uuid out of range".into(),
+                    )
+                })?;
+                Ok::<_, sqlx::Error>(Uuid::from_bytes(id))
+            })
+            .transpose()?;
+
+        let permission: i64 = row.try_get("permission")?;
+        let permission: u8 = permission.try_into().map_err(|_| {
+            sqlx::Error::Decode("parse `permission` u8 out of range".into())
+        })?;
+        let permission =
+            Permission::from_bits(permission).ok_or_else(|| {
+                sqlx::Error::Decode(
+                    "parse `permission` invalid bitflags".into(),
+                )
+            })?;
+
+        let used_at: Option<i64> = row.try_get("used_at")?;
+        let used_at = used_at
+            .map(|used_at| {
+                DateTime::from_timestamp_millis(used_at).ok_or_else(|| {
+                    sqlx::Error::Decode(
+                        "parse `used_at` field gone wrong".into(),
+                    )
+                })
+            })
+            .transpose()?;
+
+        let used_by: Option<Vec<u8>> = row.try_get("used_by")?;
+        let used_by = used_by
+            .map(|id| {
+                let id: [u8; 16] = id.try_into().map_err(|_| {
+                    sqlx::Error::Decode(
+                        "parse `used_by` uuid out of range".into(),
+                    )
+                })?;
+                Ok::<_, sqlx::Error>(Uuid::from_bytes(id))
+            })
+            .transpose()?;
+
+        Ok(Self {
+            code,
+            created_at,
+            expires_at,
+            created_by,
+            permission,
+            used_at,
+            used_by,
+        })
+    }
+}
+
+/// A login of the user. The tokens it issued carry its id as their `jti`
+/// and are revoked once it is deleted.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Session {
+    pub id: Uuid,
+    pub user_id: Uuid,
+    pub created_at: DateTime<Utc>,
+    pub expires_at: DateTime<Utc>,
+    pub ip_addr: Option<String>,
+    pub user_agent: Option<String>,
+}
+
+impl<'r, R: Row> FromRow<'r, R> for Session
+where
+    &'r str: ColumnIndex<R>,
+
+    Vec<u8>: Decode<'r, R::Database>,
+    Vec<u8>: Type<R::Database>,
+
+    i64: Decode<'r, R::Database>,
+    i64: Type<R::Database>,
+
+    String: Decode<'r, R::Database>,
+    String: Type<R::Database>,
+{
+    fn from_row(row: &'r R) -> Result<Self, sqlx::Error> {
+        let id: Vec<u8> = row.try_get("id")?;
+        let id: [u8; 16] = id.try_into().map_err(|_| {
+            sqlx::Error::Decode("parse `id` uuid out of range".into())
+        })?;
+        let id = Uuid::from_bytes(id);
+
+        let user_id: Vec<u8> = row.try_get("user_id")?;
+        let user_id: [u8; 16] = user_id.try_into().map_err(|_| {
+            sqlx::Error::Decode("parse `user_id` uuid out of range".into())
+        })?;
+        let user_id = Uuid::from_bytes(user_id);
+
+        let created_at: i64 = row.try_get("created_at")?;
+        let created_at = DateTime::from_timestamp_millis(created_at)
+            .ok_or_else(|| {
+                sqlx::Error::Decode(
+                    "parse `created_at` field gone wrong".into(),
+                )
+            })?;
+
+        let expires_at: i64 = row.try_get("expires_at")?;
+        let expires_at = DateTime::from_timestamp_millis(expires_at)
+            .ok_or_else(|| {
+                sqlx::Error::Decode(
+                    "parse `expires_at` field gone wrong".into(),
+                )
+            })?;
+
+        Ok(Self {
+            id,
+            user_id,
+            created_at,
+            expires_at,
+            ip_addr: row.try_get("ip_addr")?,
+            user_agent: row.try_get("user_agent")?,
+        })
+    }
+}
+
+/// A long lived key the scripts of the user authenticate with, limited to
+/// `permission` and to the current permission of the user. Only the
+/// SHA-256 of the key itself is stored.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ApiKey {
+    pub id: Uuid,
+    pub user_id: Uuid,
+    pub name: String,
+    pub permission: Permission,
+    pub created_at: DateTime<Utc>,
+    pub last_used_at: Option<DateTime<Utc>>,
+}
+
+impl<'r, R: Row> FromRow<'r, R> for ApiKey
+where
+    &'r str: ColumnIndex<R>,
+
+    Option<i64>: Decode<'r, R::Database>,
+    Option<i64>: Type<R::Database>,
+
+    Vec<u8>: Decode<'r, R::Database>,
+    Vec<u8>: Type<R::Database>,
+
+    i64: Decode<'r, R::Database>,
+    i64: Type<R::Database>,
+
+    String: Decode<'r, R::Database>,
+    String: Type<R::Database>,
+{
+    fn from_row(row: &'r R) -> Result<Self, sqlx::Error> {
+        let id: Vec<u8> = row.try_get("id")?;
+        let id: [u8; 16] = id.try_into().map_err(|_| {
+            sqlx::Error::Decode("parse `id` uuid out of range".into())
+        })?;
+        let id = Uuid::from_bytes(id);
+
+        let user_id: Vec<u8> = row.try_get("user_id")?;
+        let user_id: [u8; 16] = user_id.try_into().map_err(|_| {
+            sqlx::Error::Decode("parse `user_id` uuid out of range".into())
+        })?;
+        let user_id = Uuid::from_bytes(user_id);
+
+        let permission: i64 = row.try_get("permission")?;
+        let permission: u8 = permission.try_into().map_err(|_| {
+            sqlx::Error::Decode("parse `permission` u8 out of range".into())
+        })?;
+        let permission =
+            Permission::from_bits(permission).ok_or_else(|| {
+                sqlx::Error::Decode(
+                    "parse `permission` invalid bitflags".into(),
+                )
+            })?;
+
+        let created_at: i64 = row.try_get("created_at")?;
+        let created_at = DateTime::from_timestamp_millis(created_at)
+            .ok_or_else(|| {
+                sqlx::Error::Decode(
+                    "parse `created_at` field gone wrong".into(),
+                )
+            })?;
+
+        let last_used_at: Option<i64> = row.try_get("last_used_at")?;
+        let last_used_at = last_used_at
+            .map(|last_used_at| {
+                DateTime::from_timestamp_millis(last_used_at).ok_or_else(|| {
+                    sqlx::Error::Decode(
+                        "parse `last_used_at` field gone wrong".into(),
+                    )
+                })
+            })
+            .transpose()?;
+
+        Ok(Self {
+            id,
+            user_id,
+            name: row.try_get("name")?,
+            permission,
+            created_at,
+            last_used_at,
         })
     }
 }
@@ -127,3 +430,121 @@ pub struct UserData {
     pub username: String,
     pub password: String,
 }
+
+impl UserData {
+    pub fn validate(&self) -> Result<(), ValidationError> {
+        let mut violations = Vec::new();
+
+        validate_username("username", &self.username, &mut violations);
+        validate_password("password", &self.password, &mut violations);
+
+        ValidationError::check(violations)
+    }
+}
+
+pub fn validate_username(
+    field: &'static str,
+    username: &str,
+    violations: &mut Vec<FieldViolation>,
+) {
+    if !USERNAME_LEN.contains(&username.len()) {
+        violations.push(FieldViolation::new(
+            field,
+            "length",
+            format!(
+                "must have between {} and {} characters",
+                USERNAME_LEN.start(),
+                USERNAME_LEN.end(),
+            ),
+        ));
+    }
+
+    let valid_chars = username
+        .chars()
+        .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.'));
+
+    if !valid_chars {
+        violations.push(FieldViolation::new(
+            field,
+            "charset",
+            "must only contain letters, digits, `_`, `-` and `.`",
+        ));
+    }
+}
+
+pub fn validate_api_key_name(
+    field: &'static str,
+    name: &str,
+    violations: &mut Vec<FieldViolation>,
+) {
+    if !API_KEY_NAME_LEN.contains(&name.chars().count()) {
+        violations.push(FieldViolation::new(
+            field,
+            "length",
+            format!(
+                "must have between {} and {} characters",
+                API_KEY_NAME_LEN.start(),
+                API_KEY_NAME_LEN.end(),
+            ),
+        ));
+    }
+
+    if name.chars().any(char::is_control) {
+        violations.push(FieldViolation::new(
+            field,
+            "charset",
+            "must not contain control characters",
+        ));
+    }
+}
+
+pub fn validate_password(
+    field: &'static str,
+    password: &str,
+    violations: &mut Vec<FieldViolation>,
+) {
+    if !PASSWORD_LEN.contains(&password.len()) {
+        violations.push(FieldViolation::new(
+            field,
+            "length",
+            format!(
+                "must have between {} and {} bytes",
+                PASSWORD_LEN.start(),
+                PASSWORD_LEN.end(),
+            ),
+        ));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use test_log::test;
+
+    use super::UserData;
+
+    #[test]
+    fn test_validate() {
+        let data = UserData {
+            username: "some_user.name-1".into(),
+            password: "a long enough password".into(),
+        };
+        data.validate().expect("expected valid user data");
+
+        let data = UserData {
+            username: "a b".into(),
+            password: "short".into(),
+        };
+        let violations = data.validate().unwrap_err().0;
+
+        let fields = violations
+            .iter()
+            .map(|v| (v.field, v.rule))
+            .collect::<Vec<_>>();
+
+        assert_eq!(
+            fields,
+            [("username", "charset"), ("password", "length"),],
+            "expected every violated rule to be reported",
+        );
+    }
+}
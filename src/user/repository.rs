@@ -1,4 +1,9 @@
-use chrono::Utc;
+use std::time::{Duration, Instant};
+
+use base64::{prelude::BASE64_URL_SAFE_NO_PAD, Engine};
+use chrono::{DateTime, TimeDelta, Utc};
+use rand::RngCore;
+use sha2::{Digest, Sha256};
 use sqlx::{
     ColumnIndex, Database, Decode, Encode, Executor, FromRow, IntoArguments,
     Pool, Row, Type,
@@ -6,9 +11,23 @@ use sqlx::{
 use tokio::task::spawn_blocking;
 use uuid::Uuid;
 
-use crate::auth::Permission;
+use crate::{auth::Permission, config::UserRole};
+
+use super::{
+    ApiKey, Invite, Session, User, UserData, UserError, UserFilter,
+    HASH_COST_RANGE, MAX_LIMIT,
+};
+
+/// Prefix of the api keys, making them recognizable in scripts and leaks.
+pub const API_KEY_PREFIX: &str = "dl_";
 
-use super::{User, UserData, UserError};
+/// How stale `last_used_at` of an api key gets before being updated, so
+/// scripts firing requests in a loop don't write on each of them.
+const API_KEY_USE_PRECISION: TimeDelta = TimeDelta::minutes(1);
+
+const INSERT_USER_QUERY: &str = "INSERT INTO user \
+    (id, created_at, updated_at, permission, username, password) \
+    VALUES ($1, $2, $3, $4, $5, $6) RETURNING *";
 
 struct UserWithPassword {
     pub user: User,
@@ -60,8 +79,13 @@ where
     DB: Database,
     for<'a> <DB as sqlx::Database>::Arguments<'a>: IntoArguments<'a, DB>,
     for<'a> &'a Pool<DB>: Executor<'a, Database = DB>,
+    for<'c> &'c mut DB::Connection: Executor<'c, Database = DB>,
 
     for<'r> User: FromRow<'r, DB::Row>,
+    for<'r> Invite: FromRow<'r, DB::Row>,
+    for<'r> Session: FromRow<'r, DB::Row>,
+    for<'r> ApiKey: FromRow<'r, DB::Row>,
+    for<'r> (i64,): FromRow<'r, DB::Row>,
 
     for<'r> &'r str: ColumnIndex<DB::Row>,
     for<'r> String: Decode<'r, DB>,
@@ -73,8 +97,17 @@ where
     for<'e> i64: Encode<'e, DB>,
     i64: Type<DB>,
 
+    for<'e> Option<i64>: Encode<'e, DB>,
+    Option<i64>: Type<DB>,
+
+    for<'e> Option<Vec<u8>>: Encode<'e, DB>,
+    Option<Vec<u8>>: Type<DB>,
+
     for<'e> &'e str: Encode<'e, DB>,
     for<'e> &'e str: Type<DB>,
+
+    for<'e> Option<&'e str>: Encode<'e, DB>,
+    for<'e> Option<&'e str>: Type<DB>,
 {
     pub async fn get(&self, id: Uuid) -> Result<User, UserError> {
         sqlx::query_as("SELECT * FROM user WHERE id = $1")
@@ -88,12 +121,75 @@ where
             .ok_or(UserError::NotFound)
     }
 
+    /// Lists the users matching `filter` from the oldest to the newest,
+    /// skipping the first `offset` ones. Also returns how many users match
+    /// in total.
+    pub async fn list(
+        &self,
+        limit: u32,
+        offset: u32,
+        filter: &UserFilter,
+    ) -> Result<(Vec<User>, u64), UserError> {
+        if limit > MAX_LIMIT {
+            return Err(UserError::LimitOutOfRange(limit));
+        }
+
+        let pattern = match &filter.search {
+            Some(search) => format!("%{}%", escape_like(search)),
+            None => "%".into(),
+        };
+
+        // Allowed values of `UserRole::of(permission) == UserRole::Admin`
+        let is_admin: (i64, i64) = match filter.role {
+            Some(UserRole::Admin) => (1, 1),
+            Some(UserRole::Unprivileged) => (0, 0),
+            None => (0, 1),
+        };
+        let admin = Permission::ADMIN.bits() as i64;
+
+        let users = sqlx::query_as(
+            "SELECT * FROM user WHERE username LIKE $1 ESCAPE '\\' \
+            AND ((permission & $2) = $2) IN ($3, $4) \
+            ORDER BY created_at, rowid LIMIT $5 OFFSET $6",
+        )
+        .bind(pattern.as_str())
+        .bind(admin)
+        .bind(is_admin.0)
+        .bind(is_admin.1)
+        .bind(limit as i64)
+        .bind(offset as i64)
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while listing users");
+            UserError::Sqlx(error)
+        })?;
+
+        let (total,): (i64,) = sqlx::query_as(
+            "SELECT COUNT(*) FROM user WHERE username LIKE $1 ESCAPE '\\' \
+            AND ((permission & $2) = $2) IN ($3, $4)",
+        )
+        .bind(pattern.as_str())
+        .bind(admin)
+        .bind(is_admin.0)
+        .bind(is_admin.1)
+        .fetch_one(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while counting users");
+            UserError::Sqlx(error)
+        })?;
+
+        Ok((users, total as u64))
+    }
+
+    /// Usernames are matched ignoring ASCII case, as in the unique index.
     pub async fn authenticate(
         &self,
         data: UserData,
     ) -> Result<User, UserError> {
         let user: UserWithPassword = sqlx::query_as(
-            "SELECT * FROM user WHERE username = $1",
+            "SELECT * FROM user WHERE username = $1 COLLATE NOCASE",
         )
         .bind(data.username.as_str())
         .fetch_optional(&self.db)
@@ -123,32 +219,100 @@ where
         let password_hash =
             hash_password(self.hash_cost, data.password).await?;
 
+        sqlx::query_as(INSERT_USER_QUERY)
+            .bind(id.into_bytes().as_slice())
+            .bind(now_ms)
+            .bind(now_ms)
+            .bind(permission.bits() as i64)
+            .bind(data.username.as_str())
+            .bind(password_hash.as_str())
+            .fetch_one(&self.db)
+            .await
+            .map_err(|error| create_error(error, data.username))
+    }
+
+    /// Creates an invite that can be redeemed once by
+    /// [`UserRepository::create_with_invite`] until `expires_at`.
+    pub async fn create_invite(
+        &self,
+        created_by: Option<Uuid>,
+        permission: Permission,
+        expires_at: DateTime<Utc>,
+    ) -> Result<Invite, UserError> {
+        let code = Uuid::new_v4().simple().to_string();
+
         sqlx::query_as(
-            "INSERT INTO user \
-            (id, created_at, updated_at, permission, username, password) \
-            VALUES ($1, $2, $3, $4, $5, $6) RETURNING *",
+            "INSERT INTO invite \
+            (code, created_at, expires_at, created_by, permission) \
+            VALUES ($1, $2, $3, $4, $5) RETURNING *",
         )
-        .bind(id.into_bytes().as_slice())
-        .bind(now_ms)
-        .bind(now_ms)
+        .bind(code.as_str())
+        .bind(Utc::now().timestamp_millis())
+        .bind(expires_at.timestamp_millis())
+        .bind(created_by.map(|id| id.into_bytes().to_vec()))
         .bind(permission.bits() as i64)
-        .bind(data.username.as_str())
-        .bind(password_hash.as_str())
         .fetch_one(&self.db)
         .await
         .map_err(|error| {
-            if matches!(
-                &error,
-                sqlx::Error::Database(e) if e.is_unique_violation(),
-            ) {
-                return UserError::AlreadyExists(data.username);
-            }
-
-            tracing::error!(%error, "got sqlx error while creating user");
+            tracing::error!(%error, "got sqlx error while creating invite");
             UserError::Sqlx(error)
         })
     }
 
+    /// Creates a user with the permission granted by the invite `code`,
+    /// consuming it. Both happen atomically, so a failed signup leaves the
+    /// invite usable.
+    pub async fn create_with_invite(
+        &self,
+        code: &str,
+        data: UserData,
+    ) -> Result<User, UserError> {
+        let id = Uuid::new_v4();
+        let now_ms = Utc::now().timestamp_millis();
+
+        let password_hash =
+            hash_password(self.hash_cost, data.password).await?;
+
+        let mut tx = self.db.begin().await.map_err(|error| {
+            tracing::error!(%error, "got sqlx error while beginning transaction");
+            UserError::Sqlx(error)
+        })?;
+
+        let invite: Invite = sqlx::query_as(
+            "UPDATE invite SET used_at = $1, used_by = $2 \
+            WHERE code = $3 AND used_at IS NULL AND expires_at > $1 \
+            RETURNING *",
+        )
+        .bind(now_ms)
+        .bind(Some(id.into_bytes().to_vec()))
+        .bind(code)
+        .fetch_optional(&mut *tx)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while consuming invite");
+            UserError::Sqlx(error)
+        })?
+        .ok_or(UserError::InvalidInvite)?;
+
+        let user = sqlx::query_as(INSERT_USER_QUERY)
+            .bind(id.into_bytes().as_slice())
+            .bind(now_ms)
+            .bind(now_ms)
+            .bind(invite.permission.bits() as i64)
+            .bind(data.username.as_str())
+            .bind(password_hash.as_str())
+            .fetch_one(&mut *tx)
+            .await
+            .map_err(|error| create_error(error, data.username))?;
+
+        tx.commit().await.map_err(|error| {
+            tracing::error!(%error, "got sqlx error while committing user");
+            UserError::Sqlx(error)
+        })?;
+
+        Ok(user)
+    }
+
     pub async fn update_permission(
         &self,
         id: Uuid,
@@ -172,6 +336,31 @@ where
         .ok_or(UserError::NotFound)
     }
 
+    /// Overrides the quota of the role of the user, `None` removes it.
+    pub async fn update_quota(
+        &self,
+        id: Uuid,
+        quota: Option<u64>,
+    ) -> Result<User, UserError> {
+        let now_ms = Utc::now().timestamp_millis();
+        let quota = quota.map(|quota| quota.min(i64::MAX as u64) as i64);
+
+        sqlx::query_as(
+            "UPDATE user SET updated_at = $1, quota = $2 \
+            WHERE id = $3 RETURNING *",
+        )
+        .bind(now_ms)
+        .bind(quota)
+        .bind(id.into_bytes().as_slice())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while updating user");
+            UserError::Sqlx(error)
+        })?
+        .ok_or(UserError::NotFound)
+    }
+
     pub async fn update_password(
         &self,
         id: Uuid,
@@ -197,6 +386,324 @@ where
         .ok_or(UserError::NotFound)
     }
 
+    pub async fn update_username(
+        &self,
+        id: Uuid,
+        username: String,
+    ) -> Result<User, UserError> {
+        let now_ms = Utc::now().timestamp_millis();
+
+        sqlx::query_as(
+            "UPDATE user SET updated_at = $1, username = $2 \
+            WHERE id = $3 RETURNING *",
+        )
+        .bind(now_ms)
+        .bind(username.as_str())
+        .bind(id.into_bytes().as_slice())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| create_error(error, username))?
+        .ok_or(UserError::NotFound)
+    }
+
+    /// Records a login of the user, valid until `expires_at`. The expired
+    /// sessions of the user are removed meanwhile.
+    pub async fn create_session(
+        &self,
+        user_id: Uuid,
+        expires_at: DateTime<Utc>,
+        ip_addr: Option<&str>,
+        user_agent: Option<&str>,
+    ) -> Result<Session, UserError> {
+        let now_ms = Utc::now().timestamp_millis();
+
+        sqlx::query(
+            "DELETE FROM session WHERE user_id = $1 AND expires_at <= $2",
+        )
+        .bind(user_id.into_bytes().as_slice())
+        .bind(now_ms)
+        .execute(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while pruning sessions");
+            UserError::Sqlx(error)
+        })?;
+
+        sqlx::query_as(
+            "INSERT INTO session \
+            (id, user_id, created_at, expires_at, ip_addr, user_agent) \
+            VALUES ($1, $2, $3, $4, $5, $6) RETURNING *",
+        )
+        .bind(Uuid::new_v4().into_bytes().as_slice())
+        .bind(user_id.into_bytes().as_slice())
+        .bind(now_ms)
+        .bind(expires_at.timestamp_millis())
+        .bind(ip_addr)
+        .bind(user_agent)
+        .fetch_one(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while creating session");
+            UserError::Sqlx(error)
+        })
+    }
+
+    /// Lists the sessions of the user that are not expired, from the newest
+    /// to the oldest.
+    pub async fn list_sessions(
+        &self,
+        user_id: Uuid,
+    ) -> Result<Vec<Session>, UserError> {
+        sqlx::query_as(
+            "SELECT * FROM session WHERE user_id = $1 AND expires_at > $2 \
+            ORDER BY created_at DESC",
+        )
+        .bind(user_id.into_bytes().as_slice())
+        .bind(Utc::now().timestamp_millis())
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while listing sessions");
+            UserError::Sqlx(error)
+        })
+    }
+
+    /// Whether the session exists and is not expired, so its tokens are
+    /// still accepted.
+    pub async fn is_session_active(&self, id: Uuid) -> Result<bool, UserError> {
+        let (count,): (i64,) = sqlx::query_as(
+            "SELECT COUNT(*) FROM session WHERE id = $1 AND expires_at > $2",
+        )
+        .bind(id.into_bytes().as_slice())
+        .bind(Utc::now().timestamp_millis())
+        .fetch_one(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while fetching session");
+            UserError::Sqlx(error)
+        })?;
+
+        Ok(count > 0)
+    }
+
+    /// Deletes the session `id` of the user, revoking its tokens.
+    pub async fn delete_session(
+        &self,
+        user_id: Uuid,
+        id: Uuid,
+    ) -> Result<Session, UserError> {
+        sqlx::query_as(
+            "DELETE FROM session WHERE id = $1 AND user_id = $2 RETURNING *",
+        )
+        .bind(id.into_bytes().as_slice())
+        .bind(user_id.into_bytes().as_slice())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while deleting session");
+            UserError::Sqlx(error)
+        })?
+        .ok_or(UserError::SessionNotFound)
+    }
+
+    /// Deletes every session of the user but `keep`, returning the deleted
+    /// ones.
+    pub async fn delete_other_sessions(
+        &self,
+        user_id: Uuid,
+        keep: Option<Uuid>,
+    ) -> Result<Vec<Session>, UserError> {
+        sqlx::query_as(
+            "DELETE FROM session \
+            WHERE user_id = $1 AND ($2 IS NULL OR id != $2) RETURNING *",
+        )
+        .bind(user_id.into_bytes().as_slice())
+        .bind(keep.map(|id| id.into_bytes().to_vec()))
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while deleting sessions");
+            UserError::Sqlx(error)
+        })
+    }
+
+    /// Creates an api key for the user, returning it along with the key
+    /// itself, which is not stored and can't be fetched again.
+    pub async fn create_api_key(
+        &self,
+        user_id: Uuid,
+        name: &str,
+        permission: Permission,
+    ) -> Result<(ApiKey, String), UserError> {
+        let mut secret = [0u8; 32];
+        rand::thread_rng().fill_bytes(&mut secret);
+        let key = format!(
+            "{API_KEY_PREFIX}{}",
+            BASE64_URL_SAFE_NO_PAD.encode(secret),
+        );
+
+        let api_key = sqlx::query_as(
+            "INSERT INTO api_key \
+            (id, user_id, name, key_hash, permission, created_at) \
+            VALUES ($1, $2, $3, $4, $5, $6) RETURNING *",
+        )
+        .bind(Uuid::new_v4().into_bytes().as_slice())
+        .bind(user_id.into_bytes().as_slice())
+        .bind(name)
+        .bind(Sha256::digest(key.as_bytes()).as_slice())
+        .bind(permission.bits() as i64)
+        .bind(Utc::now().timestamp_millis())
+        .fetch_one(&self.db)
+        .await
+        .map_err(|error| {
+            if matches!(
+                &error,
+                sqlx::Error::Database(e) if e.is_foreign_key_violation(),
+            ) {
+                return UserError::NotFound;
+            }
+
+            tracing::error!(%error, "got sqlx error while creating api key");
+            UserError::Sqlx(error)
+        })?;
+
+        Ok((api_key, key))
+    }
+
+    /// Lists the api keys of the user from the newest to the oldest.
+    pub async fn list_api_keys(
+        &self,
+        user_id: Uuid,
+    ) -> Result<Vec<ApiKey>, UserError> {
+        sqlx::query_as(
+            "SELECT * FROM api_key WHERE user_id = $1 \
+            ORDER BY created_at DESC",
+        )
+        .bind(user_id.into_bytes().as_slice())
+        .fetch_all(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while listing api keys");
+            UserError::Sqlx(error)
+        })
+    }
+
+    /// Deletes the api key `id` of the user, revoking it.
+    pub async fn delete_api_key(
+        &self,
+        user_id: Uuid,
+        id: Uuid,
+    ) -> Result<ApiKey, UserError> {
+        sqlx::query_as(
+            "DELETE FROM api_key WHERE id = $1 AND user_id = $2 RETURNING *",
+        )
+        .bind(id.into_bytes().as_slice())
+        .bind(user_id.into_bytes().as_slice())
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while deleting api key");
+            UserError::Sqlx(error)
+        })?
+        .ok_or(UserError::ApiKeyNotFound)
+    }
+
+    /// Fetches the api key matching `key` along with its user, recording
+    /// that it was used. Returns `None` if no key matches.
+    pub async fn authenticate_api_key(
+        &self,
+        key: &str,
+    ) -> Result<Option<(ApiKey, User)>, UserError> {
+        if !key.starts_with(API_KEY_PREFIX) {
+            return Ok(None);
+        }
+
+        let api_key: Option<ApiKey> =
+            sqlx::query_as("SELECT * FROM api_key WHERE key_hash = $1")
+                .bind(Sha256::digest(key.as_bytes()).as_slice())
+                .fetch_optional(&self.db)
+                .await
+                .map_err(|error| {
+                    tracing::error!(
+                        %error,
+                        "got sqlx error while fetching api key",
+                    );
+                    UserError::Sqlx(error)
+                })?;
+
+        let Some(mut api_key) = api_key else {
+            return Ok(None);
+        };
+
+        let now = Utc::now();
+        let stale = api_key
+            .last_used_at
+            .map_or(true, |used| now - used >= API_KEY_USE_PRECISION);
+
+        if stale {
+            sqlx::query("UPDATE api_key SET last_used_at = $1 WHERE id = $2")
+                .bind(now.timestamp_millis())
+                .bind(api_key.id.into_bytes().as_slice())
+                .execute(&self.db)
+                .await
+                .map_err(|error| {
+                    tracing::error!(
+                        %error,
+                        "got sqlx error while updating api key",
+                    );
+                    UserError::Sqlx(error)
+                })?;
+
+            api_key.last_used_at =
+                DateTime::from_timestamp_millis(now.timestamp_millis());
+        }
+
+        let user = self.get(api_key.user_id).await?;
+        Ok(Some((api_key, user)))
+    }
+
+    /// Records that every token issued before `at` is revoked, never moving
+    /// it back.
+    pub async fn revoke_tokens_before(
+        &self,
+        at: DateTime<Utc>,
+    ) -> Result<(), UserError> {
+        sqlx::query(
+            "INSERT INTO token_revocation (id, revoked_before) VALUES (0, $1) \
+            ON CONFLICT (id) DO UPDATE \
+            SET revoked_before = MAX(revoked_before, excluded.revoked_before)",
+        )
+        .bind(at.timestamp_millis())
+        .execute(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(%error, "got sqlx error while revoking tokens");
+            UserError::Sqlx(error)
+        })?;
+
+        Ok(())
+    }
+
+    /// The time tokens issued before it are revoked, if they ever were.
+    pub async fn tokens_revoked_before(
+        &self,
+    ) -> Result<Option<DateTime<Utc>>, UserError> {
+        let row: Option<(i64,)> = sqlx::query_as(
+            "SELECT revoked_before FROM token_revocation WHERE id = 0",
+        )
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|error| {
+            tracing::error!(
+                %error,
+                "got sqlx error while fetching token revocation",
+            );
+            UserError::Sqlx(error)
+        })?;
+
+        Ok(row.and_then(|(ms,)| DateTime::from_timestamp_millis(ms)))
+    }
+
     pub async fn delete(&self, id: Uuid) -> Result<User, UserError> {
         sqlx::query_as("DELETE FROM user WHERE id = $1 RETURNING *")
             .bind(id.into_bytes().as_slice())
@@ -210,6 +717,48 @@ where
     }
 }
 
+/// Escapes the LIKE wildcards of `s`, using `\` as the escape character.
+fn escape_like(s: &str) -> String {
+    let mut escaped = String::with_capacity(s.len());
+    for c in s.chars() {
+        if matches!(c, '%' | '_' | '\\') {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+fn create_error(error: sqlx::Error, username: String) -> UserError {
+    if matches!(
+        &error,
+        sqlx::Error::Database(e) if e.is_unique_violation(),
+    ) {
+        return UserError::AlreadyExists(username);
+    }
+
+    tracing::error!(%error, "got sqlx error while creating user");
+    UserError::Sqlx(error)
+}
+
+/// Finds the highest bcrypt cost whose hash takes at most `target` on this
+/// host, never going below the minimum cost. Blocks while benchmarking.
+pub fn calibrate_hash_cost(target: Duration) -> u32 {
+    let mut cost = *HASH_COST_RANGE.start();
+
+    loop {
+        let start = Instant::now();
+        let _ = bcrypt::hash("calibrate-hash-cost", cost);
+        let elapsed = start.elapsed();
+
+        // Each cost increment doubles the hashing time
+        if cost == *HASH_COST_RANGE.end() || elapsed * 2 > target {
+            return cost;
+        }
+        cost += 1;
+    }
+}
+
 async fn hash_password(
     cost: u32,
     password: String,
@@ -256,16 +805,21 @@ async fn verify_password(
 
 #[cfg(test)]
 mod tests {
+    use std::time::Duration;
+
+    use axum::http::StatusCode;
+    use chrono::{DateTime, TimeDelta, Utc};
     use sqlx::{migrate, Sqlite, SqlitePool};
     use test_log::test;
     use uuid::Uuid;
 
     use crate::{
         auth::Permission,
-        user::{UserData, UserError},
+        config::UserRole,
+        user::{UserData, UserError, UserFilter, HASH_COST_RANGE, MAX_LIMIT},
     };
 
-    use super::UserRepository;
+    use super::{calibrate_hash_cost, UserRepository, API_KEY_PREFIX};
 
     fn rand_string() -> String {
         Uuid::new_v4().to_string()
@@ -329,6 +883,207 @@ mod tests {
         )
     }
 
+    #[test(tokio::test)]
+    async fn test_username_case_insensitive() {
+        let repo = repository().await;
+
+        let data = UserData {
+            username: "Foo.Bar".into(),
+            password: rand_string(),
+        };
+        let user = repo.create(Permission::ADMIN, data.clone()).await.unwrap();
+        assert_eq!(user.username, "Foo.Bar", "username case not preserved");
+
+        let mut lower = data.clone();
+        lower.username = "foo.bar".into();
+
+        let res = repo.create(Permission::ADMIN, lower.clone()).await;
+        assert!(
+            matches!(res, Err(UserError::AlreadyExists(..))),
+            "expected error while creating user differing only by case",
+        );
+
+        let fetched_user = repo
+            .authenticate(lower)
+            .await
+            .expect("failed to authenticate with a differently cased name");
+        assert_eq!(
+            user, fetched_user,
+            "fetched user mismatches the created one",
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_create_error() {
+        let repo = repository().await;
+
+        let data = rand_data();
+        repo.create(Permission::ADMIN, data.clone()).await.unwrap();
+
+        let res = repo.create(Permission::ADMIN, data.clone()).await;
+        let Err(error) = res else {
+            panic!("created a user with a duplicated username");
+        };
+        assert!(matches!(error, UserError::AlreadyExists(..)));
+        assert_eq!(error.status_code(), StatusCode::CONFLICT);
+
+        // Failures other than the conflict are not reported as one
+        repo.db.close().await;
+        let res = repo.create(Permission::ADMIN, rand_data()).await;
+        let Err(error) = res else {
+            panic!("created a user with the database closed");
+        };
+        assert!(
+            matches!(error, UserError::Sqlx(..)),
+            "expected sqlx error, got {error:?}",
+        );
+        assert_eq!(error.status_code(), StatusCode::SERVICE_UNAVAILABLE);
+    }
+
+    #[test(tokio::test)]
+    async fn test_list() {
+        let repo = repository().await;
+
+        let mut created = Vec::new();
+        for (username, permission) in [
+            ("alice", Permission::ADMIN),
+            ("bob", Permission::UNPRIVILEGED),
+            ("Alicia", Permission::UNPRIVILEGED),
+            ("al_x", Permission::UNPRIVILEGED),
+        ] {
+            let data = UserData {
+                username: username.into(),
+                password: rand_string(),
+            };
+            created.push(repo.create(permission, data).await.unwrap());
+        }
+
+        let (users, total) =
+            repo.list(2, 1, &UserFilter::default()).await.unwrap();
+        assert_eq!(total, 4);
+        assert_eq!(users, created[1..3], "page mismatches the created users");
+
+        let filter = UserFilter {
+            search: Some("ALI".into()),
+            ..Default::default()
+        };
+        let (users, total) = repo.list(10, 0, &filter).await.unwrap();
+        assert_eq!(total, 2);
+        assert_eq!(users, [created[0].clone(), created[2].clone()]);
+
+        // `_` must not match any character
+        let filter = UserFilter {
+            search: Some("l_".into()),
+            ..Default::default()
+        };
+        let (users, _) = repo.list(10, 0, &filter).await.unwrap();
+        assert_eq!(users, [created[3].clone()]);
+
+        let filter = UserFilter {
+            search: Some("ali".into()),
+            role: Some(UserRole::Unprivileged),
+        };
+        let (users, total) = repo.list(10, 0, &filter).await.unwrap();
+        assert_eq!(total, 1);
+        assert_eq!(users, [created[2].clone()]);
+
+        let filter = UserFilter {
+            role: Some(UserRole::Admin),
+            ..Default::default()
+        };
+        let (users, _) = repo.list(10, 0, &filter).await.unwrap();
+        assert_eq!(users, [created[0].clone()]);
+
+        let res = repo.list(MAX_LIMIT + 1, 0, &UserFilter::default()).await;
+        assert!(
+            matches!(res, Err(UserError::LimitOutOfRange(..))),
+            "expected error while listing beyond the maximum limit",
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_create_with_invite() {
+        let repo = repository().await;
+
+        let invite = repo
+            .create_invite(
+                None,
+                Permission::UNPRIVILEGED,
+                Utc::now() + TimeDelta::hours(1),
+            )
+            .await
+            .unwrap();
+        assert!(invite.used_at.is_none(), "new invite marked as used");
+
+        let user = repo
+            .create_with_invite(&invite.code, rand_data())
+            .await
+            .expect("failed to sign up with a valid invite");
+        assert_eq!(
+            user.permission, invite.permission,
+            "user permission differs from the invite one",
+        );
+
+        let res = repo.create_with_invite(&invite.code, rand_data()).await;
+        assert!(
+            matches!(res, Err(UserError::InvalidInvite)),
+            "expected error while reusing an invite",
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_create_with_invite_expired() {
+        let repo = repository().await;
+
+        let invite = repo
+            .create_invite(
+                None,
+                Permission::UNPRIVILEGED,
+                Utc::now() - TimeDelta::seconds(1),
+            )
+            .await
+            .unwrap();
+
+        let res = repo.create_with_invite(&invite.code, rand_data()).await;
+        assert!(
+            matches!(res, Err(UserError::InvalidInvite)),
+            "expected error while using an expired invite",
+        );
+
+        let res = repo.create_with_invite("unknown", rand_data()).await;
+        assert!(
+            matches!(res, Err(UserError::InvalidInvite)),
+            "expected error while using an unknown invite",
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_create_with_invite_conflict() {
+        let repo = repository().await;
+
+        let data = rand_data();
+        repo.create(Permission::ADMIN, data.clone()).await.unwrap();
+
+        let invite = repo
+            .create_invite(
+                None,
+                Permission::UNPRIVILEGED,
+                Utc::now() + TimeDelta::hours(1),
+            )
+            .await
+            .unwrap();
+
+        let res = repo.create_with_invite(&invite.code, data).await;
+        assert!(
+            matches!(res, Err(UserError::AlreadyExists(..))),
+            "expected error while signing up with a taken username",
+        );
+
+        repo.create_with_invite(&invite.code, rand_data())
+            .await
+            .expect("failed signup must not consume the invite");
+    }
+
     #[test(tokio::test)]
     async fn test_update_permission() {
         let repo = repository().await;
@@ -361,6 +1116,24 @@ mod tests {
         );
     }
 
+    #[test(tokio::test)]
+    async fn test_update_quota() {
+        let repo = repository().await;
+
+        let user = repo.create(Permission::ADMIN, rand_data()).await.unwrap();
+        assert_eq!(user.quota, None);
+
+        let user = repo.update_quota(user.id, Some(1024)).await.unwrap();
+        assert_eq!(user.quota, Some(1024));
+        assert_eq!(repo.get(user.id).await.unwrap().quota, Some(1024));
+
+        let user = repo.update_quota(user.id, None).await.unwrap();
+        assert_eq!(user.quota, None);
+
+        let res = repo.update_quota(Uuid::new_v4(), Some(1)).await;
+        assert!(matches!(res, Err(UserError::NotFound)));
+    }
+
     #[test(tokio::test)]
     async fn test_update_password() {
         let repo = repository().await;
@@ -406,6 +1179,43 @@ mod tests {
         );
     }
 
+    #[test(tokio::test)]
+    async fn test_update_username() {
+        let repo = repository().await;
+
+        let data = rand_data();
+        let user = repo.create(Permission::ADMIN, data.clone()).await.unwrap();
+        let other = repo.create(Permission::ADMIN, rand_data()).await.unwrap();
+
+        let new_username = rand_string();
+        let updated_user = repo
+            .update_username(user.id, new_username.clone())
+            .await
+            .unwrap();
+        assert_eq!(updated_user.username, new_username);
+        assert!(updated_user.updated_at >= user.updated_at);
+
+        let mut data = data;
+        data.username = new_username;
+        repo.authenticate(data)
+            .await
+            .expect("failed to authenticate with the new username");
+
+        let res = repo
+            .update_username(user.id, other.username.to_uppercase())
+            .await;
+        assert!(
+            matches!(res, Err(UserError::AlreadyExists(..))),
+            "expected error while taking the username of another user",
+        );
+
+        let res = repo.update_username(Uuid::new_v4(), rand_string()).await;
+        assert!(
+            matches!(res, Err(UserError::NotFound)),
+            "expected error while updating an unknown user",
+        );
+    }
+
     #[test(tokio::test)]
     async fn test_delete() {
         let repo = repository().await;
@@ -431,4 +1241,130 @@ mod tests {
             "expected not found error while fetching deleted user",
         );
     }
+
+    #[test(tokio::test)]
+    async fn test_sessions() {
+        let repo = repository().await;
+        let user = repo.create(Permission::ADMIN, rand_data()).await.unwrap();
+        let expires_at = Utc::now() + TimeDelta::hours(1);
+
+        let first = repo
+            .create_session(user.id, expires_at, Some("127.0.0.1"), None)
+            .await
+            .unwrap();
+        let second = repo
+            .create_session(user.id, expires_at, None, Some("curl/8.0"))
+            .await
+            .unwrap();
+        let third = repo
+            .create_session(user.id, expires_at, None, None)
+            .await
+            .unwrap();
+        let expired = repo
+            .create_session(user.id, Utc::now(), None, None)
+            .await
+            .unwrap();
+
+        assert_eq!(first.ip_addr.as_deref(), Some("127.0.0.1"));
+        assert_eq!(second.user_agent.as_deref(), Some("curl/8.0"));
+        assert!(repo.is_session_active(first.id).await.unwrap());
+        assert!(!repo.is_session_active(expired.id).await.unwrap());
+
+        let mut sessions = repo.list_sessions(user.id).await.unwrap();
+        sessions.sort_by_key(|session| session.id);
+        let mut expected = vec![first.clone(), second.clone(), third.clone()];
+        expected.sort_by_key(|session| session.id);
+        assert_eq!(sessions, expected);
+
+        let res = repo.delete_session(Uuid::new_v4(), first.id).await;
+        assert!(
+            matches!(res, Err(UserError::SessionNotFound)),
+            "deleted the session of another user",
+        );
+
+        repo.delete_session(user.id, first.id).await.unwrap();
+        assert!(!repo.is_session_active(first.id).await.unwrap());
+
+        let deleted = repo
+            .delete_other_sessions(user.id, Some(third.id))
+            .await
+            .unwrap();
+        assert!(deleted.iter().any(|session| session.id == second.id));
+        assert!(!repo.is_session_active(second.id).await.unwrap());
+        assert!(repo.is_session_active(third.id).await.unwrap());
+
+        // Removed along with the user
+        repo.delete(user.id).await.unwrap();
+        assert!(!repo.is_session_active(third.id).await.unwrap());
+    }
+
+    #[test(tokio::test)]
+    async fn test_api_keys() {
+        let repo = repository().await;
+        let user = repo.create(Permission::ADMIN, rand_data()).await.unwrap();
+
+        let (first, key) = repo
+            .create_api_key(user.id, "backup script", Permission::READ_ALL)
+            .await
+            .unwrap();
+        let (second, _) = repo
+            .create_api_key(user.id, "ci", Permission::ADMIN)
+            .await
+            .unwrap();
+
+        assert!(key.starts_with(API_KEY_PREFIX));
+        assert_eq!(first.name, "backup script");
+        assert_eq!(first.permission, Permission::READ_ALL);
+        assert_eq!(first.last_used_at, None);
+
+        let mut keys = repo.list_api_keys(user.id).await.unwrap();
+        keys.sort_by_key(|key| key.id);
+        let mut expected = vec![first.clone(), second.clone()];
+        expected.sort_by_key(|key| key.id);
+        assert_eq!(keys, expected);
+
+        let (api_key, fetched) =
+            repo.authenticate_api_key(&key).await.unwrap().unwrap();
+        assert_eq!(api_key.id, first.id);
+        assert!(api_key.last_used_at.is_some());
+        assert_eq!(fetched, user);
+
+        let bad_key = format!("{API_KEY_PREFIX}nope");
+        assert!(repo.authenticate_api_key(&bad_key).await.unwrap().is_none());
+
+        let res = repo.delete_api_key(Uuid::new_v4(), first.id).await;
+        assert!(
+            matches!(res, Err(UserError::ApiKeyNotFound)),
+            "deleted the api key of another user",
+        );
+
+        repo.delete_api_key(user.id, first.id).await.unwrap();
+        assert!(repo.authenticate_api_key(&key).await.unwrap().is_none());
+
+        // Removed along with the user
+        repo.delete(user.id).await.unwrap();
+        assert!(repo.list_api_keys(user.id).await.unwrap().is_empty());
+    }
+
+    #[test(tokio::test)]
+    async fn test_token_revocation() {
+        let repo = repository().await;
+        assert_eq!(repo.tokens_revoked_before().await.unwrap(), None);
+
+        let at = DateTime::from_timestamp_millis(Utc::now().timestamp_millis())
+            .unwrap();
+        repo.revoke_tokens_before(at).await.unwrap();
+        repo.revoke_tokens_before(at - TimeDelta::hours(1))
+            .await
+            .unwrap();
+        assert_eq!(repo.tokens_revoked_before().await.unwrap(), Some(at));
+    }
+
+    #[test]
+    fn test_calibrate_hash_cost() {
+        assert_eq!(calibrate_hash_cost(Duration::ZERO), 4);
+
+        let cost = calibrate_hash_cost(Duration::from_millis(50));
+        assert!(HASH_COST_RANGE.contains(&cost));
+    }
 }
@@ -1,27 +1,118 @@
-use axum::{extract::Path, routing, Extension, Router};
-use serde::Deserialize;
+use axum::{
+    extract::{Path, Query},
+    Extension,
+};
+use serde::{Deserialize, Serialize};
 use sqlx::Sqlite;
 use uuid::Uuid;
 
 use crate::{
     auth::{axum::Authorization, AuthError, Permission, Token},
-    errors::DownloaderError,
-    utils::extractors::Json,
+    config::{RoutesConfig, UserRole},
+    errors::{DownloaderError, ValidationError},
+    utils::{
+        extractors::Json,
+        openapi::{ApiRouter, Content, RouteSpec, Schema},
+    },
+};
+
+use super::{
+    repository::UserRepository, validate_password, validate_username, User,
+    UserData, UserFilter,
 };
 
-use super::{repository::UserRepository, User};
+const LIST_USERS: RouteSpec = RouteSpec::get("/", "Lists the users")
+    .auth()
+    .query(Schema::of::<ListUsersQueryData>())
+    .response(Content::Json(Schema::Named("ListUsersResponseData")))
+    .errors(&[3006, 3008, 4009]);
+const GET_SELF: RouteSpec =
+    RouteSpec::get("/self", "Gets the user of the token")
+        .auth()
+        .response(Content::Json(Schema::of::<User>()))
+        .errors(&[3001, 3006, 4009]);
+const UPDATE_SELF: RouteSpec =
+    RouteSpec::patch("/self", "Updates the username or password")
+        .auth()
+        .request(Content::Json(Schema::of::<UpdateSelfRequestData>()))
+        .response(Content::Json(Schema::of::<User>()))
+        .errors(&[3001, 3002, 3003, 3004, 3005, 3006, 4009, 5001]);
+const GET_USER: RouteSpec = RouteSpec::get("/:id", "Gets a user")
+    .auth()
+    .response(Content::Json(Schema::of::<User>()))
+    .errors(&[3001, 3006, 4009]);
+const UPDATE_USER_PASSWORD: RouteSpec =
+    RouteSpec::put("/:id/password", "Sets the password of a user")
+        .auth()
+        .request(Content::Json(Schema::of::<UpdatePasswordRequestData>()))
+        .response(Content::Json(Schema::of::<User>()))
+        .errors(&[3001, 3004, 3006, 4009, 5001]);
+const UPDATE_USER_PERMISSION: RouteSpec =
+    RouteSpec::put("/:id/permission", "Sets the permission of a user")
+        .auth()
+        .request(Content::Json(Schema::of::<UpdatePermissionRequestData>()))
+        .response(Content::Json(Schema::of::<User>()))
+        .errors(&[3001, 3006, 4009, 4010]);
+const UPDATE_USER_QUOTA: RouteSpec =
+    RouteSpec::put("/:id/quota", "Sets the storage quota of a user")
+        .auth()
+        .request(Content::Json(Schema::of::<UpdateQuotaRequestData>()))
+        .response(Content::Json(Schema::of::<User>()))
+        .errors(&[3001, 3006, 4009]);
+const DELETE_SELF: RouteSpec =
+    RouteSpec::delete("/self", "Deletes the user of the token")
+        .auth()
+        .response(Content::Json(Schema::of::<User>()))
+        .errors(&[3001, 3006, 4009]);
+const DELETE_USER: RouteSpec = RouteSpec::delete("/:id", "Deletes a user")
+    .auth()
+    .response(Content::Json(Schema::of::<User>()))
+    .errors(&[3001, 3006, 4009]);
 
-pub fn user_routes<S>(router: Router<S>) -> Router<S>
+pub fn user_routes<S>(api: ApiRouter<S>, routes: &RoutesConfig) -> ApiRouter<S>
 where
     S: Clone + Send + Sync + 'static,
 {
-    router
-        .route("/self", routing::get(get_self))
-        .route("/:id", routing::get(get_user))
-        .route("/:id/password", routing::put(update_user_password))
-        .route("/:id/permission", routing::put(update_user_permission))
-        .route("/self", routing::delete(delete_self))
-        .route("/:id", routing::delete(delete_user))
+    let mut api = api
+        .route(LIST_USERS, list_users)
+        .route(GET_SELF, get_self)
+        .route(UPDATE_SELF, update_self)
+        .route(GET_USER, get_user)
+        .route(UPDATE_USER_PASSWORD, update_user_password)
+        .route(UPDATE_USER_PERMISSION, update_user_permission)
+        .route(UPDATE_USER_QUOTA, update_user_quota);
+
+    if routes.delete {
+        api = api
+            .route(DELETE_SELF, delete_self)
+            .route(DELETE_USER, delete_user);
+    } else {
+        api = api.disabled(DELETE_SELF).disabled(DELETE_USER);
+    }
+
+    api
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ListUsersQueryData {
+    #[serde(default = "default_pagination_limit")]
+    pub limit: u32,
+    #[serde(default)]
+    pub offset: u32,
+    pub search: Option<String>,
+    pub role: Option<UserRole>,
+}
+
+const fn default_pagination_limit() -> u32 {
+    100
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct ListUsersResponseData {
+    pub users: Vec<User>,
+    /// How many users match the filters, ignoring the pagination.
+    pub total: u64,
 }
 
 #[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
@@ -29,11 +120,46 @@ pub struct UpdatePasswordRequestData {
     pub password: String,
 }
 
+/// Fields left out are kept as they are. The current password is required
+/// since the username is used to sign in.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct UpdateSelfRequestData {
+    pub username: Option<String>,
+    pub password: String,
+}
+
 #[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
 pub struct UpdatePermissionRequestData {
     pub permission: Permission,
 }
 
+/// A `null` quota makes the user fall back to the quota of its role, while
+/// zero lets it store as much as it wants.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+pub struct UpdateQuotaRequestData {
+    pub quota: Option<u64>,
+}
+
+pub async fn list_users(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Query(data): Query<ListUsersQueryData>,
+) -> Result<Json<ListUsersResponseData>, DownloaderError> {
+    if !token.permission().contains(Permission::ADMIN) {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    let filter = UserFilter {
+        search: data.search,
+        role: data.role,
+    };
+    let (users, total) =
+        user_repo.list(data.limit, data.offset, &filter).await?;
+
+    Ok(Json(ListUsersResponseData { users, total }))
+}
+
 pub async fn get_self(
     Authorization(token): Authorization,
     ext: Extension<UserRepository<Sqlite>>,
@@ -46,6 +172,38 @@ pub async fn get_self(
     get_user(Authorization(Token::Server), ext, Path(id)).await
 }
 
+pub async fn update_self(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Json(data): Json<UpdateSelfRequestData>,
+) -> Result<Json<User>, DownloaderError> {
+    let id = match token {
+        Token::User(user_token) => user_token.user_id,
+        _ => return Err(AuthError::AccessDenied.into()),
+    };
+
+    let mut violations = Vec::new();
+    if let Some(username) = &data.username {
+        validate_username("username", username, &mut violations);
+    }
+    ValidationError::check(violations)?;
+
+    // The username of the token may be outdated
+    let user = user_repo.get(id).await?;
+    let mut user = user_repo
+        .authenticate(UserData {
+            username: user.username,
+            password: data.password,
+        })
+        .await?;
+
+    if let Some(username) = data.username {
+        user = user_repo.update_username(id, username).await?;
+    }
+
+    Ok(Json(user))
+}
+
 pub async fn get_user(
     Authorization(token): Authorization,
     Extension(user_repo): Extension<UserRepository<Sqlite>>,
@@ -55,7 +213,7 @@ pub async fn get_user(
         Token::User(user_token) => {
             user_token.user_id == id || token.can_read_users()
         }
-        Token::File(_) => token.can_read_users(),
+        Token::File(_) | Token::Service(_) => token.can_read_users(),
         Token::Server => true,
     };
 
@@ -77,6 +235,10 @@ pub async fn update_user_password(
         return Err(AuthError::AccessDenied.into());
     }
 
+    let mut violations = Vec::new();
+    validate_password("password", &data.password, &mut violations);
+    ValidationError::check(violations)?;
+
     let user = user_repo.update_password(id, data.password).await?;
     Ok(Json(user))
 }
@@ -95,6 +257,20 @@ pub async fn update_user_permission(
     Ok(Json(user))
 }
 
+pub async fn update_user_quota(
+    Authorization(token): Authorization,
+    Extension(user_repo): Extension<UserRepository<Sqlite>>,
+    Path(id): Path<Uuid>,
+    Json(data): Json<UpdateQuotaRequestData>,
+) -> Result<Json<User>, DownloaderError> {
+    if !token.can_write_users() {
+        return Err(AuthError::AccessDenied.into());
+    }
+
+    let user = user_repo.update_quota(id, data.quota).await?;
+    Ok(Json(user))
+}
+
 pub async fn delete_self(
     Authorization(token): Authorization,
     Extension(user_repo): Extension<UserRepository<Sqlite>>,
@@ -0,0 +1,169 @@
+use std::{fmt, net::SocketAddr};
+
+use axum::{
+    extract::{ConnectInfo, Request},
+    http::{header, HeaderMap, Method, StatusCode, Version},
+    middleware::Next,
+    response::Response,
+};
+use chrono::{DateTime, Utc};
+
+/// What is known about a request once it was answered, formatted as a NCSA
+/// Combined Log Format line.
+#[derive(Debug, Clone)]
+pub struct RequestInfo {
+    pub remote_addr: Option<SocketAddr>,
+    pub time: DateTime<Utc>,
+    pub method: Method,
+    pub path: String,
+    pub version: Version,
+    pub status: StatusCode,
+    pub size: Option<u64>,
+    pub referer: Option<String>,
+    pub user_agent: Option<String>,
+}
+
+impl fmt::Display for RequestInfo {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.remote_addr {
+            Some(addr) => write!(f, "{}", addr.ip())?,
+            None => f.write_str("-")?,
+        }
+
+        write!(
+            f,
+            " - - [{}] \"{} {} {:?}\" {} ",
+            self.time.format("%d/%b/%Y:%H:%M:%S %z"),
+            self.method,
+            Escaped(&self.path),
+            self.version,
+            self.status.as_u16(),
+        )?;
+
+        match self.size {
+            Some(size) => write!(f, "{size}")?,
+            None => f.write_str("-")?,
+        }
+
+        write!(
+            f,
+            " \"{}\" \"{}\"",
+            Escaped(self.referer.as_deref().unwrap_or("-")),
+            Escaped(self.user_agent.as_deref().unwrap_or("-")),
+        )
+    }
+}
+
+/// Escapes quotes, backslashes and control characters so a field can not
+/// break the line apart.
+struct Escaped<'a>(&'a str);
+
+impl fmt::Display for Escaped<'_> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for c in self.0.chars() {
+            match c {
+                '"' => f.write_str("\\\"")?,
+                '\\' => f.write_str("\\\\")?,
+                c if c.is_control() => write!(f, "\\x{:02x}", c as u32)?,
+                c => write!(f, "{c}")?,
+            }
+        }
+        Ok(())
+    }
+}
+
+fn header_string(
+    headers: &HeaderMap,
+    name: header::HeaderName,
+) -> Option<String> {
+    headers
+        .get(name)
+        .map(|value| String::from_utf8_lossy(value.as_bytes()).into_owned())
+}
+
+/// Middleware that logs every request in the Combined Log Format, under the
+/// `access_log` target.
+pub async fn combined_access_log(req: Request, next: Next) -> Response {
+    let remote_addr = req
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|info| info.0);
+    let time = Utc::now();
+    let method = req.method().clone();
+    // The query is left out since it may carry file tokens
+    let path = req.uri().path().to_owned();
+    let version = req.version();
+    let referer = header_string(req.headers(), header::REFERER);
+    let user_agent = header_string(req.headers(), header::USER_AGENT);
+
+    let res = next.run(req).await;
+
+    let size = res
+        .headers()
+        .get(header::CONTENT_LENGTH)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.parse().ok());
+
+    let info = RequestInfo {
+        remote_addr,
+        time,
+        method,
+        path,
+        version,
+        status: res.status(),
+        size,
+        referer,
+        user_agent,
+    };
+    tracing::info!(target: "access_log", "{info}");
+
+    res
+}
+
+#[cfg(test)]
+mod tests {
+    use axum::http::{Method, StatusCode, Version};
+    use chrono::{TimeZone, Utc};
+
+    use super::RequestInfo;
+
+    fn info() -> RequestInfo {
+        RequestInfo {
+            remote_addr: Some("127.0.0.1:4000".parse().unwrap()),
+            time: Utc.with_ymd_and_hms(2000, 10, 10, 13, 55, 36).unwrap(),
+            method: Method::GET,
+            path: "/api/file/1/data".into(),
+            version: Version::HTTP_11,
+            status: StatusCode::OK,
+            size: Some(2326),
+            referer: Some("http://example.com/".into()),
+            user_agent: Some("curl/8.0".into()),
+        }
+    }
+
+    #[test]
+    fn test_combined_format() {
+        assert_eq!(
+            info().to_string(),
+            "127.0.0.1 - - [10/Oct/2000:13:55:36 +0000] \
+            \"GET /api/file/1/data HTTP/1.1\" 200 2326 \
+            \"http://example.com/\" \"curl/8.0\"",
+        );
+    }
+
+    #[test]
+    fn test_combined_format_missing() {
+        let mut info = info();
+        info.remote_addr = None;
+        info.size = None;
+        info.referer = None;
+        info.user_agent = Some("evil\" \"agent\n".into());
+
+        assert_eq!(
+            info.to_string(),
+            "- - - [10/Oct/2000:13:55:36 +0000] \
+            \"GET /api/file/1/data HTTP/1.1\" 200 - \
+            \"-\" \"evil\\\" \\\"agent\\x0a\"",
+        );
+    }
+}
@@ -0,0 +1,400 @@
+use std::{
+    fmt::Display,
+    io,
+    net::{IpAddr, SocketAddr},
+    path::Path,
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Arc, Mutex as StdMutex,
+    },
+};
+
+use axum::extract::ConnectInfo;
+use chrono::{DateTime, Utc};
+use futures_util::future::BoxFuture;
+use serde::{Deserialize, Serialize};
+use tokio::{
+    fs::{File, OpenOptions},
+    io::AsyncWriteExt,
+    select,
+    sync::{
+        mpsc::{self, error::TrySendError},
+        Mutex, Notify,
+    },
+    task::JoinHandle,
+};
+use uuid::Uuid;
+
+use crate::auth::Token;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AuditAction {
+    Signin,
+    Signup,
+    IssueToken,
+    ReadFile,
+    DeleteFile,
+    TransferFile,
+    RotateKey,
+    RevokeSession,
+    SetMaintenance,
+    CreateApiKey,
+    RevokeApiKey,
+    RevokeAllTokens,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AuditOutcome {
+    Success,
+    Failure,
+}
+
+/// Who performed an audited action.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct Actor {
+    pub user_id: Option<Uuid>,
+    pub ip: Option<IpAddr>,
+}
+
+impl Actor {
+    pub fn new(
+        token: Option<&Token>,
+        connect_info: Option<&ConnectInfo<SocketAddr>>,
+    ) -> Self {
+        Self {
+            user_id: match token {
+                Some(Token::User(user_token)) => Some(user_token.user_id),
+                _ => None,
+            },
+            ip: connect_info.map(|ConnectInfo(addr)| addr.ip()),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct AuditEvent {
+    pub time: DateTime<Utc>,
+    pub action: AuditAction,
+    pub actor_id: Option<Uuid>,
+    pub actor_ip: Option<IpAddr>,
+    /// The file or user acted upon.
+    pub target: Option<Uuid>,
+    /// The username given to sign in or up, kept even if it doesn't exist.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub username: Option<String>,
+    pub outcome: AuditOutcome,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl AuditEvent {
+    pub fn new<T, E: Display>(
+        action: AuditAction,
+        actor: Actor,
+        target: Option<Uuid>,
+        result: &Result<T, E>,
+    ) -> Self {
+        let (outcome, error) = match result {
+            Ok(..) => (AuditOutcome::Success, None),
+            Err(error) => (AuditOutcome::Failure, Some(error.to_string())),
+        };
+
+        Self {
+            time: Utc::now(),
+            action,
+            actor_id: actor.user_id,
+            actor_ip: actor.ip,
+            target,
+            username: None,
+            outcome,
+            error,
+        }
+    }
+
+    pub fn with_username(mut self, username: impl Into<String>) -> Self {
+        self.username = Some(username.into());
+        self
+    }
+}
+
+/// Where the audit events are kept. Events must only ever be appended.
+pub trait AuditSink: Send + Sync {
+    fn write<'a>(
+        &'a self,
+        event: &'a AuditEvent,
+    ) -> BoxFuture<'a, io::Result<()>>;
+}
+
+/// Appends the events to a file, one JSON object per line.
+pub struct FileAuditSink {
+    file: Mutex<File>,
+}
+
+impl FileAuditSink {
+    pub async fn open(path: impl AsRef<Path>) -> io::Result<Self> {
+        let file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .await?;
+
+        Ok(Self {
+            file: Mutex::new(file),
+        })
+    }
+}
+
+impl AuditSink for FileAuditSink {
+    fn write<'a>(
+        &'a self,
+        event: &'a AuditEvent,
+    ) -> BoxFuture<'a, io::Result<()>> {
+        Box::pin(async move {
+            let mut line = serde_json::to_vec(event)?;
+            line.push(b'\n');
+
+            let mut file = self.file.lock().await;
+            file.write_all(&line).await?;
+            file.sync_data().await
+        })
+    }
+}
+
+/// Records the audit events to a sink, in the order they happened, without
+/// making the requests wait for it.
+#[derive(Clone, Default)]
+pub struct AuditLogger {
+    inner: Option<Arc<Inner>>,
+}
+
+struct Inner {
+    sender: mpsc::Sender<AuditEvent>,
+    /// Events that didn't fit in the queue.
+    dropped: AtomicU64,
+    close: Arc<Notify>,
+    writer: StdMutex<Option<JoinHandle<()>>>,
+}
+
+impl AuditLogger {
+    /// A logger that drops every event.
+    pub fn disabled() -> Self {
+        Self::default()
+    }
+
+    /// Writes the events to `sink`, holding at most `queue_size` of them
+    /// while it is busy.
+    pub fn new(sink: impl AuditSink + 'static, queue_size: usize) -> Self {
+        let (sender, mut receiver) = mpsc::channel::<AuditEvent>(queue_size);
+        let close = Arc::new(Notify::new());
+
+        let writer = tokio::spawn({
+            let close = close.clone();
+            async move {
+                loop {
+                    let event = select! {
+                        event = receiver.recv() => event,
+                        _ = close.notified() => {
+                            // The queued events are still received
+                            receiver.close();
+                            continue;
+                        }
+                    };
+                    let Some(event) = event else {
+                        break;
+                    };
+
+                    if let Err(error) = sink.write(&event).await {
+                        tracing::error!(
+                            target: "audit",
+                            %error,
+                            ?event,
+                            "failed to write audit event",
+                        );
+                    }
+                }
+            }
+        });
+
+        Self {
+            inner: Some(Arc::new(Inner {
+                sender,
+                dropped: AtomicU64::new(0),
+                close,
+                writer: StdMutex::new(Some(writer)),
+            })),
+        }
+    }
+
+    /// Queues `event` to be written. If the queue is full or the logger was
+    /// closed, the event is logged instead, so it is never lost silently.
+    pub fn record(&self, event: AuditEvent) {
+        let Some(inner) = &self.inner else {
+            return;
+        };
+
+        match inner.sender.try_send(event) {
+            Ok(()) => {}
+            Err(TrySendError::Full(event)) => {
+                let dropped = inner.dropped.fetch_add(1, Ordering::Relaxed) + 1;
+                tracing::error!(
+                    target: "audit",
+                    dropped,
+                    ?event,
+                    "audit queue is full, event not written",
+                );
+            }
+            Err(TrySendError::Closed(event)) => {
+                tracing::error!(
+                    target: "audit",
+                    ?event,
+                    "audit sink task is closed",
+                );
+            }
+        }
+    }
+
+    /// Stops accepting events and waits until the queued ones are written.
+    pub async fn close(&self) {
+        let Some(inner) = &self.inner else {
+            return;
+        };
+
+        inner.close.notify_one();
+        let writer = inner.writer.lock().unwrap().take();
+        if let Some(writer) = writer {
+            if let Err(error) = writer.await {
+                tracing::error!(target: "audit", %error, "audit writer failed");
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        io,
+        sync::{
+            atomic::{AtomicUsize, Ordering},
+            Arc,
+        },
+        time::Duration,
+    };
+
+    use futures_util::future::BoxFuture;
+    use test_log::test;
+    use tokio::sync::Semaphore;
+    use uuid::Uuid;
+
+    use crate::{auth::AuthError, errors::DownloaderError};
+
+    use super::{
+        Actor, AuditAction, AuditEvent, AuditLogger, AuditOutcome, AuditSink,
+        FileAuditSink,
+    };
+
+    #[test(tokio::test)]
+    async fn test_file_sink() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("audit.log");
+        let target = Uuid::new_v4();
+        let actor = Actor {
+            user_id: Some(Uuid::new_v4()),
+            ip: Some("127.0.0.1".parse().unwrap()),
+        };
+
+        let logger =
+            AuditLogger::new(FileAuditSink::open(&path).await.unwrap(), 16);
+        logger.record(AuditEvent::new(
+            AuditAction::ReadFile,
+            actor,
+            Some(target),
+            &Ok::<_, DownloaderError>(()),
+        ));
+        logger.record(AuditEvent::new(
+            AuditAction::DeleteFile,
+            actor,
+            Some(target),
+            &Err::<(), _>(DownloaderError::from(AuthError::AccessDenied)),
+        ));
+
+        // Closing waits for the queued events
+        logger.close().await;
+        let events = tokio::fs::read_to_string(&path)
+            .await
+            .unwrap()
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect::<Vec<AuditEvent>>();
+
+        assert_eq!(events.len(), 2);
+        assert_eq!(events[0].action, AuditAction::ReadFile);
+        assert_eq!(events[0].outcome, AuditOutcome::Success);
+        assert_eq!(events[0].actor_id, actor.user_id);
+        assert_eq!(events[0].actor_ip, actor.ip);
+        assert_eq!(events[0].target, Some(target));
+        assert_eq!(events[0].error, None);
+
+        assert_eq!(events[1].action, AuditAction::DeleteFile);
+        assert_eq!(events[1].outcome, AuditOutcome::Failure);
+        assert!(events[1].error.is_some());
+    }
+
+    /// Holds the writes until released.
+    struct BlockedSink {
+        release: Arc<Semaphore>,
+        written: Arc<AtomicUsize>,
+    }
+
+    impl AuditSink for BlockedSink {
+        fn write<'a>(
+            &'a self,
+            _event: &'a AuditEvent,
+        ) -> BoxFuture<'a, io::Result<()>> {
+            Box::pin(async move {
+                self.release.acquire().await.unwrap().forget();
+                self.written.fetch_add(1, Ordering::SeqCst);
+                Ok(())
+            })
+        }
+    }
+
+    #[test(tokio::test)]
+    async fn test_full_queue() {
+        let release = Arc::new(Semaphore::new(0));
+        let written = Arc::new(AtomicUsize::new(0));
+        let logger = AuditLogger::new(
+            BlockedSink {
+                release: release.clone(),
+                written: written.clone(),
+            },
+            2,
+        );
+        let event = || {
+            AuditEvent::new(
+                AuditAction::Signin,
+                Actor::default(),
+                None,
+                &Ok::<_, DownloaderError>(()),
+            )
+        };
+
+        // One is taken by the writer, two are queued, the rest dropped
+        logger.record(event());
+        tokio::time::sleep(Duration::from_millis(20)).await;
+        for _ in 0..4 {
+            logger.record(event());
+        }
+        let inner = logger.inner.as_ref().unwrap();
+        assert_eq!(inner.dropped.load(Ordering::Relaxed), 2);
+
+        release.add_permits(3);
+        logger.close().await;
+        assert_eq!(written.load(Ordering::SeqCst), 3);
+
+        // Closed loggers don't queue anything
+        logger.record(event());
+        assert_eq!(inner.dropped.load(Ordering::Relaxed), 2);
+    }
+}
@@ -0,0 +1,54 @@
+use std::time::Duration;
+
+use chrono::{DateTime, TimeDelta, Utc};
+
+/// Source of the current time, injectable to make time-dependent logic
+/// testable.
+pub trait Clock: Send + Sync {
+    fn now(&self) -> DateTime<Utc>;
+}
+
+#[derive(Debug, Clone, Copy, Default)]
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    #[inline]
+    fn now(&self) -> DateTime<Utc> {
+        Utc::now()
+    }
+}
+
+/// Adds `duration` to `at`, returning `None` instead of panicking if the
+/// result is out of the representable range.
+pub fn checked_add(
+    at: DateTime<Utc>,
+    duration: Duration,
+) -> Option<DateTime<Utc>> {
+    TimeDelta::from_std(duration)
+        .ok()
+        .and_then(|delta| at.checked_add_signed(delta))
+}
+
+/// A clock that only moves when explicitly advanced.
+#[cfg(test)]
+#[derive(Debug)]
+pub struct MockClock(std::sync::Mutex<DateTime<Utc>>);
+
+#[cfg(test)]
+impl MockClock {
+    pub fn new(now: DateTime<Utc>) -> Self {
+        Self(std::sync::Mutex::new(now))
+    }
+
+    pub fn advance(&self, delta: chrono::TimeDelta) {
+        *self.0.lock().unwrap() += delta;
+    }
+}
+
+#[cfg(test)]
+impl Clock for MockClock {
+    #[inline]
+    fn now(&self) -> DateTime<Utc> {
+        *self.0.lock().unwrap()
+    }
+}
@@ -0,0 +1,240 @@
+use std::{
+    sync::{
+        atomic::{AtomicBool, AtomicU64, Ordering},
+        Arc,
+    },
+    time::{Duration, Instant},
+};
+
+use serde::{Deserialize, Serialize};
+use sqlx::{sqlite::SqlitePoolOptions, SqlitePool};
+
+use super::{fmt::fmt_duration, retry::Backoff};
+
+/// First wait between the checks of an unreachable database, growing up to
+/// the backoff limit.
+const OUTAGE_CHECK_DELAY: Duration = Duration::from_millis(100);
+
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DbStats {
+    pub available: bool,
+    /// Connections opened since the start, including the replaced ones.
+    pub connections_opened: u64,
+    /// Times the database was reachable again after an outage.
+    pub reconnects: u64,
+}
+
+/// Tracks whether the database is reachable. The pool replaces the broken
+/// connections by itself, this only tells when it happens.
+pub struct DbHealth {
+    available: AtomicBool,
+    connections_opened: AtomicU64,
+    reconnects: AtomicU64,
+}
+
+impl Default for DbHealth {
+    fn default() -> Self {
+        Self {
+            available: AtomicBool::new(true),
+            connections_opened: AtomicU64::new(0),
+            reconnects: AtomicU64::new(0),
+        }
+    }
+}
+
+impl DbHealth {
+    pub fn new() -> Arc<Self> {
+        Arc::default()
+    }
+
+    /// Options of a pool whose acquires fail once `acquire_timeout`
+    /// elapses, and whose idle connections are checked before being used.
+    pub fn pool_options(
+        self: &Arc<Self>,
+        max_connections: u32,
+        acquire_timeout: Duration,
+    ) -> SqlitePoolOptions {
+        let health = self.clone();
+
+        SqlitePoolOptions::new()
+            .max_connections(max_connections)
+            .acquire_timeout(acquire_timeout)
+            .test_before_acquire(true)
+            .after_connect(move |_, _| {
+                let health = health.clone();
+                Box::pin(async move {
+                    health.connections_opened.fetch_add(1, Ordering::Relaxed);
+                    Ok(())
+                })
+            })
+    }
+
+    #[inline]
+    pub fn is_available(&self) -> bool {
+        self.available.load(Ordering::Acquire)
+    }
+
+    pub fn stats(&self) -> DbStats {
+        DbStats {
+            available: self.is_available(),
+            connections_opened: self.connections_opened.load(Ordering::Relaxed),
+            reconnects: self.reconnects.load(Ordering::Relaxed),
+        }
+    }
+
+    /// Records the result of a check, returning whether the database was
+    /// reachable again after an outage.
+    fn record(&self, ok: bool) -> bool {
+        let previous = self.available.swap(ok, Ordering::AcqRel);
+        let reconnected = ok && !previous;
+        if reconnected {
+            self.reconnects.fetch_add(1, Ordering::Relaxed);
+        }
+        reconnected
+    }
+
+    /// Periodically checks that the database can be reached. While it
+    /// can't, the checks are retried more often, with backoff.
+    pub fn spawn_checks(self: Arc<Self>, db: SqlitePool, interval: Duration) {
+        let backoff = Backoff::new(u32::MAX, OUTAGE_CHECK_DELAY);
+
+        tokio::spawn(async move {
+            let mut attempt = 0;
+            let mut down_since: Option<Instant> = None;
+
+            loop {
+                let delay = match down_since {
+                    Some(_) => backoff.delay(attempt),
+                    None => interval,
+                };
+                tokio::time::sleep(delay).await;
+
+                match sqlx::query("SELECT 1").execute(&db).await {
+                    Ok(_) => {
+                        if self.record(true) {
+                            let downtime = down_since
+                                .map(|since| since.elapsed())
+                                .unwrap_or_default();
+
+                            tracing::info!(
+                                target: "db",
+                                downtime = fmt_duration(downtime),
+                                "database is reachable again",
+                            );
+                        }
+                        attempt = 0;
+                        down_since = None;
+                    }
+                    Err(error) => {
+                        self.record(false);
+                        if down_since.is_none() {
+                            tracing::error!(
+                                target: "db",
+                                %error,
+                                "database is unreachable",
+                            );
+                            down_since = Some(Instant::now());
+                        }
+                        attempt = attempt.saturating_add(1);
+                    }
+                }
+            }
+        });
+    }
+}
+
+/// Usernames that only differ by case from another one, which the
+/// migration making them case insensitive can't apply over. They must be
+/// renamed before upgrading, and nothing is returned once it was applied.
+pub async fn username_case_conflicts(
+    db: &SqlitePool,
+) -> Result<Vec<String>, sqlx::Error> {
+    let (pending,): (bool,) = sqlx::query_as(
+        "SELECT EXISTS (SELECT 1 FROM sqlite_master \
+        WHERE type = 'table' AND name = 'user') \
+        AND NOT EXISTS (SELECT 1 FROM sqlite_master \
+        WHERE type = 'index' AND name = 'user_username_nocase_idx')",
+    )
+    .fetch_one(db)
+    .await?;
+    if !pending {
+        return Ok(Vec::new());
+    }
+
+    let conflicts: Vec<(String,)> = sqlx::query_as(
+        "SELECT username FROM user WHERE username COLLATE NOCASE IN \
+        (SELECT username FROM user GROUP BY username COLLATE NOCASE \
+        HAVING COUNT(*) > 1) ORDER BY username COLLATE NOCASE, username",
+    )
+    .fetch_all(db)
+    .await?;
+
+    Ok(conflicts.into_iter().map(|(username,)| username).collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use sqlx::SqlitePool;
+    use test_log::test;
+
+    use super::{username_case_conflicts, DbHealth};
+
+    #[test]
+    fn test_record_reconnects() {
+        let health = DbHealth::new();
+        assert!(health.is_available());
+
+        assert!(!health.record(true));
+        assert!(!health.record(false));
+        assert!(!health.record(false));
+        assert!(!health.is_available());
+
+        assert!(health.record(true));
+        assert!(health.is_available());
+        assert_eq!(health.stats().reconnects, 1);
+    }
+
+    #[test(tokio::test)]
+    async fn test_acquire_fails_fast() {
+        let health = DbHealth::new();
+        let db = health
+            .pool_options(1, Duration::from_millis(100))
+            .connect("sqlite::memory:")
+            .await
+            .unwrap();
+        assert_eq!(health.stats().connections_opened, 1);
+
+        // The only connection is taken, so the next acquire times out
+        let _conn = db.acquire().await.unwrap();
+        let res = tokio::time::timeout(Duration::from_secs(1), db.acquire())
+            .await
+            .expect("acquire did not fail in time");
+        assert!(matches!(res, Err(sqlx::Error::PoolTimedOut)));
+    }
+
+    #[test(tokio::test)]
+    async fn test_username_case_conflicts() {
+        let db = SqlitePool::connect("sqlite::memory:").await.unwrap();
+        assert!(username_case_conflicts(&db).await.unwrap().is_empty());
+
+        sqlx::query(
+            "CREATE TABLE user (username TEXT NOT NULL); \
+            INSERT INTO user VALUES ('alice'), ('Alice'), ('bob')",
+        )
+        .execute(&db)
+        .await
+        .unwrap();
+        assert_eq!(
+            username_case_conflicts(&db).await.unwrap(),
+            ["Alice", "alice"],
+        );
+
+        sqlx::query("DELETE FROM user WHERE username = 'Alice'")
+            .execute(&db)
+            .await
+            .unwrap();
+        assert!(username_case_conflicts(&db).await.unwrap().is_empty());
+    }
+}
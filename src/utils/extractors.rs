@@ -1,9 +1,14 @@
+use std::{fmt::Display, io};
+
 use axum::{
     async_trait,
+    body::Body,
     extract::{FromRequest, FromRequestParts, Request},
-    http::request::Parts,
-    response::IntoResponse,
+    http::{header, request::Parts, HeaderValue},
+    response::{IntoResponse, Response},
 };
+use bytes::Bytes;
+use futures_util::{stream, Stream, StreamExt};
 use serde::{Deserialize, Serialize};
 
 use crate::errors::DownloaderError;
@@ -30,6 +35,10 @@ where
     }
 }
 
+/// Largest JSON request body accepted, enough for the bulk requests with
+/// the most ids they allow. Bigger ones are rejected with 413.
+pub const MAX_JSON_BODY_SIZE: usize = 16 * 1024;
+
 pub struct Json<T>(pub T);
 
 #[async_trait]
@@ -58,3 +67,42 @@ impl<T: Serialize> IntoResponse for Json<T> {
         axum::Json(self.0).into_response()
     }
 }
+
+/// A JSON array written one element at a time, as the stream yields them,
+/// so the response takes the same memory whatever its length. [`Json`] is
+/// still preferred for the small responses.
+///
+/// The status is sent before the elements are read, so an error of the
+/// stream aborts the body, leaving the array unterminated.
+pub struct JsonStream<S>(pub S);
+
+impl<S, T, E> IntoResponse for JsonStream<S>
+where
+    S: Stream<Item = Result<T, E>> + Send + 'static,
+    T: Serialize,
+    E: Display,
+{
+    fn into_response(self) -> Response {
+        let elements = self.0.enumerate().map(|(i, element)| {
+            let element = element.map_err(|error| {
+                tracing::error!(%error, "failed to stream json array");
+                io::Error::other(error.to_string())
+            })?;
+
+            let mut buf = if i == 0 { Vec::new() } else { vec![b','] };
+            serde_json::to_writer(&mut buf, &element)?;
+            Ok::<_, io::Error>(Bytes::from(buf))
+        });
+
+        let body = stream::once(async { Ok(Bytes::from_static(b"[")) })
+            .chain(elements)
+            .chain(stream::once(async { Ok(Bytes::from_static(b"]")) }));
+
+        let mut res = Body::from_stream(body).into_response();
+        res.headers_mut().insert(
+            header::CONTENT_TYPE,
+            HeaderValue::from_static(mime::APPLICATION_JSON.as_ref()),
+        );
+        res
+    }
+}
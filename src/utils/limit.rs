@@ -0,0 +1,258 @@
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
+use axum::{
+    body::{Body, HttpBody},
+    extract::Request,
+    http::{header, HeaderValue},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Extension,
+};
+use futures_util::StreamExt;
+use tokio::{sync::Semaphore, time::Instant};
+use uuid::Uuid;
+
+use crate::{
+    config::NetConfig,
+    errors::{DownloaderError, HttpError},
+};
+
+/// Routes answered whatever the load, so health checks don't fail because
+/// the server is busy.
+const EXEMPT_PATHS: &[&str] = &["/readyz"];
+
+/// Bounds the requests handled at once, so a spike of downloads, each one
+/// holding its buffers, can't exhaust the memory.
+pub struct RequestLimiter {
+    permits: Option<Arc<Semaphore>>,
+    retry_after: Duration,
+}
+
+impl RequestLimiter {
+    /// Zero `max_requests` disables the limit.
+    pub fn new(max_requests: usize, retry_after: Duration) -> Self {
+        Self {
+            permits: (max_requests > 0)
+                .then(|| Arc::new(Semaphore::new(max_requests))),
+            retry_after,
+        }
+    }
+
+    #[inline]
+    pub fn from_config(cfg: &NetConfig) -> Self {
+        Self::new(cfg.max_concurrent_requests, cfg.concurrency_retry_after)
+    }
+
+    /// Requests that can still start, `None` if there is no limit.
+    pub fn available(&self) -> Option<usize> {
+        self.permits
+            .as_ref()
+            .map(|permits| permits.available_permits())
+    }
+}
+
+/// Api keys tracked before the ones with an unspent budget are forgotten.
+const MAX_TRACKED_KEYS: usize = 1024;
+
+/// Bounds the requests made with each api key, refilling their budget at a
+/// steady rate up to a minute worth of requests.
+pub struct ApiKeyLimiter {
+    per_minute: u32,
+    budgets: Mutex<HashMap<Uuid, Budget>>,
+}
+
+struct Budget {
+    requests: f64,
+    updated: Instant,
+}
+
+impl ApiKeyLimiter {
+    /// Zero `per_minute` disables the limit.
+    pub fn new(per_minute: u32) -> Self {
+        Self {
+            per_minute,
+            budgets: Mutex::default(),
+        }
+    }
+
+    /// Takes a request out of the budget of `key_id`. Once it is spent,
+    /// returns how long until the next request is allowed.
+    pub fn check(&self, key_id: Uuid) -> Result<(), Duration> {
+        if self.per_minute == 0 {
+            return Ok(());
+        }
+
+        let now = Instant::now();
+        let max = self.per_minute as f64;
+        let rate = max / 60.0;
+        let refilled = |budget: &Budget| {
+            let elapsed = now.saturating_duration_since(budget.updated);
+            (budget.requests + elapsed.as_secs_f64() * rate).min(max)
+        };
+
+        let mut budgets = self.budgets.lock().unwrap();
+        if budgets.len() >= MAX_TRACKED_KEYS {
+            budgets.retain(|_, budget| refilled(budget) < max);
+        }
+
+        let budget = budgets.entry(key_id).or_insert(Budget {
+            requests: max,
+            updated: now,
+        });
+        budget.requests = refilled(budget);
+        budget.updated = now;
+
+        if budget.requests < 1.0 {
+            return Err(Duration::from_secs_f64(
+                (1.0 - budget.requests) / rate,
+            ));
+        }
+        budget.requests -= 1.0;
+        Ok(())
+    }
+}
+
+/// Answers the requests over the limit with 503 Service Unavailable, with a
+/// `Retry-After` header. The slot of a request is released once its body is
+/// sent, or the client went away.
+pub async fn limit_requests(
+    Extension(limiter): Extension<Arc<RequestLimiter>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let Some(permits) = &limiter.permits else {
+        return next.run(req).await;
+    };
+
+    let path = req.uri().path().trim_end_matches('/');
+    if EXEMPT_PATHS.contains(&path) {
+        return next.run(req).await;
+    }
+
+    let Ok(permit) = permits.clone().try_acquire_owned() else {
+        tracing::warn!(
+            target: "http_logs",
+            "too many requests in flight, rejecting",
+        );
+
+        let mut res =
+            DownloaderError::Http(HttpError::Overloaded).into_response();
+        res.headers_mut().insert(
+            header::RETRY_AFTER,
+            HeaderValue::from(limiter.retry_after.as_secs()),
+        );
+        return res;
+    };
+
+    let mut res = next.run(req).await;
+    if res.body().is_end_stream() {
+        return res;
+    }
+
+    // The length is lost by wrapping the body
+    if let Some(len) = res.body().size_hint().exact() {
+        res.headers_mut()
+            .entry(header::CONTENT_LENGTH)
+            .or_insert_with(|| HeaderValue::from(len));
+    }
+
+    res.map(|body| {
+        Body::from_stream(body.into_data_stream().map(move |chunk| {
+            let _permit = &permit;
+            chunk
+        }))
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{sync::Arc, time::Duration};
+
+    use axum::{
+        body::{to_bytes, Body},
+        http::{header, Request, StatusCode},
+        middleware, routing, Extension, Router,
+    };
+    use test_log::test;
+    use tower::ServiceExt;
+    use uuid::Uuid;
+
+    use super::{limit_requests, ApiKeyLimiter, RequestLimiter};
+
+    fn app(limiter: Arc<RequestLimiter>) -> Router {
+        Router::new()
+            .route("/data", routing::get(|| async { "data" }))
+            .route("/readyz", routing::get(|| async { StatusCode::NO_CONTENT }))
+            .layer(middleware::from_fn(limit_requests))
+            .layer(Extension(limiter))
+    }
+
+    fn get(uri: &str) -> Request<Body> {
+        Request::get(uri).body(Body::empty()).unwrap()
+    }
+
+    #[test(tokio::test)]
+    async fn test_limit_requests() {
+        let limiter = Arc::new(RequestLimiter::new(1, Duration::from_secs(3)));
+        let app = app(limiter.clone());
+
+        // Holds the only slot until its body is read
+        let res = app.clone().oneshot(get("/data")).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+        assert_eq!(res.headers()[header::CONTENT_LENGTH], "4");
+        assert_eq!(limiter.available(), Some(0));
+
+        let rejected = app.clone().oneshot(get("/data")).await.unwrap();
+        assert_eq!(rejected.status(), StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(rejected.headers()[header::RETRY_AFTER], "3");
+
+        let readyz = app.clone().oneshot(get("/readyz")).await.unwrap();
+        assert_eq!(readyz.status(), StatusCode::NO_CONTENT);
+
+        let body = to_bytes(res.into_body(), usize::MAX).await.unwrap();
+        assert_eq!(body, "data");
+        assert_eq!(limiter.available(), Some(1));
+
+        let res = app.oneshot(get("/data")).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+    }
+
+    #[test(tokio::test)]
+    async fn test_no_limit() {
+        let limiter = Arc::new(RequestLimiter::new(0, Duration::ZERO));
+        assert_eq!(limiter.available(), None);
+
+        let app = app(limiter);
+        let mut responses = Vec::new();
+        for _ in 0..8 {
+            let res = app.clone().oneshot(get("/data")).await.unwrap();
+            assert_eq!(res.status(), StatusCode::OK);
+            responses.push(res);
+        }
+    }
+
+    #[test]
+    fn test_api_key_limiter() {
+        let limiter = ApiKeyLimiter::new(2);
+        let key = Uuid::new_v4();
+
+        assert!(limiter.check(key).is_ok());
+        assert!(limiter.check(key).is_ok());
+        let wait = limiter.check(key).unwrap_err();
+        assert!(
+            wait > Duration::from_secs(29) && wait <= Duration::from_secs(30)
+        );
+
+        // Each key has its own budget
+        assert!(limiter.check(Uuid::new_v4()).is_ok());
+
+        let limiter = ApiKeyLimiter::new(0);
+        for _ in 0..8 {
+            assert!(limiter.check(key).is_ok());
+        }
+    }
+}
@@ -0,0 +1,263 @@
+use std::{
+    fs::{self, File, OpenOptions},
+    io::{self, Write},
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+    time::{Duration, SystemTime},
+};
+
+use chrono::Utc;
+use tracing_subscriber::fmt::MakeWriter;
+
+use crate::config::{LogConfig, LogOutput};
+
+/// Where the logs are written, shared by every logger, including the
+/// access logs.
+#[derive(Clone)]
+pub struct LogSink(Arc<Mutex<Output>>);
+
+enum Output {
+    Stdout,
+    Stderr,
+    File(RotatingFile),
+}
+
+impl Default for LogSink {
+    fn default() -> Self {
+        Self(Arc::new(Mutex::new(Output::Stdout)))
+    }
+}
+
+impl LogSink {
+    pub fn open(cfg: &LogConfig) -> io::Result<Self> {
+        let output = match &cfg.output {
+            LogOutput::Stdout => Output::Stdout,
+            LogOutput::Stderr => Output::Stderr,
+            LogOutput::File(path) => Output::File(RotatingFile::open(
+                path.clone(),
+                cfg.max_size,
+                cfg.max_age,
+                cfg.max_files,
+            )?),
+        };
+
+        Ok(Self(Arc::new(Mutex::new(output))))
+    }
+
+    /// Whether the logs are written to a file, which should not get the
+    /// terminal colors.
+    pub fn is_file(&self) -> bool {
+        matches!(*self.0.lock().unwrap(), Output::File(..))
+    }
+}
+
+impl<'a> MakeWriter<'a> for LogSink {
+    type Writer = SinkWriter<'a>;
+
+    #[inline]
+    fn make_writer(&'a self) -> Self::Writer {
+        SinkWriter(&self.0)
+    }
+}
+
+pub struct SinkWriter<'a>(&'a Mutex<Output>);
+
+impl Write for SinkWriter<'_> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        match &mut *self.0.lock().unwrap() {
+            Output::Stdout => io::stdout().write(buf),
+            Output::Stderr => io::stderr().write(buf),
+            Output::File(file) => file.write(buf),
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        match &mut *self.0.lock().unwrap() {
+            Output::Stdout => io::stdout().flush(),
+            Output::Stderr => io::stderr().flush(),
+            Output::File(file) => file.flush(),
+        }
+    }
+}
+
+/// A log file moved aside once it reaches `max_size` bytes, named after
+/// the time it was. Only the `max_files` most recent moved files younger
+/// than `max_age` are kept. Zero disables each of the limits.
+pub struct RotatingFile {
+    path: PathBuf,
+    file: File,
+    size: u64,
+    max_size: u64,
+    max_age: Duration,
+    max_files: usize,
+}
+
+fn open_append(path: &Path) -> io::Result<File> {
+    OpenOptions::new().create(true).append(true).open(path)
+}
+
+impl RotatingFile {
+    pub fn open(
+        path: PathBuf,
+        max_size: u64,
+        max_age: Duration,
+        max_files: usize,
+    ) -> io::Result<Self> {
+        let file = open_append(&path)?;
+        let size = file.metadata()?.len();
+
+        Ok(Self {
+            path,
+            file,
+            size,
+            max_size,
+            max_age,
+            max_files,
+        })
+    }
+
+    fn file_name(&self) -> String {
+        self.path
+            .file_name()
+            .unwrap_or_default()
+            .to_string_lossy()
+            .into_owned()
+    }
+
+    fn rotate(&mut self) -> io::Result<()> {
+        let name = self.file_name();
+        let time = Utc::now().format("%Y%m%dT%H%M%S%.3f");
+
+        let mut rotated = self.path.with_file_name(format!("{name}.{time}"));
+        // Rotated more than once in the same millisecond
+        for n in 1.. {
+            if !rotated.exists() {
+                break;
+            }
+            rotated = self.path.with_file_name(format!("{name}.{time}-{n}"));
+        }
+
+        fs::rename(&self.path, &rotated)?;
+        self.file = open_append(&self.path)?;
+        self.size = 0;
+
+        self.prune()
+    }
+
+    /// Deletes the rotated files past the limits.
+    fn prune(&self) -> io::Result<()> {
+        if self.max_files == 0 && self.max_age.is_zero() {
+            return Ok(());
+        }
+
+        let dir = match self.path.parent() {
+            Some(dir) if !dir.as_os_str().is_empty() => dir,
+            _ => Path::new("."),
+        };
+        let prefix = format!("{}.", self.file_name());
+
+        let mut rotated = Vec::new();
+        for entry in fs::read_dir(dir)? {
+            let entry = entry?;
+            if let Ok(name) = entry.file_name().into_string() {
+                if name.starts_with(&prefix) {
+                    rotated.push((name, entry.path()));
+                }
+            }
+        }
+        // Newest first, as they are named after the time they were rotated
+        rotated.sort_unstable_by(|a, b| b.0.cmp(&a.0));
+
+        let now = SystemTime::now();
+        for (i, (_, path)) in rotated.iter().enumerate() {
+            let too_many = self.max_files > 0 && i >= self.max_files;
+            let too_old = !self.max_age.is_zero()
+                && fs::metadata(path)
+                    .and_then(|meta| meta.modified())
+                    .is_ok_and(|modified| {
+                        now.duration_since(modified).unwrap_or_default()
+                            > self.max_age
+                    });
+
+            if too_many || too_old {
+                fs::remove_file(path)?;
+            }
+        }
+
+        Ok(())
+    }
+}
+
+impl Write for RotatingFile {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let full = self.size + buf.len() as u64 > self.max_size;
+        if self.max_size > 0 && self.size > 0 && full {
+            // Keeps writing to the current file rather than losing logs
+            if let Err(error) = self.rotate() {
+                eprintln!("failed to rotate the log file: {error}");
+            }
+        }
+
+        let n = self.file.write(buf)?;
+        self.size += n as u64;
+        Ok(n)
+    }
+
+    #[inline]
+    fn flush(&mut self) -> io::Result<()> {
+        self.file.flush()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{fs, io::Write, time::Duration};
+
+    use test_log::test;
+
+    use super::RotatingFile;
+
+    #[test]
+    fn test_rotation() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("downloader.log");
+        fs::write(&path, "old\n").unwrap();
+
+        let mut file =
+            RotatingFile::open(path.clone(), 10, Duration::ZERO, 2).unwrap();
+
+        for line in ["line 1\n", "line 2\n", "line 3\n", "line 4\n"] {
+            file.write_all(line.as_bytes()).unwrap();
+        }
+        assert_eq!(fs::read_to_string(&path).unwrap(), "line 4\n");
+
+        let mut rotated: Vec<_> = fs::read_dir(dir.path())
+            .unwrap()
+            .map(|entry| entry.unwrap().path())
+            .filter(|entry| *entry != path)
+            .collect();
+        rotated.sort();
+
+        // The oldest ones were deleted
+        let contents: Vec<_> = rotated
+            .iter()
+            .map(|path| fs::read_to_string(path).unwrap())
+            .collect();
+        assert_eq!(contents, ["line 2\n", "line 3\n"]);
+    }
+
+    #[test]
+    fn test_no_rotation() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("downloader.log");
+
+        let mut file =
+            RotatingFile::open(path.clone(), 0, Duration::ZERO, 0).unwrap();
+        for _ in 0..100 {
+            file.write_all(b"line\n").unwrap();
+        }
+
+        assert_eq!(fs::read_dir(dir.path()).unwrap().count(), 1);
+        assert_eq!(fs::read(&path).unwrap().len(), 500);
+    }
+}
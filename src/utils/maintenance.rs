@@ -0,0 +1,170 @@
+use std::{
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc,
+    },
+    time::Duration,
+};
+
+use axum::{
+    extract::Request,
+    http::{header, HeaderValue, Method},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Extension,
+};
+
+use crate::{
+    config::MaintenanceConfig,
+    errors::{DownloaderError, HttpError},
+};
+
+/// Routes whose writes are rejected under maintenance.
+const WRITE_PREFIXES: &[&str] = &["/api/file", "/api/user"];
+/// Routes answering `POST` requests without writing anything.
+const READ_ONLY_POSTS: &[&str] = &["/api/file/archive"];
+
+/// Whether the server is under maintenance, rejecting the uploads, deletes
+/// and other writes while still serving the reads. It can be toggled while
+/// running.
+pub struct Maintenance {
+    enabled: AtomicBool,
+    retry_after: Duration,
+}
+
+impl Maintenance {
+    pub fn new(enabled: bool, retry_after: Duration) -> Self {
+        if enabled {
+            tracing::warn!(
+                target: "maintenance",
+                "starting under maintenance, writes are rejected",
+            );
+        }
+
+        Self {
+            enabled: AtomicBool::new(enabled),
+            retry_after,
+        }
+    }
+
+    #[inline]
+    pub fn from_config(cfg: &MaintenanceConfig) -> Self {
+        Self::new(cfg.enabled, cfg.retry_after)
+    }
+
+    #[inline]
+    pub fn is_enabled(&self) -> bool {
+        self.enabled.load(Ordering::Acquire)
+    }
+
+    /// How long clients are told to wait before retrying their writes.
+    #[inline]
+    pub fn retry_after(&self) -> Duration {
+        self.retry_after
+    }
+
+    /// Enables or disables the maintenance, logging it along with what
+    /// changed it. Returns whether it was enabled before.
+    pub fn set(&self, enabled: bool, source: &str) -> bool {
+        let previous = self.enabled.swap(enabled, Ordering::AcqRel);
+        self.log_change(previous, enabled, source);
+        previous
+    }
+
+    /// Same as [`Self::set`] with the opposite of the current state.
+    pub fn toggle(&self, source: &str) -> bool {
+        let previous = self.enabled.fetch_xor(true, Ordering::AcqRel);
+        self.log_change(previous, !previous, source);
+        previous
+    }
+
+    fn log_change(&self, previous: bool, enabled: bool, source: &str) {
+        if previous == enabled {
+            return;
+        }
+
+        if enabled {
+            tracing::warn!(
+                target: "maintenance",
+                %source,
+                "maintenance enabled, writes are rejected",
+            );
+        } else {
+            tracing::warn!(
+                target: "maintenance",
+                %source,
+                "maintenance disabled, writes are accepted",
+            );
+        }
+    }
+}
+
+fn is_write(method: &Method, path: &str) -> bool {
+    if matches!(*method, Method::GET | Method::HEAD | Method::OPTIONS) {
+        return false;
+    }
+
+    let path = path.trim_end_matches('/');
+    if *method == Method::POST && READ_ONLY_POSTS.contains(&path) {
+        return false;
+    }
+
+    WRITE_PREFIXES.iter().any(|prefix| {
+        path.strip_prefix(prefix)
+            .is_some_and(|rest| rest.is_empty() || rest.starts_with('/'))
+    })
+}
+
+/// Answers the writes with 503 Service Unavailable while under
+/// maintenance, with a `Retry-After` header.
+pub async fn reject_writes(
+    Extension(maintenance): Extension<Arc<Maintenance>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    if !maintenance.is_enabled() || !is_write(req.method(), req.uri().path()) {
+        return next.run(req).await;
+    }
+
+    let mut res = DownloaderError::Http(HttpError::Maintenance).into_response();
+    res.headers_mut().insert(
+        header::RETRY_AFTER,
+        HeaderValue::from(maintenance.retry_after.as_secs()),
+    );
+    res
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use axum::http::Method;
+    use test_log::test;
+
+    use super::{is_write, Maintenance};
+
+    #[test]
+    fn test_is_write() {
+        assert!(is_write(&Method::POST, "/api/file"));
+        assert!(is_write(&Method::PUT, "/api/file/1234/data"));
+        assert!(is_write(&Method::DELETE, "/api/user/self/"));
+        assert!(is_write(&Method::POST, "/api/file/delete"));
+
+        assert!(!is_write(&Method::GET, "/api/file/1234/data"));
+        assert!(!is_write(&Method::HEAD, "/api/file/1234/data"));
+        assert!(!is_write(&Method::POST, "/api/file/archive/"));
+        assert!(!is_write(&Method::POST, "/api/auth/login"));
+        assert!(!is_write(&Method::POST, "/api/files"));
+    }
+
+    #[test]
+    fn test_toggle() {
+        let maintenance = Maintenance::new(false, Duration::from_secs(60));
+
+        assert!(!maintenance.toggle("test"));
+        assert!(maintenance.is_enabled());
+        assert!(maintenance.set(true, "test"));
+        assert!(maintenance.set(false, "test"));
+        assert!(!maintenance.is_enabled());
+    }
+}
@@ -1,5 +1,19 @@
+pub mod access_log;
+pub mod audit;
+pub mod clock;
 pub mod crypto;
+pub mod db;
 pub mod extractors;
 pub mod fmt;
+pub mod limit;
+pub mod logging;
+pub mod maintenance;
+pub mod net;
+pub mod openapi;
+pub mod retry;
+pub mod security;
 pub mod serde;
+pub mod singleflight;
 pub mod sys;
+pub mod version;
+pub mod webhook;
@@ -0,0 +1,437 @@
+use std::{
+    future::{ready, Future, Ready},
+    io,
+    pin::Pin,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc,
+    },
+    task::{Context, Poll},
+    time::Duration,
+};
+
+use axum_server::accept::Accept;
+use futures_util::future::BoxFuture;
+use pin_project_lite::pin_project;
+use tokio::{
+    io::{AsyncRead, AsyncWrite, ReadBuf},
+    sync::{OwnedSemaphorePermit, Semaphore},
+    time::{sleep_until, Instant, Sleep},
+};
+
+/// Wraps the accepted connections into a [`TimeoutStream`].
+#[derive(Debug, Clone, Copy)]
+pub struct TimeoutAcceptor {
+    idle_timeout: Option<Duration>,
+    write_timeout: Option<Duration>,
+}
+
+impl TimeoutAcceptor {
+    /// A zero duration disables the respective timeout.
+    pub fn new(idle_timeout: Duration, write_timeout: Duration) -> Self {
+        Self {
+            idle_timeout: Some(idle_timeout).filter(|d| !d.is_zero()),
+            write_timeout: Some(write_timeout).filter(|d| !d.is_zero()),
+        }
+    }
+}
+
+impl<I, S> Accept<I, S> for TimeoutAcceptor
+where
+    I: AsyncRead + AsyncWrite + Unpin,
+{
+    type Stream = TimeoutStream<I>;
+    type Service = S;
+    type Future = Ready<io::Result<(Self::Stream, Self::Service)>>;
+
+    fn accept(&self, stream: I, service: S) -> Self::Future {
+        ready(Ok((
+            TimeoutStream::new(stream, self.idle_timeout, self.write_timeout),
+            service,
+        )))
+    }
+}
+
+pin_project! {
+    /// Fails the pending reads and writes once nothing was transferred
+    /// through the connection for `idle_timeout`, or a single write stays
+    /// blocked for `write_timeout`.
+    pub struct TimeoutStream<S> {
+        #[pin]
+        inner: S,
+        last_activity: Instant,
+        idle_timeout: Option<Duration>,
+        idle: Pin<Box<Sleep>>,
+        write_timeout: Option<Duration>,
+        write_started: Option<Instant>,
+        write: Pin<Box<Sleep>>,
+    }
+}
+
+impl<S> TimeoutStream<S> {
+    pub fn new(
+        inner: S,
+        idle_timeout: Option<Duration>,
+        write_timeout: Option<Duration>,
+    ) -> Self {
+        let now = Instant::now();
+
+        Self {
+            inner,
+            last_activity: now,
+            idle_timeout,
+            idle: Box::pin(sleep_until(now)),
+            write_timeout,
+            write_started: None,
+            write: Box::pin(sleep_until(now)),
+        }
+    }
+}
+
+/// Returns `true` if `timeout` has passed since `since`, registering the
+/// waker otherwise.
+fn poll_expired(
+    sleep: &mut Pin<Box<Sleep>>,
+    since: Instant,
+    timeout: Option<Duration>,
+    cx: &mut Context<'_>,
+) -> bool {
+    let Some(timeout) = timeout else {
+        return false;
+    };
+
+    let deadline = since + timeout;
+    if sleep.deadline() != deadline {
+        sleep.as_mut().reset(deadline);
+    }
+
+    sleep.as_mut().poll(cx).is_ready()
+}
+
+#[inline]
+fn timed_out(what: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::TimedOut, format!("{what} timed out"))
+}
+
+impl<S: AsyncRead> AsyncRead for TimeoutStream<S> {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.project();
+
+        match this.inner.poll_read(cx, buf) {
+            Poll::Ready(res) => {
+                *this.last_activity = Instant::now();
+                Poll::Ready(res)
+            }
+            Poll::Pending => {
+                if poll_expired(
+                    this.idle,
+                    *this.last_activity,
+                    *this.idle_timeout,
+                    cx,
+                ) {
+                    Poll::Ready(Err(timed_out("idle connection")))
+                } else {
+                    Poll::Pending
+                }
+            }
+        }
+    }
+}
+
+impl<S: AsyncWrite> AsyncWrite for TimeoutStream<S> {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = self.project();
+
+        match this.inner.poll_write(cx, buf) {
+            Poll::Ready(res) => {
+                *this.last_activity = Instant::now();
+                *this.write_started = None;
+                Poll::Ready(res)
+            }
+            Poll::Pending => {
+                let started =
+                    *this.write_started.get_or_insert_with(Instant::now);
+
+                if poll_expired(this.write, started, *this.write_timeout, cx) {
+                    Poll::Ready(Err(timed_out("write")))
+                } else if poll_expired(
+                    this.idle,
+                    *this.last_activity,
+                    *this.idle_timeout,
+                    cx,
+                ) {
+                    Poll::Ready(Err(timed_out("idle connection")))
+                } else {
+                    Poll::Pending
+                }
+            }
+        }
+    }
+
+    #[inline]
+    fn poll_flush(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<io::Result<()>> {
+        self.project().inner.poll_flush(cx)
+    }
+
+    #[inline]
+    fn poll_shutdown(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<io::Result<()>> {
+        self.project().inner.poll_shutdown(cx)
+    }
+}
+
+/// Connections open through a [`LimitAcceptor`], including the ones still
+/// being accepted.
+#[derive(Debug, Default)]
+pub struct ActiveConnections {
+    count: AtomicUsize,
+    max: usize,
+}
+
+impl ActiveConnections {
+    #[inline]
+    pub fn count(&self) -> usize {
+        self.count.load(Ordering::Relaxed)
+    }
+
+    /// Zero if unlimited.
+    #[inline]
+    pub fn max(&self) -> usize {
+        self.max
+    }
+}
+
+/// Counts its connection in the [`ActiveConnections`] until dropped.
+#[derive(Debug)]
+struct ActiveConnection(Arc<ActiveConnections>);
+
+impl ActiveConnection {
+    fn new(connections: Arc<ActiveConnections>) -> Self {
+        connections.count.fetch_add(1, Ordering::Relaxed);
+        Self(connections)
+    }
+}
+
+impl Drop for ActiveConnection {
+    fn drop(&mut self) {
+        self.0.count.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// Caps the connections open at once. The ones over the limit are closed
+/// as soon as accepted, before the TLS handshake when wrapped by it.
+#[derive(Debug, Clone)]
+pub struct LimitAcceptor<A> {
+    inner: A,
+    max_connections: usize,
+    permits: Option<Arc<Semaphore>>,
+    connections: Arc<ActiveConnections>,
+}
+
+impl<A> LimitAcceptor<A> {
+    /// Zero disables the limit.
+    pub fn new(inner: A, max_connections: usize) -> Self {
+        Self {
+            inner,
+            max_connections,
+            permits: Some(max_connections)
+                .filter(|&max| max > 0)
+                .map(|max| Arc::new(Semaphore::new(max))),
+            connections: Arc::new(ActiveConnections {
+                count: AtomicUsize::new(0),
+                max: max_connections,
+            }),
+        }
+    }
+
+    /// The connections open through this acceptor, even without a limit.
+    pub fn connections(&self) -> Arc<ActiveConnections> {
+        self.connections.clone()
+    }
+}
+
+impl<I, S, A> Accept<I, S> for LimitAcceptor<A>
+where
+    A: Accept<I, S>,
+    A::Future: Send + 'static,
+{
+    type Stream = LimitedStream<A::Stream>;
+    type Service = A::Service;
+    type Future = BoxFuture<'static, io::Result<(Self::Stream, Self::Service)>>;
+
+    fn accept(&self, stream: I, service: S) -> Self::Future {
+        let permit = match &self.permits {
+            Some(permits) => match permits.clone().try_acquire_owned() {
+                Ok(permit) => Some(permit),
+                Err(..) => {
+                    tracing::warn!(
+                        target: "http_logs",
+                        max_connections = self.max_connections,
+                        "rejected connection over the limit",
+                    );
+                    return Box::pin(ready(Err(io::Error::new(
+                        io::ErrorKind::ConnectionRefused,
+                        "too many open connections",
+                    ))));
+                }
+            },
+            None => None,
+        };
+
+        let active = ActiveConnection::new(self.connections.clone());
+        let accept = self.inner.accept(stream, service);
+        Box::pin(async move {
+            let (inner, service) = accept.await?;
+            Ok((
+                LimitedStream {
+                    inner,
+                    _permit: permit,
+                    _active: active,
+                },
+                service,
+            ))
+        })
+    }
+}
+
+pin_project! {
+    /// Holds its slot of the [`LimitAcceptor`] until closed.
+    pub struct LimitedStream<S> {
+        #[pin]
+        inner: S,
+        _permit: Option<OwnedSemaphorePermit>,
+        _active: ActiveConnection,
+    }
+}
+
+impl<S: AsyncRead> AsyncRead for LimitedStream<S> {
+    #[inline]
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        self.project().inner.poll_read(cx, buf)
+    }
+}
+
+impl<S: AsyncWrite> AsyncWrite for LimitedStream<S> {
+    #[inline]
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        self.project().inner.poll_write(cx, buf)
+    }
+
+    #[inline]
+    fn poll_flush(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<io::Result<()>> {
+        self.project().inner.poll_flush(cx)
+    }
+
+    #[inline]
+    fn poll_shutdown(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<io::Result<()>> {
+        self.project().inner.poll_shutdown(cx)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{io::ErrorKind, time::Duration};
+
+    use test_log::test;
+    use tokio::io::{duplex, AsyncReadExt, AsyncWriteExt};
+
+    use axum_server::accept::{Accept, DefaultAcceptor};
+
+    use super::{LimitAcceptor, TimeoutStream};
+
+    #[test(tokio::test)]
+    async fn test_idle_timeout() {
+        let (client, server) = duplex(64);
+        let mut server =
+            TimeoutStream::new(server, Some(Duration::from_millis(50)), None);
+
+        let mut client = client;
+        client.write_all(b"ping").await.unwrap();
+
+        let mut buf = [0u8; 4];
+        server.read_exact(&mut buf).await.unwrap();
+
+        let err = server.read(&mut buf).await.unwrap_err();
+        assert_eq!(err.kind(), std::io::ErrorKind::TimedOut);
+    }
+
+    #[test(tokio::test)]
+    async fn test_write_timeout() {
+        let (_client, server) = duplex(4);
+        let mut server =
+            TimeoutStream::new(server, None, Some(Duration::from_millis(50)));
+
+        let err = server.write_all(&[0u8; 16]).await.unwrap_err();
+        assert_eq!(err.kind(), std::io::ErrorKind::TimedOut);
+    }
+
+    #[test(tokio::test)]
+    async fn test_connection_limit() {
+        let acceptor = LimitAcceptor::new(DefaultAcceptor::new(), 1);
+        let connections = acceptor.connections();
+        assert_eq!(connections.max(), 1);
+
+        let (_client, server) = duplex(4);
+        let first = acceptor.accept(server, ()).await;
+        assert!(first.is_ok());
+        assert_eq!(connections.count(), 1);
+
+        let (_client, server) = duplex(4);
+        let res = acceptor.accept(server, ()).await;
+        assert!(
+            matches!(&res, Err(e) if e.kind() == ErrorKind::ConnectionRefused),
+            "expected the connection over the limit to be refused",
+        );
+
+        // The refused one is not counted
+        assert_eq!(connections.count(), 1);
+
+        drop(first);
+        assert_eq!(connections.count(), 0);
+        let (_client, server) = duplex(4);
+        assert!(acceptor.accept(server, ()).await.is_ok());
+    }
+
+    #[test(tokio::test)]
+    async fn test_connections_without_limit() {
+        let acceptor = LimitAcceptor::new(DefaultAcceptor::new(), 0);
+        let connections = acceptor.connections();
+
+        let mut streams = Vec::new();
+        for _ in 0..3 {
+            let (_client, server) = duplex(4);
+            streams.push(acceptor.accept(server, ()).await.unwrap());
+        }
+        assert_eq!(connections.count(), 3);
+
+        streams.clear();
+        assert_eq!(connections.count(), 0);
+    }
+}
@@ -0,0 +1,656 @@
+use std::{collections::BTreeMap, fmt};
+
+use axum::{
+    extract::DefaultBodyLimit,
+    handler::Handler,
+    http::{header, StatusCode},
+    routing::{self, MethodFilter, MethodRouter},
+    Router,
+};
+use bytes::Bytes;
+use serde::{
+    de::{self, DeserializeOwned, Visitor},
+    forward_to_deserialize_any, Deserializer,
+};
+use serde_json::{json, Map, Value};
+
+use crate::errors::{route_disabled, ERROR_CODES};
+
+use super::version::VERSION;
+
+/// Where the document of the api is served.
+pub const OPENAPI_PATH: &str = "/openapi.json";
+
+const OPENAPI: RouteSpec =
+    RouteSpec::get(OPENAPI_PATH, "Describes the api in an OpenAPI 3 document")
+        .response(Content::Json(Schema::Named("OpenApi")));
+
+/// Error codes every route may answer.
+const SERVER_ERRORS: &[u32] = &[99007, 99255];
+/// Error codes of the routes requiring an `Authorization` header.
+const AUTH_ERRORS: &[u32] = &[4003, 4004, 4005, 4006, 4007, 4008, 4012, 99008];
+/// Error codes of the routes taking an optional `Authorization` header.
+const OPTIONAL_AUTH_ERRORS: &[u32] =
+    &[4003, 4004, 4005, 4007, 4008, 4012, 99008];
+/// Error codes of the routes that may be rejected during the maintenance.
+const WRITE_ERRORS: &[u32] = &[99006];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ApiMethod {
+    Get,
+    Post,
+    Put,
+    Patch,
+    Delete,
+}
+
+impl ApiMethod {
+    #[inline]
+    fn filter(self) -> MethodFilter {
+        match self {
+            ApiMethod::Get => MethodFilter::GET,
+            ApiMethod::Post => MethodFilter::POST,
+            ApiMethod::Put => MethodFilter::PUT,
+            ApiMethod::Patch => MethodFilter::PATCH,
+            ApiMethod::Delete => MethodFilter::DELETE,
+        }
+    }
+
+    /// Name of the operation in the document.
+    #[inline]
+    pub fn as_str(self) -> &'static str {
+        match self {
+            ApiMethod::Get => "get",
+            ApiMethod::Post => "post",
+            ApiMethod::Put => "put",
+            ApiMethod::Patch => "patch",
+            ApiMethod::Delete => "delete",
+        }
+    }
+}
+
+/// Whether a route takes an `Authorization` header.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Auth {
+    None,
+    Optional,
+    Required,
+}
+
+/// Name and fields of a struct.
+pub type StructFields = (&'static str, &'static [&'static str]);
+
+#[derive(Debug, Clone, Copy)]
+pub enum Schema {
+    Uuid,
+    /// A type described by its name only.
+    Named(&'static str),
+    /// A struct whose fields are read from its `Deserialize` impl, so they
+    /// follow the renames of the type.
+    Struct(fn() -> Option<StructFields>),
+}
+
+impl Schema {
+    #[inline]
+    pub const fn of<T: DeserializeOwned>() -> Self {
+        Schema::Struct(struct_fields::<T>)
+    }
+
+    fn fields(self) -> Option<StructFields> {
+        match self {
+            Schema::Struct(fields) => fields(),
+            _ => None,
+        }
+    }
+
+    /// The schema to use in an operation, registering it in `schemas` if it
+    /// is named.
+    fn reference(self, schemas: &mut Map<String, Value>) -> Value {
+        let (name, schema) = match self {
+            Schema::Uuid => {
+                return json!({ "type": "string", "format": "uuid" });
+            }
+            Schema::Named(name) => (name, json!({ "type": "object" })),
+            Schema::Struct(fields) => match fields() {
+                Some((name, fields)) => {
+                    let properties = fields
+                        .iter()
+                        .map(|&field| (field.to_owned(), json!({})))
+                        .collect::<Map<_, _>>();
+                    let schema = json!({
+                        "type": "object",
+                        "properties": properties,
+                    });
+                    (name, schema)
+                }
+                None => return json!({ "type": "object" }),
+            },
+        };
+
+        match schemas.get(name) {
+            // Another type with the same name, kept inline
+            Some(registered) if *registered != schema => return schema,
+            Some(..) => {}
+            None => {
+                schemas.insert(name.into(), schema);
+            }
+        }
+        json!({ "$ref": format!("#/components/schemas/{name}") })
+    }
+}
+
+#[derive(Debug, Clone, Copy)]
+pub enum Content {
+    Empty,
+    Json(Schema),
+    /// A JSON array of the schema.
+    JsonList(Schema),
+    /// A multipart form carrying the file.
+    Multipart,
+    /// Bytes of the given content type.
+    Binary(&'static str),
+    /// Server-sent events.
+    EventStream,
+}
+
+impl Content {
+    fn content(self, schemas: &mut Map<String, Value>) -> Option<Value> {
+        let (content_type, schema) = match self {
+            Content::Empty => return None,
+            Content::Json(schema) => {
+                ("application/json", schema.reference(schemas))
+            }
+            Content::JsonList(schema) => (
+                "application/json",
+                json!({ "type": "array", "items": schema.reference(schemas) }),
+            ),
+            Content::Multipart => {
+                ("multipart/form-data", json!({ "type": "object" }))
+            }
+            Content::Binary(content_type) => (
+                content_type,
+                json!({ "type": "string", "format": "binary" }),
+            ),
+            Content::EventStream => {
+                ("text/event-stream", json!({ "type": "string" }))
+            }
+        };
+
+        let mut content = Map::new();
+        content.insert(content_type.into(), json!({ "schema": schema }));
+        Some(content.into())
+    }
+}
+
+/// What a route takes and answers, documented in the OpenAPI document.
+#[derive(Debug, Clone, Copy)]
+pub struct RouteSpec {
+    pub method: ApiMethod,
+    pub path: &'static str,
+    pub summary: &'static str,
+    pub auth: Auth,
+    pub query: Option<Schema>,
+    pub request: Option<Content>,
+    pub response: Content,
+    /// Error codes answered by the route itself, besides the ones of the
+    /// authentication and of the server.
+    pub errors: &'static [u32],
+}
+
+impl RouteSpec {
+    #[inline]
+    pub const fn new(
+        method: ApiMethod,
+        path: &'static str,
+        summary: &'static str,
+    ) -> Self {
+        Self {
+            method,
+            path,
+            summary,
+            auth: Auth::None,
+            query: None,
+            request: None,
+            response: Content::Empty,
+            errors: &[],
+        }
+    }
+
+    #[inline]
+    pub const fn get(path: &'static str, summary: &'static str) -> Self {
+        Self::new(ApiMethod::Get, path, summary)
+    }
+
+    #[inline]
+    pub const fn post(path: &'static str, summary: &'static str) -> Self {
+        Self::new(ApiMethod::Post, path, summary)
+    }
+
+    #[inline]
+    pub const fn put(path: &'static str, summary: &'static str) -> Self {
+        Self::new(ApiMethod::Put, path, summary)
+    }
+
+    #[inline]
+    pub const fn patch(path: &'static str, summary: &'static str) -> Self {
+        Self::new(ApiMethod::Patch, path, summary)
+    }
+
+    #[inline]
+    pub const fn delete(path: &'static str, summary: &'static str) -> Self {
+        Self::new(ApiMethod::Delete, path, summary)
+    }
+
+    #[inline]
+    pub const fn auth(mut self) -> Self {
+        self.auth = Auth::Required;
+        self
+    }
+
+    #[inline]
+    pub const fn optional_auth(mut self) -> Self {
+        self.auth = Auth::Optional;
+        self
+    }
+
+    #[inline]
+    pub const fn query(mut self, query: Schema) -> Self {
+        self.query = Some(query);
+        self
+    }
+
+    #[inline]
+    pub const fn request(mut self, request: Content) -> Self {
+        self.request = Some(request);
+        self
+    }
+
+    #[inline]
+    pub const fn response(mut self, response: Content) -> Self {
+        self.response = response;
+        self
+    }
+
+    #[inline]
+    pub const fn errors(mut self, errors: &'static [u32]) -> Self {
+        self.errors = errors;
+        self
+    }
+
+    fn operation(
+        &self,
+        path_params: Vec<&str>,
+        schemas: &mut Map<String, Value>,
+    ) -> Value {
+        let mut parameters = path_params
+            .into_iter()
+            .map(|name| {
+                json!({
+                    "name": name,
+                    "in": "path",
+                    "required": true,
+                    "schema": { "type": "string" },
+                })
+            })
+            .collect::<Vec<_>>();
+        if let Some((_, fields)) = self.query.and_then(Schema::fields) {
+            parameters.extend(fields.iter().map(|name| {
+                json!({
+                    "name": name,
+                    "in": "query",
+                    "schema": { "type": "string" },
+                })
+            }));
+        }
+
+        let mut responses = Map::new();
+        let (status, success) = match self.response.content(schemas) {
+            Some(content) => (
+                "200",
+                json!({ "description": "Success", "content": content }),
+            ),
+            None => ("204", json!({ "description": "Success" })),
+        };
+        responses.insert(status.into(), success);
+
+        for (status, codes) in self.error_codes() {
+            let description = StatusCode::from_u16(status)
+                .ok()
+                .and_then(|status| status.canonical_reason())
+                .unwrap_or("Error");
+            let schema = json!({
+                "allOf": [
+                    { "$ref": "#/components/schemas/ErrorResponse" },
+                    { "properties": { "error_code": { "enum": codes } } },
+                ],
+            });
+            responses.insert(
+                status.to_string(),
+                json!({
+                    "description": description,
+                    "content": { "application/json": { "schema": schema } },
+                }),
+            );
+        }
+
+        let mut operation = json!({
+            "summary": self.summary,
+            "responses": responses,
+        });
+        if !parameters.is_empty() {
+            operation["parameters"] = parameters.into();
+        }
+        if let Some(content) =
+            self.request.and_then(|request| request.content(schemas))
+        {
+            operation["requestBody"] =
+                json!({ "required": true, "content": content });
+        }
+        match self.auth {
+            Auth::None => {}
+            Auth::Optional => {
+                operation["security"] = json!([{}, { "bearer": [] }]);
+            }
+            Auth::Required => {
+                operation["security"] = json!([{ "bearer": [] }]);
+            }
+        }
+        operation
+    }
+
+    /// The error codes of the route grouped by their status.
+    fn error_codes(&self) -> BTreeMap<u16, Vec<u32>> {
+        let mut codes = self.errors.to_vec();
+        codes.extend(SERVER_ERRORS);
+        match self.auth {
+            Auth::None => {}
+            Auth::Optional => codes.extend(OPTIONAL_AUTH_ERRORS),
+            Auth::Required => codes.extend(AUTH_ERRORS),
+        }
+        if self.method != ApiMethod::Get {
+            codes.extend(WRITE_ERRORS);
+        }
+        codes.sort_unstable();
+        codes.dedup();
+
+        let mut by_status = BTreeMap::<u16, Vec<u32>>::new();
+        for code in codes {
+            let status = ERROR_CODES
+                .iter()
+                .find(|listed| listed.code == code)
+                .map_or(StatusCode::INTERNAL_SERVER_ERROR, |listed| {
+                    listed.status
+                });
+            by_status.entry(status.as_u16()).or_default().push(code);
+        }
+        by_status
+    }
+}
+
+/// A router keeping the spec of each route it registers, to generate the
+/// OpenAPI document from the routes actually served.
+pub struct ApiRouter<S = ()> {
+    router: Router<S>,
+    routes: Vec<(String, RouteSpec)>,
+}
+
+impl<S> Default for ApiRouter<S>
+where
+    S: Clone + Send + Sync + 'static,
+{
+    #[inline]
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl<S> ApiRouter<S>
+where
+    S: Clone + Send + Sync + 'static,
+{
+    #[inline]
+    pub fn new() -> Self {
+        Self {
+            router: Router::new(),
+            routes: Vec::new(),
+        }
+    }
+
+    pub fn route<H, T>(self, spec: RouteSpec, handler: H) -> Self
+    where
+        H: Handler<T, S>,
+        T: 'static,
+    {
+        let method_router = routing::on(spec.method.filter(), handler);
+        self.add(spec, method_router)
+    }
+
+    /// Registers a route without the default body limit, for the uploads
+    /// that are limited while they are streamed instead.
+    pub fn route_unlimited<H, T>(self, spec: RouteSpec, handler: H) -> Self
+    where
+        H: Handler<T, S>,
+        T: 'static,
+    {
+        let method_router = routing::on(spec.method.filter(), handler)
+            .layer(DefaultBodyLimit::disable());
+        self.add(spec, method_router)
+    }
+
+    /// Registers a route disabled by the configuration, which is left out of
+    /// the document.
+    pub fn disabled(mut self, spec: RouteSpec) -> Self {
+        self.router = self.router.route(
+            spec.path,
+            routing::on(spec.method.filter(), route_disabled),
+        );
+        self
+    }
+
+    pub fn nest(mut self, path: &str, api: ApiRouter<S>) -> Self {
+        self.router = self.router.nest(path, api.router);
+        self.routes
+            .extend(api.routes.into_iter().map(|(route, spec)| {
+                let route = match route.as_str() {
+                    "/" => path.to_owned(),
+                    route => format!("{path}{route}"),
+                };
+                (route, spec)
+            }));
+        self
+    }
+
+    /// Serves the document of the registered routes at [`OPENAPI_PATH`].
+    pub fn into_router(mut self) -> Router<S> {
+        self.routes.push((OPENAPI_PATH.to_owned(), OPENAPI));
+        let document = Bytes::from(document(&self.routes).to_string());
+
+        self.router.route(
+            OPENAPI_PATH,
+            routing::get(move || async move {
+                ([(header::CONTENT_TYPE, "application/json")], document)
+            }),
+        )
+    }
+
+    fn add(mut self, spec: RouteSpec, method_router: MethodRouter<S>) -> Self {
+        self.router = self.router.route(spec.path, method_router);
+        self.routes.push((spec.path.to_owned(), spec));
+        self
+    }
+}
+
+fn document(routes: &[(String, RouteSpec)]) -> Value {
+    let mut paths = BTreeMap::<String, Map<String, Value>>::new();
+    let mut schemas = Map::new();
+
+    for (path, spec) in routes {
+        let (path, params) = path_params(path);
+        let operation = spec.operation(params, &mut schemas);
+        paths
+            .entry(path)
+            .or_default()
+            .insert(spec.method.as_str().into(), operation);
+    }
+    schemas.insert("ErrorResponse".into(), error_response_schema());
+
+    json!({
+        "openapi": "3.0.3",
+        "info": { "title": "downloader", "version": VERSION },
+        "paths": paths,
+        "components": {
+            "schemas": schemas,
+            "securitySchemes": {
+                "bearer": { "type": "http", "scheme": "bearer" },
+            },
+        },
+    })
+}
+
+/// Turns the axum `:param` segments into the OpenAPI `{param}` ones,
+/// returning the names of the parameters.
+fn path_params(path: &str) -> (String, Vec<&str>) {
+    let mut params = Vec::new();
+    let segments = path
+        .split('/')
+        .map(|segment| match segment.strip_prefix(':') {
+            Some(param) => {
+                params.push(param);
+                format!("{{{param}}}")
+            }
+            None => segment.to_owned(),
+        })
+        .collect::<Vec<_>>();
+
+    (segments.join("/"), params)
+}
+
+fn error_response_schema() -> Value {
+    let codes = ERROR_CODES
+        .iter()
+        .map(|listed| listed.code)
+        .collect::<Vec<_>>();
+    let description = ERROR_CODES
+        .iter()
+        .map(|listed| format!("* `{}`: {}", listed.code, listed.description))
+        .collect::<Vec<_>>()
+        .join("\n");
+
+    json!({
+        "type": "object",
+        "required": ["error", "error_code"],
+        "properties": {
+            "error": { "type": "string" },
+            "error_code": {
+                "type": "integer",
+                "enum": codes,
+                "description": description,
+            },
+            "errors": {
+                "type": "array",
+                "items": {
+                    "type": "object",
+                    "properties": {
+                        "field": { "type": "string" },
+                        "rule": { "type": "string" },
+                        "message": { "type": "string" },
+                    },
+                },
+            },
+        },
+    })
+}
+
+/// Reads the name and fields of `T` by deserializing it from a deserializer
+/// that only records what the struct asks for.
+pub fn struct_fields<T: DeserializeOwned>() -> Option<StructFields> {
+    match T::deserialize(FieldsTracer) {
+        Ok(_) => None,
+        Err(Traced(fields)) => fields,
+    }
+}
+
+#[derive(Debug)]
+struct Traced(Option<StructFields>);
+
+impl fmt::Display for Traced {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("traced the fields of the type")
+    }
+}
+
+impl std::error::Error for Traced {}
+
+impl de::Error for Traced {
+    #[inline]
+    fn custom<T: fmt::Display>(_: T) -> Self {
+        Traced(None)
+    }
+}
+
+struct FieldsTracer;
+
+impl<'de> Deserializer<'de> for FieldsTracer {
+    type Error = Traced;
+
+    #[inline]
+    fn deserialize_any<V: Visitor<'de>>(
+        self,
+        _: V,
+    ) -> Result<V::Value, Self::Error> {
+        Err(Traced(None))
+    }
+
+    #[inline]
+    fn deserialize_struct<V: Visitor<'de>>(
+        self,
+        name: &'static str,
+        fields: &'static [&'static str],
+        _: V,
+    ) -> Result<V::Value, Self::Error> {
+        Err(Traced(Some((name, fields))))
+    }
+
+    forward_to_deserialize_any! {
+        bool i8 i16 i32 i64 i128 u8 u16 u32 u64 u128 f32 f64 char str string
+        bytes byte_buf option unit unit_struct newtype_struct seq tuple
+        tuple_struct map enum identifier ignored_any
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use serde::Deserialize;
+    use test_log::test;
+    use uuid::Uuid;
+
+    use super::{path_params, struct_fields};
+
+    #[derive(Deserialize)]
+    #[serde(rename_all = "camelCase")]
+    #[allow(dead_code)]
+    struct RequestData {
+        file_name: String,
+        #[serde(default)]
+        max_size: Option<u64>,
+    }
+
+    #[test]
+    fn test_struct_fields() {
+        assert_eq!(
+            struct_fields::<RequestData>(),
+            Some(("RequestData", &["fileName", "maxSize"][..])),
+        );
+        assert_eq!(struct_fields::<Vec<Uuid>>(), None);
+        assert_eq!(struct_fields::<String>(), None);
+    }
+
+    #[test]
+    fn test_path_params() {
+        assert_eq!(
+            path_params("/api/file/:id/data/:name"),
+            ("/api/file/{id}/data/{name}".to_owned(), vec!["id", "name"]),
+        );
+        assert_eq!(path_params("/readyz"), ("/readyz".to_owned(), vec![]));
+    }
+}
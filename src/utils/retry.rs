@@ -0,0 +1,145 @@
+use std::{fmt::Display, future::Future, time::Duration};
+
+use rand::Rng;
+
+/// Longest wait between two attempts, however many were made.
+const MAX_DELAY: Duration = Duration::from_secs(2);
+
+/// Bounded retries with exponential backoff. Each wait is drawn between half
+/// and the whole of `base * 2^attempt`, so concurrent requests that failed
+/// together don't retry in lockstep.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct Backoff {
+    pub retries: u32,
+    pub base: Duration,
+}
+
+impl Backoff {
+    pub const fn new(retries: u32, base: Duration) -> Self {
+        Self { retries, base }
+    }
+
+    /// How long to wait before the retry number `attempt`, starting at 0.
+    pub fn delay(&self, attempt: u32) -> Duration {
+        let ceiling = self
+            .base
+            .saturating_mul(1 << attempt.min(16))
+            .min(MAX_DELAY);
+
+        let half = ceiling / 2;
+        half + rand::thread_rng().gen_range(Duration::ZERO..=half)
+    }
+
+    /// Runs `op` until it succeeds, fails with an error `is_transient`
+    /// rejects or runs out of retries, returning the last result.
+    pub async fn retry<T, E, F, Fut>(
+        &self,
+        mut op: F,
+        is_transient: impl Fn(&E) -> bool,
+    ) -> Result<T, E>
+    where
+        E: Display,
+        F: FnMut() -> Fut,
+        Fut: Future<Output = Result<T, E>>,
+    {
+        let mut attempt = 0;
+
+        loop {
+            match op().await {
+                Err(error)
+                    if attempt < self.retries && is_transient(&error) =>
+                {
+                    let delay = self.delay(attempt);
+                    tracing::warn!(
+                        target: "retry",
+                        %error,
+                        attempt = attempt + 1,
+                        ?delay,
+                        "transient failure, retrying",
+                    );
+
+                    tokio::time::sleep(delay).await;
+                    attempt += 1;
+                }
+                res => return res,
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        io::{self, ErrorKind},
+        time::Duration,
+    };
+
+    use test_log::test;
+
+    use super::{Backoff, MAX_DELAY};
+
+    #[test]
+    fn test_delay() {
+        let backoff = Backoff::new(3, Duration::from_millis(100));
+
+        for attempt in 0..4 {
+            let ceiling = Duration::from_millis(100 << attempt);
+            for _ in 0..16 {
+                let delay = backoff.delay(attempt);
+                assert!(delay >= ceiling / 2 && delay <= ceiling);
+            }
+        }
+
+        assert!(backoff.delay(u32::MAX) <= MAX_DELAY);
+    }
+
+    #[test(tokio::test)]
+    async fn test_retry() {
+        let backoff = Backoff::new(2, Duration::from_millis(1));
+        let transient = |e: &io::Error| e.kind() == ErrorKind::TimedOut;
+
+        let mut calls = 0;
+        let res = backoff
+            .retry(
+                || {
+                    calls += 1;
+                    let res = match calls {
+                        3 => Ok(calls),
+                        _ => Err(io::Error::from(ErrorKind::TimedOut)),
+                    };
+                    async move { res }
+                },
+                transient,
+            )
+            .await;
+        assert_eq!(res.unwrap(), 3);
+
+        // Out of retries
+        let mut calls = 0;
+        let res = backoff
+            .retry(
+                || {
+                    calls += 1;
+                    async { Err::<(), _>(io::Error::from(ErrorKind::TimedOut)) }
+                },
+                transient,
+            )
+            .await;
+        assert!(res.is_err());
+        assert_eq!(calls, 3);
+
+        // Permanent errors are never retried
+        let mut calls = 0;
+        let res = backoff
+            .retry(
+                || {
+                    calls += 1;
+                    async { Err::<(), _>(io::Error::from(ErrorKind::NotFound)) }
+                },
+                transient,
+            )
+            .await;
+        assert!(res.is_err());
+        assert_eq!(calls, 1);
+    }
+}
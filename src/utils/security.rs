@@ -0,0 +1,168 @@
+use std::sync::Arc;
+
+use axum::{
+    extract::Request,
+    http::{header, HeaderMap, HeaderValue},
+    middleware::Next,
+    response::Response,
+    Extension,
+};
+
+use crate::config::HeadersConfig;
+
+/// Only the api responses get the content security policy, which would
+/// break the embedded frontend.
+const API_PREFIX: &str = "/api/";
+
+/// Security headers added to the responses that don't set them already.
+pub struct SecurityHeaders {
+    headers: HeaderMap,
+    api_headers: HeaderMap,
+}
+
+impl SecurityHeaders {
+    /// The strict transport security is only sent if `tls` is. The values
+    /// must have been checked by [`crate::config::Config::validate`].
+    pub fn from_config(cfg: &HeadersConfig, tls: bool) -> Self {
+        let mut headers = HeaderMap::new();
+        let mut api_headers = HeaderMap::new();
+
+        if cfg.nosniff {
+            headers.insert(
+                header::X_CONTENT_TYPE_OPTIONS,
+                HeaderValue::from_static("nosniff"),
+            );
+        }
+        if !cfg.frame_options.is_empty() {
+            headers.insert(
+                header::X_FRAME_OPTIONS,
+                HeaderValue::from_str(&cfg.frame_options)
+                    .expect("invalid frame options"),
+            );
+        }
+        if tls && !cfg.hsts_max_age.is_zero() {
+            headers.insert(
+                header::STRICT_TRANSPORT_SECURITY,
+                HeaderValue::from_str(&format!(
+                    "max-age={}",
+                    cfg.hsts_max_age.as_secs(),
+                ))
+                .unwrap(),
+            );
+        }
+        if !cfg.content_security_policy.is_empty() {
+            api_headers.insert(
+                header::CONTENT_SECURITY_POLICY,
+                HeaderValue::from_str(&cfg.content_security_policy)
+                    .expect("invalid content security policy"),
+            );
+        }
+
+        Self {
+            headers,
+            api_headers,
+        }
+    }
+}
+
+pub async fn set_security_headers(
+    Extension(security): Extension<Arc<SecurityHeaders>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let api = req.uri().path().starts_with(API_PREFIX);
+    let mut res = next.run(req).await;
+
+    let api_headers = api.then_some(&security.api_headers);
+    let headers = res.headers_mut();
+    for (name, value) in security
+        .headers
+        .iter()
+        .chain(api_headers.into_iter().flatten())
+    {
+        headers.entry(name).or_insert_with(|| value.clone());
+    }
+
+    res
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{sync::Arc, time::Duration};
+
+    use axum::{
+        body::Body,
+        http::{header, Request},
+        middleware, routing, Extension, Router,
+    };
+    use test_log::test;
+    use tower::ServiceExt;
+
+    use crate::config::HeadersConfig;
+
+    use super::{set_security_headers, SecurityHeaders};
+
+    fn app(security: SecurityHeaders) -> Router {
+        Router::new()
+            .route("/api/data", routing::get(|| async { "data" }))
+            .route("/index.html", routing::get(|| async { "page" }))
+            .route(
+                "/api/framed",
+                routing::get(|| async {
+                    ([(header::X_FRAME_OPTIONS, "SAMEORIGIN")], "framed")
+                }),
+            )
+            .layer(middleware::from_fn(set_security_headers))
+            .layer(Extension(Arc::new(security)))
+    }
+
+    fn get(uri: &str) -> Request<Body> {
+        Request::get(uri).body(Body::empty()).unwrap()
+    }
+
+    #[test(tokio::test)]
+    async fn test_default_headers() {
+        let cfg = HeadersConfig {
+            hsts_max_age: Duration::from_secs(3600),
+            ..Default::default()
+        };
+        let app = app(SecurityHeaders::from_config(&cfg, false));
+
+        let res = app.clone().oneshot(get("/api/data")).await.unwrap();
+        let headers = res.headers();
+        assert_eq!(headers[header::X_CONTENT_TYPE_OPTIONS], "nosniff");
+        assert_eq!(headers[header::X_FRAME_OPTIONS], "DENY");
+        assert_eq!(
+            headers[header::CONTENT_SECURITY_POLICY],
+            "default-src 'none'; sandbox",
+        );
+        // Not sent without TLS
+        assert!(!headers.contains_key(header::STRICT_TRANSPORT_SECURITY));
+
+        let res = app.clone().oneshot(get("/index.html")).await.unwrap();
+        assert_eq!(res.headers()[header::X_CONTENT_TYPE_OPTIONS], "nosniff");
+        assert!(!res.headers().contains_key(header::CONTENT_SECURITY_POLICY));
+
+        // The ones set by the handler are kept
+        let res = app.oneshot(get("/api/framed")).await.unwrap();
+        assert_eq!(res.headers()[header::X_FRAME_OPTIONS], "SAMEORIGIN");
+    }
+
+    #[test(tokio::test)]
+    async fn test_configured_headers() {
+        let cfg = HeadersConfig {
+            nosniff: false,
+            frame_options: String::new(),
+            content_security_policy: String::new(),
+            hsts_max_age: Duration::from_secs(3600),
+        };
+        let app = app(SecurityHeaders::from_config(&cfg, true));
+
+        let res = app.oneshot(get("/api/data")).await.unwrap();
+        let headers = res.headers();
+        assert_eq!(headers[header::STRICT_TRANSPORT_SECURITY], "max-age=3600");
+        assert!(!headers.contains_key(header::X_CONTENT_TYPE_OPTIONS));
+        assert!(!headers.contains_key(header::X_FRAME_OPTIONS));
+        assert!(!headers.contains_key(header::CONTENT_SECURITY_POLICY));
+    }
+}
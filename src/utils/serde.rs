@@ -160,6 +160,16 @@ impl<'de> Visitor<'de> for NumberSocketAddrVisitor {
     {
         visit_any_n(v)
     }
+    /// Addresses, or ports given as strings, like the environment does.
+    fn visit_str<E>(self, v: &str) -> Result<Self::Value, E>
+    where
+        E: serde::de::Error,
+    {
+        match v.parse::<u16>() {
+            Ok(port) => visit_any_n(port),
+            Err(..) => v.parse().map_err(serde::de::Error::custom),
+        }
+    }
 }
 
 pub fn deserialize_socket_addr<'de, D: Deserializer<'de>>(
@@ -168,6 +178,25 @@ pub fn deserialize_socket_addr<'de, D: Deserializer<'de>>(
     deserializer.deserialize_any(NumberSocketAddrVisitor)
 }
 
+/// Accepts either a single value or a list of them.
+pub fn one_or_many<'de, D, T>(deserializer: D) -> Result<Vec<T>, D::Error>
+where
+    D: Deserializer<'de>,
+    T: Deserialize<'de>,
+{
+    #[derive(Deserialize)]
+    #[serde(untagged)]
+    enum OneOrMany<T> {
+        One(T),
+        Many(Vec<T>),
+    }
+
+    match OneOrMany::deserialize(deserializer)? {
+        OneOrMany::One(v) => Ok(vec![v]),
+        OneOrMany::Many(v) => Ok(v),
+    }
+}
+
 pub mod duration_secs {
     use std::time::Duration;
 
@@ -189,6 +218,33 @@ pub mod duration_secs {
     }
 }
 
+/// Permissions written as their names, like `READ_ALL | SHARE`, instead of
+/// their bits.
+pub mod permission_names {
+    use serde::{Deserialize, Deserializer, Serialize, Serializer};
+
+    use crate::auth::Permission;
+
+    pub fn serialize<S: Serializer>(
+        permission: &Permission,
+        serializer: S,
+    ) -> Result<S::Ok, S::Error> {
+        let mut names = String::new();
+        bitflags::parser::to_writer(permission, &mut names)
+            .map_err(serde::ser::Error::custom)?;
+        names.serialize(serializer)
+    }
+
+    pub fn deserialize<'de, D: Deserializer<'de>>(
+        deserializer: D,
+    ) -> Result<Permission, D::Error> {
+        let names = String::deserialize(deserializer)?;
+        bitflags::parser::from_str(&names).map_err(|err| {
+            serde::de::Error::custom(format!("invalid permission: {err}"))
+        })
+    }
+}
+
 pub mod base64 {
     use base64::{prelude::BASE64_STANDARD as BASE64, Engine};
     use serde::{Deserialize, Deserializer, Serialize, Serializer};
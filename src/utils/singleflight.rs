@@ -0,0 +1,164 @@
+use std::{collections::HashMap, future::Future, hash::Hash, sync::Mutex};
+
+use tokio::sync::watch;
+
+type Calls<K, V> = Mutex<HashMap<K, watch::Receiver<Option<V>>>>;
+
+/// Coalesces the concurrent calls with the same key, so only the first one
+/// runs and the others wait for its result.
+pub struct Singleflight<K, V> {
+    calls: Calls<K, V>,
+}
+
+impl<K, V> Default for Singleflight<K, V> {
+    fn default() -> Self {
+        Self {
+            calls: Mutex::default(),
+        }
+    }
+}
+
+/// Removes the call once it finished, or was cancelled.
+struct Call<'a, K: Eq + Hash, V> {
+    calls: &'a Calls<K, V>,
+    key: &'a K,
+}
+
+impl<K: Eq + Hash, V> Drop for Call<'_, K, V> {
+    fn drop(&mut self) {
+        self.calls.lock().unwrap().remove(self.key);
+    }
+}
+
+impl<K, V> Singleflight<K, V>
+where
+    K: Eq + Hash + Clone,
+    V: Clone,
+{
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Runs `f`, unless a call with the same `key` is running, returning its
+    /// result instead. If that call is cancelled, one of the waiting ones
+    /// runs `f` in its place.
+    pub async fn run<F, Fut>(&self, key: K, f: F) -> V
+    where
+        F: FnOnce() -> Fut,
+        Fut: Future<Output = V>,
+    {
+        loop {
+            let (sender, mut receiver) = {
+                let mut calls = self.calls.lock().unwrap();
+                match calls.get(&key) {
+                    Some(receiver) => (None, receiver.clone()),
+                    None => {
+                        let (sender, receiver) = watch::channel(None);
+                        calls.insert(key.clone(), receiver.clone());
+                        (Some(sender), receiver)
+                    }
+                }
+            };
+
+            let Some(sender) = sender else {
+                if let Ok(value) = receiver.wait_for(Option::is_some).await {
+                    return value.clone().unwrap();
+                }
+                continue;
+            };
+
+            let _call = Call {
+                calls: &self.calls,
+                key: &key,
+            };
+            let value = f().await;
+            sender.send_replace(Some(value.clone()));
+            return value;
+        }
+    }
+
+    /// Calls running at the moment.
+    pub fn running(&self) -> usize {
+        self.calls.lock().unwrap().len()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        sync::{
+            atomic::{AtomicUsize, Ordering},
+            Arc,
+        },
+        time::Duration,
+    };
+
+    use test_log::test;
+    use tokio::sync::Notify;
+
+    use super::Singleflight;
+
+    #[test(tokio::test)]
+    async fn test_run_coalesced() {
+        let group = Arc::new(Singleflight::<u32, u32>::new());
+        let runs = Arc::new(AtomicUsize::new(0));
+        let release = Arc::new(Notify::new());
+
+        let mut tasks = Vec::new();
+        for _ in 0..8 {
+            let (group, runs, release) =
+                (group.clone(), runs.clone(), release.clone());
+            tasks.push(tokio::spawn(async move {
+                group
+                    .run(1, || async move {
+                        runs.fetch_add(1, Ordering::SeqCst);
+                        release.notified().await;
+                        42
+                    })
+                    .await
+            }));
+        }
+
+        while runs.load(Ordering::SeqCst) == 0 {
+            tokio::time::sleep(Duration::from_millis(5)).await;
+        }
+        tokio::time::sleep(Duration::from_millis(20)).await;
+        release.notify_one();
+
+        for task in tasks {
+            assert_eq!(task.await.unwrap(), 42);
+        }
+        assert_eq!(runs.load(Ordering::SeqCst), 1);
+        assert_eq!(group.running(), 0);
+
+        // Finished calls are not reused
+        assert_eq!(group.run(1, || async { 7 }).await, 7);
+    }
+
+    #[test(tokio::test)]
+    async fn test_run_cancelled() {
+        let group = Arc::new(Singleflight::<u32, u32>::new());
+
+        let leader = tokio::spawn({
+            let group = group.clone();
+            async move { group.run(1, std::future::pending).await }
+        });
+        while group.running() == 0 {
+            tokio::time::sleep(Duration::from_millis(5)).await;
+        }
+
+        let follower = tokio::spawn({
+            let group = group.clone();
+            async move { group.run(1, || async { 7 }).await }
+        });
+        tokio::time::sleep(Duration::from_millis(20)).await;
+        leader.abort();
+
+        let value = tokio::time::timeout(Duration::from_secs(1), follower)
+            .await
+            .expect("follower did not take over")
+            .unwrap();
+        assert_eq!(value, 7);
+        assert_eq!(group.running(), 0);
+    }
+}
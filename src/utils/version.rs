@@ -0,0 +1,53 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+
+pub const VERSION: &str = env!("CARGO_PKG_VERSION");
+/// Abbreviated hash of the built commit, `unknown` when built outside of
+/// the git checkout.
+pub const GIT_COMMIT: &str = env!("DOWNLOADER_GIT_COMMIT");
+/// Seconds since the unix epoch.
+pub const BUILD_TIMESTAMP: &str = env!("DOWNLOADER_BUILD_TIMESTAMP");
+
+/// Shown by `--version`.
+pub const LONG_VERSION: &str = concat!(
+    env!("CARGO_PKG_VERSION"),
+    " (",
+    env!("DOWNLOADER_GIT_COMMIT"),
+    ")"
+);
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct BuildInfo {
+    pub version: String,
+    pub git_commit: String,
+    pub build_date: Option<DateTime<Utc>>,
+}
+
+impl BuildInfo {
+    pub fn current() -> Self {
+        Self {
+            version: VERSION.into(),
+            git_commit: GIT_COMMIT.into(),
+            build_date: BUILD_TIMESTAMP
+                .parse()
+                .ok()
+                .and_then(|secs| DateTime::from_timestamp(secs, 0)),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use test_log::test;
+
+    use super::{BuildInfo, VERSION};
+
+    #[test]
+    fn test_build_info() {
+        let info = BuildInfo::current();
+
+        assert_eq!(info.version, VERSION);
+        assert!(!info.git_commit.is_empty());
+        assert!(info.build_date.is_some());
+    }
+}
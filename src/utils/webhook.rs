@@ -0,0 +1,627 @@
+use std::{
+    io,
+    path::PathBuf,
+    sync::{Arc, Mutex as StdMutex},
+    time::Duration,
+};
+
+use bytes::Bytes;
+use chrono::{DateTime, Utc};
+use reqwest::{header, StatusCode};
+use ring::hmac;
+use serde::{Deserialize, Serialize};
+use tokio::{
+    fs::OpenOptions,
+    io::AsyncWriteExt,
+    select,
+    sync::{
+        mpsc::{self, error::TrySendError},
+        Notify, Semaphore,
+    },
+    task::JoinHandle,
+};
+use uuid::Uuid;
+
+use crate::config::WebhookConfig;
+
+use super::retry::Backoff;
+
+/// Header with the HMAC-SHA256 of the body, as `sha256=<hex>`.
+pub const SIGNATURE_HEADER: &str = "X-Downloader-Signature";
+
+/// Deliveries running at once, the others waiting in the queue.
+const MAX_CONCURRENT_DELIVERIES: usize = 16;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum WebhookEventKind {
+    #[serde(rename = "file.created")]
+    FileCreated,
+    #[serde(rename = "file.deleted")]
+    FileDeleted,
+    #[serde(rename = "file.transferred")]
+    FileTransferred,
+    /// The server is shutting down and stopped taking requests.
+    #[serde(rename = "server.offline")]
+    ServerOffline,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct WebhookEvent {
+    /// Unique to the event, so receivers can ignore the retried deliveries
+    /// they already processed.
+    pub id: Uuid,
+    #[serde(rename = "type")]
+    pub kind: WebhookEventKind,
+    /// The file the event is about, none for the server events.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub file_id: Option<Uuid>,
+    /// The user that made the request, if any.
+    pub user_id: Option<Uuid>,
+    /// The new owner of a transferred file.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub to_user_id: Option<Uuid>,
+    pub time: DateTime<Utc>,
+}
+
+impl WebhookEvent {
+    pub fn new(
+        kind: WebhookEventKind,
+        file_id: Uuid,
+        user_id: Option<Uuid>,
+    ) -> Self {
+        Self {
+            id: Uuid::new_v4(),
+            kind,
+            file_id: Some(file_id),
+            user_id,
+            to_user_id: None,
+            time: Utc::now(),
+        }
+    }
+
+    pub fn server_offline() -> Self {
+        Self {
+            id: Uuid::new_v4(),
+            kind: WebhookEventKind::ServerOffline,
+            file_id: None,
+            user_id: None,
+            to_user_id: None,
+            time: Utc::now(),
+        }
+    }
+
+    pub fn with_to_user(mut self, to_user_id: Uuid) -> Self {
+        self.to_user_id = Some(to_user_id);
+        self
+    }
+}
+
+#[derive(Debug, thiserror::Error)]
+enum DeliveryError {
+    #[error("request failed: {0}")]
+    Request(#[from] reqwest::Error),
+    #[error("receiver answered {0}")]
+    Status(StatusCode),
+    #[error("delivery queue is full")]
+    QueueFull,
+}
+
+impl DeliveryError {
+    fn is_transient(&self) -> bool {
+        match self {
+            DeliveryError::Request(..) => true,
+            DeliveryError::Status(status) => {
+                status.is_server_error()
+                    || *status == StatusCode::TOO_MANY_REQUESTS
+            }
+            DeliveryError::QueueFull => false,
+        }
+    }
+}
+
+/// An event that could not be delivered, as written to the dead letter
+/// file.
+#[derive(Serialize)]
+struct DeadLetter<'a> {
+    event: &'a WebhookEvent,
+    error: String,
+}
+
+/// Returns the signature of `body` sent in [`SIGNATURE_HEADER`].
+pub fn sign(secret: &[u8], body: &[u8]) -> String {
+    let key = hmac::Key::new(hmac::HMAC_SHA256, secret);
+    format!("sha256={}", hex::encode(hmac::sign(&key, body)))
+}
+
+struct Dispatcher {
+    client: reqwest::Client,
+    url: String,
+    secret: Vec<u8>,
+    backoff: Backoff,
+    dead_letter_file: Option<PathBuf>,
+}
+
+impl Dispatcher {
+    async fn deliver(&self, event: &WebhookEvent) -> Result<(), DeliveryError> {
+        let body = Bytes::from(
+            serde_json::to_vec(event).expect("failed to serialize the event"),
+        );
+        let signature = sign(&self.secret, &body);
+        let (body, signature) = (&body, &signature);
+
+        let post = move || self.post(body.clone(), signature);
+
+        self.backoff.retry(post, DeliveryError::is_transient).await
+    }
+
+    /// Delivers `event` once, without retrying.
+    async fn deliver_once(
+        &self,
+        event: &WebhookEvent,
+    ) -> Result<(), DeliveryError> {
+        let body = Bytes::from(
+            serde_json::to_vec(event).expect("failed to serialize the event"),
+        );
+        let signature = sign(&self.secret, &body);
+        self.post(body, &signature).await
+    }
+
+    async fn post(
+        &self,
+        body: Bytes,
+        signature: &str,
+    ) -> Result<(), DeliveryError> {
+        let res = self
+            .client
+            .post(&self.url)
+            .header(header::CONTENT_TYPE, "application/json")
+            .header(SIGNATURE_HEADER, signature)
+            .body(body)
+            .send()
+            .await?;
+
+        match res.status() {
+            status if status.is_success() => Ok(()),
+            status => Err(DeliveryError::Status(status)),
+        }
+    }
+
+    /// Gives up on `event`, writing it to the dead letter file.
+    async fn dead_letter(&self, event: &WebhookEvent, error: &DeliveryError) {
+        if let Err(error) = self.write_dead_letter(event, error).await {
+            tracing::error!(
+                target: "webhook",
+                %error,
+                "failed to write the dead letter file",
+            );
+        }
+    }
+
+    async fn write_dead_letter(
+        &self,
+        event: &WebhookEvent,
+        error: &DeliveryError,
+    ) -> io::Result<()> {
+        tracing::error!(
+            target: "webhook",
+            %error,
+            ?event,
+            "failed to deliver webhook event",
+        );
+
+        let Some(path) = &self.dead_letter_file else {
+            return Ok(());
+        };
+
+        let mut line = serde_json::to_vec(&DeadLetter {
+            event,
+            error: error.to_string(),
+        })?;
+        line.push(b'\n');
+
+        let mut file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .await?;
+        file.write_all(&line).await?;
+        file.sync_data().await
+    }
+}
+
+/// Posts the file lifecycle events to the configured url without making the
+/// requests wait for it, retrying the failed deliveries.
+#[derive(Clone, Default)]
+pub struct Webhooks {
+    inner: Option<Arc<Inner>>,
+}
+
+struct Inner {
+    sender: mpsc::Sender<WebhookEvent>,
+    dispatcher: Arc<Dispatcher>,
+    close: Arc<Notify>,
+    worker: StdMutex<Option<JoinHandle<()>>>,
+}
+
+impl Webhooks {
+    /// Webhooks that drop every event.
+    pub fn disabled() -> Self {
+        Self::default()
+    }
+
+    pub fn new(cfg: &WebhookConfig) -> Self {
+        let Some(url) = &cfg.url else {
+            return Self::disabled();
+        };
+
+        let client = reqwest::Client::builder()
+            .timeout(cfg.timeout)
+            .build()
+            .expect("failed to build the http client");
+
+        let dispatcher = Arc::new(Dispatcher {
+            client,
+            url: url.clone(),
+            secret: cfg.secret.as_bytes().to_vec(),
+            backoff: Backoff::new(
+                cfg.retries,
+                Duration::from_millis(cfg.retry_delay_ms),
+            ),
+            dead_letter_file: cfg.dead_letter_file.clone(),
+        });
+
+        let (sender, mut receiver) =
+            mpsc::channel::<WebhookEvent>(cfg.queue_size);
+        let permits = Arc::new(Semaphore::new(MAX_CONCURRENT_DELIVERIES));
+        let close = Arc::new(Notify::new());
+
+        let worker = tokio::spawn({
+            let dispatcher = dispatcher.clone();
+            let close = close.clone();
+            async move {
+                loop {
+                    let event = select! {
+                        event = receiver.recv() => event,
+                        _ = close.notified() => {
+                            // The queued events are still delivered
+                            receiver.close();
+                            continue;
+                        }
+                    };
+                    let Some(event) = event else {
+                        break;
+                    };
+
+                    let permit = permits.clone().acquire_owned().await.unwrap();
+                    let dispatcher = dispatcher.clone();
+
+                    tokio::spawn(async move {
+                        let _permit = permit;
+                        if let Err(error) = dispatcher.deliver(&event).await {
+                            dispatcher.dead_letter(&event, &error).await;
+                        }
+                    });
+                }
+
+                // Waits for the running deliveries
+                let _ = permits
+                    .acquire_many(MAX_CONCURRENT_DELIVERIES as u32)
+                    .await;
+            }
+        });
+
+        Self {
+            inner: Some(Arc::new(Inner {
+                sender,
+                dispatcher,
+                close,
+                worker: StdMutex::new(Some(worker)),
+            })),
+        }
+    }
+
+    /// Queues `event` to be delivered. If the queue is full, the event goes
+    /// to the dead letter file right away.
+    pub fn send(&self, event: WebhookEvent) {
+        let Some(inner) = &self.inner else {
+            return;
+        };
+
+        match inner.sender.try_send(event) {
+            Ok(()) => {}
+            Err(TrySendError::Full(event)) => {
+                let dispatcher = inner.dispatcher.clone();
+                tokio::spawn(async move {
+                    dispatcher
+                        .dead_letter(&event, &DeliveryError::QueueFull)
+                        .await;
+                });
+            }
+            Err(TrySendError::Closed(event)) => {
+                tracing::error!(
+                    target: "webhook",
+                    ?event,
+                    "webhook task is closed",
+                );
+            }
+        }
+    }
+
+    /// Tells the receiver the server is going offline, so it doesn't have to
+    /// wait for failed requests to notice. The events still queued are
+    /// delivered first, then the notification is sent once, waiting for it,
+    /// since the process is about to exit; a failure is only logged.
+    pub async fn notify_offline(&self) {
+        let Some(inner) = &self.inner else {
+            return;
+        };
+
+        inner.close.notify_one();
+        let worker = inner.worker.lock().unwrap().take();
+        if let Some(worker) = worker {
+            if let Err(error) = worker.await {
+                tracing::error!(target: "webhook", %error, "webhook task failed");
+            }
+        }
+
+        match inner
+            .dispatcher
+            .deliver_once(&WebhookEvent::server_offline())
+            .await
+        {
+            Ok(()) => {
+                tracing::info!(target: "webhook", "sent offline notification");
+            }
+            Err(error) => {
+                tracing::warn!(
+                    target: "webhook",
+                    %error,
+                    "failed to send offline notification",
+                );
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        sync::{
+            atomic::{AtomicUsize, Ordering},
+            Arc, Mutex,
+        },
+        time::Duration,
+    };
+
+    use axum::{
+        body::Bytes,
+        http::{HeaderMap, StatusCode},
+        routing, Extension, Router,
+    };
+    use test_log::test;
+    use tokio::net::TcpListener;
+    use uuid::Uuid;
+
+    use crate::config::WebhookConfig;
+
+    use super::{
+        sign, WebhookEvent, WebhookEventKind, Webhooks, SIGNATURE_HEADER,
+    };
+
+    const SECRET: &str = "secret";
+
+    #[derive(Default)]
+    struct Receiver {
+        attempts: AtomicUsize,
+        /// Attempts answered with an error before accepting the event.
+        failures: usize,
+        status: Option<StatusCode>,
+        events: Mutex<Vec<WebhookEvent>>,
+    }
+
+    async fn receive(
+        Extension(receiver): Extension<Arc<Receiver>>,
+        headers: HeaderMap,
+        body: Bytes,
+    ) -> StatusCode {
+        let attempt = receiver.attempts.fetch_add(1, Ordering::SeqCst);
+        if attempt < receiver.failures {
+            return receiver.status.unwrap();
+        }
+
+        let signature = headers.get(SIGNATURE_HEADER).unwrap();
+        assert_eq!(signature.to_str().unwrap(), sign(SECRET.as_bytes(), &body));
+
+        let event = serde_json::from_slice(&body).unwrap();
+        receiver.events.lock().unwrap().push(event);
+        StatusCode::NO_CONTENT
+    }
+
+    async fn serve(receiver: Arc<Receiver>) -> String {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+
+        let app = Router::new()
+            .route("/", routing::post(receive))
+            .layer(Extension(receiver));
+        tokio::spawn(async move { axum::serve(listener, app).await });
+
+        format!("http://{addr}/")
+    }
+
+    fn config(url: String) -> WebhookConfig {
+        WebhookConfig {
+            url: Some(url),
+            secret: SECRET.into(),
+            retries: 2,
+            retry_delay_ms: 1,
+            ..Default::default()
+        }
+    }
+
+    async fn wait_for(f: impl Fn() -> bool) {
+        for _ in 0..100 {
+            if f() {
+                return;
+            }
+            tokio::time::sleep(Duration::from_millis(10)).await;
+        }
+    }
+
+    #[test(tokio::test)]
+    async fn test_delivery_retried() {
+        let receiver = Arc::new(Receiver {
+            failures: 2,
+            status: Some(StatusCode::SERVICE_UNAVAILABLE),
+            ..Default::default()
+        });
+        let webhooks = Webhooks::new(&config(serve(receiver.clone()).await));
+
+        let event = WebhookEvent::new(
+            WebhookEventKind::FileCreated,
+            Uuid::new_v4(),
+            Some(Uuid::new_v4()),
+        );
+        webhooks.send(event.clone());
+
+        wait_for(|| !receiver.events.lock().unwrap().is_empty()).await;
+        assert_eq!(*receiver.events.lock().unwrap(), [event]);
+        assert_eq!(receiver.attempts.load(Ordering::SeqCst), 3);
+    }
+
+    #[test(tokio::test)]
+    async fn test_dead_letter() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("dead.log");
+
+        let receiver = Arc::new(Receiver {
+            failures: usize::MAX,
+            status: Some(StatusCode::BAD_REQUEST),
+            ..Default::default()
+        });
+        let webhooks = Webhooks::new(&WebhookConfig {
+            dead_letter_file: Some(path.clone()),
+            ..config(serve(receiver.clone()).await)
+        });
+
+        let event = WebhookEvent::new(
+            WebhookEventKind::FileDeleted,
+            Uuid::new_v4(),
+            None,
+        );
+        webhooks.send(event.clone());
+
+        wait_for(|| {
+            std::fs::read_to_string(&path).is_ok_and(|s| s.ends_with('\n'))
+        })
+        .await;
+        let line = tokio::fs::read_to_string(&path).await.unwrap();
+        let letter: serde_json::Value = serde_json::from_str(&line).unwrap();
+        assert_eq!(letter["event"]["id"], event.id.to_string());
+        assert_eq!(letter["event"]["type"], "file.deleted");
+
+        // Client errors are not retried
+        assert_eq!(receiver.attempts.load(Ordering::SeqCst), 1);
+    }
+
+    #[test(tokio::test)]
+    async fn test_queue_full() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("dead.log");
+
+        let receiver = Arc::new(Receiver::default());
+        let webhooks = Webhooks::new(&WebhookConfig {
+            dead_letter_file: Some(path.clone()),
+            queue_size: 1,
+            ..config(serve(receiver.clone()).await)
+        });
+
+        // The dispatcher doesn't run until this task yields
+        let events = (0..3)
+            .map(|_| {
+                WebhookEvent::new(
+                    WebhookEventKind::FileCreated,
+                    Uuid::new_v4(),
+                    None,
+                )
+            })
+            .collect::<Vec<_>>();
+        for event in &events {
+            webhooks.send(event.clone());
+        }
+
+        wait_for(|| {
+            std::fs::read_to_string(&path).is_ok_and(|s| s.lines().count() == 2)
+        })
+        .await;
+        let letters = tokio::fs::read_to_string(&path)
+            .await
+            .unwrap()
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect::<Vec<serde_json::Value>>();
+        for letter in &letters {
+            assert_eq!(letter["error"], "delivery queue is full");
+        }
+
+        wait_for(|| !receiver.events.lock().unwrap().is_empty()).await;
+        assert_eq!(*receiver.events.lock().unwrap(), events[..1]);
+    }
+
+    #[test(tokio::test)]
+    async fn test_notify_offline() {
+        let receiver = Arc::new(Receiver::default());
+        let webhooks = Webhooks::new(&config(serve(receiver.clone()).await));
+
+        webhooks.notify_offline().await;
+
+        let events = receiver.events.lock().unwrap();
+        assert_eq!(events.len(), 1);
+        assert_eq!(events[0].kind, WebhookEventKind::ServerOffline);
+        assert_eq!(events[0].file_id, None);
+    }
+
+    #[test(tokio::test)]
+    async fn test_notify_offline_drains_queue() {
+        let receiver = Arc::new(Receiver::default());
+        let webhooks = Webhooks::new(&config(serve(receiver.clone()).await));
+
+        let events = (0..4)
+            .map(|_| {
+                WebhookEvent::new(
+                    WebhookEventKind::FileDeleted,
+                    Uuid::new_v4(),
+                    None,
+                )
+            })
+            .collect::<Vec<_>>();
+        for event in &events {
+            webhooks.send(event.clone());
+        }
+        webhooks.notify_offline().await;
+
+        let received = receiver.events.lock().unwrap();
+        assert_eq!(received.len(), events.len() + 1);
+        for event in &events {
+            assert!(received.contains(event));
+        }
+        // Only sent once the queue was drained
+        assert_eq!(
+            received[events.len()].kind,
+            WebhookEventKind::ServerOffline
+        );
+    }
+
+    #[test(tokio::test)]
+    async fn test_notify_offline_unreachable() {
+        // Nothing listens on the port once the listener is dropped
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        drop(listener);
+
+        let webhooks = Webhooks::new(&config(format!("http://{addr}/")));
+        tokio::time::timeout(Duration::from_secs(5), webhooks.notify_offline())
+            .await
+            .expect("offline notification was retried");
+    }
+}